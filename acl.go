@@ -0,0 +1,71 @@
+package godrop
+
+import "github.com/horgh/irc"
+
+// IsAdmin checks whether a message is from one of the client's
+// administrators.
+//
+// Administrators are set by the admins config key. This is a space separated
+// list of nick!user@host masks and $a:account entries. See Identity's
+// MatchesAny.
+func (c *Client) IsAdmin(m irc.Message) bool {
+	return c.Identify(m).MatchesAny(c.Conf()["admins"])
+}
+
+// IsAdminEvent is like IsAdmin, but uses the account on the event if it has
+// one. See IdentifyEvent.
+func (c *Client) IsAdminEvent(e Event) bool {
+	return c.IdentifyEvent(e).MatchesAny(c.Conf()["admins"])
+}
+
+// IsOwnerEvent checks whether an event is from one of the client's owners.
+// Owners may do what could take the bot down, such as restarting it.
+//
+// Owners are set by the owners config key, in the same form as admins. Being
+// an administrator doesn't make someone an owner.
+func (c *Client) IsOwnerEvent(e Event) bool {
+	return c.IdentifyEvent(e).MatchesAny(c.Conf().GetString("owners"))
+}
+
+// MatchMask checks whether s matches the mask. The mask may contain the
+// wildcards * (any number of characters) and ? (one character). Matching is
+// case insensitive.
+func MatchMask(mask, s string) bool {
+	mask = Canonicalize(mask)
+	s = Canonicalize(s)
+
+	// Position of the last * in the mask, and the position in s we were trying
+	// to match it from. If a later match fails we backtrack to there.
+	star, starS := -1, 0
+
+	i, j := 0, 0
+	for j < len(s) {
+		if i < len(mask) && (mask[i] == '?' || mask[i] == s[j]) {
+			i++
+			j++
+			continue
+		}
+
+		if i < len(mask) && mask[i] == '*' {
+			star = i
+			starS = j
+			i++
+			continue
+		}
+
+		if star != -1 {
+			i = star + 1
+			starS++
+			j = starS
+			continue
+		}
+
+		return false
+	}
+
+	for i < len(mask) && mask[i] == '*' {
+		i++
+	}
+
+	return i == len(mask)
+}
@@ -0,0 +1,139 @@
+// Package admin runs commands only administrators may use.
+//
+// Administrators are set by the admins config key, a space separated list of
+// nick!user@host masks and $a:account entries for NickServ accounts.
+//
+// Usage:
+// - !admin - List the admin commands.
+// - !join <channel> [key] - Join a channel.
+// - !part [channel] [reason] - Leave a channel. Without a channel, leave the
+//   one the command is on.
+// - !say <channel or nick> <message> - Send a message.
+// - !quit [reason] - Quit and exit.
+// - !reload or !rehash - Reload the config. We stay connected unless a
+//   setting that needs a new connection, such as nick, changed.
+//
+// Other plugins add their own admin commands with godrop's RegisterCommand.
+package admin
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/horgh/godrop"
+	"github.com/horgh/irc"
+)
+
+func init() {
+	godrop.Register("admin", nil)
+	godrop.RegisterConfig("admin",
+		godrop.ConfigKey{Name: "admins", Required: true},
+	)
+
+	for _, cmd := range []godrop.Command{
+		{Name: "admin", Help: "List the admin commands.", Run: list},
+		{
+			Name:    "join",
+			Usage:   "<channel> [key]",
+			Help:    "Join a channel.",
+			MinArgs: 1,
+			Run:     join,
+		},
+		{
+			Name:  "part",
+			Usage: "[channel] [reason]",
+			Help:  "Leave a channel.",
+			Run:   part,
+		},
+		{
+			Name:    "say",
+			Usage:   "<channel or nick> <message>",
+			Help:    "Send a message.",
+			MinArgs: 2,
+			Run:     say,
+		},
+		{Name: "quit", Usage: "[reason]", Help: "Quit and exit.", Run: quit},
+		{
+			Name:    "reload",
+			Aliases: []string{"rehash"},
+			Help:    "Reload the config.",
+			Run:     reload,
+		},
+	} {
+		cmd.Admin = true
+		godrop.RegisterCommand("admin", cmd)
+	}
+}
+
+// Reload is called to reload the config. Programs that can reload should set
+// it.
+var Reload func() error
+
+// list tells the administrator the admin commands.
+func list(c *godrop.Client, m irc.Message, args []string) error {
+	var commands []string
+	for _, cmd := range c.Commands() {
+		if cmd.Admin {
+			commands = append(commands, c.FormatCommand(cmd.Name))
+		}
+	}
+	return reply(c, m, fmt.Sprintf("%s: Admin commands: %s",
+		godrop.SourceNick(m), strings.Join(commands, ", ")))
+}
+
+func join(c *godrop.Client, m irc.Message, args []string) error {
+	if !godrop.IsChannel(args[0]) {
+		return fmt.Errorf("%s is not a channel", args[0])
+	}
+
+	key := ""
+	if len(args) > 1 {
+		key = args[1]
+	}
+	return c.JoinWithKey(args[0], key)
+}
+
+func part(c *godrop.Client, m irc.Message, args []string) error {
+	channel := m.Params[0]
+	if len(args) > 0 && godrop.IsChannel(args[0]) {
+		channel = args[0]
+		args = args[1:]
+	}
+	if !godrop.IsChannel(channel) {
+		return reply(c, m, fmt.Sprintf("Usage: %s <channel> [reason]",
+			c.FormatCommand("part")))
+	}
+	return c.Part(channel, strings.Join(args, " "))
+}
+
+func say(c *godrop.Client, m irc.Message, args []string) error {
+	return c.MessageWithPriority(args[0], strings.Join(args[1:], " "),
+		godrop.PriorityHigh)
+}
+
+func quit(c *godrop.Client, m irc.Message, args []string) error {
+	reason := strings.Join(args, " ")
+	if reason == "" {
+		reason = fmt.Sprintf("Quit by %s", godrop.SourceNick(m))
+	}
+	return c.Quit(reason)
+}
+
+func reload(c *godrop.Client, m irc.Message, args []string) error {
+	source := godrop.SourceNick(m)
+
+	if Reload == nil {
+		return reply(c, m, fmt.Sprintf("%s: Reloading is not supported.",
+			source))
+	}
+	if err := Reload(); err != nil {
+		return err
+	}
+	return reply(c, m, fmt.Sprintf("%s: Reloading config.", source))
+}
+
+// reply answers an admin command. Replies jump ahead of other output.
+func reply(c *godrop.Client, m irc.Message, message string) error {
+	return c.MessageWithPriority(godrop.ReplyTarget(m), message,
+		godrop.PriorityHigh)
+}
@@ -0,0 +1,534 @@
+// Package announce sends messages to channels on a schedule. For example,
+// weekly meeting reminders or a nightly quote.
+//
+// Schedules are like cron's: minute, hour, day of month, month, and day of
+// week. Each field may be *, a number, a range such as 1-5, or a list such as
+// 1,3,5. Any of these may have a step, such as */15. Days of the week are 0
+// to 6 starting on Sunday. 7 is also Sunday. @hourly, @daily, @weekly,
+// @monthly, and @yearly work as well. If both the day of month and the day of
+// week are restricted, either matching is enough.
+//
+// An announcement may start with TZ=<zone> to give its timezone, such as
+// TZ=America/Vancouver.
+//
+// Messages are text/template templates. They may use .Now (the time of the
+// announcement in its timezone), .Target, and .Nick (ours). They may also use
+// godrop's TemplateFuncs. For example, choose picks one of its arguments at
+// random:
+//   It's {{.Now.Format "Monday"}}! {{choose "Hello" "Good morning"}}
+// Each line of the result is a separate message.
+//
+// Usage:
+// - !announce add [TZ=<zone>] <schedule> <target> <message> - Add an
+//   announcement. Only administrators may do this. For example:
+//   !announce add 0 9 * * 1 #project Weekly meeting in an hour!
+// - !announce list - List the announcements.
+// - !announce del <number> - Delete an announcement added with !announce add.
+//   The number is the one shown by !announce list. Only administrators may do
+//   this.
+//
+// Announcements added with !announce add are kept in persistent storage. This
+// requires storage-file to be set.
+//
+// Configuration options:
+// - announce-<name> - An announcement. This is written the same as with
+//   !announce add. For example:
+//   announce-meeting = TZ=America/Vancouver 0 9 * * 1 #project Meeting soon!
+// - announce-timezone - The timezone of announcements that don't give one.
+//   The default is the local timezone.
+package announce
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/horgh/godrop"
+	"github.com/horgh/irc"
+)
+
+func init() {
+	godrop.Register("announce", Hook)
+	godrop.RegisterConfig("announce",
+		godrop.ConfigKey{Name: "storage-file", Required: true},
+		godrop.ConfigKey{Name: "announce-timezone", Kind: godrop.ConfigTimezone},
+	)
+	godrop.RegisterCommand("announce", godrop.Command{
+		Name: "announce",
+		Help: "Manage scheduled announcements.",
+		Run:  triggerAnnounce,
+		Usage: "add [TZ=<zone>] <schedule> <target> <message>, list, or " +
+			"del <number>",
+	})
+}
+
+var delRE = regexp.MustCompile(`(?i)^del\s+#?([0-9]+)$`)
+
+const (
+	// bucket is the storage bucket holding announcements added with !announce
+	// add.
+	bucket = "announcements"
+
+	// configPrefix starts config keys defining announcements.
+	configPrefix = "announce-"
+
+	// Limit how many announcements may be added with !announce add.
+	maxAnnouncements = 50
+)
+
+// Announcement is a message to send on a schedule.
+type Announcement struct {
+	// ID is the storage key for announcements added with !announce add, and
+	// the name for ones from the config.
+	ID string
+
+	// Spec is how the announcement was written: [TZ=<zone>] <schedule>
+	// <target> <message>
+	Spec string
+
+	// Nick is who added it.
+	Nick string
+
+	// FromConfig is whether it came from the config.
+	FromConfig bool `json:"-"`
+}
+
+// parsed is an announcement ready to schedule.
+type parsed struct {
+	Announcement
+	location *time.Location
+	schedule *godrop.Schedule
+	target   string
+	message  *template.Template
+}
+
+var (
+	mutex sync.Mutex
+
+	// client is the client we're scheduling announcements for. This changes
+	// when the config is reloaded.
+	client *godrop.Client
+
+	// scheduled holds the announcements we've scheduled, keyed by ID.
+	scheduled = map[string]*time.Timer{}
+)
+
+// Hook fires when an IRC message of some kind occurs.
+func Hook(c *godrop.Client, m irc.Message) {
+	// Schedule everything again each time we connect. The config might be new.
+	if m.Command == irc.ReplyWelcome {
+		restart(c)
+	}
+}
+
+// triggerAnnounce handles !announce
+func triggerAnnounce(c *godrop.Client, m irc.Message, args []string) error {
+	target := godrop.ReplyTarget(m)
+	nick := godrop.SourceNick(m)
+
+	// Messages are templates, so take them as written.
+	text := strings.TrimSpace(c.CommandText(m))
+
+	if text == "list" {
+		listAnnouncements(c, target)
+		return nil
+	}
+
+	if delMatches := delRE.FindStringSubmatch(text); delMatches != nil {
+		if !c.IsAdmin(m) {
+			return c.Message(target, fmt.Sprintf(
+				"%s: Only administrators may delete announcements.", nick))
+		}
+		deleteAnnouncement(c, target, nick, delMatches[1])
+		return nil
+	}
+
+	if cmd, spec := nextField(text); strings.EqualFold(cmd, "add") {
+		if !c.IsAdmin(m) {
+			return c.Message(target, fmt.Sprintf(
+				"%s: Only administrators may add announcements.", nick))
+		}
+		addAnnouncement(c, target, nick, spec)
+		return nil
+	}
+
+	return c.Message(target,
+		"Usage: !announce add [TZ=<zone>] <schedule> <target> <message>, "+
+			"!announce list, or !announce del <number>")
+}
+
+func addAnnouncement(c *godrop.Client, target, nick, spec string) {
+	now := time.Now()
+	a := Announcement{
+		ID:   strconv.FormatInt(now.UnixNano(), 10),
+		Spec: spec,
+		Nick: nick,
+	}
+
+	p, err := parse(c, a)
+	if err != nil {
+		_ = c.Message(target, fmt.Sprintf("%s: %s", nick, err))
+		return
+	}
+
+	store, err := c.Storage()
+	if err != nil {
+		_ = c.Message(target, fmt.Sprintf("Unable to store announcement: %s",
+			err))
+		return
+	}
+
+	announcements, err := getStoredAnnouncements(c)
+	if err != nil {
+		_ = c.Message(target, fmt.Sprintf("Unable to look up announcements: %s",
+			err))
+		return
+	}
+
+	if len(announcements) >= maxAnnouncements {
+		_ = c.Message(target, fmt.Sprintf("%s: There are too many announcements.",
+			nick))
+		return
+	}
+
+	if err := store.Put(bucket, a.ID, a); err != nil {
+		_ = c.Message(target, fmt.Sprintf("Unable to store announcement: %s",
+			err))
+		return
+	}
+
+	mutex.Lock()
+	if client == c {
+		scheduleAfter(p, now)
+	}
+	mutex.Unlock()
+
+	_ = c.Message(target, fmt.Sprintf("%s: Added announcement #%d. Next at %s.",
+		nick, len(announcements)+1, formatTime(p.next(now))))
+}
+
+// listAnnouncements handles !announce list
+func listAnnouncements(c *godrop.Client, target string) {
+	announcements := getConfigAnnouncements(c)
+
+	stored, err := getStoredAnnouncements(c)
+	if err != nil {
+		c.Log().Error("Unable to look up announcements", "plugin", "announce",
+			"error", err)
+	}
+
+	if len(announcements) == 0 && len(stored) == 0 {
+		_ = c.Message(target, "There are no announcements.")
+		return
+	}
+
+	now := time.Now()
+	for _, a := range announcements {
+		_ = c.Message(target, describe(c, a, a.ID+" (config)", now))
+	}
+	for i, a := range stored {
+		_ = c.Message(target, describe(c, a,
+			fmt.Sprintf("#%d (added by %s)", i+1, a.Nick), now))
+	}
+}
+
+// describe makes a line describing the announcement for !announce list.
+func describe(c *godrop.Client, a Announcement, label string,
+	now time.Time) string {
+	p, err := parse(c, a)
+	if err != nil {
+		return fmt.Sprintf("%s: %s: Invalid: %s", label, a.Spec, err)
+	}
+
+	next := "never"
+	if t := p.next(now); !t.IsZero() {
+		next = formatTime(t)
+	}
+
+	return fmt.Sprintf("%s: %s (next at %s)", label, a.Spec, next)
+}
+
+// deleteAnnouncement handles !announce del
+func deleteAnnouncement(c *godrop.Client, target, nick, number string) {
+	announcements, err := getStoredAnnouncements(c)
+	if err != nil {
+		_ = c.Message(target, fmt.Sprintf("Unable to look up announcements: %s",
+			err))
+		return
+	}
+
+	n, err := strconv.Atoi(number)
+	if err != nil || n < 1 || n > len(announcements) {
+		_ = c.Message(target, fmt.Sprintf("%s: No such announcement.", nick))
+		return
+	}
+
+	a := announcements[n-1]
+
+	store, err := c.Storage()
+	if err != nil {
+		_ = c.Message(target, fmt.Sprintf("Unable to delete announcement: %s",
+			err))
+		return
+	}
+
+	if err := store.Delete(bucket, a.ID); err != nil {
+		_ = c.Message(target, fmt.Sprintf("Unable to delete announcement: %s",
+			err))
+		return
+	}
+
+	mutex.Lock()
+	if t, ok := scheduled[a.ID]; ok {
+		t.Stop()
+		delete(scheduled, a.ID)
+	}
+	mutex.Unlock()
+
+	_ = c.Message(target, fmt.Sprintf("%s: Deleted announcement #%d.", nick,
+		n))
+}
+
+// getConfigAnnouncements retrieves the announcements in the config ordered by
+// name.
+func getConfigAnnouncements(c *godrop.Client) []Announcement {
+	var announcements []Announcement
+	for k, v := range c.Conf() {
+		if !strings.HasPrefix(k, configPrefix) || k == "announce-timezone" {
+			continue
+		}
+		announcements = append(announcements, Announcement{
+			ID:         strings.TrimPrefix(k, configPrefix),
+			Spec:       v,
+			FromConfig: true,
+		})
+	}
+
+	sort.Slice(announcements, func(i, j int) bool {
+		return announcements[i].ID < announcements[j].ID
+	})
+
+	return announcements
+}
+
+// getStoredAnnouncements retrieves the announcements added with !announce add
+// ordered by when they were added.
+func getStoredAnnouncements(c *godrop.Client) ([]Announcement, error) {
+	store, err := c.Storage()
+	if err != nil {
+		return nil, err
+	}
+
+	ids, err := store.Keys(bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	var announcements []Announcement
+	for _, id := range ids {
+		var a Announcement
+		ok, err := store.Get(bucket, id, &a)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		announcements = append(announcements, a)
+	}
+
+	// IDs are when they were added.
+	sort.Slice(announcements, func(i, j int) bool {
+		x, _ := strconv.ParseInt(announcements[i].ID, 10, 64)
+		y, _ := strconv.ParseInt(announcements[j].ID, 10, 64)
+		return x < y
+	})
+
+	return announcements, nil
+}
+
+// restart stops all scheduled announcements and schedules them again for the
+// client.
+func restart(c *godrop.Client) {
+	announcements := getConfigAnnouncements(c)
+
+	// We still schedule the ones in the config if storage is unavailable.
+	stored, err := getStoredAnnouncements(c)
+	if err != nil {
+		c.PluginError("announce",
+			fmt.Errorf("unable to look up announcements: %s", err))
+	}
+	announcements = append(announcements, stored...)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	client = c
+	for id, t := range scheduled {
+		t.Stop()
+		delete(scheduled, id)
+	}
+
+	for _, a := range announcements {
+		p, err := parse(c, a)
+		if err != nil {
+			c.Log().Warn("Invalid announcement", "plugin", "announce", "id", a.ID,
+				"error", err)
+			continue
+		}
+		scheduleAfter(p, time.Now())
+	}
+}
+
+// scheduleAfter arranges for the announcement to be sent at its first time
+// after the given time.
+//
+// The caller must hold the mutex.
+func scheduleAfter(p *parsed, after time.Time) {
+	next := p.next(after)
+	if next.IsZero() {
+		return
+	}
+
+	d := time.Until(next)
+	if d < 0 {
+		d = 0
+	}
+
+	var t *time.Timer
+	t = client.After("announce", d, func(c *godrop.Client) {
+		fire(c, p, t, next)
+	})
+	scheduled[p.ID] = t
+}
+
+// fire sends the announcement and schedules it again.
+func fire(c *godrop.Client, p *parsed, t *time.Timer, at time.Time) {
+	mutex.Lock()
+	// We might have been replaced by a restart or deleted.
+	if client != c || scheduled[p.ID] != t {
+		mutex.Unlock()
+		return
+	}
+	scheduleAfter(p, at)
+	mutex.Unlock()
+
+	lines, err := p.render(c, at)
+	if err != nil {
+		c.PluginError("announce",
+			fmt.Errorf("unable to render announcement %s: %s", p.ID, err))
+		return
+	}
+
+	for _, line := range lines {
+		if err := c.Message(p.target, line); err != nil {
+			c.PluginError("announce",
+				fmt.Errorf("unable to send announcement %s: %s", p.ID, err))
+			return
+		}
+	}
+}
+
+// parse parses the announcement's spec.
+func parse(c *godrop.Client, a Announcement) (*parsed, error) {
+	p := &parsed{Announcement: a, location: time.Local}
+
+	if c.Conf().GetString("announce-timezone") != "" {
+		loc, err := time.LoadLocation(c.Conf().GetString("announce-timezone"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid announce-timezone: %s", err)
+		}
+		p.location = loc
+	}
+
+	field, rest := nextField(a.Spec)
+	if strings.HasPrefix(strings.ToUpper(field), "TZ=") {
+		loc, err := time.LoadLocation(field[3:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid timezone: %s", field[3:])
+		}
+		p.location = loc
+		field, rest = nextField(rest)
+	}
+
+	fields := []string{field}
+	if !strings.HasPrefix(field, "@") {
+		for i := 0; i < 4; i++ {
+			field, rest = nextField(rest)
+			fields = append(fields, field)
+		}
+	}
+
+	s, err := godrop.ParseSchedule(strings.Join(fields, " "))
+	if err != nil {
+		return nil, err
+	}
+	p.schedule = s
+
+	p.target, rest = nextField(rest)
+	if p.target == "" || rest == "" {
+		return nil, fmt.Errorf(
+			"an announcement needs a schedule, a target, and a message")
+	}
+
+	tmpl, err := template.New(a.ID).Funcs(godrop.TemplateFuncs).Parse(rest)
+	if err != nil {
+		return nil, fmt.Errorf("invalid message: %s", err)
+	}
+	p.message = tmpl
+
+	if p.next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("the schedule never happens")
+	}
+
+	return p, nil
+}
+
+// next finds the first time after the given time the announcement should be
+// sent. If there is none it returns the zero time.
+func (p *parsed) next(after time.Time) time.Time {
+	return p.schedule.Next(after.In(p.location))
+}
+
+// render makes the messages to send.
+func (p *parsed) render(c *godrop.Client, at time.Time) ([]string, error) {
+	buf := &bytes.Buffer{}
+	if err := p.message.Execute(buf, struct {
+		Now    time.Time
+		Target string
+		Nick   string
+	}{
+		Now:    at.In(p.location),
+		Target: p.target,
+		Nick:   c.GetNick(),
+	}); err != nil {
+		return nil, err
+	}
+
+	var lines []string
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
+
+// nextField splits off the first space separated field.
+func nextField(s string) (string, string) {
+	s = strings.TrimSpace(s)
+	if i := strings.IndexAny(s, " \t"); i != -1 {
+		return s[:i], strings.TrimSpace(s[i+1:])
+	}
+	return s, ""
+}
+
+func formatTime(t time.Time) string {
+	return t.Format("2006-01-02 15:04 MST")
+}
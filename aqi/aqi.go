@@ -0,0 +1,223 @@
+// Package aqi provides air quality lookups using the World Air Quality Index
+// project's API (https://aqicn.org/api/).
+//
+// Usage:
+// - !aqi <city> - Look up the air quality in a city. The city becomes your
+//   default location.
+// - !aqi - Look up the air quality in your default location.
+//
+// Default locations are kept in persistent storage in the "locations" bucket
+// keyed by nick. Other plugins that take a location may share it.
+//
+// Setup:
+// - Request an API token at https://aqicn.org/data-platform/token/
+// - Set it in the configuration with key "aqi-token".
+// - Set storage-file in the configuration to remember default locations.
+package aqi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/horgh/godrop"
+	"github.com/horgh/irc"
+)
+
+func init() {
+	godrop.Register("aqi", nil)
+	godrop.RegisterConfig("aqi",
+		godrop.ConfigKey{Name: "aqi-token", Required: true},
+	)
+	godrop.RegisterCommand("aqi", godrop.Command{
+		Name:  "aqi",
+		Usage: "[city]",
+		Help:  "Look up the air quality.",
+		Run:   triggerAQI,
+	})
+}
+
+// locationsBucket is the storage bucket holding default locations.
+const locationsBucket = "locations"
+
+// triggerAQI handles !aqi
+func triggerAQI(c *godrop.Client, m irc.Message, words []string) error {
+	target := godrop.ReplyTarget(m)
+	nick := godrop.SourceNick(m)
+	location := strings.Join(words, " ")
+
+	if location == "" {
+		loc, err := getDefaultLocation(c, nick)
+		if err != nil {
+			c.Log().Error("Unable to look up default location", "plugin", "aqi",
+				"error", err)
+		}
+		if loc == "" {
+			return c.Message(target, "Usage: !aqi <city>")
+		}
+		location = loc
+	}
+
+	aq, err := getAirQuality(c.Web(), c.Conf()["aqi-token"], location)
+	if err != nil {
+		return c.Message(target, fmt.Sprintf("Unable to look up air quality: %s",
+			err))
+	}
+
+	_ = c.Message(target, aq.String())
+
+	if err := setDefaultLocation(c, nick, location); err != nil {
+		c.Log().Error("Unable to store default location", "plugin", "aqi",
+			"error", err)
+	}
+	return nil
+}
+
+func getDefaultLocation(c *godrop.Client, nick string) (string, error) {
+	store, err := c.Storage()
+	if err != nil {
+		return "", err
+	}
+
+	var location string
+	if _, err := store.Get(locationsBucket, strings.ToLower(nick),
+		&location); err != nil {
+		return "", err
+	}
+
+	return location, nil
+}
+
+func setDefaultLocation(c *godrop.Client, nick, location string) error {
+	store, err := c.Storage()
+	if err != nil {
+		return err
+	}
+
+	return store.Put(locationsBucket, strings.ToLower(nick), location)
+}
+
+// AirQuality describes the air quality at a station.
+type AirQuality struct {
+	AQI      int
+	Dominant string
+	Station  string
+	Time     string
+}
+
+func (a AirQuality) String() string {
+	s := fmt.Sprintf("%s: AQI %d (%s)", a.Station, a.AQI, category(a.AQI))
+	if a.Dominant != "" {
+		s += fmt.Sprintf(", dominant pollutant %s", pollutantName(a.Dominant))
+	}
+	if a.Time != "" {
+		s += fmt.Sprintf(", measured %s", a.Time)
+	}
+	return s
+}
+
+// category gives the US EPA category for an AQI value.
+func category(aqi int) string {
+	switch {
+	case aqi <= 50:
+		return "good"
+	case aqi <= 100:
+		return "moderate"
+	case aqi <= 150:
+		return "unhealthy for sensitive groups"
+	case aqi <= 200:
+		return "unhealthy"
+	case aqi <= 300:
+		return "very unhealthy"
+	default:
+		return "hazardous"
+	}
+}
+
+func pollutantName(p string) string {
+	switch p {
+	case "pm25":
+		return "PM2.5"
+	case "pm10":
+		return "PM10"
+	case "o3":
+		return "ozone"
+	case "no2":
+		return "nitrogen dioxide"
+	case "so2":
+		return "sulfur dioxide"
+	case "co":
+		return "carbon monoxide"
+	default:
+		return p
+	}
+}
+
+func getAirQuality(web *godrop.WebClient, token,
+	location string) (AirQuality, error) {
+	token = strings.TrimSpace(token)
+	if token == "" {
+		return AirQuality{}, fmt.Errorf("no API token configured")
+	}
+
+	u := fmt.Sprintf("https://api.waqi.info/feed/%s/?token=%s",
+		url.PathEscape(location), url.QueryEscape(token))
+
+	resp, body, err := web.Get(u)
+	if err != nil {
+		// Don't include the error as it contains the URL, and so the token.
+		return AirQuality{}, fmt.Errorf("failed to perform HTTP request")
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return AirQuality{}, fmt.Errorf("unsuccessful request: %s", resp.Status)
+	}
+
+	var response struct {
+		Status string          `json:"status"`
+		Data   json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return AirQuality{}, fmt.Errorf("unable to decode: %s", err)
+	}
+
+	if response.Status != "ok" {
+		// On error, data is a string describing the problem.
+		var msg string
+		_ = json.Unmarshal(response.Data, &msg)
+		if msg == "Unknown station" {
+			return AirQuality{}, fmt.Errorf("no station found for %s", location)
+		}
+		return AirQuality{}, fmt.Errorf("API error: %s", msg)
+	}
+
+	var data struct {
+		// AQI is a number, or "-" if there is no current reading.
+		AQI         interface{} `json:"aqi"`
+		DominentPol string      `json:"dominentpol"`
+		City        struct {
+			Name string `json:"name"`
+		} `json:"city"`
+		Time struct {
+			S string `json:"s"`
+		} `json:"time"`
+	}
+	if err := json.Unmarshal(response.Data, &data); err != nil {
+		return AirQuality{}, fmt.Errorf("unable to decode data: %s", err)
+	}
+
+	aqi, ok := data.AQI.(float64)
+	if !ok {
+		return AirQuality{}, fmt.Errorf("no current reading for %s",
+			data.City.Name)
+	}
+
+	return AirQuality{
+		AQI:      int(aqi),
+		Dominant: data.DominentPol,
+		Station:  data.City.Name,
+		Time:     data.Time.S,
+	}, nil
+}
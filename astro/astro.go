@@ -0,0 +1,316 @@
+// Package astro provides sunrise, sunset, and moon phase information.
+//
+// Everything is calculated locally. There is no API dependency.
+//
+// Usage:
+// - !sun <latitude>,<longitude> [timezone] - Show today's sunrise, sunset, and
+//   day length at the location. Timezone is an IANA name such as
+//   America/Vancouver. These become your default location.
+// - !sun - Show the same for your default location (or the configured
+//   location if you have none).
+// - !moon - Show the current moon phase.
+//
+// Default locations are kept in persistent storage in the "coordinates"
+// bucket keyed by nick.
+//
+// Configuration options:
+// - astro-latitude, astro-longitude, astro-timezone - Optional. Location to
+//   use when a user has no default.
+package astro
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/horgh/godrop"
+	"github.com/horgh/irc"
+)
+
+func init() {
+	godrop.Register("astro", nil)
+	godrop.RegisterConfig("astro",
+		godrop.ConfigKey{Name: "astro-latitude", Kind: godrop.ConfigFloat},
+		godrop.ConfigKey{Name: "astro-longitude", Kind: godrop.ConfigFloat},
+		godrop.ConfigKey{Name: "astro-timezone", Kind: godrop.ConfigTimezone},
+	)
+	godrop.RegisterCommand("astro", godrop.Command{
+		Name:  "sun",
+		Usage: "[<latitude>,<longitude> [timezone]]",
+		Help:  "Show today's sunrise and sunset.",
+		Run:   triggerSun,
+	})
+	godrop.RegisterCommand("astro", godrop.Command{
+		Name: "moon",
+		Help: "Show the current moon phase.",
+		Run:  triggerMoon,
+	})
+}
+
+var locationRE = regexp.MustCompile(
+	`^(-?[0-9]+(?:\.[0-9]+)?)\s*,\s*(-?[0-9]+(?:\.[0-9]+)?)(?:\s+(\S+))?$`)
+
+// coordinatesBucket is the storage bucket holding default locations.
+const coordinatesBucket = "coordinates"
+
+// Location is a place on Earth.
+type Location struct {
+	Latitude  float64
+	Longitude float64
+	Timezone  string
+}
+
+// triggerSun handles !sun
+func triggerSun(c *godrop.Client, m irc.Message, words []string) error {
+	target := godrop.ReplyTarget(m)
+	nick := godrop.SourceNick(m)
+	args := strings.Join(words, " ")
+
+	var loc Location
+
+	if args != "" {
+		matches := locationRE.FindStringSubmatch(args)
+		if matches == nil {
+			return c.Message(target,
+				"Usage: !sun [<latitude>,<longitude> [timezone]]")
+		}
+
+		l, err := parseLocation(matches[1], matches[2], matches[3])
+		if err != nil {
+			return c.Message(target, err.Error())
+		}
+		loc = l
+
+		if err := setDefaultLocation(c, nick, loc); err != nil {
+			c.Log().Error("Unable to store default location", "plugin", "astro",
+				"error", err)
+		}
+	} else {
+		l, ok, err := getDefaultLocation(c, nick)
+		if err != nil {
+			c.Log().Error("Unable to look up default location", "plugin",
+				"astro", "error", err)
+		}
+		if !ok {
+			l, err = parseLocation(c.Conf()["astro-latitude"],
+				c.Conf()["astro-longitude"], c.Conf()["astro-timezone"])
+			if err != nil {
+				return c.Message(target,
+					"Usage: !sun [<latitude>,<longitude> [timezone]]")
+			}
+		}
+		loc = l
+	}
+
+	tz, err := time.LoadLocation(loc.Timezone)
+	if err != nil {
+		return c.Message(target, fmt.Sprintf("Unknown timezone: %s",
+			loc.Timezone))
+	}
+
+	return c.Message(target, describeSun(time.Now().In(tz), loc))
+}
+
+// triggerMoon handles !moon
+func triggerMoon(c *godrop.Client, m irc.Message, args []string) error {
+	return c.Message(godrop.ReplyTarget(m), describeMoon(time.Now()))
+}
+
+func parseLocation(latitude, longitude, timezone string) (Location, error) {
+	lat, err := strconv.ParseFloat(strings.TrimSpace(latitude), 64)
+	if err != nil || lat < -90 || lat > 90 {
+		return Location{}, fmt.Errorf("invalid latitude: %s", latitude)
+	}
+
+	lon, err := strconv.ParseFloat(strings.TrimSpace(longitude), 64)
+	if err != nil || lon < -180 || lon > 180 {
+		return Location{}, fmt.Errorf("invalid longitude: %s", longitude)
+	}
+
+	timezone = strings.TrimSpace(timezone)
+	if timezone == "" {
+		timezone = "UTC"
+	}
+	if _, err := time.LoadLocation(timezone); err != nil {
+		return Location{}, fmt.Errorf("unknown timezone: %s", timezone)
+	}
+
+	return Location{Latitude: lat, Longitude: lon, Timezone: timezone}, nil
+}
+
+func getDefaultLocation(c *godrop.Client, nick string) (Location, bool,
+	error) {
+	store, err := c.Storage()
+	if err != nil {
+		return Location{}, false, err
+	}
+
+	var loc Location
+	ok, err := store.Get(coordinatesBucket, strings.ToLower(nick), &loc)
+	if err != nil {
+		return Location{}, false, err
+	}
+
+	return loc, ok, nil
+}
+
+func setDefaultLocation(c *godrop.Client, nick string, loc Location) error {
+	store, err := c.Storage()
+	if err != nil {
+		return err
+	}
+
+	return store.Put(coordinatesBucket, strings.ToLower(nick), loc)
+}
+
+// describeSun describes the sunrise and sunset on the day of the given time.
+//
+// Times are shown in the time's location.
+func describeSun(now time.Time, loc Location) string {
+	rise, set, state := sunTimes(now, loc.Latitude, loc.Longitude)
+
+	place := fmt.Sprintf("%.2f,%.2f", loc.Latitude, loc.Longitude)
+
+	switch state {
+	case polarDay:
+		return fmt.Sprintf("%s: The sun does not set today.", place)
+	case polarNight:
+		return fmt.Sprintf("%s: The sun does not rise today.", place)
+	}
+
+	dayLength := set.Sub(rise)
+	hours := int(dayLength.Hours())
+	minutes := int(dayLength.Minutes()) - hours*60
+
+	return fmt.Sprintf("%s: Sunrise %s, sunset %s, day length %dh%02dm", place,
+		rise.In(now.Location()).Format("15:04 MST"),
+		set.In(now.Location()).Format("15:04 MST"), hours, minutes)
+}
+
+type sunState int
+
+const (
+	normalDay sunState = iota
+	polarDay
+	polarNight
+)
+
+// sunTimes calculates sunrise and sunset on the day of the given time at the
+// given place.
+//
+// This is the sunrise equation as described at
+// https://en.wikipedia.org/wiki/Sunrise_equation. It is accurate to within a
+// minute or so, which is plenty for our purposes.
+func sunTimes(day time.Time, latitude, longitude float64) (time.Time,
+	time.Time, sunState) {
+	// Local noon on the day in question.
+	noon := time.Date(day.Year(), day.Month(), day.Day(), 12, 0, 0, 0,
+		day.Location())
+
+	// Current Julian day.
+	n := math.Round(julianDate(noon) - 2451545.0 + 0.0008)
+
+	// Mean solar noon.
+	jStar := n - longitude/360
+
+	// Solar mean anomaly.
+	m := math.Mod(357.5291+0.98560028*jStar, 360)
+
+	// Equation of the center.
+	c := 1.9148*sinDeg(m) + 0.0200*sinDeg(2*m) + 0.0003*sinDeg(3*m)
+
+	// Ecliptic longitude.
+	lambda := math.Mod(m+c+180+102.9372, 360)
+
+	// Solar transit.
+	jTransit := 2451545.0 + jStar + 0.0053*sinDeg(m) - 0.0069*sinDeg(2*lambda)
+
+	// Declination of the sun.
+	sinDecl := sinDeg(lambda) * sinDeg(23.4397)
+	cosDecl := math.Cos(math.Asin(sinDecl))
+
+	// Hour angle. -0.833 degrees accounts for refraction and the sun's disc.
+	cosOmega := (sinDeg(-0.833) - sinDeg(latitude)*sinDecl) /
+		(cosDeg(latitude) * cosDecl)
+
+	if cosOmega < -1 {
+		return time.Time{}, time.Time{}, polarDay
+	}
+	if cosOmega > 1 {
+		return time.Time{}, time.Time{}, polarNight
+	}
+
+	omega := math.Acos(cosOmega) * 180 / math.Pi
+
+	return fromJulianDate(jTransit - omega/360),
+		fromJulianDate(jTransit + omega/360), normalDay
+}
+
+// Julian date of the Unix epoch.
+const unixEpochJulian = 2440587.5
+
+func julianDate(t time.Time) float64 {
+	return float64(t.Unix())/86400 + unixEpochJulian
+}
+
+func fromJulianDate(j float64) time.Time {
+	return time.Unix(int64(math.Round((j-unixEpochJulian)*86400)), 0)
+}
+
+func sinDeg(d float64) float64 { return math.Sin(d * math.Pi / 180) }
+func cosDeg(d float64) float64 { return math.Cos(d * math.Pi / 180) }
+
+// Length of the synodic month in days.
+const synodicMonth = 29.530588853
+
+// A known new moon: 2000-01-06 18:14 UTC.
+var knownNewMoon = time.Date(2000, 1, 6, 18, 14, 0, 0, time.UTC)
+
+// describeMoon describes the moon phase at the given time.
+func describeMoon(now time.Time) string {
+	days := now.Sub(knownNewMoon).Hours() / 24
+	age := math.Mod(days, synodicMonth)
+	if age < 0 {
+		age += synodicMonth
+	}
+
+	phase := age / synodicMonth
+	illumination := (1 - math.Cos(2*math.Pi*phase)) / 2
+
+	untilFull := synodicMonth/2 - age
+	if untilFull < 0 {
+		untilFull += synodicMonth
+	}
+	untilNew := synodicMonth - age
+
+	return fmt.Sprintf(
+		"The moon is %s (%.0f%% illuminated, %.1f days old). Full moon in %.1f days, new moon in %.1f days.",
+		phaseName(phase), illumination*100, age, untilFull, untilNew)
+}
+
+// phaseName names the phase. phase is the fraction of the way through the
+// synodic month.
+func phaseName(phase float64) string {
+	// Each phase gets an eighth of the cycle centred on it.
+	switch {
+	case phase < 1.0/16 || phase >= 15.0/16:
+		return "new"
+	case phase < 3.0/16:
+		return "a waxing crescent"
+	case phase < 5.0/16:
+		return "at first quarter"
+	case phase < 7.0/16:
+		return "a waxing gibbous"
+	case phase < 9.0/16:
+		return "full"
+	case phase < 11.0/16:
+		return "a waning gibbous"
+	case phase < 13.0/16:
+		return "at last quarter"
+	default:
+		return "a waning crescent"
+	}
+}
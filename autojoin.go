@@ -0,0 +1,241 @@
+package godrop
+
+import (
+	"strings"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+// Autojoin says which channels to join once we register and how to stay on
+// them.
+type Autojoin struct {
+	// Channels to join. Set Key for channels that need one.
+	Channels []Channel
+
+	// RejoinOnKick is whether to join a channel again after we're kicked from
+	// it.
+	RejoinOnKick bool
+
+	// RetryDelay is how long to wait before trying again to join a channel
+	// when we can't, such as because it's invite only (+i) or our key is wrong.
+	// Each time in a row we fail we wait twice as long, up to
+	// maxAutojoinRetryDelay. If it's zero we use defaultAutojoinRetryDelay.
+	RetryDelay time.Duration
+}
+
+const (
+	defaultAutojoinRetryDelay = time.Minute
+	maxAutojoinRetryDelay     = 30 * time.Minute
+
+	// autojoinKickDelay is how long to wait before rejoining after a kick.
+	autojoinKickDelay = 5 * time.Second
+)
+
+// SetAutojoin sets which channels to join once we register. We join them
+// each time we connect, along with any channels we were on before
+// reconnecting.
+//
+// If we're registered we join channels that weren't set before and leave
+// those that no longer are.
+func (c *Client) SetAutojoin(a Autojoin) {
+	c.mutex.Lock()
+	old := c.autojoin.Channels
+	c.autojoin = a
+	registered := c.state.nick != ""
+	c.mutex.Unlock()
+
+	if !registered {
+		return
+	}
+
+	for _, ch := range a.Channels {
+		if hasChannel(old, ch.Name) {
+			continue
+		}
+		if err := c.JoinWithKey(ch.Name, ch.Key); err != nil {
+			c.Log().Error("Unable to join channel", "channel", ch.Name, "error", err)
+		}
+	}
+
+	for _, ch := range old {
+		if hasChannel(a.Channels, ch.Name) {
+			continue
+		}
+		if err := c.Part(ch.Name, ""); err != nil {
+			c.Log().Error("Unable to part channel", "channel", ch.Name, "error", err)
+		}
+	}
+}
+
+// hasChannel checks whether the channel is in the list.
+func hasChannel(channels []Channel, name string) bool {
+	for _, ch := range channels {
+		if Canonicalize(ch.Name) == Canonicalize(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// AutojoinChannel looks up a channel set with SetAutojoin. It reports
+// whether there is one.
+func (c *Client) AutojoinChannel(name string) (Channel, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.autojoinChannelLocked(name)
+}
+
+// autojoinChannelLocked is AutojoinChannel for callers holding the mutex.
+func (c *Client) autojoinChannelLocked(name string) (Channel, bool) {
+	for _, ch := range c.autojoin.Channels {
+		if Canonicalize(ch.Name) == Canonicalize(name) {
+			return ch, true
+		}
+	}
+	return Channel{}, false
+}
+
+// ParseChannels parses space separated channels such as "#a #b:key". A key
+// follows its channel after a colon. Channel names can't contain colons.
+func ParseChannels(s string) []Channel {
+	var channels []Channel
+	for _, field := range strings.Fields(s) {
+		ch := Channel{Name: field}
+		if i := strings.Index(field, ":"); i != -1 {
+			ch.Name, ch.Key = field[:i], field[i+1:]
+		}
+		if ch.Name == "" {
+			continue
+		}
+		channels = append(channels, ch)
+	}
+	return channels
+}
+
+// joinAutojoin joins the autojoin channels once we register. We skip those
+// we're rejoining after reconnecting since we're already joining them.
+func (c *Client) joinAutojoin(rejoining []Channel) error {
+	c.mutex.Lock()
+	channels := c.autojoin.Channels
+	c.autojoinFailures = map[string]int{}
+	c.mutex.Unlock()
+
+	skip := map[string]struct{}{}
+	for _, ch := range rejoining {
+		skip[Canonicalize(ch.Name)] = struct{}{}
+	}
+
+	for _, ch := range channels {
+		if _, ok := skip[Canonicalize(ch.Name)]; ok {
+			continue
+		}
+		if err := c.JoinWithKey(ch.Name, ch.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleAutojoin keeps us on the autojoin channels. If we can't join one we
+// try again later. If we're kicked from one we rejoin if RejoinOnKick is
+// set.
+func (c *Client) handleAutojoin(m irc.Message) {
+	switch m.Command {
+	case "JOIN":
+		if len(m.Params) < 1 || !c.isUs(SourceNick(m)) {
+			return
+		}
+		c.mutex.Lock()
+		delete(c.autojoinFailures, Canonicalize(m.Params[0]))
+		c.mutex.Unlock()
+
+	case "471", "473", "474", "475", "477":
+		// ERR_CHANNELISFULL, ERR_INVITEONLYCHAN, ERR_BANNEDFROMCHAN,
+		// ERR_BADCHANNELKEY, ERR_NEEDREGGEDNICK: <nick> <channel> :<text>
+		if len(m.Params) < 2 {
+			return
+		}
+
+		c.mutex.Lock()
+		ch, ok := c.autojoinChannelLocked(m.Params[1])
+		if !ok {
+			c.mutex.Unlock()
+			return
+		}
+		if c.autojoinFailures == nil {
+			c.autojoinFailures = map[string]int{}
+		}
+		c.autojoinFailures[Canonicalize(ch.Name)]++
+		delay := c.autojoin.retryDelay(
+			c.autojoinFailures[Canonicalize(ch.Name)])
+		c.mutex.Unlock()
+
+		reason := ""
+		if len(m.Params) > 2 {
+			reason = m.Params[2]
+		}
+		c.Log().Warn("Unable to join channel. Trying again later", "channel",
+			ch.Name, "reason", reason, "delay", delay)
+		c.joinLater(ch, delay)
+
+	case "KICK":
+		if len(m.Params) < 2 || !c.isUs(m.Params[1]) {
+			return
+		}
+
+		c.mutex.Lock()
+		ch, ok := c.autojoinChannelLocked(m.Params[0])
+		rejoin := c.autojoin.RejoinOnKick
+		c.mutex.Unlock()
+		if !ok || !rejoin {
+			return
+		}
+
+		c.Log().Info("Kicked from channel. Rejoining", "channel", ch.Name,
+			"delay", autojoinKickDelay)
+		c.joinLater(ch, autojoinKickDelay)
+	}
+}
+
+// joinLater joins the channel after the delay if we're still on the same
+// connection.
+func (c *Client) joinLater(ch Channel, delay time.Duration) {
+	ctx := c.connContext()
+	c.After("autojoin", delay, func(c *Client) {
+		if ctx.Err() != nil {
+			return
+		}
+		if err := c.JoinWithKey(ch.Name, ch.Key); err != nil {
+			c.Log().Error("Unable to join channel", "channel", ch.Name, "error", err)
+		}
+	})
+}
+
+// isUs checks whether the nick is ours.
+func (c *Client) isUs(nick string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.state.nick != "" &&
+		Canonicalize(nick) == Canonicalize(c.state.nick)
+}
+
+// retryDelay decides how long to wait before trying to join a channel again
+// after failing some number of times in a row.
+func (a Autojoin) retryDelay(failures int) time.Duration {
+	d := a.RetryDelay
+	if d <= 0 {
+		d = defaultAutojoinRetryDelay
+	}
+
+	for i := 1; i < failures && d < maxAutojoinRetryDelay; i++ {
+		d *= 2
+	}
+
+	if d > maxAutojoinRetryDelay {
+		return maxAutojoinRetryDelay
+	}
+	return d
+}
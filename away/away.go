@@ -0,0 +1,336 @@
+// Package away answers private messages while the bot's owner is away.
+//
+// Usage:
+// - !away <reason> - Mark yourself away. We mark the bot away too.
+// - !back - Mark yourself back. We send you the private messages that came
+//   while you were away.
+//
+// Only administrators may use these.
+//
+// While away we reply to private messages with the reason, at most once per
+// person each away-reply-interval. We keep the messages for when you're back.
+//
+// We keep the away status and messages in persistent storage. This requires
+// storage-file to be set.
+//
+// Configuration options:
+// - away-reply-interval - How long to wait before replying to the same
+//   person again. Default 30m.
+//
+// Replies use the template reply. Its data is a Status. See godrop's Format
+// to override it.
+package away
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/horgh/godrop"
+	"github.com/horgh/irc"
+)
+
+func init() {
+	godrop.Register("away", Hook)
+	godrop.RegisterConfig("away",
+		godrop.ConfigKey{Name: "storage-file", Required: true},
+		godrop.ConfigKey{
+			Name: "away-reply-interval",
+			Kind: godrop.ConfigDuration,
+		},
+	)
+	godrop.RegisterTemplate("away", "reply",
+		"I'm away: {{.Reason}} (since {{time .Since}}). I'll pass on your "+
+			"message.")
+	godrop.RegisterCommand("away", godrop.Command{
+		Name:    "away",
+		Usage:   "<reason>",
+		Help:    "Mark yourself away.",
+		MinArgs: 1,
+		Admin:   true,
+		Run:     triggerAway,
+	})
+	godrop.RegisterCommand("away", godrop.Command{
+		Name:  "back",
+		Help:  "Mark yourself back and get your messages.",
+		Admin: true,
+		Run:   triggerBack,
+	})
+}
+
+const (
+	// bucket holds the Status under statusKey and the []Message that came
+	// while away under messagesKey.
+	bucket      = "away"
+	statusKey   = "status"
+	messagesKey = "messages"
+
+	defaultReplyInterval = 30 * time.Minute
+
+	// maxMessages is how many messages we keep. We drop the oldest.
+	maxMessages = 200
+
+	// maxLines is how many messages we send as lines when you're back. If
+	// there are more we paste them if we can.
+	maxLines = 10
+)
+
+// Status is why and since when the owner is away.
+type Status struct {
+	Reason string
+	Since  time.Time
+}
+
+// Message is a private message that came while away.
+type Message struct {
+	Nick string
+	Text string
+	Time time.Time
+}
+
+var mutex sync.Mutex
+
+// replied holds when we last replied to each person, keyed by canonicalized
+// nick.
+var replied = map[string]time.Time{}
+
+// Hook fires when an IRC message of some kind occurs.
+func Hook(c *godrop.Client, m irc.Message) {
+	if m.Command == irc.ReplyWelcome {
+		// Stay marked away if we reconnect.
+		status, ok, err := getStatus(c)
+		if err != nil {
+			c.PluginError("away", err)
+			return
+		}
+		if ok {
+			setAway(c, status.Reason)
+		}
+		return
+	}
+
+	if m.Command != "PRIVMSG" || len(m.Params) != 2 {
+		return
+	}
+
+	source := godrop.SourceNick(m)
+	text := m.Params[1]
+
+	// Private messages from people. Not from services or servers, and not
+	// CTCPs or commands.
+	if _, _, ok := c.ParseCommand(text); ok ||
+		godrop.IsChannel(m.Params[0]) || !strings.Contains(m.Prefix, "!") ||
+		strings.HasPrefix(text, "\x01") || c.IsAdmin(m) {
+		return
+	}
+
+	status, ok, err := getStatus(c)
+	if err != nil {
+		c.PluginError("away", err)
+		return
+	}
+	if !ok {
+		return
+	}
+
+	if err := keep(c, Message{
+		Nick: source,
+		Text: text,
+		Time: time.Now(),
+	}); err != nil {
+		c.PluginError("away", fmt.Errorf("unable to keep message: %s", err))
+	}
+
+	if !shouldReply(source, replyInterval(c.Conf())) {
+		return
+	}
+
+	// Reply with a notice so other bots don't reply to us.
+	_ = c.Send(irc.Message{
+		Command: "NOTICE",
+		Params:  []string{source, c.Format("away", "reply", source, status)},
+	}, godrop.PriorityNormal)
+}
+
+// triggerAway handles !away
+func triggerAway(c *godrop.Client, m irc.Message, args []string) error {
+	target := godrop.ReplyTarget(m)
+	source := godrop.SourceNick(m)
+
+	if err := away(c, strings.Join(args, " ")); err != nil {
+		c.PluginError("away", err)
+		return c.Message(target, fmt.Sprintf("%s: Unable to mark you away: %s",
+			source, err))
+	}
+	return c.Message(target, fmt.Sprintf("%s: You're marked as away.", source))
+}
+
+// triggerBack handles !back
+func triggerBack(c *godrop.Client, m irc.Message, args []string) error {
+	messages, err := back(c)
+	if err != nil {
+		c.PluginError("away", err)
+		return c.Message(godrop.ReplyTarget(m), fmt.Sprintf(
+			"%s: Unable to mark you back: %s", godrop.SourceNick(m), err))
+	}
+	summarize(c, godrop.SourceNick(m), messages)
+	return nil
+}
+
+// away marks the owner and the bot away.
+func away(c *godrop.Client, reason string) error {
+	s, err := c.Storage()
+	if err != nil {
+		return err
+	}
+
+	mutex.Lock()
+	err = s.Put(bucket, statusKey, Status{
+		Reason: reason,
+		Since:  time.Now(),
+	})
+	replied = map[string]time.Time{}
+	mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	setAway(c, reason)
+	return nil
+}
+
+// back marks the owner and the bot back. It returns the messages that came
+// while away.
+func back(c *godrop.Client) ([]Message, error) {
+	s, err := c.Storage()
+	if err != nil {
+		return nil, err
+	}
+
+	mutex.Lock()
+	var messages []Message
+	if _, err := s.Get(bucket, messagesKey, &messages); err != nil {
+		mutex.Unlock()
+		return nil, err
+	}
+	if err := s.Delete(bucket, messagesKey); err != nil {
+		mutex.Unlock()
+		return nil, err
+	}
+	err = s.Delete(bucket, statusKey)
+	mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	setAway(c, "")
+	return messages, nil
+}
+
+// setAway sets the bot's away status on the server. An empty reason marks it
+// back.
+func setAway(c *godrop.Client, reason string) {
+	m := irc.Message{Command: "AWAY"}
+	if reason != "" {
+		m.Params = []string{reason}
+	}
+	_ = c.Send(m, godrop.PriorityLow)
+}
+
+// summarize tells the owner about the messages that came while away.
+func summarize(c *godrop.Client, nick string, messages []Message) {
+	if len(messages) == 0 {
+		_ = c.Message(nick, "Welcome back. There were no messages.")
+		return
+	}
+
+	people := map[string]struct{}{}
+	var lines []string
+	for _, msg := range messages {
+		people[godrop.Canonicalize(msg.Nick)] = struct{}{}
+		lines = append(lines, fmt.Sprintf("[%s] <%s> %s",
+			c.ChannelSettings(nick).FormatTime(msg.Time), msg.Nick, msg.Text))
+	}
+
+	summary := fmt.Sprintf("Welcome back. %d %s from %d %s", len(messages),
+		plural(len(messages), "message", "messages"), len(people),
+		plural(len(people), "person", "people"))
+
+	if len(lines) > maxLines {
+		if url, err := c.Paste(strings.Join(lines, "\n")); err == nil {
+			_ = c.Message(nick, summary+": "+url)
+			return
+		}
+	}
+
+	_ = c.Message(nick, summary+":")
+	for _, line := range lines {
+		_ = c.Message(nick, line)
+	}
+}
+
+// getStatus retrieves the away status. It reports whether the owner is away.
+func getStatus(c *godrop.Client) (Status, bool, error) {
+	s, err := c.Storage()
+	if err != nil {
+		return Status{}, false, err
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	var status Status
+	ok, err := s.Get(bucket, statusKey, &status)
+	return status, ok, err
+}
+
+// keep stores a message for when the owner is back.
+func keep(c *godrop.Client, msg Message) error {
+	s, err := c.Storage()
+	if err != nil {
+		return err
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	var messages []Message
+	if _, err := s.Get(bucket, messagesKey, &messages); err != nil {
+		return err
+	}
+	messages = append(messages, msg)
+	if len(messages) > maxMessages {
+		messages = messages[len(messages)-maxMessages:]
+	}
+	return s.Put(bucket, messagesKey, messages)
+}
+
+// shouldReply checks whether we may reply to the person. If so it records
+// that we did.
+func shouldReply(nick string, interval time.Duration) bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	key := godrop.Canonicalize(nick)
+	if last, ok := replied[key]; ok && time.Since(last) < interval {
+		return false
+	}
+	replied[key] = time.Now()
+	return true
+}
+
+func replyInterval(config godrop.Config) time.Duration {
+	d := config.GetDuration("away-reply-interval", defaultReplyInterval)
+	if d < 0 {
+		return defaultReplyInterval
+	}
+	return d
+}
+
+func plural(n int, singular, plural string) string {
+	if n == 1 {
+		return singular
+	}
+	return plural
+}
@@ -0,0 +1,137 @@
+// Package backup provides a way to back up the data plugins keep.
+//
+// Usage:
+// - !backup - Write everything in storage to a file in backup-dir.
+//
+// Only administrators may use it. Administrators are set by the admins config
+// key.
+//
+// The file is JSON. Restore it, or move the data to another host, by running
+// godrop with -import <file>.
+//
+// Configuration options:
+// - backup-dir - The directory to write backups to. Required.
+// - backup-keep - How many backups to keep. Default 10.
+package backup
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/horgh/godrop"
+	"github.com/horgh/godrop/storage"
+	"github.com/horgh/irc"
+)
+
+func init() {
+	godrop.Register("backup", nil)
+	godrop.RegisterConfig("backup",
+		godrop.ConfigKey{Name: "storage-file", Required: true},
+		godrop.ConfigKey{
+			Name:     "backup-dir",
+			Kind:     godrop.ConfigDir,
+			Required: true,
+		},
+		godrop.ConfigKey{Name: "backup-keep", Kind: godrop.ConfigInt},
+	)
+	godrop.RegisterCommand("backup", godrop.Command{
+		Name:  "backup",
+		Help:  "Back up everything in storage.",
+		Admin: true,
+		Run:   triggerBackup,
+	})
+}
+
+// defaultKeep is how many backups we keep by default.
+const defaultKeep = 10
+
+// triggerBackup handles !backup
+func triggerBackup(c *godrop.Client, m irc.Message, args []string) error {
+	target := godrop.ReplyTarget(m)
+	nick := godrop.SourceNick(m)
+
+	file, count, err := backup(c)
+	if err != nil {
+		c.PluginError("backup", err)
+		return c.Message(target, fmt.Sprintf("%s: Backup failed: %s", nick, err))
+	}
+
+	return c.Message(target, fmt.Sprintf("%s: Backed up %d values to %s.",
+		nick, count, file))
+}
+
+// backup writes a backup. It returns the file and how many values it holds.
+func backup(c *godrop.Client) (string, int, error) {
+	dir := c.Conf().GetString("backup-dir")
+	if dir == "" {
+		return "", 0, fmt.Errorf("no backup-dir configured")
+	}
+
+	store, err := c.Storage()
+	if err != nil {
+		return "", 0, err
+	}
+
+	// Write to a temporary file and rename it so there's never a partial
+	// backup with a backup's name.
+	tmp, err := ioutil.TempFile(dir, ".backup")
+	if err != nil {
+		return "", 0, fmt.Errorf("error creating temporary file: %s", err)
+	}
+
+	b, err := storage.Export(store, tmp)
+	if err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return "", 0, err
+	}
+
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return "", 0, fmt.Errorf("error closing %s: %s", tmp.Name(), err)
+	}
+
+	file := filepath.Join(dir, "godrop-"+
+		b.Created.Format("20060102-150405")+".json")
+	if err := os.Rename(tmp.Name(), file); err != nil {
+		_ = os.Remove(tmp.Name())
+		return "", 0, fmt.Errorf("error renaming %s: %s", tmp.Name(), err)
+	}
+
+	if err := prune(dir, keep(c.Conf())); err != nil {
+		c.PluginError("backup", err)
+	}
+
+	return file, b.Count(), nil
+}
+
+func keep(config godrop.Config) int {
+	n := config.GetInt("backup-keep", defaultKeep)
+	if n < 1 {
+		return defaultKeep
+	}
+	return n
+}
+
+// prune removes the oldest backups so there are at most keep.
+func prune(dir string, keep int) error {
+	files, err := filepath.Glob(filepath.Join(dir, "godrop-*.json"))
+	if err != nil {
+		return err
+	}
+
+	// The names sort by time.
+	sort.Strings(files)
+
+	for len(files) > keep {
+		if err := os.Remove(files[0]); err != nil {
+			return fmt.Errorf("error removing old backup: %s", err)
+		}
+		files = files[1:]
+	}
+
+	return nil
+}
@@ -0,0 +1,161 @@
+// Package badnicks acts against clients whose nicks or realnames match
+// patterns, such as those of known drones.
+//
+// We watch client connection notices (as an operator, see the oper plugin
+// and godrop.ParseClientConnect). When a client's nick or realname matches
+// a pattern we do what badnicks-action says.
+//
+// Configuration options:
+// - badnicks-nicks - Space separated regular expressions to match nicks
+//   against. Use \s to match a space.
+// - badnicks-realnames - Space separated regular expressions to match
+//   realnames against.
+// - badnicks-action - What to do: alert (tell badnicks-channel), kill (KILL
+//   them), or kline (set a temporary K-Line on their IP). Default alert. We
+//   tell badnicks-channel about kills and K-Lines too.
+// - badnicks-channel - The staff channel to tell. Required.
+// - badnicks-kline-duration - How long K-Lines last. Default 24h.
+//
+// Patterns are case insensitive. The reason we give for kills and K-Lines
+// uses the template reason. Its data is a Match.
+package badnicks
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/horgh/godrop"
+	"github.com/horgh/irc"
+)
+
+func init() {
+	godrop.Register("badnicks", Hook)
+	godrop.RegisterConfig("badnicks",
+		godrop.ConfigKey{Name: "badnicks-channel", Required: true},
+		godrop.ConfigKey{Name: "badnicks-nicks", Check: checkPatterns},
+		godrop.ConfigKey{Name: "badnicks-realnames", Check: checkPatterns},
+		godrop.ConfigKey{Name: "badnicks-action", Check: checkAction},
+		godrop.ConfigKey{Name: "badnicks-kline-duration",
+			Kind: godrop.ConfigDuration},
+	)
+	godrop.RegisterTemplate("badnicks", "reason",
+		"Your client looks like a drone. Contact the operators if this is a "+
+			"mistake.")
+}
+
+const defaultKlineDuration = 24 * time.Hour
+
+// Match is a client that matched a pattern.
+type Match struct {
+	godrop.ClientConnect
+
+	// Field is what matched: nick or realname.
+	Field string
+
+	// Pattern is the pattern it matched.
+	Pattern string
+}
+
+// Hook fires when an IRC message of some kind occurs.
+func Hook(c *godrop.Client, m irc.Message) {
+	cc, ok := godrop.ParseClientConnect(m)
+	if !ok {
+		return
+	}
+
+	match, ok := check(c.Conf(), cc)
+	if !ok {
+		return
+	}
+
+	channel := c.Conf().GetString("badnicks-channel")
+	reason := c.Format("badnicks", "reason", "", match)
+
+	switch strings.ToLower(c.Conf().GetString("badnicks-action")) {
+	case "kill":
+		if err := c.Kill(cc.Nick, reason); err != nil {
+			c.PluginError("badnicks", fmt.Errorf("unable to kill %s: %s", cc.Nick,
+				err))
+			return
+		}
+		_ = c.Message(channel, fmt.Sprintf("Killed %s (%s) because its %s "+
+			"matches %s.", cc.Mask(), cc.IP, match.Field, match.Pattern))
+	case "kline":
+		host := cc.IP
+		if net.ParseIP(host) == nil {
+			host = cc.Host
+		}
+		minutes := int(klineDuration(c.Conf()) / time.Minute)
+		if err := c.Send(irc.Message{
+			Command: "KLINE",
+			Params:  []string{strconv.Itoa(minutes), "*@" + host, reason},
+		}, godrop.PriorityHigh); err != nil {
+			c.PluginError("badnicks", fmt.Errorf("unable to K-Line %s: %s", host,
+				err))
+			return
+		}
+		_ = c.Message(channel, fmt.Sprintf("K-Lined *@%s for %d minutes "+
+			"because %s's %s matches %s.", host, minutes, cc.Nick, match.Field,
+			match.Pattern))
+	default:
+		_ = c.Message(channel, fmt.Sprintf("%s (%s) connected and its %s "+
+			"matches %s. Realname: %s", cc.Mask(), cc.IP, match.Field,
+			match.Pattern, cc.Realname))
+	}
+}
+
+// check checks whether the client matches a pattern.
+func check(config map[string]string, cc godrop.ClientConnect) (Match, bool) {
+	for _, field := range []struct {
+		name  string
+		value string
+		key   string
+	}{
+		{"nick", cc.Nick, "badnicks-nicks"},
+		{"realname", cc.Realname, "badnicks-realnames"},
+	} {
+		for _, pattern := range strings.Fields(config[field.key]) {
+			re, err := regexp.Compile("(?i)" + pattern)
+			if err != nil {
+				continue
+			}
+			if re.MatchString(field.value) {
+				return Match{
+					ClientConnect: cc,
+					Field:         field.name,
+					Pattern:       pattern,
+				}, true
+			}
+		}
+	}
+	return Match{}, false
+}
+
+func klineDuration(config godrop.Config) time.Duration {
+	d := config.GetDuration("badnicks-kline-duration", defaultKlineDuration)
+	if d < time.Minute {
+		return defaultKlineDuration
+	}
+	return d
+}
+
+func checkPatterns(value string) error {
+	for _, pattern := range strings.Fields(value) {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("invalid pattern %s: %s", pattern, err)
+		}
+	}
+	return nil
+}
+
+func checkAction(value string) error {
+	switch strings.ToLower(value) {
+	case "alert", "kill", "kline":
+		return nil
+	}
+	return fmt.Errorf("expected alert, kill, or kline")
+}
@@ -0,0 +1,429 @@
+// Package birthday remembers people's birthdays and congratulates them.
+//
+// Usage:
+// - !bday set <YYYY-MM-DD or MM-DD> [timezone] - Set your birthday. Timezone
+//   is an IANA name such as America/Vancouver. We congratulate you on your
+//   birthday in the channel you set it in. Set it in each channel you want to
+//   be congratulated in.
+// - !bday del - Forget your birthday.
+// - !bday [nick] - Show when someone's birthday is.
+//
+// Birthdays are kept in persistent storage. This requires storage-file to be
+// set.
+//
+// Configuration options:
+// - bday-channels - A space separated list of channels where we congratulate
+//   people. Channels must opt in this way.
+// - bday-timezone - Optional. The timezone to use for people who don't give
+//   one. The default is UTC.
+//
+// Greetings use the template greeting. Its data has .Nick, and .Age and
+// .Ordinal (such as 30th) if we know the year they were born. See godrop's
+// Format to override it.
+package birthday
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/horgh/godrop"
+	"github.com/horgh/irc"
+)
+
+func init() {
+	godrop.Register("birthday", Hook)
+	godrop.RegisterConfig("birthday",
+		godrop.ConfigKey{Name: "storage-file", Required: true},
+		godrop.ConfigKey{Name: "bday-channels"},
+		godrop.ConfigKey{Name: "bday-timezone", Kind: godrop.ConfigTimezone},
+	)
+	godrop.RegisterTemplate("birthday", "greeting",
+		"Happy {{if .Age}}{{.Ordinal}} {{end}}birthday, {{.Nick}}!")
+	godrop.RegisterCommand("birthday", godrop.Command{
+		Name:    "bday",
+		Aliases: []string{"birthday"},
+		Usage:   "set <YYYY-MM-DD> [timezone], del, or [nick]",
+		Help:    "Remember or show birthdays.",
+		Run:     triggerBirthday,
+	})
+}
+
+// greeting is the data for the greeting template.
+type greeting struct {
+	Nick    string
+	Age     int
+	Ordinal string
+}
+
+var setRE = regexp.MustCompile(
+	`(?i)^set\s+(?:([0-9]{4})-)?([0-9]{1,2})-([0-9]{1,2})(?:\s+(\S+))?$`)
+
+const (
+	// bucket is the storage bucket holding birthdays.
+	bucket = "birthdays"
+
+	// How often we check whether it is anyone's birthday.
+	checkInterval = time.Hour
+)
+
+// Birthday holds a person's birthday.
+type Birthday struct {
+	Nick string
+
+	// Year is 0 if unknown.
+	Year  int
+	Month time.Month
+	Day   int
+
+	Timezone string
+
+	// Channels are where we congratulate them.
+	Channels []string
+
+	// LastGreeted is the year we last congratulated them.
+	LastGreeted int
+}
+
+var (
+	mutex sync.Mutex
+
+	// started holds the clients we're checking for.
+	started = map[*godrop.Client]bool{}
+)
+
+// Hook fires when an IRC message of some kind occurs.
+func Hook(c *godrop.Client, m irc.Message) {
+	if m.Command == irc.ReplyWelcome {
+		startChecking(c)
+	}
+}
+
+// triggerBirthday handles !bday
+func triggerBirthday(c *godrop.Client, m irc.Message, words []string) error {
+	target := godrop.ReplyTarget(m)
+	nick := godrop.SourceNick(m)
+	args := strings.Join(words, " ")
+
+	if matches := setRE.FindStringSubmatch(args); matches != nil {
+		setBirthday(c, target, nick, matches[1], matches[2], matches[3],
+			matches[4])
+		return nil
+	}
+
+	if strings.EqualFold(args, "del") {
+		deleteBirthday(c, target, nick)
+		return nil
+	}
+
+	if strings.Contains(args, " ") {
+		return c.Message(target,
+			"Usage: !bday set <YYYY-MM-DD> [timezone] | !bday del | !bday [nick]")
+	}
+
+	who := args
+	if who == "" {
+		who = nick
+	}
+	showBirthday(c, target, who)
+	return nil
+}
+
+func setBirthday(c *godrop.Client, target, nick, year, month, day,
+	timezone string) {
+	var y int
+	if year != "" {
+		_, _ = fmt.Sscanf(year, "%d", &y)
+	}
+	var mo, d int
+	_, _ = fmt.Sscanf(month, "%d", &mo)
+	_, _ = fmt.Sscanf(day, "%d", &d)
+
+	// Check the date is real. Use a leap year if we don't know the year so Feb
+	// 29 is allowed.
+	checkYear := y
+	if checkYear == 0 {
+		checkYear = 2000
+	}
+	date := time.Date(checkYear, time.Month(mo), d, 0, 0, 0, 0, time.UTC)
+	if date.Month() != time.Month(mo) || date.Day() != d ||
+		y > time.Now().Year() {
+		_ = c.Message(target, fmt.Sprintf("%s: That is not a valid date.", nick))
+		return
+	}
+
+	if timezone != "" {
+		if _, err := time.LoadLocation(timezone); err != nil {
+			_ = c.Message(target, fmt.Sprintf("%s: Unknown timezone: %s", nick,
+				timezone))
+			return
+		}
+	}
+
+	store, err := c.Storage()
+	if err != nil {
+		_ = c.Message(target, fmt.Sprintf("Unable to store birthday: %s", err))
+		return
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	var b Birthday
+	if _, err := store.Get(bucket, strings.ToLower(nick), &b); err != nil {
+		_ = c.Message(target, fmt.Sprintf("Unable to look up birthday: %s", err))
+		return
+	}
+
+	// If the date changes, they may be due another greeting this year.
+	if b.Month != time.Month(mo) || b.Day != d {
+		b.LastGreeted = 0
+	}
+
+	b.Nick = nick
+	b.Year = y
+	b.Month = time.Month(mo)
+	b.Day = d
+	if timezone != "" {
+		b.Timezone = timezone
+	}
+
+	if godrop.IsChannel(target) && !hasChannel(b.Channels, target) {
+		b.Channels = append(b.Channels, target)
+	}
+
+	if err := store.Put(bucket, strings.ToLower(nick), b); err != nil {
+		_ = c.Message(target, fmt.Sprintf("Unable to store birthday: %s", err))
+		return
+	}
+
+	_ = c.Message(target, fmt.Sprintf("%s: Your birthday is set to %s.", nick,
+		b.dateString()))
+}
+
+func deleteBirthday(c *godrop.Client, target, nick string) {
+	store, err := c.Storage()
+	if err != nil {
+		_ = c.Message(target, fmt.Sprintf("Unable to delete birthday: %s", err))
+		return
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if err := store.Delete(bucket, strings.ToLower(nick)); err != nil {
+		_ = c.Message(target, fmt.Sprintf("Unable to delete birthday: %s", err))
+		return
+	}
+
+	_ = c.Message(target, fmt.Sprintf("%s: I forgot your birthday.", nick))
+}
+
+func showBirthday(c *godrop.Client, target, who string) {
+	store, err := c.Storage()
+	if err != nil {
+		_ = c.Message(target, fmt.Sprintf("Unable to look up birthday: %s", err))
+		return
+	}
+
+	var b Birthday
+	ok, err := store.Get(bucket, strings.ToLower(who), &b)
+	if err != nil {
+		_ = c.Message(target, fmt.Sprintf("Unable to look up birthday: %s", err))
+		return
+	}
+
+	if !ok {
+		_ = c.Message(target, fmt.Sprintf("I don't know %s's birthday.", who))
+		return
+	}
+
+	now := time.Now().In(b.location(c.Conf()))
+	next := b.next(now)
+	days := int(next.Sub(today(now)).Hours()/24 + 0.5)
+
+	s := fmt.Sprintf("%s's birthday is %s", b.Nick, b.dateString())
+	switch {
+	case days == 0:
+		s += ". That's today!"
+	case b.Year != 0:
+		s += fmt.Sprintf(" (turning %d in %d days)", next.Year()-b.Year, days)
+	default:
+		s += fmt.Sprintf(" (in %d days)", days)
+	}
+
+	_ = c.Message(target, s)
+}
+
+func (b Birthday) dateString() string {
+	if b.Year == 0 {
+		return fmt.Sprintf("%s %d", b.Month, b.Day)
+	}
+	return fmt.Sprintf("%s %d, %d", b.Month, b.Day, b.Year)
+}
+
+// location retrieves the person's timezone, falling back to the configured
+// one, and then UTC.
+func (b Birthday) location(config map[string]string) *time.Location {
+	for _, name := range []string{b.Timezone, config["bday-timezone"]} {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if loc, err := time.LoadLocation(name); err == nil {
+			return loc
+		}
+	}
+	return time.UTC
+}
+
+// next finds the date of their next birthday (which may be today) in now's
+// location.
+func (b Birthday) next(now time.Time) time.Time {
+	for _, year := range []int{now.Year(), now.Year() + 1} {
+		d := b.dateIn(year, now.Location())
+		if !d.Before(today(now)) {
+			return d
+		}
+	}
+	return time.Time{}
+}
+
+// dateIn gives the date of their birthday in the year. If their birthday is
+// February 29 and it is not a leap year, we use February 28.
+func (b Birthday) dateIn(year int, loc *time.Location) time.Time {
+	d := time.Date(year, b.Month, b.Day, 0, 0, 0, 0, loc)
+	if d.Month() != b.Month {
+		d = time.Date(year, b.Month, b.Day-1, 0, 0, 0, 0, loc)
+	}
+	return d
+}
+
+func today(now time.Time) time.Time {
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0,
+		now.Location())
+}
+
+func hasChannel(channels []string, channel string) bool {
+	for _, ch := range channels {
+		if strings.EqualFold(ch, channel) {
+			return true
+		}
+	}
+	return false
+}
+
+// startChecking starts checking for birthdays periodically. We only do this
+// once for each client no matter how many times it connects. The checks stop
+// when the client is shut down.
+func startChecking(c *godrop.Client) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if started[c] {
+		return
+	}
+	started[c] = true
+
+	var check func(*godrop.Client)
+	check = func(c *godrop.Client) {
+		checkBirthdays(c)
+		c.After("birthday", checkInterval, check)
+	}
+
+	c.After("birthday", 0, check)
+}
+
+// checkBirthdays congratulates everyone whose birthday it is, unless we
+// already have this year.
+func checkBirthdays(c *godrop.Client) {
+	channels := c.Conf().GetStringSlice("bday-channels")
+	if len(channels) == 0 {
+		return
+	}
+
+	store, err := c.Storage()
+	if err != nil {
+		c.PluginError("birthday",
+			fmt.Errorf("unable to check birthdays: %s", err))
+		return
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	keys, err := store.Keys(bucket)
+	if err != nil {
+		c.PluginError("birthday",
+			fmt.Errorf("unable to check birthdays: %s", err))
+		return
+	}
+
+	for _, key := range keys {
+		var b Birthday
+		ok, err := store.Get(bucket, key, &b)
+		if err != nil {
+			c.PluginError("birthday",
+				fmt.Errorf("unable to look up birthday: %s", err))
+			continue
+		}
+		if !ok {
+			continue
+		}
+
+		now := time.Now().In(b.location(c.Conf()))
+		if b.LastGreeted == now.Year() ||
+			!b.dateIn(now.Year(), now.Location()).Equal(today(now)) {
+			continue
+		}
+
+		g := greeting{Nick: b.Nick}
+		if b.Year != 0 {
+			g.Age = now.Year() - b.Year
+			g.Ordinal = ordinal(g.Age)
+		}
+
+		sent := false
+		for _, ch := range b.Channels {
+			if !hasChannel(channels, ch) {
+				continue
+			}
+			message := c.Format("birthday", "greeting", ch, g)
+			if err := c.Message(ch, message); err != nil {
+				c.PluginError("birthday",
+					fmt.Errorf("unable to send to %s: %s", ch, err))
+				continue
+			}
+			sent = true
+		}
+
+		// If we couldn't send anywhere, try again at the next check.
+		if !sent {
+			continue
+		}
+
+		b.LastGreeted = now.Year()
+		if err := store.Put(bucket, key, b); err != nil {
+			c.PluginError("birthday",
+				fmt.Errorf("unable to store birthday: %s", err))
+		}
+	}
+}
+
+func ordinal(n int) string {
+	suffix := "th"
+	switch n % 10 {
+	case 1:
+		suffix = "st"
+	case 2:
+		suffix = "nd"
+	case 3:
+		suffix = "rd"
+	}
+	if n%100 >= 11 && n%100 <= 13 {
+		suffix = "th"
+	}
+	return fmt.Sprintf("%d%s", n, suffix)
+}
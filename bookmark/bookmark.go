@@ -0,0 +1,262 @@
+// Package bookmark provides named bookmarks for channels.
+//
+// Bookmarks are useful for things like links to rules, answers to frequently
+// asked questions, and meeting URLs. Each channel has its own bookmarks.
+//
+// Usage:
+// - !bm add <name> <url or text> - Add a bookmark. Only administrators may
+//   replace an existing bookmark.
+// - !bm del <name> - Delete a bookmark. Only the person who added it or
+//   administrators may do this.
+// - !bm <name> - Show a bookmark.
+// - !bm list - List the channel's bookmarks.
+//
+// Bookmarks are kept in persistent storage. This requires storage-file to be
+// set. Administrators are set by the admins config key.
+package bookmark
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/horgh/godrop"
+	"github.com/horgh/irc"
+)
+
+func init() {
+	godrop.Register("bookmark", nil)
+	godrop.RegisterConfig("bookmark",
+		godrop.ConfigKey{Name: "storage-file", Required: true},
+	)
+	godrop.RegisterCommand("bookmark", godrop.Command{
+		Name:    "bm",
+		Aliases: []string{"bookmark"},
+		Usage:   "<name>, list, add <name> <text>, or del <name>",
+		Help:    "Manage the channel's bookmarks.",
+		MinArgs: 1,
+		Run:     triggerBookmark,
+	})
+}
+
+var addRE = regexp.MustCompile(`(?i)^add\s+(\S+)\s+(.+)$`)
+var delRE = regexp.MustCompile(`(?i)^del\s+(\S+)$`)
+var nameRE = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,32}$`)
+
+// bucket is the storage bucket holding bookmarks.
+const bucket = "bookmarks"
+
+// Bookmark is a named piece of text.
+type Bookmark struct {
+	Name    string
+	Channel string
+	Text    string
+	Nick    string
+	Added   time.Time
+
+	// Owner identifies who added it. See godrop's Identity.Key. Bookmarks
+	// added before we recorded this don't have it.
+	Owner string
+}
+
+// mutex serializes changes so checking whether a bookmark exists and
+// replacing it happen together.
+var mutex sync.Mutex
+
+// triggerBookmark handles !bm. Bookmarks belong to channels, so we ignore
+// it in private.
+func triggerBookmark(c *godrop.Client, m irc.Message, args []string) error {
+	if !godrop.IsChannel(m.Params[0]) {
+		return nil
+	}
+
+	channel := m.Params[0]
+	text := strings.TrimSpace(c.CommandText(m))
+
+	if strings.EqualFold(text, "list") {
+		listBookmarks(c, channel)
+		return nil
+	}
+
+	if matches := addRE.FindStringSubmatch(text); matches != nil {
+		addBookmark(c, m, channel, matches[1], strings.TrimSpace(matches[2]))
+		return nil
+	}
+
+	if matches := delRE.FindStringSubmatch(text); matches != nil {
+		deleteBookmark(c, m, channel, matches[1])
+		return nil
+	}
+
+	showBookmark(c, channel, text)
+	return nil
+}
+
+func key(channel, name string) string {
+	return godrop.Canonicalize(channel) + " " + strings.ToLower(name)
+}
+
+func addBookmark(c *godrop.Client, m irc.Message, channel, name,
+	text string) {
+	nick := godrop.SourceNick(m)
+
+	if !nameRE.MatchString(name) {
+		_ = c.Message(channel, fmt.Sprintf(
+			"%s: Names may only have letters, numbers, _, ., and -.", nick))
+		return
+	}
+
+	if strings.EqualFold(name, "list") || strings.EqualFold(name, "add") ||
+		strings.EqualFold(name, "del") {
+		_ = c.Message(channel, fmt.Sprintf("%s: That name is reserved.", nick))
+		return
+	}
+
+	store, err := c.Storage()
+	if err != nil {
+		_ = c.Message(channel, fmt.Sprintf("Unable to store bookmark: %s", err))
+		return
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	var existing Bookmark
+	exists, err := store.Get(bucket, key(channel, name), &existing)
+	if err != nil {
+		_ = c.Message(channel, fmt.Sprintf("Unable to look up bookmark: %s", err))
+		return
+	}
+
+	if exists && !c.IsAdmin(m) {
+		_ = c.Message(channel, fmt.Sprintf(
+			"%s: %s already exists. Only administrators may replace it.", nick,
+			existing.Name))
+		return
+	}
+
+	b := Bookmark{
+		Name:    name,
+		Channel: channel,
+		Text:    text,
+		Nick:    nick,
+		Added:   time.Now(),
+		Owner:   c.Identify(m).Key(),
+	}
+
+	if err := store.Put(bucket, key(channel, name), b); err != nil {
+		_ = c.Message(channel, fmt.Sprintf("Unable to store bookmark: %s", err))
+		return
+	}
+
+	if exists {
+		_ = c.Message(channel, fmt.Sprintf("%s: Replaced %s.", nick, name))
+		return
+	}
+	_ = c.Message(channel, fmt.Sprintf("%s: Added %s.", nick, name))
+}
+
+func deleteBookmark(c *godrop.Client, m irc.Message, channel, name string) {
+	nick := godrop.SourceNick(m)
+
+	store, err := c.Storage()
+	if err != nil {
+		_ = c.Message(channel, fmt.Sprintf("Unable to delete bookmark: %s", err))
+		return
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	var b Bookmark
+	exists, err := store.Get(bucket, key(channel, name), &b)
+	if err != nil {
+		_ = c.Message(channel, fmt.Sprintf("Unable to look up bookmark: %s", err))
+		return
+	}
+
+	if !exists {
+		_ = c.Message(channel, fmt.Sprintf("%s: No such bookmark.", nick))
+		return
+	}
+
+	if !isOwner(c, m, b) && !c.IsAdmin(m) {
+		_ = c.Message(channel, fmt.Sprintf(
+			"%s: Only %s or administrators may delete %s.", nick, b.Nick, b.Name))
+		return
+	}
+
+	if err := store.Delete(bucket, key(channel, name)); err != nil {
+		_ = c.Message(channel, fmt.Sprintf("Unable to delete bookmark: %s", err))
+		return
+	}
+
+	_ = c.Message(channel, fmt.Sprintf("%s: Deleted %s.", nick, b.Name))
+}
+
+// isOwner checks whether the message is from who added the bookmark. We
+// compare nicks only for old bookmarks that don't say who added them.
+func isOwner(c *godrop.Client, m irc.Message, b Bookmark) bool {
+	if b.Owner != "" {
+		return c.Identify(m).Matches(b.Owner)
+	}
+	return godrop.Canonicalize(b.Nick) ==
+		godrop.Canonicalize(godrop.SourceNick(m))
+}
+
+func showBookmark(c *godrop.Client, channel, name string) {
+	store, err := c.Storage()
+	if err != nil {
+		_ = c.Message(channel, fmt.Sprintf("Unable to look up bookmark: %s", err))
+		return
+	}
+
+	var b Bookmark
+	exists, err := store.Get(bucket, key(channel, name), &b)
+	if err != nil {
+		_ = c.Message(channel, fmt.Sprintf("Unable to look up bookmark: %s", err))
+		return
+	}
+
+	if !exists {
+		_ = c.Message(channel, fmt.Sprintf("No such bookmark: %s", name))
+		return
+	}
+
+	_ = c.Message(channel, fmt.Sprintf("%s: %s", b.Name, b.Text))
+}
+
+func listBookmarks(c *godrop.Client, channel string) {
+	store, err := c.Storage()
+	if err != nil {
+		_ = c.Message(channel, fmt.Sprintf("Unable to list bookmarks: %s", err))
+		return
+	}
+
+	keys, err := store.Keys(bucket)
+	if err != nil {
+		_ = c.Message(channel, fmt.Sprintf("Unable to list bookmarks: %s", err))
+		return
+	}
+
+	prefix := godrop.Canonicalize(channel) + " "
+
+	var names []string
+	for _, k := range keys {
+		if strings.HasPrefix(k, prefix) {
+			names = append(names, strings.TrimPrefix(k, prefix))
+		}
+	}
+
+	if len(names) == 0 {
+		_ = c.Message(channel, "There are no bookmarks.")
+		return
+	}
+
+	sort.Strings(names)
+	_ = c.Message(channel, fmt.Sprintf("Bookmarks: %s",
+		strings.Join(names, ", ")))
+}
@@ -0,0 +1,812 @@
+// Package bouncer lets IRC clients connect to the bot and use its connection.
+//
+// This makes the bot work like a simple bouncer such as ZNC. Clients that
+// connect see the channels the bot is on and messages since they were last
+// attached. What they send goes to the server through the bot's connection.
+//
+// Clients authenticate with the server password (PASS).
+//
+// Configuration options:
+// - bouncer-listen - The address to listen on, such as 127.0.0.1:6667. If this
+//   is not set, we don't listen.
+// - bouncer-password - The password clients must give. Required.
+// - bouncer-cert, bouncer-key - A TLS certificate and key. If these are set,
+//   clients must connect with TLS.
+// - bouncer-buffer - How many messages to keep for each channel and private
+//   conversation to play back to clients. Default 500.
+// - bouncer-network - The network whose connection clients use, for programs
+//   running several with a Manager. If this is not set, we use the first
+//   client we see until it shuts down.
+//
+// Clients play back messages since they last detached. We tell them apart by
+// the username they give in USER.
+package bouncer
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/horgh/godrop"
+	"github.com/horgh/irc"
+)
+
+func init() {
+	godrop.RegisterAllEventsHook("bouncer", Hook)
+	godrop.RegisterConfig("bouncer",
+		godrop.ConfigKey{Name: "bouncer-listen", Required: true},
+		godrop.ConfigKey{Name: "bouncer-password", Required: true},
+		godrop.ConfigKey{Name: "bouncer-cert", Kind: godrop.ConfigFile},
+		godrop.ConfigKey{Name: "bouncer-key", Kind: godrop.ConfigFile},
+		godrop.ConfigKey{Name: "bouncer-buffer", Kind: godrop.ConfigInt},
+		godrop.ConfigKey{Name: "bouncer-network"},
+	)
+}
+
+const (
+	// serverName is the name we use as the prefix of messages we create.
+	serverName = "godrop.bouncer"
+
+	// defaultBufferSize is how many messages we keep per target by default.
+	defaultBufferSize = 500
+
+	// registrationTimeout is how long clients have to register.
+	registrationTimeout = 30 * time.Second
+
+	// idleTimeout is how long we wait on client I/O.
+	idleTimeout = 10 * time.Minute
+
+	// maxPending is how many of its messages we wait for the server to echo
+	// for each client. If the server doesn't echo them we forget the oldest.
+	maxPending = 100
+)
+
+var mutex sync.Mutex
+
+// client is the client whose connection we use.
+var client *godrop.Client
+
+// bouncers holds the bouncer for each client whose connection we use.
+var bouncers = map[*godrop.Client]*bouncer{}
+
+// bouncer is what we have for a client whose connection clients use.
+type bouncer struct {
+	c *godrop.Client
+
+	// listener accepts clients. It's nil until we're listening.
+	listener net.Listener
+
+	// downstreams are the attached clients.
+	downstreams map[*downstream]struct{}
+
+	// buffers hold recent messages keyed by canonicalized target.
+	buffers map[string][]godrop.Event
+
+	// detached holds when each client last detached keyed by the username it
+	// gave. We play back messages since then.
+	detached map[string]time.Time
+
+	// isupport holds the server's ISUPPORT (005) replies. Clients need them
+	// to know things such as the channel prefixes, so we send them as they
+	// attach.
+	isupport []irc.Message
+}
+
+// downstream is a client connected to us.
+type downstream struct {
+	conn net.Conn
+	rw   *bufio.ReadWriter
+
+	writeMutex sync.Mutex
+
+	// user is the username the client gave in USER.
+	user string
+
+	// serverTime is true if the client wants the server-time tag.
+	serverTime bool
+
+	// pending are messages the client sent that we expect the server to echo
+	// back. We don't send the echo to this client since it shows its own
+	// messages itself.
+	pending []string
+}
+
+// start sets up the bouncer if the client is the one to use and starts
+// listening if we're not already. It returns nil if we don't use the client.
+func start(c *godrop.Client) *bouncer {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	select {
+	case <-c.Done():
+		return nil
+	default:
+	}
+
+	if !uses(c) {
+		return nil
+	}
+	client = c
+
+	if b, ok := bouncers[c]; ok {
+		return b
+	}
+
+	b := &bouncer{
+		c:           c,
+		downstreams: map[*downstream]struct{}{},
+		buffers:     map[string][]godrop.Event{},
+		detached:    map[string]time.Time{},
+	}
+	bouncers[c] = b
+
+	listen := c.Conf().GetString("bouncer-listen")
+	if listen == "" {
+		return b
+	}
+
+	if c.Conf().GetString("bouncer-password") == "" {
+		c.Log().Warn("bouncer-password must be set", "plugin", "bouncer")
+		return b
+	}
+
+	certFile := c.Conf().GetString("bouncer-cert")
+	keyFile := c.Conf().GetString("bouncer-key")
+	c.Go("bouncer", func() error {
+		ln, err := listenOn(listen, certFile, keyFile)
+		if err != nil {
+			return fmt.Errorf("unable to listen: %s", err)
+		}
+
+		if !b.setListener(ln) {
+			_ = ln.Close()
+			return nil
+		}
+
+		c.Log().Info("Listening", "plugin", "bouncer", "addr", listen)
+		return b.acceptLoop(ln)
+	})
+	return b
+}
+
+// setListener remembers the listener so we can close it when the client
+// shuts down. It reports false if the client already did.
+func (b *bouncer) setListener(ln net.Listener) bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if bouncers[b.c] != b {
+		return false
+	}
+	b.listener = ln
+	return true
+}
+
+// stop stops listening and detaches the clients once the client whose
+// connection they use shuts down.
+func stop(c *godrop.Client) {
+	mutex.Lock()
+	b, ok := bouncers[c]
+	if !ok {
+		mutex.Unlock()
+		return
+	}
+	delete(bouncers, c)
+	if client == c {
+		client = nil
+	}
+
+	ln := b.listener
+	var conns []net.Conn
+	for d := range b.downstreams {
+		conns = append(conns, d.conn)
+	}
+	mutex.Unlock()
+
+	if ln != nil {
+		_ = ln.Close()
+	}
+	for _, conn := range conns {
+		_ = conn.Close()
+	}
+}
+
+// uses checks whether c is the client whose connection we use. If
+// bouncer-network is set, that's the client for the network. Otherwise we
+// stay with the client we have until it shuts down, such as when it's
+// replaced to reload the config.
+//
+// The caller must hold the mutex.
+func uses(c *godrop.Client) bool {
+	if network := c.Conf().GetString("bouncer-network"); network != "" {
+		return c.Network() == network
+	}
+
+	if client == nil || client == c {
+		return true
+	}
+
+	select {
+	case <-client.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+func listenOn(addr, certFile, keyFile string) (net.Listener, error) {
+	if certFile == "" && keyFile == "" {
+		return net.Listen("tcp", addr)
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load certificate: %s", err)
+	}
+
+	return tls.Listen("tcp", addr, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	})
+}
+
+// acceptLoop accepts connections until accepting fails, such as after we
+// close the listener.
+func (b *bouncer) acceptLoop(ln net.Listener) error {
+	defer func() {
+		_ = ln.Close()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-b.c.Done():
+				return nil
+			default:
+			}
+			return fmt.Errorf("unable to accept: %s", err)
+		}
+
+		go b.serve(conn)
+	}
+}
+
+// serve handles a client connection.
+func (b *bouncer) serve(conn net.Conn) {
+	logger := b.c.Log()
+	d := &downstream{
+		conn: conn,
+		rw:   bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)),
+	}
+
+	defer func() {
+		mutex.Lock()
+		if _, ok := b.downstreams[d]; ok {
+			delete(b.downstreams, d)
+			b.detached[d.user] = time.Now()
+		}
+		mutex.Unlock()
+
+		_ = conn.Close()
+	}()
+
+	if err := b.register(d); err != nil {
+		logger.Warn("Client failed to register", "plugin", "bouncer", "addr",
+			conn.RemoteAddr(), "error", err)
+		return
+	}
+
+	logger.Info("Client attached", "plugin", "bouncer", "addr",
+		conn.RemoteAddr())
+
+	for {
+		m, err := d.read(idleTimeout)
+		if err != nil {
+			logger.Info("Client detached", "plugin", "bouncer", "addr",
+				conn.RemoteAddr(), "error", err)
+			return
+		}
+
+		if !b.handle(d, m) {
+			logger.Info("Client detached", "plugin", "bouncer", "addr",
+				conn.RemoteAddr())
+			return
+		}
+	}
+}
+
+// register waits for the client to register and then attaches it.
+func (b *bouncer) register(d *downstream) error {
+	deadline := time.Now().Add(registrationTimeout)
+
+	var pass, nick, user string
+	capNegotiating := false
+
+	for pass == "" || nick == "" || user == "" || capNegotiating {
+		m, err := d.read(time.Until(deadline))
+		if err != nil {
+			return err
+		}
+
+		switch m.Command {
+		case "PASS":
+			if len(m.Params) > 0 {
+				pass = m.Params[0]
+			}
+		case "NICK":
+			if len(m.Params) > 0 {
+				nick = m.Params[0]
+			}
+		case "USER":
+			if len(m.Params) > 0 {
+				user = m.Params[0]
+			}
+		case "CAP":
+			capNegotiating = d.handleCap(m, nick)
+		case "PING":
+			d.pong(m)
+		}
+	}
+
+	want := b.c.Conf().GetString("bouncer-password")
+	if want == "" || subtle.ConstantTimeCompare([]byte(pass), []byte(want)) != 1 {
+		_ = d.write(irc.Message{
+			Prefix:  serverName,
+			Command: "464",
+			Params:  []string{nick, "Password incorrect"},
+		})
+		return fmt.Errorf("wrong password")
+	}
+
+	d.user = user
+	b.attach(d)
+	return nil
+}
+
+// handleCap negotiates capabilities with the client. We offer only
+// server-time. It reports whether negotiation is still happening.
+func (d *downstream) handleCap(m irc.Message, nick string) bool {
+	if nick == "" {
+		nick = "*"
+	}
+
+	if len(m.Params) == 0 {
+		return false
+	}
+
+	switch strings.ToUpper(m.Params[0]) {
+	case "LS":
+		_ = d.write(irc.Message{
+			Prefix:  serverName,
+			Command: "CAP",
+			Params:  []string{nick, "LS", "server-time"},
+		})
+		return true
+
+	case "REQ":
+		if len(m.Params) < 2 {
+			return true
+		}
+		caps := strings.Fields(m.Params[1])
+		if len(caps) == 1 && caps[0] == "server-time" {
+			d.serverTime = true
+			_ = d.write(irc.Message{
+				Prefix:  serverName,
+				Command: "CAP",
+				Params:  []string{nick, "ACK", m.Params[1]},
+			})
+			return true
+		}
+		_ = d.write(irc.Message{
+			Prefix:  serverName,
+			Command: "CAP",
+			Params:  []string{nick, "NAK", m.Params[1]},
+		})
+		return true
+
+	case "END":
+		return false
+	}
+
+	return true
+}
+
+// attach sends the client what it needs to know about our connection and
+// plays back messages since it last detached.
+func (b *bouncer) attach(d *downstream) {
+	c := b.c
+	nick := c.GetNick()
+
+	mutex.Lock()
+	isupport := b.isupport
+	mutex.Unlock()
+
+	_ = d.write(irc.Message{
+		Prefix:  serverName,
+		Command: irc.ReplyWelcome,
+		Params:  []string{nick, "Welcome to godrop " + nick},
+	})
+
+	for _, m := range isupport {
+		params := append([]string{nick}, m.Params[1:]...)
+		_ = d.write(irc.Message{
+			Prefix:  serverName,
+			Command: m.Command,
+			Params:  params,
+		})
+	}
+
+	// Clients consider registration done once the MOTD ends.
+	_ = d.write(irc.Message{
+		Prefix:  serverName,
+		Command: "376",
+		Params:  []string{nick, "End of /MOTD command."},
+	})
+
+	for _, name := range c.Channels() {
+		ch, ok := c.Channel(name)
+		if !ok {
+			continue
+		}
+
+		_ = d.write(irc.Message{
+			Prefix:  nick,
+			Command: "JOIN",
+			Params:  []string{ch.Name},
+		})
+
+		var names []string
+		for _, m := range ch.Members {
+			names = append(names, statusPrefix(m.Modes)+m.Nick)
+		}
+		// Send names in batches so lines stay short.
+		for len(names) > 0 {
+			n := len(names)
+			if n > 20 {
+				n = 20
+			}
+			_ = d.write(irc.Message{
+				Prefix:  serverName,
+				Command: "353",
+				Params:  []string{nick, "=", ch.Name, strings.Join(names[:n], " ")},
+			})
+			names = names[n:]
+		}
+		_ = d.write(irc.Message{
+			Prefix:  serverName,
+			Command: "366",
+			Params:  []string{nick, ch.Name, "End of /NAMES list."},
+		})
+	}
+
+	mutex.Lock()
+	since := b.detached[d.user]
+	var playback []godrop.Event
+	for _, events := range b.buffers {
+		for _, e := range events {
+			if e.Time.After(since) {
+				playback = append(playback, e)
+			}
+		}
+	}
+	b.downstreams[d] = struct{}{}
+	mutex.Unlock()
+
+	sortEvents(playback)
+	for _, e := range playback {
+		_ = d.writeEvent(e, true)
+	}
+}
+
+// handle deals with a message from an attached client. It reports whether
+// the client is still attached.
+func (b *bouncer) handle(d *downstream, m irc.Message) bool {
+	switch m.Command {
+	case "QUIT":
+		return false
+	case "PING":
+		d.pong(m)
+		return true
+	case "PASS", "USER", "CAP", "PONG":
+		return true
+	}
+
+	c := b.c
+	if (m.Command == "PRIVMSG" || m.Command == "NOTICE") && len(m.Params) == 2 {
+		b.sent(d, m)
+	}
+
+	if err := c.Send(irc.Message{
+		Command: m.Command,
+		Params:  m.Params,
+	}, godrop.PriorityNormal); err != nil {
+		c.Log().Error("Unable to relay message", "plugin", "bouncer",
+			"error", err)
+	}
+
+	return true
+}
+
+// sent records a message a client sent. We show it to the other clients and
+// keep it in the buffer.
+func (b *bouncer) sent(d *downstream, m irc.Message) {
+	c := b.c
+
+	// If the server echoes our messages we handle them when they come back.
+	if c.HasCap("echo-message") {
+		mutex.Lock()
+		d.pending = append(d.pending, m.Command+" "+m.Params[0]+" "+m.Params[1])
+		if len(d.pending) > maxPending {
+			d.pending = d.pending[len(d.pending)-maxPending:]
+		}
+		mutex.Unlock()
+		return
+	}
+
+	e := godrop.Event{
+		Message: irc.Message{
+			Prefix:  c.GetNick(),
+			Command: m.Command,
+			Params:  m.Params,
+		},
+		Time: time.Now(),
+	}
+
+	mutex.Lock()
+	b.record(e)
+	others := b.otherDownstreams(d)
+	mutex.Unlock()
+
+	for _, o := range others {
+		_ = o.writeEvent(e, false)
+	}
+}
+
+// Hook fires when an IRC message of some kind occurs.
+//
+// We relay messages from the server to attached clients and keep messages in
+// the buffer. Unlike most plugins we see our own messages so clients see
+// what other clients sent. Once the client shuts down we stop listening.
+func Hook(c *godrop.Client, e godrop.Event) {
+	if e.Kind == godrop.EventShutdown {
+		stop(c)
+		return
+	}
+
+	b := start(c)
+	if b == nil {
+		return
+	}
+
+	if e.Historical {
+		return
+	}
+
+	switch e.Kind {
+	case godrop.EventResync, godrop.EventNetsplit, godrop.EventNetjoin,
+		godrop.EventReload:
+		return
+	}
+
+	switch e.Command {
+	case "PING", "PONG", "CAP", "AUTHENTICATE", "BATCH":
+		return
+	}
+
+	// Numerics from registration. Clients get our own welcome instead, along
+	// with the ISUPPORT replies.
+	if n, err := strconv.Atoi(e.Command); err == nil && n < 100 {
+		mutex.Lock()
+		b.registration(e.Message)
+		mutex.Unlock()
+		return
+	}
+
+	mutex.Lock()
+	if e.Command == "PRIVMSG" || e.Command == "NOTICE" {
+		b.record(e)
+	}
+
+	var targets []*downstream
+	for d := range b.downstreams {
+		if e.Kind == godrop.EventSelfMessage && d.takePending(e) {
+			continue
+		}
+		targets = append(targets, d)
+	}
+	mutex.Unlock()
+
+	for _, d := range targets {
+		if err := d.writeEvent(e, false); err != nil {
+			c.Log().Warn("Unable to write to client", "plugin", "bouncer",
+				"error", err)
+		}
+	}
+}
+
+// registration remembers the ISUPPORT replies from registering. We forget
+// the last connection's when we register again.
+//
+// The caller must hold the mutex.
+func (b *bouncer) registration(m irc.Message) {
+	switch m.Command {
+	case irc.ReplyWelcome:
+		b.isupport = nil
+	case "005":
+		if len(m.Params) > 1 {
+			b.isupport = append(b.isupport, m)
+		}
+	}
+}
+
+// takePending checks whether the echoed message is one the client sent and
+// forgets it if so.
+//
+// The caller must hold the mutex.
+func (d *downstream) takePending(e godrop.Event) bool {
+	if len(e.Params) != 2 {
+		return false
+	}
+
+	key := e.Command + " " + e.Params[0] + " " + e.Params[1]
+	for i, p := range d.pending {
+		if p == key {
+			d.pending = append(d.pending[:i], d.pending[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// record adds a message to the buffer.
+//
+// The caller must hold the mutex.
+func (b *bouncer) record(e godrop.Event) {
+	c := b.c
+
+	if len(e.Params) != 2 {
+		return
+	}
+
+	// Private messages go in the buffer of the other person.
+	target := e.Params[0]
+	if !godrop.IsChannel(target) {
+		target = godrop.SourceNick(e.Message)
+		if godrop.Canonicalize(target) == godrop.Canonicalize(c.GetNick()) {
+			target = e.Params[0]
+		}
+	}
+
+	size := c.Conf().GetInt("bouncer-buffer", defaultBufferSize)
+	if size < 0 {
+		size = defaultBufferSize
+	}
+
+	key := godrop.Canonicalize(target)
+	b.buffers[key] = append(b.buffers[key], e)
+	if len(b.buffers[key]) > size {
+		b.buffers[key] = b.buffers[key][len(b.buffers[key])-size:]
+	}
+}
+
+// otherDownstreams lists attached clients other than d.
+//
+// The caller must hold the mutex.
+func (b *bouncer) otherDownstreams(d *downstream) []*downstream {
+	var others []*downstream
+	for o := range b.downstreams {
+		if o != d {
+			others = append(others, o)
+		}
+	}
+	return others
+}
+
+// statusPrefix converts channel status modes to the NAMES prefix.
+func statusPrefix(modes string) string {
+	prefixes := map[byte]string{'q': "~", 'a': "&", 'o': "@", 'h': "%", 'v': "+"}
+	for i := 0; i < len(modes); i++ {
+		if p, ok := prefixes[modes[i]]; ok {
+			return p
+		}
+	}
+	return ""
+}
+
+func sortEvents(events []godrop.Event) {
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Time.Before(events[j].Time)
+	})
+}
+
+func (d *downstream) read(timeout time.Duration) (irc.Message, error) {
+	if err := d.conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return irc.Message{}, fmt.Errorf("unable to set deadline: %s", err)
+	}
+
+	line, err := d.rw.ReadString('\n')
+	if err != nil {
+		return irc.Message{}, err
+	}
+
+	// We don't support tags from clients. Drop them.
+	if strings.HasPrefix(line, "@") {
+		if i := strings.IndexByte(line, ' '); i != -1 {
+			line = strings.TrimLeft(line[i:], " ")
+		}
+	}
+
+	m, err := irc.ParseMessage(line)
+	if err != nil && err != irc.ErrTruncated {
+		return irc.Message{}, fmt.Errorf("unable to parse message: %s", err)
+	}
+
+	return m, nil
+}
+
+func (d *downstream) pong(m irc.Message) {
+	params := []string{serverName}
+	if len(m.Params) > 0 {
+		params = []string{serverName, m.Params[0]}
+	}
+	_ = d.write(irc.Message{
+		Prefix:  serverName,
+		Command: "PONG",
+		Params:  params,
+	})
+}
+
+// writeEvent sends an event to the client.
+//
+// If the client supports server-time we include the event's time. Otherwise
+// when playing back we put the time in the message text.
+func (d *downstream) writeEvent(e godrop.Event, playback bool) error {
+	m := e.Message
+
+	if !d.serverTime {
+		if playback && len(m.Params) == 2 {
+			m.Params = []string{m.Params[0],
+				"[" + e.Time.Local().Format("15:04") + "] " + m.Params[1]}
+		}
+		return d.write(m)
+	}
+
+	buf, err := m.Encode()
+	if err != nil && err != irc.ErrTruncated {
+		return fmt.Errorf("unable to encode message: %s", err)
+	}
+
+	return d.writeString("@time=" +
+		e.Time.UTC().Format("2006-01-02T15:04:05.000Z") + " " + buf)
+}
+
+func (d *downstream) write(m irc.Message) error {
+	buf, err := m.Encode()
+	if err != nil && err != irc.ErrTruncated {
+		return fmt.Errorf("unable to encode message: %s", err)
+	}
+
+	return d.writeString(buf)
+}
+
+func (d *downstream) writeString(s string) error {
+	d.writeMutex.Lock()
+	defer d.writeMutex.Unlock()
+
+	if err := d.conn.SetWriteDeadline(time.Now().Add(idleTimeout)); err != nil {
+		return fmt.Errorf("unable to set deadline: %s", err)
+	}
+
+	if _, err := d.rw.WriteString(s); err != nil {
+		return err
+	}
+
+	return d.rw.Flush()
+}
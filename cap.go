@@ -0,0 +1,211 @@
+package godrop
+
+import (
+	"strings"
+
+	"github.com/horgh/irc"
+)
+
+// capState tracks IRCv3 capability negotiation for a connection.
+type capState struct {
+	// available holds the capabilities the server offers and their values.
+	available map[string]string
+
+	// enabled holds the capabilities the server acknowledged.
+	enabled map[string]bool
+
+	// negotiating is true from when we start negotiating until we send CAP
+	// END.
+	negotiating bool
+
+	// authenticated is true if we authenticated with SASL.
+	authenticated bool
+}
+
+func newCapState() *capState {
+	return &capState{
+		available: map[string]string{},
+		enabled:   map[string]bool{},
+	}
+}
+
+// defaultCaps are the capabilities we always request if the server offers
+// them.
+var defaultCaps = []string{
+	"account-notify",
+	"account-tag",
+	"away-notify",
+	"batch",
+	"draft/chathistory",
+	"echo-message",
+	"extended-join",
+	"message-tags",
+	"multi-prefix",
+	"server-time",
+	"userhost-in-names",
+}
+
+// RequestCap adds a capability to request if the server offers it.
+//
+// Call this before connecting.
+func (c *Client) RequestCap(name string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, w := range c.wantCaps {
+		if w == name {
+			return
+		}
+	}
+	c.wantCaps = append(c.wantCaps, name)
+}
+
+// HasCap checks whether a capability is enabled on the connection.
+func (c *Client) HasCap(name string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.caps.enabled[name]
+}
+
+// CapValue retrieves the value the server advertised for a capability. It
+// reports whether the server offers the capability.
+func (c *Client) CapValue(name string) (string, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	v, ok := c.caps.available[name]
+	return v, ok
+}
+
+// capLS starts capability negotiation.
+func (c *Client) capLS() error {
+	c.mutex.Lock()
+	c.caps.negotiating = true
+	c.mutex.Unlock()
+
+	return c.WriteMessage(irc.Message{
+		Command: "CAP",
+		Params:  []string{"LS", "302"},
+	})
+}
+
+// handleCap deals with CAP messages from the server.
+func (c *Client) handleCap(m irc.Message) error {
+	// CAP <nick> <subcommand> [*] :<capabilities>
+	if m.Command != "CAP" || len(m.Params) < 3 {
+		return nil
+	}
+
+	subcommand := strings.ToUpper(m.Params[1])
+	more := len(m.Params) > 3 && m.Params[2] == "*"
+	list := strings.Fields(m.Params[len(m.Params)-1])
+
+	switch subcommand {
+	case "LS", "NEW":
+		c.mutex.Lock()
+		for _, cp := range list {
+			kv := strings.SplitN(cp, "=", 2)
+			if len(kv) == 2 {
+				c.caps.available[kv[0]] = kv[1]
+			} else {
+				c.caps.available[kv[0]] = ""
+			}
+		}
+		c.mutex.Unlock()
+
+		// With CAP LS 302 the list may span several messages.
+		if more {
+			return nil
+		}
+
+		if err := c.handleSTS(); err != nil {
+			return err
+		}
+
+		return c.capRequest()
+
+	case "ACK":
+		c.mutex.Lock()
+		for _, cp := range list {
+			if strings.HasPrefix(cp, "-") {
+				delete(c.caps.enabled, cp[1:])
+				continue
+			}
+			c.caps.enabled[cp] = true
+		}
+		sasl := c.caps.enabled["sasl"] && c.cert != nil && c.caps.negotiating
+		c.mutex.Unlock()
+
+		// If we're authenticating we end negotiation once that's done.
+		if sasl {
+			return c.startSASL()
+		}
+		return c.capEnd()
+
+	case "NAK":
+		return c.capEnd()
+
+	case "DEL":
+		c.mutex.Lock()
+		for _, cp := range list {
+			delete(c.caps.available, cp)
+			delete(c.caps.enabled, cp)
+		}
+		c.mutex.Unlock()
+	}
+
+	return nil
+}
+
+// capRequest requests the capabilities we want that the server offers and
+// that we don't have yet. If there are none, we end negotiation.
+func (c *Client) capRequest() error {
+	c.mutex.Lock()
+	var req []string
+	for _, want := range append(append([]string(nil), defaultCaps...),
+		c.wantCaps...) {
+		if _, ok := c.caps.available[want]; !ok || c.caps.enabled[want] {
+			continue
+		}
+		seen := false
+		for _, r := range req {
+			if r == want {
+				seen = true
+			}
+		}
+		if !seen {
+			req = append(req, want)
+		}
+	}
+	if c.wantSASL() && !c.caps.enabled["sasl"] {
+		req = append(req, "sasl")
+	}
+	c.mutex.Unlock()
+
+	if len(req) == 0 {
+		return c.capEnd()
+	}
+
+	return c.WriteMessage(irc.Message{
+		Command: "CAP",
+		Params:  []string{"REQ", strings.Join(req, " ")},
+	})
+}
+
+// capEnd ends capability negotiation if we're negotiating.
+func (c *Client) capEnd() error {
+	c.mutex.Lock()
+	negotiating := c.caps.negotiating
+	c.caps.negotiating = false
+	c.mutex.Unlock()
+
+	if !negotiating {
+		return nil
+	}
+
+	return c.WriteMessage(irc.Message{
+		Command: "CAP",
+		Params:  []string{"END"},
+	})
+}
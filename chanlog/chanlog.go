@@ -0,0 +1,606 @@
+// Package chanlog writes what happens on channels to log files.
+//
+// Each channel gets a file per day named after the date, such as
+// <chanlog-dir>/#godrop/2020-01-02.log. Days follow the channel's timezone
+// (see godrop's ChannelSettings). If the client is in a Manager, each
+// network gets its own directory under chanlog-dir.
+//
+// We log messages, notices, joins, parts, quits, kicks, nick changes, mode
+// changes, and topic changes, including our own, in the format irssi uses:
+//
+//	03:04:05 <alice> hi there
+//	03:04:05 * alice waves
+//	03:04:05 -alice- a notice
+//	03:04:05 -!- bob [b@example.com] has joined #godrop
+//	03:04:05 -!- bob [b@example.com] has quit [Bye]
+//	03:04:05 -!- alice changed the topic of #godrop to: Hello
+//
+// When a day's file is done we gzip it if chanlog-gzip is true. We delete
+// files older than chanlog-keep-days.
+//
+// Other packages may read back the messages we logged with Messages.
+//
+// Configuration options:
+// - chanlog-dir - The directory to write logs in. Required.
+// - chanlog-channels - Space separated channels to log. Default all of them.
+// - chanlog-gzip - Whether to gzip files for past days. Default false.
+// - chanlog-keep-days - How many days of files to keep. Default 0, which
+//   keeps them forever.
+package chanlog
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/horgh/godrop"
+	"github.com/horgh/irc"
+)
+
+func init() {
+	godrop.RegisterEventHook("chanlog", Hook)
+	godrop.RegisterConfig("chanlog",
+		godrop.ConfigKey{Name: "chanlog-dir", Kind: godrop.ConfigDir,
+			Required: true},
+		godrop.ConfigKey{Name: "chanlog-channels"},
+		godrop.ConfigKey{Name: "chanlog-gzip", Kind: godrop.ConfigBool},
+		godrop.ConfigKey{Name: "chanlog-keep-days", Kind: godrop.ConfigInt},
+	)
+}
+
+// queueSize is how many lines may wait to be written. If more arrive we drop
+// them rather than hold up the client.
+const queueSize = 1000
+
+// fileRE matches the names of log files and captures their dates.
+var fileRE = regexp.MustCompile(`^(\d{4}-\d{2}-\d{2})\.log(\.gz)?$`)
+
+// entry is something to log.
+type entry struct {
+	m irc.Message
+	t time.Time
+
+	// channels are where to log it.
+	channels []string
+
+	// own is true if we sent it. Its prefix is blank.
+	own bool
+}
+
+// logFile is the file we're writing for a channel.
+type logFile struct {
+	file *os.File
+	day  string
+}
+
+// writer writes a client's logs.
+type writer struct {
+	c     *godrop.Client
+	queue chan entry
+
+	// files holds the open files keyed by their directory.
+	files map[string]*logFile
+}
+
+var (
+	mutex sync.Mutex
+
+	// writers holds the writer for each client.
+	writers = map[*godrop.Client]*writer{}
+)
+
+// Hook fires when an IRC message of some kind occurs.
+func Hook(c *godrop.Client, e godrop.Event) {
+	// The writer stops by itself once the client is shut down.
+	if e.Kind == godrop.EventShutdown {
+		return
+	}
+
+	w := getWriter(c)
+
+	m := e.Message
+	var channels []string
+	switch m.Command {
+	case "PRIVMSG", "NOTICE", "JOIN", "PART", "KICK", "MODE", "TOPIC":
+		if len(m.Params) == 0 || !godrop.IsChannel(m.Params[0]) {
+			return
+		}
+		channels = []string{m.Params[0]}
+	case "QUIT", "NICK":
+		channels = e.Channels
+	default:
+		return
+	}
+
+	w.enqueue(entry{m: m, t: e.Time, channels: channels})
+}
+
+// getWriter retrieves the client's writer. The first time, we start it
+// writing and tap what we send so we log our own messages.
+func getWriter(c *godrop.Client) *writer {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if w, ok := writers[c]; ok {
+		return w
+	}
+
+	w := &writer{
+		c:     c,
+		queue: make(chan entry, queueSize),
+		files: map[string]*logFile{},
+	}
+	writers[c] = w
+
+	c.Go("chanlog", w.run)
+	if err := c.AddTap("chanlog", w.tap); err != nil {
+		c.PluginError("chanlog", err)
+	}
+	return w
+}
+
+// tap queues messages we send to channels. It runs as we write, so it must
+// be quick.
+func (w *writer) tap(c *godrop.Client, d godrop.TapDirection, line string) {
+	if d != godrop.TapSent {
+		return
+	}
+	if !strings.HasPrefix(line, "PRIVMSG ") && !strings.HasPrefix(line,
+		"NOTICE ") {
+		return
+	}
+
+	m, err := irc.ParseMessage(line + "\r\n")
+	if err != nil && err != irc.ErrTruncated {
+		return
+	}
+	if len(m.Params) == 0 || !godrop.IsChannel(m.Params[0]) {
+		return
+	}
+
+	// We log our messages here even if the server echoes them, since hooks
+	// don't see echoes.
+	w.enqueue(entry{m: m, t: time.Now(), channels: []string{m.Params[0]},
+		own: true})
+}
+
+// enqueue queues an entry to write. If the queue is full we drop it.
+func (w *writer) enqueue(e entry) {
+	select {
+	case w.queue <- e:
+	default:
+		w.c.Log().Warn("Log queue is full. Dropping line", "plugin", "chanlog")
+	}
+}
+
+// run writes entries as they arrive until the client is shut down. Then we
+// write what's left and close the files.
+func (w *writer) run() error {
+	for {
+		select {
+		case e := <-w.queue:
+			w.writeEntry(e)
+		case <-w.c.Done():
+			w.stop()
+			return nil
+		}
+	}
+}
+
+// stop writes the entries waiting, closes the files, and forgets the writer.
+func (w *writer) stop() {
+	mutex.Lock()
+	delete(writers, w.c)
+	mutex.Unlock()
+
+	w.c.RemoveTap("chanlog")
+
+	for len(w.queue) > 0 {
+		w.writeEntry(<-w.queue)
+	}
+
+	for dir, f := range w.files {
+		if err := f.file.Close(); err != nil {
+			w.c.Log().Warn("Unable to close log", "plugin", "chanlog", "error",
+				err)
+		}
+		delete(w.files, dir)
+	}
+}
+
+// writeEntry writes the entry to each of its channels' files.
+func (w *writer) writeEntry(e entry) {
+	for _, channel := range e.channels {
+		if !w.logs(channel) {
+			continue
+		}
+		if err := w.write(channel, e); err != nil {
+			w.c.PluginError("chanlog", fmt.Errorf("unable to log to %s: %s",
+				channel, err))
+		}
+	}
+}
+
+// logs checks whether we log the channel.
+func (w *writer) logs(channel string) bool {
+	channels := w.c.Conf().GetStringSlice("chanlog-channels")
+	if len(channels) == 0 {
+		return true
+	}
+	for _, ch := range channels {
+		if godrop.Canonicalize(ch) == godrop.Canonicalize(channel) {
+			return true
+		}
+	}
+	return false
+}
+
+// write writes the entry to the channel's file for its day.
+func (w *writer) write(channel string, e entry) error {
+	t := e.t.In(w.c.ChannelSettings(channel).Location())
+	line := format(e, channel, w.c.GetNick())
+	if line == "" {
+		return nil
+	}
+
+	f, err := w.open(channel, t)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(f.file, "%s %s\n", t.Format("15:04:05"), line)
+	return err
+}
+
+// open retrieves the open file for the channel on the time's day. If it's a
+// new day, we close the old file and tidy up.
+func (w *writer) open(channel string, t time.Time) (*logFile, error) {
+	dir := logDir(w.c, channel)
+	day := t.Format("2006-01-02")
+
+	if f, ok := w.files[dir]; ok {
+		if f.day == day {
+			return f, nil
+		}
+		if err := f.file.Close(); err != nil {
+			w.c.PluginError("chanlog", fmt.Errorf("unable to close log: %s", err))
+		}
+		delete(w.files, dir)
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("unable to create directory: %s", err)
+	}
+
+	file, err := os.OpenFile(filepath.Join(dir, day+".log"),
+		os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open log: %s", err)
+	}
+
+	if _, err := fmt.Fprintf(file, "--- Log opened %s\n",
+		t.Format("Mon Jan 02 15:04:05 2006")); err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("unable to write log: %s", err)
+	}
+
+	f := &logFile{file: file, day: day}
+	w.files[dir] = f
+
+	if err := tidy(dir, day, w.c.Conf().GetBool("chanlog-gzip", false),
+		w.c.Conf().GetInt("chanlog-keep-days", 0), t); err != nil {
+		w.c.PluginError("chanlog", fmt.Errorf("unable to tidy %s: %s", dir,
+			err))
+	}
+	return f, nil
+}
+
+// logDir is the directory holding the channel's files.
+func logDir(c *godrop.Client, channel string) string {
+	return filepath.Join(c.Conf().GetString("chanlog-dir"), c.Network(),
+		dirName(channel))
+}
+
+// dirName makes a channel name safe to use as a directory name.
+func dirName(channel string) string {
+	return strings.NewReplacer("/", "_", "\\", "_").Replace(
+		godrop.Canonicalize(channel))
+}
+
+// tidy gzips the files in the directory for days before today if compress
+// is true and deletes those older than keepDays if it's positive.
+func tidy(dir, today string, compress bool, keepDays int,
+	now time.Time) error {
+	names, err := filepath.Glob(filepath.Join(dir, "*.log*"))
+	if err != nil {
+		return err
+	}
+
+	oldest := ""
+	if keepDays > 0 {
+		oldest = now.AddDate(0, 0, -keepDays).Format("2006-01-02")
+	}
+
+	for _, name := range names {
+		matches := fileRE.FindStringSubmatch(filepath.Base(name))
+		if matches == nil || matches[1] >= today {
+			continue
+		}
+
+		// Dates sort as strings.
+		if matches[1] < oldest {
+			if err := os.Remove(name); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if compress && matches[2] == "" {
+			if err := gzipFile(name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// gzipFile compresses the file to a .gz file and removes it.
+func gzipFile(name string) error {
+	in, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = in.Close()
+	}()
+
+	out, err := os.OpenFile(name+".gz", os.O_CREATE|os.O_TRUNC|os.O_WRONLY,
+		0600)
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(out)
+	if _, err := io.Copy(gz, in); err != nil {
+		_ = out.Close()
+		_ = os.Remove(name + ".gz")
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		_ = out.Close()
+		_ = os.Remove(name + ".gz")
+		return err
+	}
+	if err := out.Close(); err != nil {
+		_ = os.Remove(name + ".gz")
+		return err
+	}
+
+	return os.Remove(name)
+}
+
+// format formats the entry as a line for the channel's log, without the
+// time. It's blank if there's nothing to log.
+func format(e entry, channel, ourNick string) string {
+	m := e.m
+	nick := godrop.SourceNick(m)
+	if e.own {
+		nick = ourNick
+	}
+	mask := ""
+	if i := strings.Index(m.Prefix, "!"); i != -1 {
+		mask = m.Prefix[i+1:]
+	}
+
+	switch m.Command {
+	case "PRIVMSG":
+		if len(m.Params) < 2 {
+			return ""
+		}
+		text := m.Params[1]
+		if strings.HasPrefix(text, "\x01ACTION") {
+			return fmt.Sprintf("* %s %s", nick, strings.TrimSuffix(
+				strings.TrimSpace(strings.TrimPrefix(text, "\x01ACTION")), "\x01"))
+		}
+		if strings.HasPrefix(text, "\x01") {
+			return ""
+		}
+		return fmt.Sprintf("<%s> %s", nick, text)
+	case "NOTICE":
+		if len(m.Params) < 2 {
+			return ""
+		}
+		return fmt.Sprintf("-%s- %s", nick, m.Params[1])
+	case "JOIN":
+		return fmt.Sprintf("-!- %s [%s] has joined %s", nick, mask, channel)
+	case "PART":
+		return fmt.Sprintf("-!- %s [%s] has left %s [%s]", nick, mask, channel,
+			param(m, 1))
+	case "QUIT":
+		return fmt.Sprintf("-!- %s [%s] has quit [%s]", nick, mask, param(m, 0))
+	case "KICK":
+		return fmt.Sprintf("-!- %s was kicked from %s by %s [%s]", param(m, 1),
+			channel, nick, param(m, 2))
+	case "NICK":
+		return fmt.Sprintf("-!- %s is now known as %s", nick, param(m, 0))
+	case "MODE":
+		if len(m.Params) < 2 {
+			return ""
+		}
+		return fmt.Sprintf("-!- mode/%s [%s] by %s", channel,
+			strings.Join(m.Params[1:], " "), nick)
+	case "TOPIC":
+		return fmt.Sprintf("-!- %s changed the topic of %s to: %s", nick,
+			channel, param(m, 1))
+	}
+	return ""
+}
+
+// param retrieves the message's parameter at the index. It's blank if there
+// isn't one.
+func param(m irc.Message, i int) string {
+	if i >= len(m.Params) {
+		return ""
+	}
+	return m.Params[i]
+}
+
+// Logs checks whether the client logs the channel.
+func Logs(c *godrop.Client, channel string) bool {
+	if c.Conf().GetString("chanlog-dir") == "" {
+		return false
+	}
+
+	enabled := false
+	for _, name := range c.EnabledPlugins() {
+		if name == "chanlog" {
+			enabled = true
+		}
+	}
+	if !enabled {
+		return false
+	}
+
+	return (&writer{c: c}).logs(channel)
+}
+
+// Messages calls fn with the messages in the channel's logs, newest first,
+// until it returns false. We stop at messages before since unless it's zero.
+//
+// Each is a PRIVMSG to the channel from the nick who said it. Actions are
+// CTCP ACTIONs.
+func Messages(c *godrop.Client, channel string, since time.Time,
+	fn func(godrop.Event) bool) error {
+	names, err := filepath.Glob(filepath.Join(logDir(c, channel), "*.log*"))
+	if err != nil {
+		return err
+	}
+
+	// Dates sort as strings.
+	days := map[string]string{}
+	for _, name := range names {
+		matches := fileRE.FindStringSubmatch(filepath.Base(name))
+		if matches == nil {
+			continue
+		}
+		// We may see a day's file while we gzip it. Read the original.
+		if _, ok := days[matches[1]]; ok && matches[2] != "" {
+			continue
+		}
+		days[matches[1]] = name
+	}
+	var sorted []string
+	for day := range days {
+		sorted = append(sorted, day)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(sorted)))
+
+	loc := c.ChannelSettings(channel).Location()
+	oldest := ""
+	if !since.IsZero() {
+		oldest = since.In(loc).Format("2006-01-02")
+	}
+
+	for _, day := range sorted {
+		if day < oldest {
+			return nil
+		}
+
+		events, err := readMessages(days[day], day, channel, loc)
+		if err != nil {
+			return fmt.Errorf("unable to read %s: %s", days[day], err)
+		}
+
+		for i := len(events) - 1; i >= 0; i-- {
+			if !since.IsZero() && events[i].Time.Before(since) {
+				return nil
+			}
+			if !fn(events[i]) {
+				return nil
+			}
+		}
+	}
+
+	return nil
+}
+
+// readMessages reads the messages in a day's file, oldest first.
+func readMessages(name, day, channel string,
+	loc *time.Location) ([]godrop.Event, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	var r io.Reader = f
+	if strings.HasSuffix(name, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		r = gz
+	}
+
+	var events []godrop.Event
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 4096), 1<<20)
+	for scanner.Scan() {
+		if e, ok := parseMessage(scanner.Text(), day, channel, loc); ok {
+			events = append(events, e)
+		}
+	}
+	return events, scanner.Err()
+}
+
+// parseMessage parses a message or action line from a log. ok is false if
+// the line is something else.
+func parseMessage(line, day, channel string,
+	loc *time.Location) (godrop.Event, bool) {
+	if len(line) < 10 || line[8] != ' ' {
+		return godrop.Event{}, false
+	}
+
+	t, err := time.ParseInLocation("2006-01-02 15:04:05", day+" "+line[:8], loc)
+	if err != nil {
+		return godrop.Event{}, false
+	}
+
+	rest := line[9:]
+	var nick, text string
+	switch {
+	case strings.HasPrefix(rest, "<"):
+		i := strings.Index(rest, "> ")
+		if i == -1 {
+			return godrop.Event{}, false
+		}
+		nick, text = rest[1:i], rest[i+2:]
+	case strings.HasPrefix(rest, "* "):
+		fields := strings.SplitN(rest[2:], " ", 2)
+		if len(fields) != 2 {
+			return godrop.Event{}, false
+		}
+		nick, text = fields[0], "\x01ACTION "+fields[1]+"\x01"
+	default:
+		return godrop.Event{}, false
+	}
+
+	return godrop.Event{
+		Message: irc.Message{
+			Prefix:  nick,
+			Command: "PRIVMSG",
+			Params:  []string{channel, text},
+		},
+		Time: t,
+	}, true
+}
@@ -0,0 +1,151 @@
+// Package chanset provides a way to change a channel's settings. These are how
+// plugins show things such as times, temperatures, and prices on the channel.
+//
+// Usage:
+// - !chanset - Show the channel's settings.
+// - !chanset tz <timezone> - Set the channel's timezone, such as
+//   America/Vancouver.
+// - !chanset locale <locale> - Set the channel's locale, such as en-US.
+// - !chanset clock <12|24> - Show times with a 12 or 24 hour clock.
+// - !chanset units <metric|imperial> - Show measurements such as
+//   temperatures in metric or imperial units.
+// - !chanset currency <code> - Show prices in a currency, such as EUR.
+// - !chanset reset - Go back to the defaults.
+//
+// Only administrators and channel operators may change settings. Settings are
+// kept in persistent storage. This requires storage-file to be set.
+package chanset
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/horgh/godrop"
+	"github.com/horgh/irc"
+)
+
+func init() {
+	godrop.Register("chanset", nil)
+	godrop.RegisterConfig("chanset",
+		godrop.ConfigKey{Name: "storage-file", Required: true},
+	)
+	godrop.RegisterCommand("chanset", godrop.Command{
+		Name:  "chanset",
+		Usage: "[tz|locale|clock|units|currency <value>, or reset]",
+		Help:  "Show or change the channel's settings.",
+		Run:   triggerChanset,
+	})
+}
+
+// triggerChanset handles !chanset. Settings belong to channels, so we ignore
+// it in private.
+func triggerChanset(c *godrop.Client, m irc.Message, fields []string) error {
+	channel := m.Params[0]
+	if !godrop.IsChannel(channel) {
+		return nil
+	}
+
+	if len(fields) == 0 {
+		return c.Message(channel, describe(c.ChannelSettings(channel)))
+	}
+
+	nick := godrop.SourceNick(m)
+	member, _ := c.Member(channel, nick)
+	if !c.IsAdmin(m) && !member.IsOp() {
+		return c.Message(channel, fmt.Sprintf(
+			"%s: Only administrators and channel operators may do that.", nick))
+	}
+
+	s, err := change(c, channel, fields)
+	if err != nil {
+		return c.Message(channel, fmt.Sprintf("%s: %s", nick, err))
+	}
+
+	if err := c.SetChannelSettings(channel, s); err != nil {
+		return fmt.Errorf("unable to save settings: %s", err)
+	}
+
+	return c.Message(channel, describe(c.ChannelSettings(channel)))
+}
+
+// change applies a change to the channel's stored settings. These are the
+// ones the channel set rather than defaults.
+func change(c *godrop.Client, channel string,
+	fields []string) (godrop.ChannelSettings, error) {
+	s, err := c.StoredChannelSettings(channel)
+	if err != nil {
+		return s, err
+	}
+
+	setting := strings.ToLower(fields[0])
+	if setting == "reset" {
+		return godrop.ChannelSettings{}, nil
+	}
+
+	if len(fields) != 2 {
+		return s, fmt.Errorf(
+			"usage: !chanset [tz <timezone> | locale <locale> | clock <12|24> | " +
+				"units <metric|imperial> | currency <code> | reset]")
+	}
+	value := fields[1]
+
+	switch setting {
+	case "tz", "timezone":
+		if _, err := time.LoadLocation(value); err != nil {
+			return s, fmt.Errorf("unknown timezone: %s", value)
+		}
+		s.Timezone = value
+	case "locale":
+		s.Locale = value
+	case "clock":
+		n, err := strconv.Atoi(value)
+		if err != nil || (n != 12 && n != 24) {
+			return s, fmt.Errorf("clock must be 12 or 24")
+		}
+		s.Clock = n
+	case "units":
+		value = strings.ToLower(value)
+		if value != godrop.UnitsMetric && value != godrop.UnitsImperial {
+			return s, fmt.Errorf("units must be %s or %s", godrop.UnitsMetric,
+				godrop.UnitsImperial)
+		}
+		s.Units = value
+	case "currency":
+		value = strings.ToUpper(value)
+		if !godrop.IsCurrencyCode(value) {
+			return s, fmt.Errorf("currency must be a code such as USD")
+		}
+		s.Currency = value
+	default:
+		return s, fmt.Errorf("unknown setting: %s", fields[0])
+	}
+
+	return s, nil
+}
+
+// describe shows the settings along with the current time using them.
+func describe(s godrop.ChannelSettings) string {
+	tz := s.Timezone
+	if tz == "" {
+		tz = "UTC"
+	}
+	locale := s.Locale
+	if locale == "" {
+		locale = "none"
+	}
+	clock := s.Clock
+	if clock == 0 {
+		clock = 24
+	}
+	units := s.Units
+	if units == "" {
+		units = godrop.UnitsMetric
+	}
+
+	return fmt.Sprintf(
+		"Timezone: %s, locale: %s, clock: %d hour, units: %s, currency: %s. "+
+			"It's %s.", tz, locale, clock, units, s.CurrencyCode(),
+		s.FormatTime(time.Now()))
+}
@@ -0,0 +1,149 @@
+// Package choose makes the client choose between options for people.
+//
+// Usage:
+// - !choose pizza | sushi | tacos - Pick one option. Options may be separated
+//   by | or ,.
+// - !shuffle a, b, c - Show the options in a random order.
+//
+// Options are sanitized before we repeat them: Formatting and control
+// characters are removed, and we insert a zero width space into each option
+// so that listing nicks does not highlight those people.
+package choose
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/horgh/godrop"
+	"github.com/horgh/irc"
+)
+
+func init() {
+	godrop.Register("choose", nil)
+	godrop.RegisterCommand("choose", godrop.Command{
+		Name:    "choose",
+		Aliases: []string{"choice"},
+		Usage:   "<option> | <option> [| ...]",
+		Help:    "Pick one of the options.",
+		Run:     triggerChoose,
+	})
+	godrop.RegisterCommand("choose", godrop.Command{
+		Name:  "shuffle",
+		Usage: "<option>, <option> [, ...]",
+		Help:  "Show the options in a random order.",
+		Run:   triggerShuffle,
+	})
+	rand.Seed(time.Now().UnixNano())
+}
+
+const (
+	// Don't accept more options than this.
+	maxOptions = 20
+
+	// Limit how long each option may be.
+	maxOptionLength = 50
+
+	zeroWidthSpace = '​'
+)
+
+// triggerChoose handles !choose
+func triggerChoose(c *godrop.Client, m irc.Message, args []string) error {
+	target := godrop.ReplyTarget(m)
+	nick := godrop.SourceNick(m)
+
+	options, err := parseOptions(strings.Join(args, " "))
+	if err != nil {
+		return c.Message(target, fmt.Sprintf("%s: %s", nick, err))
+	}
+
+	if len(options) < 2 {
+		return c.Message(target, "Usage: !choose <option> | <option> [| ...]")
+	}
+
+	return c.Message(target, fmt.Sprintf("%s: %s", nick,
+		options[rand.Intn(len(options))]))
+}
+
+// triggerShuffle handles !shuffle
+func triggerShuffle(c *godrop.Client, m irc.Message, args []string) error {
+	target := godrop.ReplyTarget(m)
+	nick := godrop.SourceNick(m)
+
+	options, err := parseOptions(strings.Join(args, " "))
+	if err != nil {
+		return c.Message(target, fmt.Sprintf("%s: %s", nick, err))
+	}
+
+	if len(options) < 2 {
+		return c.Message(target, "Usage: !shuffle <option>, <option> [, ...]")
+	}
+
+	rand.Shuffle(len(options), func(i, j int) {
+		options[i], options[j] = options[j], options[i]
+	})
+
+	return c.Message(target, fmt.Sprintf("%s: %s", nick,
+		strings.Join(options, ", ")))
+}
+
+// parseOptions splits the arguments into sanitized options.
+//
+// If there is a | we split on that. Otherwise we split on ,. This means
+// options may contain commas when using |.
+func parseOptions(args string) ([]string, error) {
+	sep := ","
+	if strings.Contains(args, "|") {
+		sep = "|"
+	}
+
+	var options []string
+	for _, o := range strings.Split(args, sep) {
+		o = sanitize(o)
+		if o == "" {
+			continue
+		}
+
+		if utf8.RuneCountInString(o) > maxOptionLength {
+			return nil, fmt.Errorf("options may be at most %d characters",
+				maxOptionLength)
+		}
+
+		options = append(options, dehighlight(o))
+	}
+
+	if len(options) > maxOptions {
+		return nil, fmt.Errorf("too many options (at most %d)", maxOptions)
+	}
+
+	return options, nil
+}
+
+// sanitize removes IRC formatting and other control characters and collapses
+// whitespace.
+func sanitize(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if unicode.IsControl(r) || r == zeroWidthSpace {
+			continue
+		}
+		_, _ = b.WriteRune(r)
+	}
+	return strings.Join(strings.Fields(b.String()), " ")
+}
+
+// dehighlight inserts a zero width space after the first character of each
+// word so that clients won't treat any of them as a nick.
+func dehighlight(s string) string {
+	words := strings.Split(s, " ")
+	for i, word := range words {
+		_, size := utf8.DecodeRuneInString(word)
+		if size < len(word) {
+			words[i] = word[:size] + string(zeroWidthSpace) + word[size:]
+		}
+	}
+	return strings.Join(words, " ")
+}
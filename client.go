@@ -3,13 +3,18 @@ package godrop
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
-	"log"
 	"net"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/horgh/godrop/storage"
 	"github.com/horgh/irc"
 )
 
@@ -39,16 +44,211 @@ type Client struct {
 	// tls toggles whether we connect with TLS/SSL or not.
 	tls bool
 
-	// Config holds the parsed config file data.
+	// Config holds the parsed config file data. Set it before running the
+	// client. After that, read it with Conf and change it with SetConfig.
 	//
 	// TODO(horgh): This doesn't really seem to belong here.
-	Config map[string]string
+	Config Config
+
+	// Deadline on read/writes.
+	timeoutTime time.Duration
+
+	// writeMutex serializes writes to the connection. Plugins may send messages
+	// from their own goroutines, such as when a timer fires. It also protects
+	// conn and rw from changing while writing.
+	writeMutex sync.Mutex
+
+	// mutex protects the fields below.
+	mutex sync.Mutex
 
 	// Track whether we've successfully registered.
 	registered bool
 
-	// Deadline on read/writes.
-	timeoutTime time.Duration
+	// store is persistent storage for plugins. We open it when first needed.
+	// storeClosed is true once Shutdown closes it for good.
+	store       storage.Store
+	storeClosed bool
+
+	// state holds what we know about our nick and channels.
+	state *state
+
+	// caps tracks IRCv3 capability negotiation.
+	caps *capState
+
+	// wantCaps are capabilities to request in addition to the defaults.
+	wantCaps []string
+
+	// batches are the open batches keyed by reference. The values are their
+	// types.
+	batches map[string]string
+
+	// historyOnJoin is how many messages of history to request when we join a
+	// channel.
+	historyOnJoin int
+
+	// stsPolicies are the STS policies we know keyed by host. We also keep
+	// them in storage if we have it.
+	stsPolicies map[string]stsPolicy
+
+	// plugins are the plugins chosen with SetPlugins. pluginsSet is true if
+	// SetPlugins was called.
+	plugins    []*plugin
+	pluginsSet bool
+
+	// cert is the TLS client certificate to use, if any.
+	cert *tls.Certificate
+
+	// tlsVerify, tlsRoots, and tlsFingerprint say how to check the server's
+	// certificate. See TLSVerification.
+	tlsVerify      bool
+	tlsRoots       *x509.CertPool
+	tlsFingerprint []byte
+
+	// proxy is the proxy to connect through, if any.
+	proxy *url.URL
+
+	// serverPassword is the password to send with PASS, if any. webIRC is the
+	// WEBIRC command to send, if any.
+	serverPassword string
+	webIRC         WebIRC
+
+	// stsUpgraded is true if we switched to TLS because the server told us
+	// to.
+	stsUpgraded bool
+
+	// servers are the servers set by SetServers. serverIndex is the one we're
+	// using. host, port, and tls hold its details.
+	servers     []Server
+	serverIndex int
+
+	// restore is what to restore after we reconnect.
+	restore *restoreState
+
+	// nickServPassword is the password to identify to NickServ with.
+	nickServPassword string
+
+	// altNicks are nicks to try if ours is taken. See SetAltNicks.
+	altNicks []string
+
+	// joinHold is how long to wait to join channels after connecting. See
+	// HoldJoins. While we wait, joinsReleased is closed to stop waiting and
+	// heldRestore is what we'll restore.
+	joinHold      time.Duration
+	joinsReleased chan struct{}
+	heldRestore   *restoreState
+
+	// autojoin is which channels to join. autojoinFailures counts how many
+	// times in a row we failed to join each, keyed by canonicalized name.
+	autojoin         Autojoin
+	autojoinFailures map[string]int
+
+	// history holds recent messages keyed by canonicalized channel or nick.
+	// historySize is how many we keep for each.
+	history     map[string][]Event
+	historySize int
+
+	// sendq holds messages waiting to be sent on the current connection.
+	sendq *sendQueue
+
+	// sendInterval and sendBurst limit how fast we send queued messages. See
+	// SetSendRate.
+	sendInterval time.Duration
+	sendBurst    int
+
+	// lag tracks how lagged the current connection is.
+	lag lagState
+
+	// transcriptDir is where to write transcripts, if anywhere. transcriptKeep
+	// is how many to keep. transcript is the current connection's.
+	transcriptDir  string
+	transcriptKeep int
+	transcript     *transcript
+
+	// replaying is true while running Replay. replaySecrets holds the lines
+	// we sent with SendSecret during the last Replay.
+	replaying     bool
+	replaySecrets map[string]bool
+
+	// duplicateWindow is how long we suppress duplicate lines for.
+	// recentLines holds when we sent the lines we sent within it. suppressed
+	// counts the lines we suppressed.
+	duplicateWindow time.Duration
+	recentLines     map[string]time.Time
+	suppressed      int
+
+	// secretEchoes holds when we sent the secret lines we expect the server to
+	// echo back keyed by parseEcho.
+	secretEchoes map[string]time.Time
+
+	// paster uploads messages longer than pasteMaxLines lines.
+	paster        Paster
+	pasteMaxLines int
+
+	// netsplits tracks netsplits.
+	netsplits *netsplitState
+
+	// identities are recent nick changes and quits, oldest first. We keep
+	// them across connections.
+	identities []identityEvent
+
+	// identdAddr is where to listen for ident queries while connecting, if
+	// anywhere. identdListener is the listener while we're listening.
+	identdAddr     string
+	identdListener net.Listener
+
+	// localPort and remotePort are the ports of the current connection.
+	localPort  int
+	remotePort int
+
+	// errorTarget is the channel or nick to report errors to, if any.
+	// errorReports tracks what we reported.
+	errorTarget  string
+	errorReports errorReports
+
+	// web makes HTTP requests for plugins. We create it when first needed.
+	web *WebClient
+
+	// whois holds the WHOIS requests we're waiting on keyed by canonicalized
+	// nick.
+	whois map[string]*pendingWhois
+
+	// reconnect is how Run reconnects.
+	reconnect ReconnectPolicy
+
+	// quitting is true if we sent QUIT since Run started. Closing stopRun
+	// tells Run to stop waiting to reconnect.
+	quitting bool
+	stopRun  chan struct{}
+
+	// workers run each plugin's handler in its own goroutine.
+	workers map[*plugin]*pluginWorker
+
+	// connCtx is done once the current connection ends. Handlers get it.
+	connCtx    context.Context
+	cancelConn context.CancelFunc
+
+	// taps get each raw line we read and write. We replace the map rather
+	// than change it.
+	taps map[string]Tap
+
+	// shutdown is true once Shutdown is called. done is closed then.
+	shutdown bool
+	done     chan struct{}
+
+	// manager is the Manager running the client, if any.
+	manager *Manager
+
+	// logger is the Logger to use. If it's nil we use defaultLogger. network
+	// is the client's name in its Manager. logMutex guards these rather than
+	// mutex so we can log while holding mutex.
+	logMutex sync.Mutex
+	logger   Logger
+	network  string
+
+	// health holds how each plugin is doing, keyed by plugin name. See
+	// PluginStatuses. healthMutex guards it.
+	healthMutex sync.Mutex
+	health      map[string]*pluginHealth
 }
 
 const (
@@ -60,10 +260,17 @@ const (
 
 	// keepAliveDuration is how long between TCP keepalives.
 	keepAliveDuration = 30 * time.Second
+
+	// contextQuitTimeout is how long LoopContext waits for the server to close
+	// the connection after the context is done and we send QUIT.
+	contextQuitTimeout = 5 * time.Second
 )
 
 // Hooks are functions to call for each message. Packages can take actions
 // this way.
+//
+// Deprecated: Every client calls these. Use Register, or AddHandler to add a
+// Handler to one client.
 var Hooks []func(*Client, irc.Message)
 
 // New creates a new client connection.
@@ -76,6 +283,14 @@ func New(nick, name, ident, host string, port int, tls bool) *Client {
 		port:        port,
 		tls:         tls,
 		timeoutTime: timeoutTime,
+		state:       newState(),
+		caps:        newCapState(),
+		batches:     map[string]string{},
+		stsPolicies: map[string]stsPolicy{},
+		history:     map[string][]Event{},
+		historySize: defaultHistorySize,
+		netsplits:   newNetsplitState(),
+		whois:       map[string]*pendingWhois{},
 	}
 }
 
@@ -86,9 +301,27 @@ func (c *Client) SetTimeoutTime(d time.Duration) {
 
 // Close cleans up the client. It closes the connection.
 func (c *Client) Close() error {
-	c.registered = false
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
 	c.rw = nil
 
+	c.mutex.Lock()
+	c.registered = false
+	c.saveRestoreState()
+	c.state = newState()
+	c.caps = newCapState()
+	c.batches = map[string]string{}
+	c.netsplits = newNetsplitState()
+	c.stopIdentd()
+	c.stopSendQueue()
+	c.lag = lagState{}
+	c.stopTranscript()
+	c.failWhois(fmt.Errorf("disconnected"))
+	c.secretEchoes = nil
+	c.endConnContext()
+	c.mutex.Unlock()
+
 	if c.conn != nil {
 		err := c.conn.Close()
 		c.conn = nil
@@ -98,82 +331,246 @@ func (c *Client) Close() error {
 }
 
 // Connect opens a new connection to the server.
+//
+// If the server gave us an STS policy that is still valid, we connect with TLS
+// even if we're set not to. We don't fall back to connecting without TLS.
 func (c *Client) Connect() error {
+	return c.ConnectContext(context.Background())
+}
+
+// ConnectContext is like Connect. If the context is done before we finish
+// connecting, we give up.
+func (c *Client) ConnectContext(ctx context.Context) error {
 	dialer := &net.Dialer{
 		Timeout:   timeoutConnect,
 		KeepAlive: keepAliveDuration,
 	}
 
-	if c.tls {
-		conn, err := tls.DialWithDialer(dialer, "tcp",
-			fmt.Sprintf("%s:%d", c.host, c.port),
-			&tls.Config{
-				// Often IRC servers don't have valid certs.
-				InsecureSkipVerify: true,
-			})
-		if err != nil {
+	sts := c.applySTSPolicy()
+
+	// The server may ask who we are as soon as we connect.
+	c.startIdentd()
+
+	c.mutex.Lock()
+	sts = sts || c.stsUpgraded
+	host := c.host
+	addr := net.JoinHostPort(c.host, strconv.Itoa(c.port))
+	useTLS := c.tls
+	c.mutex.Unlock()
+
+	conn, err := c.dial(ctx, dialer, addr)
+	if err != nil {
+		return err
+	}
+
+	if useTLS {
+		tlsConn := tls.Client(conn, c.tlsConfig(host, sts))
+		if err := handshake(ctx, tlsConn); err != nil {
+			_ = conn.Close()
 			return err
 		}
+		conn = tlsConn
+	}
 
-		c.conn = conn
-		c.rw = bufio.NewReadWriter(bufio.NewReader(c.conn), bufio.NewWriter(c.conn))
-		return nil
+	c.setConn(conn)
+	return nil
+}
+
+// handshake does the TLS handshake. It gives up if it takes longer than
+// timeoutConnect or the context is done.
+func handshake(ctx context.Context, conn *tls.Conn) error {
+	if err := conn.SetDeadline(time.Now().Add(timeoutConnect)); err != nil {
+		return fmt.Errorf("unable to set deadline: %s", err)
 	}
 
-	conn, err := dialer.Dial("tcp", fmt.Sprintf("%s:%d", c.host, c.port))
-	if err != nil {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// Make the handshake fail right away.
+			_ = conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	if err := conn.Handshake(); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		return err
 	}
 
+	return conn.SetDeadline(time.Time{})
+}
+
+// setConn sets the connection to use.
+func (c *Client) setConn(conn net.Conn) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
 	c.conn = conn
 	c.rw = bufio.NewReadWriter(bufio.NewReader(c.conn), bufio.NewWriter(c.conn))
-	return nil
+
+	c.mutex.Lock()
+	c.stopSendQueue()
+	c.startSendQueue()
+	c.startTranscript()
+	c.setConnPorts(conn)
+	c.mutex.Unlock()
 }
 
 // ReadMessage reads a line from the connection and parses it as an IRC message.
-func (c Client) ReadMessage() (irc.Message, error) {
-	buf, err := c.read()
+func (c *Client) ReadMessage() (irc.Message, error) {
+	e, err := c.ReadEvent()
 	if err != nil {
 		return irc.Message{}, err
 	}
 
-	m, err := irc.ParseMessage(buf)
+	return e.Message, nil
+}
+
+// ReadMessageContext is like ReadMessage. If the context is done before a
+// line arrives, we stop waiting and return its error.
+func (c *Client) ReadMessageContext(ctx context.Context) (irc.Message,
+	error) {
+	e, err := c.ReadEventContext(ctx)
+	if err != nil {
+		return irc.Message{}, err
+	}
+
+	return e.Message, nil
+}
+
+// ReadEvent reads a line from the connection and parses it as an IRC message
+// along with its tags.
+func (c *Client) ReadEvent() (Event, error) {
+	return c.ReadEventContext(context.Background())
+}
+
+// ReadEventContext is like ReadEvent. If the context is done before a line
+// arrives, we stop waiting and return its error.
+func (c *Client) ReadEventContext(ctx context.Context) (Event, error) {
+	buf, secret, err := c.read(ctx)
+	if err != nil {
+		return Event{}, err
+	}
+
+	received := time.Now()
+
+	tags, rest := splitTags(buf)
+
+	m, err := irc.ParseMessage(rest)
 	if err != nil && err != irc.ErrTruncated {
-		return irc.Message{}, fmt.Errorf("unable to parse message: %s: %s", buf,
-			err)
+		return Event{}, fmt.Errorf("unable to parse message: %s: %s", buf, err)
 	}
 
-	return m, nil
+	e := newEvent(m, tags, received)
+	e.secret = secret
+	return e, nil
 }
 
-// read reads a line from the connection.
-func (c Client) read() (string, error) {
-	if err := c.conn.SetReadDeadline(time.Now().Add(c.timeoutTime)); err != nil {
-		return "", fmt.Errorf("unable to set deadline: %s", err)
+// read reads a line from the connection. secret is true if it's the server
+// echoing a line we sent with SendSecret.
+//
+// If the context is done first, we stop waiting and return its error.
+func (c *Client) read(ctx context.Context) (string, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return "", false, err
+	}
+
+	// Close may clear these while we wait. Hold onto the ones we read from.
+	c.writeMutex.Lock()
+	conn := c.conn
+	rw := c.rw
+	c.writeMutex.Unlock()
+
+	if conn == nil || rw == nil {
+		return "", false, fmt.Errorf("not connected")
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(c.timeoutTime)); err != nil {
+		return "", false, fmt.Errorf("unable to set deadline: %s", err)
+	}
+
+	if ctx.Done() != nil {
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-ctx.Done():
+				// Make the read fail right away.
+				_ = conn.SetReadDeadline(time.Now())
+			case <-done:
+			}
+		}()
 	}
 
-	line, err := c.rw.ReadString('\n')
+	line, err := rw.ReadString('\n')
 	if err != nil {
-		return "", err
+		if ctx.Err() != nil {
+			return "", false, ctx.Err()
+		}
+		return "", false, err
+	}
+
+	secret := c.isSecretEcho(line)
+	logged := line
+	if secret {
+		logged = redactSecret(line)
 	}
 
-	log.Printf("Read: %s", strings.TrimRight(line, "\r\n"))
+	c.Log().Debug("Read", "line", strings.TrimRight(logged, "\r\n"))
+	c.recordTranscript("<", logged)
+	c.tap(TapReceived, logged)
 
-	return line, nil
+	return line, secret, nil
 }
 
 // WriteMessage writes an IRC message to the connection.
-func (c Client) WriteMessage(m irc.Message) error {
+//
+// This sends right away. Use Send to queue a message instead.
+func (c *Client) WriteMessage(m irc.Message) error {
 	buf, err := m.Encode()
 	if err != nil && err != irc.ErrTruncated {
 		return fmt.Errorf("unable to encode message: %s", err)
 	}
 
-	return c.write(buf)
+	return c.writeLine(buf, false)
+}
+
+// WriteMessageContext is like WriteMessage. If the context is done we don't
+// send. Writes are quick so we don't stop one once it starts. It gives up
+// after the I/O timeout (see SetTimeoutTime) regardless.
+func (c *Client) WriteMessageContext(ctx context.Context,
+	m irc.Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.WriteMessage(m)
 }
 
 // write writes a string to the connection
-func (c Client) write(s string) error {
+//
+// It is safe to call this concurrently.
+func (c *Client) write(s string) error {
+	return c.writeLine(s, false)
+}
+
+// writeLine is write for a line that may be secret (see SendSecret).
+func (c *Client) writeLine(s string, secret bool) error {
+	// The echo may arrive as soon as we write.
+	if secret {
+		c.expectSecretEcho(s)
+	}
+
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	if c.conn == nil {
+		return fmt.Errorf("not connected")
+	}
+
 	if err := c.conn.SetWriteDeadline(time.Now().Add(c.timeoutTime)); err != nil {
 		return fmt.Errorf("unable to set deadline: %s", err)
 	}
@@ -191,7 +588,20 @@ func (c Client) write(s string) error {
 		return fmt.Errorf("flush error: %s", err)
 	}
 
-	log.Printf("Sent: %s", strings.TrimRight(s, "\r\n"))
+	redacted := redactLine(s)
+	if secret {
+		redacted = redactSecret(s)
+	}
+	c.Log().Debug("Sent", "line", strings.TrimRight(redacted, "\r\n"))
+	c.recordTranscript(">", redacted)
+	c.tap(TapSent, redacted)
+
+	if secret {
+		c.recordReplaySecret(s)
+		return nil
+	}
+
+	c.recordEchoSent(s)
 
 	return nil
 }
@@ -202,11 +612,85 @@ func (c Client) write(s string) error {
 //
 // Hook events will fire.
 func (c *Client) Loop() error {
+	return c.LoopContext(context.Background())
+}
+
+// LoopContext is like Loop. Once the context is done we send QUIT, wait a
+// little for the server to close the connection, and return the context's
+// error.
+//
+// Handlers get a context derived from this one. See Context.
+func (c *Client) LoopContext(ctx context.Context) error {
+	c.mutex.Lock()
+	c.endConnContext()
+	c.connCtx, c.cancelConn = context.WithCancel(ctx)
+	c.mutex.Unlock()
+
+	c.writeMutex.Lock()
+	conn := c.conn
+	c.writeMutex.Unlock()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+			return
+		}
+
+		_ = c.Quit("Shutting down")
+
+		select {
+		case <-time.After(contextQuitTimeout):
+			// The read fails once we close it.
+			if conn != nil {
+				_ = conn.Close()
+			}
+		case <-done:
+		}
+	}()
+
+	err := c.loop()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// loop reads from the server until the connection ends.
+func (c *Client) loop() error {
 	for {
-		msg, err := c.ReadMessage()
+		event, err := c.ReadEvent()
 		if err != nil {
 			return err
 		}
+		msg := event.Message
+
+		// Nothing sees echoes of our secrets.
+		if event.secret {
+			continue
+		}
+
+		if c.isSelfMessage(msg) {
+			event.Kind = EventSelfMessage
+		}
+
+		// History is only for hooks. It doesn't change our state.
+		if c.trackBatch(event) {
+			event.Historical = true
+			c.recordHistory(event)
+			c.hooks(event)
+			continue
+		}
+
+		c.recordHistory(event)
+		c.trackNetsplit(&event)
+		c.trackSharedChannels(&event)
+		c.trackIdentity(msg)
+		c.handleEcho(event)
+		c.handleLagPong(msg)
+		c.handleWhois(msg)
 
 		if msg.Command == "PING" {
 			if err := c.Pong(msg); err != nil {
@@ -214,46 +698,299 @@ func (c *Client) Loop() error {
 			}
 		}
 
+		if msg.Command == irc.ReplyWelcome {
+			c.SetRegistered()
+			c.startLagCheck()
+
+			c.mutex.Lock()
+			c.stopIdentd()
+			c.mutex.Unlock()
+		}
+
 		if msg.Command == "ERROR" {
 			// Error terminates the connection. We get it as an acknowledgement after
 			// sending a QUIT.
 			return c.Close()
 		}
 
-		c.hooks(msg)
+		if msg.Command == "CAP" {
+			if err := c.handleCap(msg); err != nil {
+				if err == ErrSTSUpgrade {
+					_ = c.Close()
+				}
+				return err
+			}
+		}
+
+		if err := c.handleSASL(msg); err != nil {
+			return err
+		}
+
+		c.updateState(msg)
+		c.trackAccountTag(event)
+		c.handleAutojoin(msg)
+
+		if err := c.handleNick(msg); err != nil {
+			return err
+		}
+
+		if err := c.requestHistoryOnJoin(msg); err != nil {
+			return err
+		}
+
+		c.hooks(event)
+
+		if msg.Command == irc.ReplyWelcome {
+			if err := c.restoreAfterConnect(); err != nil {
+				return err
+			}
+			c.sendPendingErrors()
+		}
+
+		c.expireErrors()
+
+		for _, e := range c.netsplitEvents() {
+			c.eventHooks(e)
+		}
 	}
 }
 
 // hooks calls each registered IRC package hook.
-func (c *Client) hooks(message irc.Message) {
-	for _, hook := range Hooks {
-		hook(c, message)
+//
+// Plugins run in their own goroutines (see dispatch) so a slow one doesn't
+// hold up reading from the server. Hooks and EventHooks run here before we
+// read the next message.
+//
+// Hooks don't see messages we sent ourselves. This way plugins don't trigger
+// on our own output.
+//
+// Hooks also don't see history. Otherwise commands in the history would
+// trigger again.
+func (c *Client) hooks(event Event) {
+	if !hidden(event) {
+		for _, hook := range Hooks {
+			hook(c, event.Message)
+		}
+		c.handleHelp(event)
+	}
+
+	c.eventHooks(event)
+}
+
+// eventHooks calls each of EventHooks and gives the event to the plugins that
+// see it.
+func (c *Client) eventHooks(event Event) {
+	c.dispatch(event)
+
+	for _, hook := range EventHooks {
+		hook(c, event)
 	}
 }
 
+// hidden checks whether the event is one only EventHooks and plugins
+// registered with RegisterAllEventsHook see. These are our own messages,
+// history, and events that don't come from the server.
+func hidden(event Event) bool {
+	switch event.Kind {
+	case EventSelfMessage, EventResync, EventNetsplit, EventNetjoin,
+		EventReload, EventShutdown:
+		return true
+	}
+	return event.Historical
+}
+
+// isSelfMessage checks whether the message is a PRIVMSG or NOTICE from us.
+func (c *Client) isSelfMessage(m irc.Message) bool {
+	if m.Command != "PRIVMSG" && m.Command != "NOTICE" {
+		return false
+	}
+
+	source := SourceNick(m)
+	return source != "" && Canonicalize(source) == Canonicalize(c.GetNick())
+}
+
 // IsConnected checks whether the client is connected
 func (c *Client) IsConnected() bool {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
 	return c.conn != nil
 }
 
 // SetRegistered sets us as registered.
 func (c *Client) SetRegistered() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
 	c.registered = true
 }
 
 // IsRegistered checks whether the client is registered.
 func (c *Client) IsRegistered() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
 	return c.registered
 }
 
+// Storage retrieves persistent storage plugins may use.
+//
+// Unless storage was set with SetStorage, we open a store the first time
+// this is called. Once the client is shut down (see Shutdown) it returns an
+// error. If the storage-dsn config key is set, this is a database
+// (see storage.OpenSQL). storage-driver says which kind: postgres (the
+// default) or mysql. Otherwise it's a file based store. The file is set by the
+// storage-file config key.
+func (c *Client) Storage() (storage.Store, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.storeClosed {
+		return nil, fmt.Errorf("client is shut down")
+	}
+
+	if c.store != nil {
+		return c.store, nil
+	}
+
+	if dsn := c.Config.GetString("storage-dsn"); dsn != "" {
+		driver := c.Config.GetString("storage-driver")
+		if driver == "" {
+			driver = "postgres"
+		}
+
+		store, err := storage.OpenSQL(driver, dsn)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open storage: %s", err)
+		}
+
+		c.store = store
+		return c.store, nil
+	}
+
+	file := c.Config.GetString("storage-file")
+	if file == "" {
+		return nil, fmt.Errorf("no storage-file configured")
+	}
+
+	store, err := storage.OpenFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open storage: %s", err)
+	}
+
+	c.store = store
+	return c.store, nil
+}
+
+// SetStorage sets the persistent storage plugins use.
+func (c *Client) SetStorage(store storage.Store) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.store = store
+}
+
+// CloseStorage closes the storage if it's open. If Storage is called after
+// this, it opens the store again. Shutdown closes it for good.
+func (c *Client) CloseStorage() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.store == nil {
+		return nil
+	}
+
+	err := c.store.Close()
+	c.store = nil
+	return err
+}
+
 // GetNick retrieves the client's nick.
+//
+// Once registered this is the nick the server knows us by. Before that it is
+// the nick we want.
 func (c *Client) GetNick() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.currentNick()
+}
+
+// currentNick is GetNick for when the caller holds the mutex.
+func (c *Client) currentNick() string {
+	if c.state.nick != "" {
+		return c.state.nick
+	}
 	return c.nick
 }
 
-// Register sends the client's registration/greeting. This consists of NICK and
-// USER.
+// WebIRC is what we tell a server when connecting through a gateway, such as
+// a web client, that the server trusts to say who its users are.
+type WebIRC struct {
+	// Password is the gateway's password in the server's config.
+	Password string
+
+	// Gateway is the gateway's name, such as cgiirc.
+	Gateway string
+
+	// Host and IP are the hostname and IP address of the user the gateway
+	// connects for.
+	Host string
+	IP   string
+}
+
+// SetServerPassword sets a password to send with PASS when we register. An
+// empty string means not to send one.
+func (c *Client) SetServerPassword(password string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.serverPassword = password
+}
+
+// SetWebIRC sets a WEBIRC command to send when we register. A WebIRC with no
+// Password means not to send one.
+func (c *Client) SetWebIRC(w WebIRC) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.webIRC = w
+}
+
+// Register sends the client's registration/greeting. This consists of
+// WEBIRC and PASS if they're set, then CAP LS, NICK, and USER.
+//
+// Servers that don't support capability negotiation ignore CAP.
 func (c *Client) Register() error {
+	c.mutex.Lock()
+	webIRC := c.webIRC
+	password := c.serverPassword
+	c.mutex.Unlock()
+
+	// WEBIRC must come before anything else.
+	if webIRC.Password != "" {
+		if err := c.WriteMessage(irc.Message{
+			Command: "WEBIRC",
+			Params: []string{webIRC.Password, webIRC.Gateway, webIRC.Host,
+				webIRC.IP},
+		}); err != nil {
+			return fmt.Errorf("failed to send WEBIRC: %s", err)
+		}
+	}
+
+	if password != "" {
+		if err := c.WriteMessage(irc.Message{
+			Command: "PASS",
+			Params:  []string{password},
+		}); err != nil {
+			return fmt.Errorf("failed to send PASS: %s", err)
+		}
+	}
+
+	if err := c.capLS(); err != nil {
+		return fmt.Errorf("failed to send CAP LS: %s", err)
+	}
+
 	if err := c.Nick(); err != nil {
 		return err
 	}
@@ -301,11 +1038,107 @@ func (c *Client) Join(name string) error {
 	})
 }
 
+// JoinWithKey joins a channel using a key. If the key is empty it's the same
+// as Join.
+func (c *Client) JoinWithKey(name, key string) error {
+	if key == "" {
+		return c.Join(name)
+	}
+
+	return c.WriteMessage(irc.Message{
+		Command: "JOIN",
+		Params:  []string{name, key},
+	})
+}
+
+// Part leaves a channel.
+func (c *Client) Part(name, reason string) error {
+	params := []string{name}
+	if reason != "" {
+		params = append(params, reason)
+	}
+
+	return c.WriteMessage(irc.Message{
+		Command: "PART",
+		Params:  params,
+	})
+}
+
+// Kick kicks a user from a channel.
+func (c *Client) Kick(channel, nick, reason string) error {
+	return c.WriteMessage(irc.Message{
+		Command: "KICK",
+		Params:  []string{channel, nick, reason},
+	})
+}
+
+// Invite invites a user to a channel.
+func (c *Client) Invite(nick, channel string) error {
+	return c.WriteMessage(irc.Message{
+		Command: "INVITE",
+		Params:  []string{nick, channel},
+	})
+}
+
+// Knock asks the operators of an invite only channel for an invite. Not all
+// servers support this.
+func (c *Client) Knock(channel, message string) error {
+	params := []string{channel}
+	if message != "" {
+		params = append(params, message)
+	}
+
+	return c.WriteMessage(irc.Message{
+		Command: "KNOCK",
+		Params:  params,
+	})
+}
+
 // Message sends a message.
 //
 // If the message is too long for a single line, then it will be split over
 // several lines.
+//
+// If it would take too many lines for a channel and we have a way to paste
+// it, we send a link to it instead. See SetPaster.
+//
+// The message is queued with PriorityNormal. See Send.
 func (c *Client) Message(target string, message string) error {
+	return c.MessageWithPriority(target, message, PriorityNormal)
+}
+
+// MessageWithPriority sends a message queued with the given priority.
+func (c *Client) MessageWithPriority(target, message string,
+	p Priority) error {
+	// If the server echoes our messages we record them when they come back.
+	record := !c.HasCap("echo-message")
+
+	pieces := splitMessage(message)
+	if summary, ok := c.pasteMessage(target, message, len(pieces)); ok {
+		pieces = []string{summary}
+	}
+
+	for _, piece := range pieces {
+		m := irc.Message{
+			Command: "PRIVMSG",
+			Params:  []string{target, piece},
+		}
+		if err := c.Send(m, p); err != nil {
+			return err
+		}
+
+		if record {
+			m.Prefix = c.GetNick()
+			c.recordHistory(Event{Message: m, Time: time.Now()})
+		}
+	}
+
+	return nil
+}
+
+// splitMessage splits a message into pieces short enough to send. It also
+// removes newlines.
+func splitMessage(message string) []string {
 	// 512 is the maximum IRC protocol length.
 	// However, user and host takes up some of that. Let's cut down a bit.
 	// This is arbitrary.
@@ -314,6 +1147,7 @@ func (c *Client) Message(target string, message string) error {
 	// Number of overhead bytes.
 	overhead := len("PRIVMSG ") + len(" :") + len("\r\n")
 
+	var pieces []string
 	for i := 0; i < len(message); i += maxMessage - overhead {
 		endIndex := i + maxMessage - overhead
 		if endIndex > len(message) {
@@ -322,22 +1156,26 @@ func (c *Client) Message(target string, message string) error {
 		piece := message[i:endIndex]
 		piece = strings.Replace(piece, "\r", "", -1)
 		piece = strings.Replace(piece, "\n", " ", -1)
-
-		if err := c.WriteMessage(irc.Message{
-			Command: "PRIVMSG",
-			Params:  []string{target, piece},
-		}); err != nil {
-			return nil
-		}
+		pieces = append(pieces, piece)
 	}
 
-	return nil
+	return pieces
 }
 
 // Quit sends a quit.
 //
-// We track when we send this as we expect an ERROR message in response.
+// We track when we send this as we expect an ERROR message in response. If
+// Run is running, it returns once the connection ends rather than
+// reconnecting. If it's waiting to reconnect, it returns right away.
 func (c *Client) Quit(message string) error {
+	c.mutex.Lock()
+	c.quitting = true
+	if c.stopRun != nil {
+		close(c.stopRun)
+		c.stopRun = nil
+	}
+	c.mutex.Unlock()
+
 	return c.WriteMessage(irc.Message{
 		Command: "QUIT",
 		Params:  []string{message},
@@ -352,6 +1190,14 @@ func (c *Client) Oper(name string, password string) error {
 	})
 }
 
+// Kill sends a KILL command. We must be an operator.
+func (c *Client) Kill(nick, reason string) error {
+	return c.WriteMessage(irc.Message{
+		Command: "KILL",
+		Params:  []string{nick, reason},
+	})
+}
+
 // UserMode sends a MODE command.
 func (c *Client) UserMode(nick string, modes string) error {
 	return c.WriteMessage(irc.Message{
@@ -0,0 +1,317 @@
+// Package clones watches for many connections from one place and tells
+// staff about them.
+//
+// We group people by IP, or by host if we don't know their IP, and by the
+// IPv4 /24 or IPv6 /64 they're in. When a group reaches its threshold we
+// send the nicks in it to clones-channel. We tell the channel about a group
+// again only if it grows or an hour passes.
+//
+// We learn about people the same ways as the hostmasks and recordips
+// plugins: from joins, messages, and WHO replies on our channels, and as an
+// operator from client connection notices. The notices are ircd-ratbox
+// specific.
+//
+// Configuration options:
+// - clones-channel - The channel to alert. Required.
+// - clones-threshold - How many connections from one IP or host to alert
+//   about. Default 3.
+// - clones-subnet-threshold - How many connections from one /24 or /64 to
+//   alert about. Default 5. 0 disables it.
+// - clones-exempt - Space separated hosts and CIDRs to ignore, such as
+//   *.example.com and 192.0.2.0/24. Hosts may contain the wildcards * and ?.
+package clones
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/horgh/godrop"
+	"github.com/horgh/irc"
+)
+
+func init() {
+	godrop.Register("clones", Hook)
+	godrop.RegisterConfig("clones",
+		godrop.ConfigKey{Name: "clones-channel", Required: true,
+			Check: checkChannel},
+		godrop.ConfigKey{Name: "clones-threshold", Kind: godrop.ConfigInt},
+		godrop.ConfigKey{Name: "clones-subnet-threshold", Kind: godrop.ConfigInt},
+		godrop.ConfigKey{Name: "clones-exempt", Check: checkExempt},
+	)
+}
+
+const (
+	defaultThreshold       = 3
+	defaultSubnetThreshold = 5
+
+	// alertInterval is how long we wait before telling the channel about a
+	// group again if it hasn't grown.
+	alertInterval = time.Hour
+)
+
+// connection is someone connected.
+type connection struct {
+	nick string
+	host string
+
+	// ip is their IP if we know it.
+	ip net.IP
+
+	// oper is true if we learned about them from a connection notice. We
+	// forget them when they exit rather than when they leave our channels.
+	oper bool
+}
+
+// alert is when we last told the channel about a group and its size then.
+type alert struct {
+	time  time.Time
+	count int
+}
+
+var (
+	mutex sync.Mutex
+
+	// connections holds who we know is connected keyed by canonicalized nick.
+	connections = map[string]*connection{}
+
+	// alerts holds the alerts we sent keyed by group.
+	alerts = map[string]alert{}
+)
+
+// Hook fires when an IRC message of some kind occurs.
+func Hook(c *godrop.Client, m irc.Message) {
+	switch m.Command {
+	case irc.ReplyWelcome:
+		// We've reconnected and don't know who's around anymore.
+		mutex.Lock()
+		connections = map[string]*connection{}
+		mutex.Unlock()
+	case "JOIN", "PRIVMSG":
+		seen(c, godrop.SourceNick(m), m.Prefix, nil, false)
+	case "352":
+		// RPL_WHOREPLY: <me> <channel> <user> <host> <server> <nick> <flags>
+		// :<hops> <realname>
+		if len(m.Params) >= 6 {
+			seen(c, m.Params[5], m.Params[5]+"!"+m.Params[2]+"@"+m.Params[3], nil,
+				false)
+		}
+	case "NICK":
+		if len(m.Params) >= 1 {
+			renamed(godrop.SourceNick(m), m.Params[0])
+		}
+	case "QUIT":
+		gone(godrop.SourceNick(m), true)
+	case "PART":
+		if _, ok := c.LookupUser(godrop.SourceNick(m)); !ok {
+			gone(godrop.SourceNick(m), false)
+		}
+	case "KICK":
+		if len(m.Params) >= 2 {
+			if _, ok := c.LookupUser(m.Params[1]); !ok {
+				gone(m.Params[1], false)
+			}
+		}
+	case "NOTICE":
+		if cc, ok := godrop.ParseClientConnect(m); ok {
+			seen(c, cc.Nick, cc.Mask(), net.ParseIP(cc.IP), true)
+			return
+		}
+		if len(m.Params) == 2 && !strings.Contains(m.Prefix, "!") {
+			serverNotice(strings.Fields(m.Params[1]))
+		}
+	}
+}
+
+// serverNotice looks at a server notice for clients exiting.
+//
+// They look like:
+// *** Notice -- CLIEXIT <nick> <user> <host> <ip> ...
+// *** Notice -- Client exiting: <nick> (<user>@<host>) [<reason>] [<ip>]
+func serverNotice(fields []string) {
+	if len(fields) < 6 || fields[0] != "***" || fields[1] != "Notice" {
+		return
+	}
+
+	switch {
+	case fields[3] == "CLIEXIT":
+		gone(fields[4], true)
+	case fields[3] == "Client" && fields[4] == "exiting:":
+		gone(fields[5], true)
+	}
+}
+
+// seen records that someone is connected and checks whether their groups
+// are big enough to alert about.
+func seen(c *godrop.Client, nick, mask string, ip net.IP, oper bool) {
+	at := strings.LastIndex(mask, "@")
+	if nick == "" || !strings.Contains(mask, "!") || at == -1 {
+		return
+	}
+	host := mask[at+1:]
+	if ip == nil {
+		ip = net.ParseIP(host)
+	}
+
+	if exempt(c.Conf()["clones-exempt"], host, ip) {
+		return
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	key := godrop.Canonicalize(nick)
+	if conn, ok := connections[key]; ok {
+		// We already know about them.
+		if strings.EqualFold(conn.host, host) &&
+			(ip == nil || ip.Equal(conn.ip)) {
+			return
+		}
+		// Their host may be a cloak that we see after learning their IP.
+		if ip == nil {
+			ip = conn.ip
+		}
+		if conn.oper {
+			oper = true
+		}
+	}
+	connections[key] = &connection{nick: nick, host: host, ip: ip, oper: oper}
+
+	conn := connections[key]
+	checkGroup(c, hostGroup(conn), threshold(c.Conf()["clones-threshold"],
+		defaultThreshold))
+	if subnet := subnetGroup(conn); subnet != "" {
+		checkGroup(c, subnet, threshold(c.Conf()["clones-subnet-threshold"],
+			defaultSubnetThreshold))
+	}
+}
+
+// renamed follows someone changing nick.
+func renamed(oldNick, newNick string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	conn, ok := connections[godrop.Canonicalize(oldNick)]
+	if !ok {
+		return
+	}
+	delete(connections, godrop.Canonicalize(oldNick))
+	conn.nick = newNick
+	connections[godrop.Canonicalize(newNick)] = conn
+}
+
+// gone forgets someone. If they're gone only from our channels, we keep
+// them if we learned about them from a connection notice.
+func gone(nick string, exited bool) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	key := godrop.Canonicalize(nick)
+	if conn, ok := connections[key]; ok && (exited || !conn.oper) {
+		delete(connections, key)
+	}
+}
+
+// checkGroup alerts about a group if it's big enough.
+//
+// The caller must hold the mutex.
+func checkGroup(c *godrop.Client, group string, threshold int) {
+	if threshold <= 0 {
+		return
+	}
+
+	var nicks []string
+	for _, conn := range connections {
+		if hostGroup(conn) == group || subnetGroup(conn) == group {
+			nicks = append(nicks, conn.nick)
+		}
+	}
+	if len(nicks) < threshold {
+		return
+	}
+
+	if a, ok := alerts[group]; ok && len(nicks) <= a.count &&
+		time.Since(a.time) < alertInterval {
+		return
+	}
+	alerts[group] = alert{time: time.Now(), count: len(nicks)}
+
+	for g, a := range alerts {
+		if time.Since(a.time) >= alertInterval {
+			delete(alerts, g)
+		}
+	}
+
+	sort.Strings(nicks)
+	_ = c.Message(c.Conf().GetString("clones-channel"), fmt.Sprintf(
+		"%d connections from %s: %s", len(nicks), group,
+		strings.Join(nicks, ", ")))
+}
+
+// hostGroup is the IP or host a connection is from.
+func hostGroup(conn *connection) string {
+	if conn.ip != nil {
+		return conn.ip.String()
+	}
+	return strings.ToLower(conn.host)
+}
+
+// subnetGroup is the /24 or /64 a connection is from, if we know its IP.
+func subnetGroup(conn *connection) string {
+	if conn.ip == nil {
+		return ""
+	}
+	if ip4 := conn.ip.To4(); ip4 != nil {
+		return (&net.IPNet{IP: ip4.Mask(net.CIDRMask(24, 32)),
+			Mask: net.CIDRMask(24, 32)}).String()
+	}
+	return (&net.IPNet{IP: conn.ip.Mask(net.CIDRMask(64, 128)),
+		Mask: net.CIDRMask(64, 128)}).String()
+}
+
+// exempt checks whether a host or IP matches clones-exempt.
+func exempt(value, host string, ip net.IP) bool {
+	for _, e := range strings.Fields(value) {
+		if _, network, err := net.ParseCIDR(e); err == nil {
+			if ip != nil && network.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if godrop.MatchMask(e, host) || (ip != nil && godrop.MatchMask(e,
+			ip.String())) {
+			return true
+		}
+	}
+	return false
+}
+
+func threshold(value string, def int) int {
+	n, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return def
+	}
+	return n
+}
+
+func checkChannel(value string) error {
+	if !godrop.IsChannel(strings.TrimSpace(value)) {
+		return fmt.Errorf("%s is not a channel", value)
+	}
+	return nil
+}
+
+func checkExempt(value string) error {
+	for _, e := range strings.Fields(value) {
+		if strings.Contains(e, "/") {
+			if _, _, err := net.ParseCIDR(e); err != nil {
+				return fmt.Errorf("invalid CIDR %s", e)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+// Package codec provides hashing and encoding utilities.
+//
+// Usage:
+// - !hash md5|sha1|sha256 <text> - Hash the text and show it in hex.
+// - !b64 encode|decode <text> - Base64 encode or decode the text.
+// - !url encode|decode <text> - URL encode or decode the text.
+//
+// We show at most a line's worth of output. If decoding gives something that
+// isn't printable text, we show it in hex.
+package codec
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/horgh/godrop"
+	"github.com/horgh/irc"
+)
+
+func init() {
+	godrop.Register("codec", nil)
+	godrop.RegisterCommand("codec", godrop.Command{
+		Name:    "hash",
+		Usage:   "md5|sha1|sha256 <text>",
+		Help:    "Hash text.",
+		MinArgs: 2,
+		Run: codecCommand("Usage: !hash md5|sha1|sha256 <text>",
+			hash),
+	})
+	godrop.RegisterCommand("codec", godrop.Command{
+		Name:    "b64",
+		Usage:   "encode|decode <text>",
+		Help:    "Base64 encode or decode text.",
+		MinArgs: 2,
+		Run: codecCommand("Usage: !b64 encode|decode <text>",
+			b64),
+	})
+	godrop.RegisterCommand("codec", godrop.Command{
+		Name:    "url",
+		Usage:   "encode|decode <text>",
+		Help:    "URL encode or decode text.",
+		MinArgs: 2,
+		Run: codecCommand("Usage: !url encode|decode <text>",
+			urlCode),
+	})
+}
+
+// errUsage means the command wasn't used right.
+var errUsage = fmt.Errorf("invalid usage")
+
+// maxOutput is how many bytes of output we show.
+const maxOutput = 300
+
+// codecCommand makes a command's Run from a function taking the action, such
+// as encode, and the text to act on.
+func codecCommand(usage string,
+	run func(action, text string) (string, error)) func(*godrop.Client,
+	irc.Message, []string) error {
+	return func(c *godrop.Client, m irc.Message, args []string) error {
+		target := godrop.ReplyTarget(m)
+		source := godrop.SourceNick(m)
+
+		// The action is the first word. The text is everything after the space
+		// following it, as written.
+		action, text := c.CommandText(m), ""
+		if i := strings.Index(action, " "); i != -1 {
+			action, text = action[:i], action[i+1:]
+		}
+
+		out, err := run(strings.ToLower(action), text)
+		if err == errUsage || (err == nil && text == "") {
+			return c.Message(target, usage)
+		}
+		if err != nil {
+			return fmt.Errorf("unable to %s: %s", action, err)
+		}
+
+		return c.Message(target, fmt.Sprintf("%s: %s", source, limit(out)))
+	}
+}
+
+// hash handles !hash
+func hash(algorithm, text string) (string, error) {
+	switch algorithm {
+	case "md5":
+		sum := md5.Sum([]byte(text))
+		return hex.EncodeToString(sum[:]), nil
+	case "sha1":
+		sum := sha1.Sum([]byte(text))
+		return hex.EncodeToString(sum[:]), nil
+	case "sha256":
+		sum := sha256.Sum256([]byte(text))
+		return hex.EncodeToString(sum[:]), nil
+	}
+	return "", errUsage
+}
+
+// b64 handles !b64
+func b64(action, text string) (string, error) {
+	switch action {
+	case "encode":
+		return base64.StdEncoding.EncodeToString([]byte(text)), nil
+	case "decode":
+		text = strings.TrimSpace(text)
+		b, err := base64.StdEncoding.DecodeString(text)
+		if err != nil {
+			// Try without padding and the URL alphabet before giving up.
+			var err2 error
+			b, err2 = base64.RawStdEncoding.DecodeString(strings.TrimRight(text,
+				"="))
+			if err2 != nil {
+				b, err2 = base64.RawURLEncoding.DecodeString(strings.TrimRight(text,
+					"="))
+			}
+			if err2 != nil {
+				return "", err
+			}
+		}
+		return printable(b), nil
+	}
+	return "", errUsage
+}
+
+// urlCode handles !url
+func urlCode(action, text string) (string, error) {
+	switch action {
+	case "encode":
+		return url.QueryEscape(text), nil
+	case "decode":
+		s, err := url.QueryUnescape(strings.TrimSpace(text))
+		if err != nil {
+			return "", err
+		}
+		return printable([]byte(s)), nil
+	}
+	return "", errUsage
+}
+
+// printable gives decoded bytes as text if they're printable. Otherwise it
+// gives them in hex. This stops people using us to send control characters.
+func printable(b []byte) string {
+	if !utf8.Valid(b) {
+		return "(hex) " + hex.EncodeToString(b)
+	}
+	for _, r := range string(b) {
+		if !unicode.IsPrint(r) && r != ' ' {
+			return "(hex) " + hex.EncodeToString(b)
+		}
+	}
+	return string(b)
+}
+
+// limit cuts output to maxOutput bytes.
+func limit(s string) string {
+	if len(s) <= maxOutput {
+		return s
+	}
+	n := maxOutput
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n] + "... (truncated)"
+}
@@ -0,0 +1,324 @@
+package godrop
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/horgh/irc"
+)
+
+// Command is a command people use by sending a message such as !ddg query.
+// Plugins register them with RegisterCommand rather than matching messages
+// themselves.
+type Command struct {
+	// Name is what follows the prefix to use the command, such as ddg.
+	Name string
+
+	// Aliases are other names for the command.
+	Aliases []string
+
+	// Usage describes the command's arguments, such as <query>.
+	Usage string
+
+	// Help says what the command does. !help shows it.
+	Help string
+
+	// MinArgs is how many arguments the command needs. If there are fewer we
+	// reply with its usage rather than running it.
+	MinArgs int
+
+	// Admin is true if only administrators may use the command. See IsAdmin.
+	Admin bool
+
+	// Owner is true if only owners may use the command. See IsOwnerEvent.
+	Owner bool
+
+	// Run runs the command. args are the words after its name. Run replies
+	// itself. If it returns an error we reply with it.
+	Run func(c *Client, m irc.Message, args []string) error
+}
+
+// registeredCommand is a Command and the plugin that registered it.
+type registeredCommand struct {
+	plugin  string
+	command Command
+}
+
+// commands holds the commands plugins registered keyed by lowercase name and
+// alias.
+var commands = struct {
+	sync.Mutex
+	names map[string]registeredCommand
+}{names: map[string]registeredCommand{}}
+
+// defaultCommandPrefix holds the characters commands start with unless the
+// command-prefix config key says otherwise.
+const defaultCommandPrefix = "!."
+
+// RegisterCommand adds a command for the plugin. Clients have the command if
+// they run the plugin. We call its Run in the plugin's goroutine, before the
+// plugin's hook gets the message. Packages call this from an init() function.
+//
+// It panics if a command with the name or one of the aliases is already
+// registered.
+func RegisterCommand(plugin string, command Command) {
+	commands.Lock()
+	defer commands.Unlock()
+
+	for _, name := range append([]string{command.Name}, command.Aliases...) {
+		name = strings.ToLower(name)
+		if _, ok := commands.names[name]; ok {
+			panic(fmt.Sprintf("command %s registered twice", name))
+		}
+		commands.names[name] = registeredCommand{
+			plugin:  plugin,
+			command: command,
+		}
+	}
+}
+
+// Command looks up one of the client's commands by name or alias. It reports
+// whether there is one.
+func (c *Client) Command(name string) (Command, bool) {
+	commands.Lock()
+	cmd, ok := commands.names[strings.ToLower(name)]
+	commands.Unlock()
+	if !ok || !c.hasPlugin(cmd.plugin) {
+		return Command{}, false
+	}
+	return cmd.command, true
+}
+
+// Commands lists the client's commands sorted by name.
+func (c *Client) Commands() []Command {
+	commands.Lock()
+	var registered []registeredCommand
+	for name, cmd := range commands.names {
+		// Once each, not once per alias.
+		if name == strings.ToLower(cmd.command.Name) {
+			registered = append(registered, cmd)
+		}
+	}
+	commands.Unlock()
+
+	var enabled []Command
+	for _, cmd := range registered {
+		if c.hasPlugin(cmd.plugin) {
+			enabled = append(enabled, cmd.command)
+		}
+	}
+	sort.Slice(enabled, func(i, j int) bool {
+		return enabled[i].Name < enabled[j].Name
+	})
+	return enabled
+}
+
+// ParseCommand parses a command from a message's text, such as !ddg query.
+// Commands start with one of the characters in the command-prefix config key
+// (default ! and .) or with our nick and a : or , such as godrop: ddg query.
+//
+// It returns the command's name in lowercase and its arguments. It reports
+// whether the text is a command.
+func (c *Client) ParseCommand(text string) (string, []string, bool) {
+	text, ok := c.trimCommandPrefix(text)
+	if !ok {
+		return "", nil, false
+	}
+
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return "", nil, false
+	}
+	return strings.ToLower(fields[0]), fields[1:], true
+}
+
+// CommandText retrieves the arguments to the command in the message as they
+// were written rather than split into words. This is for commands that take
+// text as is, such as text to hash. It's blank if there are none or the
+// message isn't a command.
+func (c *Client) CommandText(m irc.Message) string {
+	if len(m.Params) != 2 {
+		return ""
+	}
+
+	text, ok := c.trimCommandPrefix(m.Params[1])
+	if !ok {
+		return ""
+	}
+
+	text = strings.TrimLeft(text, " \t")
+	if i := strings.IndexAny(text, " \t"); i != -1 {
+		return strings.TrimLeft(text[i:], " \t")
+	}
+	return ""
+}
+
+// trimCommandPrefix removes the prefix from a command, such as the ! from
+// !ddg query. It reports whether the text starts with one.
+func (c *Client) trimCommandPrefix(text string) (string, bool) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return "", false
+	}
+
+	if strings.IndexByte(c.commandPrefix(), text[0]) != -1 {
+		text = text[1:]
+		// Not ! by itself or followed by a space.
+		if text == "" || text[0] == ' ' {
+			return "", false
+		}
+		return text, true
+	}
+
+	nick := c.GetNick()
+	if nick == "" || len(text) <= len(nick) ||
+		Canonicalize(text[:len(nick)]) != Canonicalize(nick) ||
+		(text[len(nick)] != ':' && text[len(nick)] != ',') {
+		return "", false
+	}
+	return text[len(nick)+1:], true
+}
+
+// commandPrefix retrieves the characters commands start with.
+func (c *Client) commandPrefix() string {
+	if prefix := c.Conf().GetString("command-prefix"); prefix != "" {
+		return prefix
+	}
+	return defaultCommandPrefix
+}
+
+// runCommand runs the command in the message if the plugin registered it.
+func (c *Client) runCommand(p *plugin, e Event) {
+	m := e.Message
+	if m.Command != "PRIVMSG" || len(m.Params) != 2 {
+		return
+	}
+
+	name, args, ok := c.ParseCommand(m.Params[1])
+	if !ok {
+		return
+	}
+
+	commands.Lock()
+	cmd, ok := commands.names[name]
+	commands.Unlock()
+	if !ok || cmd.plugin != p.name {
+		return
+	}
+
+	target := ReplyTarget(m)
+	source := SourceNick(m)
+
+	// Refusals go at normal priority so anyone can't jump ahead of other
+	// output by trying admin commands.
+	if cmd.command.Admin && !c.IsAdminEvent(e) {
+		_ = c.Message(target, fmt.Sprintf("%s: Only administrators may do that.",
+			source))
+		return
+	}
+
+	if cmd.command.Owner && !c.IsOwnerEvent(e) {
+		_ = c.Message(target, fmt.Sprintf("%s: Only owners may do that.",
+			source))
+		return
+	}
+
+	// Replies to admin and owner commands jump ahead of other output.
+	priority := PriorityNormal
+	if cmd.command.Admin || cmd.command.Owner {
+		priority = PriorityHigh
+	}
+
+	if len(args) < cmd.command.MinArgs {
+		_ = c.MessageWithPriority(target,
+			"Usage: "+c.commandUsage(cmd.command), priority)
+		return
+	}
+
+	if err := cmd.command.Run(c, m, args); err != nil {
+		_ = c.MessageWithPriority(target, fmt.Sprintf("%s: Unable to %s: %s",
+			source, cmd.command.Name, err), priority)
+	}
+}
+
+// handleHelp answers !help, unless a plugin has its own help command.
+//
+// !help lists the commands. !help <command> tells how to use one.
+// Administrators see admin commands as well.
+func (c *Client) handleHelp(e Event) {
+	m := e.Message
+	if m.Command != "PRIVMSG" || len(m.Params) != 2 {
+		return
+	}
+
+	name, args, ok := c.ParseCommand(m.Params[1])
+	if !ok || name != "help" {
+		return
+	}
+	if _, ok := c.Command("help"); ok {
+		return
+	}
+
+	target := ReplyTarget(m)
+	source := SourceNick(m)
+	admin := c.IsAdminEvent(e)
+	owner := c.IsOwnerEvent(e)
+
+	if len(args) > 0 {
+		cmd, ok := c.Command(strings.TrimLeft(args[0], c.commandPrefix()))
+		if !ok || (cmd.Admin && !admin) || (cmd.Owner && !owner) {
+			_ = c.Message(target, fmt.Sprintf("%s: I don't know that command.",
+				source))
+			return
+		}
+
+		help := c.commandUsage(cmd)
+		if cmd.Help != "" {
+			help += " - " + cmd.Help
+		}
+		_ = c.Message(target, fmt.Sprintf("%s: %s", source, help))
+		return
+	}
+
+	var names []string
+	for _, cmd := range c.Commands() {
+		if (cmd.Admin && !admin) || (cmd.Owner && !owner) {
+			continue
+		}
+		names = append(names, c.FormatCommand(cmd.Name))
+	}
+	if len(names) == 0 {
+		_ = c.Message(target, fmt.Sprintf("%s: There are no commands.", source))
+		return
+	}
+	_ = c.Message(target, fmt.Sprintf(
+		"%s: Commands: %s. Use %s <command> to learn about one.", source,
+		strings.Join(names, ", "), c.FormatCommand("help")))
+}
+
+// FormatCommand shows how to write a command, such as !ddg. It starts with
+// the first character of command-prefix.
+func (c *Client) FormatCommand(name string) string {
+	return c.commandPrefix()[:1] + name
+}
+
+// commandUsage describes how to use the command, such as !ddg <query>.
+func (c *Client) commandUsage(cmd Command) string {
+	usage := c.FormatCommand(cmd.Name)
+	if cmd.Usage != "" {
+		usage += " " + cmd.Usage
+	}
+	return usage
+}
+
+// hasPlugin checks whether the client runs the plugin.
+func (c *Client) hasPlugin(name string) bool {
+	for _, p := range c.enabledPlugins() {
+		if p.name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,377 @@
+package godrop
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+// Config holds settings keyed by name.
+//
+// Plugins' keys start with the plugin's name, such as twitchstreams-users.
+// Section retrieves a plugin's keys without the prefix.
+type Config map[string]string
+
+// LoadConfig reads a config file.
+//
+// Each line is a key and a value separated by =, such as:
+//
+//   nick = godrop
+//
+// Keys may be in sections for each plugin. Keys in a section get the
+// section's name and a - in front. This is the same as setting
+// twitchstreams-users:
+//
+//   [twitchstreams]
+//   users = alice bob
+//
+// Blank lines and lines starting with # are ignored. Whitespace around keys
+// and values is ignored.
+func LoadConfig(file string) (Config, error) {
+	fh, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open config: %s", err)
+	}
+	defer func() {
+		_ = fh.Close()
+	}()
+
+	config := Config{}
+
+	scanner := bufio.NewScanner(fh)
+	lineNumber := 0
+	section := ""
+	for scanner.Scan() {
+		lineNumber++
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			if section == "" {
+				return nil, fmt.Errorf("%s line %d: missing section name", file,
+					lineNumber)
+			}
+			continue
+		}
+
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("%s line %d: missing =", file, lineNumber)
+		}
+
+		key := strings.TrimSpace(kv[0])
+		if key == "" {
+			return nil, fmt.Errorf("%s line %d: missing key", file, lineNumber)
+		}
+		if section != "" {
+			key = section + "-" + key
+		}
+
+		if _, ok := config[key]; ok {
+			return nil, fmt.Errorf("%s line %d: %s is already set", file,
+				lineNumber, key)
+		}
+
+		config[key] = strings.TrimSpace(kv[1])
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read config: %s", err)
+	}
+
+	return config, nil
+}
+
+// webConfigKeys are the settings Web uses.
+var webConfigKeys = []string{"web-timeout", "web-proxy", "web-user-agent",
+	"web-host-interval", "web-cache"}
+
+// Conf retrieves the config. Read it this way rather than through Config
+// since SetConfig may replace Config while other goroutines, such as plugins',
+// are running. Don't modify what it returns.
+func (c *Client) Conf() Config {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.Config
+}
+
+// SetConfig replaces Config, such as after reloading the config file, without
+// reconnecting. Plugins see the new settings the next time they look. We tell
+// EventHooks and plugins registered with RegisterAllEventsHook with an
+// EventReload event.
+//
+// Settings for things we set up once, such as storage, don't change until we
+// create the client again. The web settings apply to the next Web call.
+func (c *Client) SetConfig(config Config) {
+	c.mutex.Lock()
+	old := c.Config
+	c.Config = config
+	for _, key := range webConfigKeys {
+		if old[key] != config[key] {
+			c.web = nil
+			break
+		}
+	}
+	c.mutex.Unlock()
+
+	e := Event{
+		Message: irc.Message{Command: "RELOAD"},
+		Time:    time.Now(),
+		Kind:    EventReload,
+	}
+	c.eventHooks(e)
+}
+
+// Section retrieves the keys starting with the name and a -, such as a
+// plugin's, without that prefix.
+func (c Config) Section(name string) Config {
+	section := Config{}
+	prefix := name + "-"
+	for k, v := range c {
+		if strings.HasPrefix(k, prefix) {
+			section[strings.TrimPrefix(k, prefix)] = v
+		}
+	}
+	return section
+}
+
+// GetString retrieves a value without surrounding whitespace.
+func (c Config) GetString(key string) string {
+	return strings.TrimSpace(c[key])
+}
+
+// GetStringSlice retrieves a space separated value as a slice.
+func (c Config) GetStringSlice(key string) []string {
+	return strings.Fields(c[key])
+}
+
+// GetInt retrieves an integer. If the key isn't set or isn't an integer it
+// returns def.
+func (c Config) GetInt(key string, def int) int {
+	n, err := strconv.Atoi(c.GetString(key))
+	if err != nil {
+		return def
+	}
+	return n
+}
+
+// GetFloat retrieves a number. If the key isn't set or isn't a number it
+// returns def.
+func (c Config) GetFloat(key string, def float64) float64 {
+	f, err := strconv.ParseFloat(c.GetString(key), 64)
+	if err != nil {
+		return def
+	}
+	return f
+}
+
+// GetBool retrieves true or false. If the key isn't set or is neither it
+// returns def.
+func (c Config) GetBool(key string, def bool) bool {
+	b, err := strconv.ParseBool(c.GetString(key))
+	if err != nil {
+		return def
+	}
+	return b
+}
+
+// GetDuration retrieves a duration such as 30s. If the key isn't set or isn't
+// a duration it returns def.
+func (c Config) GetDuration(key string, def time.Duration) time.Duration {
+	d, err := time.ParseDuration(c.GetString(key))
+	if err != nil {
+		return def
+	}
+	return d
+}
+
+// ConfigKind is the type of a config value.
+type ConfigKind int
+
+const (
+	// ConfigString is any text.
+	ConfigString ConfigKind = iota
+
+	// ConfigInt is an integer.
+	ConfigInt
+
+	// ConfigFloat is a number.
+	ConfigFloat
+
+	// ConfigBool is true or false.
+	ConfigBool
+
+	// ConfigDuration is a duration such as 30s.
+	ConfigDuration
+
+	// ConfigTimezone is a timezone name such as America/Vancouver.
+	ConfigTimezone
+
+	// ConfigFile is the path to a file that exists.
+	ConfigFile
+
+	// ConfigDir is the path to a directory that exists.
+	ConfigDir
+)
+
+// ConfigKey describes a config key a plugin uses.
+type ConfigKey struct {
+	Name string
+	Kind ConfigKind
+
+	// Required is true if the plugin doesn't work without the key.
+	Required bool
+
+	// Check checks the value if it's set, in addition to checking it is of the
+	// right kind. It's optional.
+	Check func(string) error
+}
+
+// configKeys holds the config keys plugins use keyed by plugin name.
+var configKeys = struct {
+	sync.Mutex
+	keys map[string][]ConfigKey
+}{keys: map[string][]ConfigKey{}}
+
+// RegisterConfig declares the config keys a plugin uses so ValidateConfig can
+// check them. Packages call this from an init() function.
+func RegisterConfig(plugin string, keys ...ConfigKey) {
+	configKeys.Lock()
+	defer configKeys.Unlock()
+
+	configKeys.keys[plugin] = append(configKeys.keys[plugin], keys...)
+}
+
+// ConfigProblem is a problem with a config key.
+type ConfigProblem struct {
+	Plugin string
+	Key    string
+
+	// Missing is true if the key is required but not set. Otherwise its value
+	// is invalid and Err says why.
+	Missing bool
+	Err     error
+}
+
+func (p ConfigProblem) String() string {
+	if p.Missing {
+		return fmt.Sprintf("%s: %s is not set. The plugin needs it.", p.Plugin,
+			p.Key)
+	}
+	return fmt.Sprintf("%s: %s is invalid: %s", p.Plugin, p.Key, p.Err)
+}
+
+// ValidateConfig checks Config has the keys the client's plugins declare with
+// RegisterConfig and that their values are valid. It also checks templates
+// set in the config (see Format). It returns a problem for each key that
+// isn't valid.
+func (c *Client) ValidateConfig() []ConfigProblem {
+	plugins := c.EnabledPlugins()
+
+	c.mutex.Lock()
+	config := c.Config
+	store := c.store != nil
+	c.mutex.Unlock()
+
+	return validateConfig(config, plugins, store)
+}
+
+// CheckConfig is like ValidateConfig for a config no client uses yet, such as
+// one we're about to reload. plugins are the plugins that would run.
+func CheckConfig(config Config, plugins []string) []ConfigProblem {
+	return validateConfig(config, plugins, false)
+}
+
+// validateConfig checks the config for the plugins. store is true if storage
+// was set with SetStorage.
+func validateConfig(config Config, plugins []string,
+	store bool) []ConfigProblem {
+	configKeys.Lock()
+	defer configKeys.Unlock()
+
+	var problems []ConfigProblem
+	for _, plugin := range plugins {
+		for _, key := range configKeys.keys[plugin] {
+			value := strings.TrimSpace(config[key.Name])
+			if value == "" {
+				// Plugins require storage-file to say they need storage. A database
+				// works too.
+				if key.Name == "storage-file" &&
+					(store || config.GetString("storage-dsn") != "") {
+					continue
+				}
+				if key.Required {
+					problems = append(problems, ConfigProblem{
+						Plugin:  plugin,
+						Key:     key.Name,
+						Missing: true,
+					})
+				}
+				continue
+			}
+
+			if err := checkConfigValue(key, value); err != nil {
+				problems = append(problems, ConfigProblem{
+					Plugin: plugin,
+					Key:    key.Name,
+					Err:    err,
+				})
+			}
+		}
+	}
+
+	return append(problems, validateTemplates(config)...)
+}
+
+// checkConfigValue checks a value is valid for a key.
+func checkConfigValue(key ConfigKey, value string) error {
+	switch key.Kind {
+	case ConfigInt:
+		if _, err := strconv.Atoi(value); err != nil {
+			return fmt.Errorf("%s is not an integer", value)
+		}
+	case ConfigFloat:
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			return fmt.Errorf("%s is not a number", value)
+		}
+	case ConfigBool:
+		if _, err := strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("%s is not true or false", value)
+		}
+	case ConfigDuration:
+		if _, err := time.ParseDuration(value); err != nil {
+			return fmt.Errorf("%s is not a duration such as 30s", value)
+		}
+	case ConfigTimezone:
+		if _, err := time.LoadLocation(value); err != nil {
+			return fmt.Errorf("unknown timezone %s", value)
+		}
+	case ConfigFile, ConfigDir:
+		fi, err := os.Stat(value)
+		if err != nil {
+			return err
+		}
+		if key.Kind == ConfigFile && fi.IsDir() {
+			return fmt.Errorf("%s is a directory", value)
+		}
+		if key.Kind == ConfigDir && !fi.IsDir() {
+			return fmt.Errorf("%s is not a directory", value)
+		}
+	}
+
+	if key.Check != nil {
+		return key.Check(value)
+	}
+	return nil
+}
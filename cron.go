@@ -0,0 +1,174 @@
+package godrop
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule says when something happens, like a cron schedule.
+//
+// Schedules have five fields: minute, hour, day of month, month, and day of
+// week. Each field may be *, a number, a range such as 1-5, or a list such as
+// 1,3,5. Any of these may have a step, such as */15. Days of the week are 0
+// to 6 starting on Sunday. 7 is also Sunday. @hourly, @daily, @weekly,
+// @monthly, and @yearly work as well. If both the day of month and the day of
+// week are restricted, either matching is enough.
+type Schedule struct {
+	// Each field holds the values matching it as bits.
+	minute, hour, dom, month, dow uint64
+
+	// Whether the day fields were *. If either is, the other decides the day.
+	// Otherwise either may match.
+	domStar, dowStar bool
+}
+
+var scheduleShortcuts = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// ParseSchedule parses a schedule such as "*/15 9-17 * * 1-5" or "@daily".
+func ParseSchedule(spec string) (*Schedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) == 1 {
+		s, ok := scheduleShortcuts[strings.ToLower(fields[0])]
+		if !ok {
+			return nil, fmt.Errorf("invalid schedule: %s", fields[0])
+		}
+		fields = strings.Fields(s)
+	}
+
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("a schedule needs five fields")
+	}
+
+	s := &Schedule{}
+	bounds := []struct {
+		bits     *uint64
+		min, max int
+	}{
+		{&s.minute, 0, 59},
+		{&s.hour, 0, 23},
+		{&s.dom, 1, 31},
+		{&s.month, 1, 12},
+		{&s.dow, 0, 7},
+	}
+
+	for i, b := range bounds {
+		bits, err := parseScheduleField(fields[i], b.min, b.max)
+		if err != nil {
+			return nil, err
+		}
+		*b.bits = bits
+	}
+
+	// 7 is also Sunday.
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+
+	s.domStar = fields[2] == "*"
+	s.dowStar = fields[4] == "*"
+
+	return s, nil
+}
+
+// parseScheduleField parses one field of a schedule.
+func parseScheduleField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i != -1 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid step: %s", part)
+			}
+			step = n
+			part = part[:i]
+		}
+
+		lo, hi := min, max
+		if part != "*" {
+			r := strings.SplitN(part, "-", 2)
+			n, err := strconv.Atoi(r[0])
+			if err != nil {
+				return 0, fmt.Errorf("invalid schedule field: %s", field)
+			}
+			lo, hi = n, n
+			if len(r) == 2 {
+				n, err := strconv.Atoi(r[1])
+				if err != nil {
+					return 0, fmt.Errorf("invalid schedule field: %s", field)
+				}
+				hi = n
+			} else if step != 1 {
+				// 5/15 means from 5 on.
+				hi = max
+			}
+		}
+
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("schedule field out of range: %s", field)
+		}
+
+		for i := lo; i <= hi; i += step {
+			bits |= 1 << uint(i)
+		}
+	}
+
+	return bits, nil
+}
+
+// Next finds the first minute after the given time matching the schedule.
+// It's in the given time's location. If there is none within a few years it
+// returns the zero time.
+func (s *Schedule) Next(after time.Time) time.Time {
+	loc := after.Location()
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+			continue
+		}
+
+		if !s.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+			continue
+		}
+
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0,
+				loc)
+			continue
+		}
+
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+
+		return t
+	}
+
+	return time.Time{}
+}
+
+// matchDay checks whether the day matches the schedule.
+func (s *Schedule) matchDay(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+
+	if s.domStar || s.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
@@ -0,0 +1,396 @@
+// Package dashboard provides a web page showing the client's status.
+//
+// It shows whether we're connected and to which server, our lag, the channels
+// we're on and how many people are on them, recent log lines, and the health
+// of each plugin. It also has forms to send a message and to join a channel.
+//
+// It is served at /dashboard/ by the httpapi package's server, so the httpapi
+// plugin must be enabled and http-listen set. Since it sends the password
+// with each request, we only serve it over TLS (see http-cert and http-key)
+// or to connections to a loopback address.
+//
+// To show log lines, wrap the client's Logger with Logger and set it with
+// SetLogger. Each client's dashboard shows only its own.
+//
+// Configuration options:
+// - dashboard-user, dashboard-password - The HTTP basic authentication
+//   credentials. Both are required. If they are not set, the dashboard is
+//   disabled.
+package dashboard
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/horgh/godrop"
+	"github.com/horgh/godrop/httpapi"
+)
+
+func init() {
+	httpapi.Handle("/dashboard/", requireAuth(http.HandlerFunc(pageHandler)))
+	httpapi.Handle("/dashboard/message",
+		requireAuth(http.HandlerFunc(messageHandler)))
+	httpapi.Handle("/dashboard/join", requireAuth(http.HandlerFunc(joinHandler)))
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	formToken = hex.EncodeToString(b)
+}
+
+// logLines is how many log lines we keep.
+const logLines = 100
+
+var (
+	logsMutex sync.Mutex
+
+	// logs holds each client's recent log lines.
+	logs = map[*godrop.Client]*logBuffer{}
+)
+
+// formToken must be in each form we receive. This stops other sites from
+// submitting forms using the browser's credentials.
+var formToken string
+
+// logBuffer keeps the most recent log lines.
+type logBuffer struct {
+	mutex sync.Mutex
+	lines []string
+}
+
+func (b *logBuffer) add(line string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.lines = append(b.lines, line)
+	if len(b.lines) > logLines {
+		b.lines = b.lines[len(b.lines)-logLines:]
+	}
+}
+
+func (b *logBuffer) Lines() []string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return append([]string(nil), b.lines...)
+}
+
+// clientLogs retrieves the client's log lines. We forget them once the
+// client shuts down.
+func clientLogs(c *godrop.Client) *logBuffer {
+	logsMutex.Lock()
+	defer logsMutex.Unlock()
+
+	if b, ok := logs[c]; ok {
+		return b
+	}
+
+	b := &logBuffer{}
+	logs[c] = b
+	go func() {
+		<-c.Done()
+		logsMutex.Lock()
+		delete(logs, c)
+		logsMutex.Unlock()
+	}()
+	return b
+}
+
+// Logger wraps the client's Logger so its dashboard shows what it logs.
+// Debug messages aren't shown.
+func Logger(c *godrop.Client, l godrop.Logger) godrop.Logger {
+	return logger{Logger: l, logs: clientLogs(c)}
+}
+
+// logger records messages in the client's logs and passes them on.
+type logger struct {
+	godrop.Logger
+	logs *logBuffer
+}
+
+func (l logger) Info(msg string, keyvals ...interface{}) {
+	l.record(godrop.LevelInfo, msg, keyvals)
+	l.Logger.Info(msg, keyvals...)
+}
+
+func (l logger) Warn(msg string, keyvals ...interface{}) {
+	l.record(godrop.LevelWarn, msg, keyvals)
+	l.Logger.Warn(msg, keyvals...)
+}
+
+func (l logger) Error(msg string, keyvals ...interface{}) {
+	l.record(godrop.LevelError, msg, keyvals)
+	l.Logger.Error(msg, keyvals...)
+}
+
+func (l logger) record(level godrop.LogLevel, msg string,
+	keyvals []interface{}) {
+	var b strings.Builder
+	b.WriteString(time.Now().Format("2006/01/02 15:04:05 "))
+	b.WriteString(level.String() + " " + msg)
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		fmt.Fprintf(&b, " %v=%v", keyvals[i], keyvals[i+1])
+	}
+	l.logs.add(b.String())
+}
+
+// requireAuth wraps a handler so requests must have the basic authentication
+// credentials. We refuse requests that could expose them: those without TLS
+// unless they're to a loopback address.
+func requireAuth(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := httpapi.Client(r)
+
+		if r.TLS == nil && !isLoopback(r) {
+			http.Error(w, "The dashboard requires TLS", http.StatusForbidden)
+			return
+		}
+
+		wantUser := c.Conf().GetString("dashboard-user")
+		wantPass := c.Conf().GetString("dashboard-password")
+		if wantUser == "" || wantPass == "" {
+			http.NotFound(w, r)
+			return
+		}
+
+		user, pass, ok := r.BasicAuth()
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(user), []byte(wantUser)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(pass), []byte(wantPass)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="godrop"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// isLoopback checks whether the request came to a loopback address.
+func isLoopback(r *http.Request) bool {
+	addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		return false
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+type channelInfo struct {
+	Name    string
+	Members int
+}
+
+type pageData struct {
+	Nick       string
+	Server     string
+	Connected  bool
+	Registered bool
+	Lag        time.Duration
+	Suppressed int
+	Channels   []channelInfo
+	Plugins    []godrop.PluginStatus
+	Enabled    map[string]bool
+	Logs       []string
+	Token      string
+	Flash      string
+	Now        time.Time
+}
+
+func pageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/dashboard/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	c := httpapi.Client(r)
+
+	data := pageData{
+		Nick:       c.GetNick(),
+		Server:     c.CurrentServer().String(),
+		Connected:  c.IsConnected(),
+		Registered: c.IsRegistered(),
+		Lag:        c.Lag().Round(time.Millisecond),
+		Suppressed: c.SuppressedDuplicates(),
+		Plugins:    c.PluginStatuses(),
+		Enabled:    map[string]bool{},
+		Logs:       clientLogs(c).Lines(),
+		Token:      formToken,
+		Flash:      r.URL.Query().Get("flash"),
+		Now:        time.Now(),
+	}
+
+	for _, name := range c.Channels() {
+		ch, ok := c.Channel(name)
+		if !ok {
+			continue
+		}
+		data.Channels = append(data.Channels, channelInfo{
+			Name:    ch.Name,
+			Members: len(ch.Members),
+		})
+	}
+
+	for _, name := range c.EnabledPlugins() {
+		data.Enabled[name] = true
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := pageTemplate.Execute(w, data); err != nil {
+		c.Log().Error("Unable to render page", "plugin", "dashboard",
+			"error", err)
+	}
+}
+
+func messageHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkForm(w, r) {
+		return
+	}
+
+	target := strings.TrimSpace(r.PostFormValue("target"))
+	text := strings.TrimSpace(r.PostFormValue("text"))
+	if target == "" || strings.ContainsAny(target, " \r\n") || text == "" {
+		redirect(w, r, "A target and text are required.")
+		return
+	}
+
+	if err := httpapi.Client(r).Message(target, text); err != nil {
+		redirect(w, r, "Unable to send message: "+err.Error())
+		return
+	}
+
+	redirect(w, r, "Sent message to "+target+".")
+}
+
+func joinHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkForm(w, r) {
+		return
+	}
+
+	channel := strings.TrimSpace(r.PostFormValue("channel"))
+	if !godrop.IsChannel(channel) || strings.ContainsAny(channel, " ,\r\n") {
+		redirect(w, r, "Invalid channel.")
+		return
+	}
+
+	if err := httpapi.Client(r).Join(channel); err != nil {
+		redirect(w, r, "Unable to join: "+err.Error())
+		return
+	}
+
+	redirect(w, r, "Joining "+channel+".")
+}
+
+// checkForm checks a form submission is a POST with our token.
+func checkForm(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+
+	if subtle.ConstantTimeCompare([]byte(r.PostFormValue("token")),
+		[]byte(formToken)) != 1 {
+		http.Error(w, "Invalid form", http.StatusForbidden)
+		return false
+	}
+
+	return true
+}
+
+func redirect(w http.ResponseWriter, r *http.Request, flash string) {
+	http.Redirect(w, r, "/dashboard/?flash="+template.URLQueryEscaper(flash),
+		http.StatusSeeOther)
+}
+
+var pageTemplate = template.Must(template.New("page").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>godrop: {{.Nick}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+td, th { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: left; }
+pre { background: #f4f4f4; padding: 1em; overflow-x: auto; }
+.flash { background: #ffd; padding: 0.5em; }
+.bad { color: #b00; }
+</style>
+</head>
+<body>
+<h1>{{.Nick}}</h1>
+
+{{if .Flash}}<p class="flash">{{.Flash}}</p>{{end}}
+
+<h2>Connection</h2>
+<p>
+{{if .Connected}}Connected to{{else}}<span class="bad">Not connected</span> to{{end}}
+{{.Server}},
+{{if .Registered}}registered{{else}}<span class="bad">not registered</span>{{end}}.
+Lag {{.Lag}}.
+{{if .Suppressed}}Suppressed {{.Suppressed}} duplicate messages.{{end}}
+As of {{.Now.Format "2006-01-02 15:04:05 MST"}}.
+</p>
+
+<h2>Channels</h2>
+{{if .Channels}}
+<table>
+<tr><th>Channel</th><th>Members</th></tr>
+{{range .Channels}}<tr><td>{{.Name}}</td><td>{{.Members}}</td></tr>
+{{end}}
+</table>
+{{else}}
+<p>Not on any channels.</p>
+{{end}}
+
+<form method="post" action="/dashboard/join">
+<input type="hidden" name="token" value="{{.Token}}">
+<input name="channel" placeholder="#channel">
+<button>Join</button>
+</form>
+
+<h2>Send message</h2>
+<form method="post" action="/dashboard/message">
+<input type="hidden" name="token" value="{{.Token}}">
+<input name="target" placeholder="#channel or nick">
+<input name="text" size="60" placeholder="Message">
+<button>Send</button>
+</form>
+
+<h2>Plugins</h2>
+<table>
+<tr><th>Plugin</th><th>Enabled</th><th>Calls</th><th>Average</th><th>Max</th><th>Errors</th><th>Last error</th><th>Panics</th><th>Last panic</th></tr>
+{{range .Plugins}}<tr>
+<td>{{.Name}}</td>
+<td>{{if index $.Enabled .Name}}Yes{{else}}No{{end}}</td>
+<td>{{.Calls}}</td>
+<td>{{.AverageTime}}</td>
+<td>{{.MaxTime}}</td>
+<td{{if .Errors}} class="bad"{{end}}>{{.Errors}}</td>
+<td>{{if .Errors}}{{.LastErrorTime.Format "2006-01-02 15:04:05"}}: {{.LastError}}{{end}}</td>
+<td{{if .Panics}} class="bad"{{end}}>{{.Panics}}</td>
+<td>{{if .Panics}}{{.LastPanicTime.Format "2006-01-02 15:04:05"}}: {{.LastPanic}}{{end}}</td>
+</tr>
+{{end}}
+</table>
+
+<h2>Recent log</h2>
+<pre>{{range .Logs}}{{.}}
+{{end}}</pre>
+</body>
+</html>
+`))
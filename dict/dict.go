@@ -0,0 +1,190 @@
+// Package dict looks up what words mean.
+//
+// Definitions come from the Free Dictionary API
+// (https://dictionaryapi.dev).
+//
+// Usage:
+// - !dict <word> - Show the word's first definition and how many it has.
+// - !dict <word> <number> - Show another of its definitions.
+//
+// Configuration options:
+// - dict-language - The language of the dictionary to use, such as en or es.
+//   Default en.
+// - dict-url - The URL of the API. The default is
+//   https://api.dictionaryapi.dev/api/v2/entries.
+package dict
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/horgh/godrop"
+	"github.com/horgh/irc"
+)
+
+func init() {
+	godrop.Register("dict", nil)
+	godrop.RegisterConfig("dict",
+		godrop.ConfigKey{Name: "dict-language", Check: checkLanguage},
+		godrop.ConfigKey{Name: "dict-url"},
+	)
+	godrop.RegisterCommand("dict", godrop.Command{
+		Name:    "dict",
+		Usage:   "<word> [number]",
+		Help:    "Look up what a word means.",
+		MinArgs: 1,
+		Run:     triggerDict,
+	})
+}
+
+var languageRE = regexp.MustCompile(`^[a-z]{2}(?:[-_][A-Za-z]{2})?$`)
+
+const (
+	defaultLanguage = "en"
+	defaultURL      = "https://api.dictionaryapi.dev/api/v2/entries"
+)
+
+// Entry is an entry for a word in the API's response.
+type Entry struct {
+	Word     string    `json:"word"`
+	Phonetic string    `json:"phonetic"`
+	Meanings []Meaning `json:"meanings"`
+}
+
+// Meaning is a word's definitions as one part of speech.
+type Meaning struct {
+	PartOfSpeech string       `json:"partOfSpeech"`
+	Definitions  []Definition `json:"definitions"`
+}
+
+// Definition is one sense of a word.
+type Definition struct {
+	Definition string `json:"definition"`
+	Example    string `json:"example"`
+}
+
+// Sense is a definition along with its part of speech.
+type Sense struct {
+	Word         string
+	Phonetic     string
+	PartOfSpeech string
+	Definition
+}
+
+// triggerDict handles !dict
+func triggerDict(c *godrop.Client, m irc.Message, fields []string) error {
+	target := godrop.ReplyTarget(m)
+
+	index := 1
+	if len(fields) > 1 {
+		if n, err := strconv.Atoi(fields[len(fields)-1]); err == nil {
+			index = n
+			fields = fields[:len(fields)-1]
+		}
+	}
+	word := strings.Join(fields, " ")
+
+	if word == "" || index < 1 {
+		return c.Message(target, "Usage: !dict <word> [number]")
+	}
+
+	senses, err := lookup(c.Web(), apiURL(c.Conf()), language(c.Conf()), word)
+	if err != nil {
+		return c.Message(target, fmt.Sprintf("Unable to look up %s: %s", word,
+			err))
+	}
+
+	if index > len(senses) {
+		return c.Message(target, fmt.Sprintf("%s has %d definitions.", word,
+			len(senses)))
+	}
+
+	return c.Message(target, describe(senses[index-1], index, len(senses)))
+}
+
+// lookup finds a word's senses.
+func lookup(web *godrop.WebClient, base, lang,
+	word string) ([]Sense, error) {
+	u := strings.TrimRight(base, "/") + "/" + url.PathEscape(lang) + "/" +
+		url.PathEscape(word)
+
+	resp, body, err := web.Get(u)
+	if err != nil {
+		return nil, fmt.Errorf("failed to perform HTTP request: %s", err)
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("no definitions found")
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unsuccessful request: %s", resp.Status)
+	}
+
+	var entries []Entry
+	if err := json.Unmarshal(body, &entries); err != nil {
+		return nil, fmt.Errorf("unable to decode: %s", err)
+	}
+
+	var senses []Sense
+	for _, e := range entries {
+		for _, m := range e.Meanings {
+			for _, d := range m.Definitions {
+				senses = append(senses, Sense{
+					Word:         e.Word,
+					Phonetic:     e.Phonetic,
+					PartOfSpeech: m.PartOfSpeech,
+					Definition:   d,
+				})
+			}
+		}
+	}
+
+	if len(senses) == 0 {
+		return nil, fmt.Errorf("no definitions found")
+	}
+
+	return senses, nil
+}
+
+// describe shows a sense.
+func describe(s Sense, index, count int) string {
+	out := s.Word
+	if s.Phonetic != "" {
+		out += " " + s.Phonetic
+	}
+	if s.PartOfSpeech != "" {
+		out += " (" + s.PartOfSpeech + ")"
+	}
+	out += fmt.Sprintf(" %d/%d: %s", index, count, s.Definition.Definition)
+	if s.Example != "" {
+		out += fmt.Sprintf(" e.g. \"%s\"", s.Example)
+	}
+	return out
+}
+
+func apiURL(config map[string]string) string {
+	if u := strings.TrimSpace(config["dict-url"]); u != "" {
+		return u
+	}
+	return defaultURL
+}
+
+func language(config map[string]string) string {
+	if l := strings.TrimSpace(config["dict-language"]); l != "" {
+		return l
+	}
+	return defaultLanguage
+}
+
+func checkLanguage(value string) error {
+	if !languageRE.MatchString(value) {
+		return fmt.Errorf("expected a language code such as en")
+	}
+	return nil
+}
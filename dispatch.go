@@ -0,0 +1,145 @@
+package godrop
+
+import (
+	"fmt"
+)
+
+// pluginQueueSize is how many messages may wait for a plugin. If a plugin
+// falls further behind than this we drop messages for it.
+const pluginQueueSize = 256
+
+// pluginWorker runs a plugin's handler in its own goroutine so a slow plugin,
+// such as one making an HTTP request, doesn't stop us reading from the
+// server. Messages reach each plugin in the order they arrived.
+type pluginWorker struct {
+	queue chan Event
+
+	// stop is closed to stop the worker.
+	stop chan struct{}
+}
+
+// dispatch gives an event to each plugin's worker. Only plugins registered
+// with RegisterAllEventsHook get hidden events.
+//
+// While replaying we call the plugins ourselves so what they send comes out
+// in a predictable order.
+func (c *Client) dispatch(e Event) {
+	plugins := c.enabledPlugins()
+
+	c.mutex.Lock()
+	replaying := c.replaying
+	c.mutex.Unlock()
+
+	if replaying {
+		for _, p := range plugins {
+			if !hidden(e) || p.allEvents {
+				c.runPlugin(p, e)
+			}
+		}
+		return
+	}
+
+	for _, w := range c.pluginWorkers(plugins) {
+		if hidden(e) && !w.plugin.allEvents {
+			continue
+		}
+		select {
+		case w.worker.queue <- e:
+			c.pluginQueued(w.plugin.name)
+		default:
+			c.pluginBacklogged(w.plugin.name)
+		}
+	}
+}
+
+// workerFor is a plugin and its worker.
+type workerFor struct {
+	plugin *plugin
+	worker *pluginWorker
+}
+
+// pluginWorkers finds the workers for the plugins, starting any that aren't
+// running. It stops the workers of plugins no longer enabled.
+func (c *Client) pluginWorkers(plugins []*plugin) []workerFor {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// Once shut down we don't start workers again.
+	if c.shutdown {
+		return nil
+	}
+
+	if c.workers == nil {
+		c.workers = map[*plugin]*pluginWorker{}
+	}
+
+	enabled := map[*plugin]struct{}{}
+	var workers []workerFor
+	for _, p := range plugins {
+		enabled[p] = struct{}{}
+
+		w, ok := c.workers[p]
+		if !ok {
+			w = &pluginWorker{
+				queue: make(chan Event, pluginQueueSize),
+				stop:  make(chan struct{}),
+			}
+			c.workers[p] = w
+			go c.runWorker(p, w)
+		}
+		workers = append(workers, workerFor{plugin: p, worker: w})
+	}
+
+	for p, w := range c.workers {
+		if _, ok := enabled[p]; !ok {
+			close(w.stop)
+			delete(c.workers, p)
+		}
+	}
+
+	return workers
+}
+
+// runWorker calls the plugin with each message given to its worker until
+// the worker stops. runPlugin recovers panics so one bad message doesn't
+// stop the worker.
+func (c *Client) runWorker(p *plugin, w *pluginWorker) {
+	for {
+		select {
+		case e := <-w.queue:
+			c.runPlugin(p, e)
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+// pluginBacklogged records that we dropped a message because the plugin's
+// queue was full. We report it once when the plugin falls behind rather than
+// for each message we drop.
+func (c *Client) pluginBacklogged(name string) {
+	c.healthMutex.Lock()
+	h := c.pluginHealth(name)
+	h.dropped++
+	h.dropping++
+	first := h.dropping == 1
+	c.healthMutex.Unlock()
+
+	if first {
+		c.PluginError(name, fmt.Errorf("too far behind, dropping messages"))
+	}
+}
+
+// pluginQueued notes we gave the plugin a message. If we were dropping its
+// messages, we log how many now that its queue has room again.
+func (c *Client) pluginQueued(name string) {
+	c.healthMutex.Lock()
+	h := c.pluginHealth(name)
+	dropped := h.dropping
+	h.dropping = 0
+	c.healthMutex.Unlock()
+
+	if dropped > 0 {
+		c.Log().Warn("Plugin caught up", "plugin", name, "dropped", dropped)
+	}
+}
@@ -3,16 +3,15 @@ package duckduckgo
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/url"
 	"os"
 	"regexp"
 	"strings"
-	"time"
 
 	"github.com/horgh/godrop"
 	"github.com/horgh/irc"
@@ -44,84 +43,61 @@ type Answer struct {
 	APIURL string
 }
 
-// Regular expressions to match on !triggers
-var ddgTriggerRe = regexp.MustCompile(`(?i)^\s*[!.](?:ddg|d|g|google)(\s+.*|$)`)
-var ddg1TriggerRe = regexp.MustCompile(`(?i)^\s*[!.](?:ddg1|d1|g1)(\s+.*|$)`)
-var duckTriggerRe = regexp.MustCompile(`(?i)^\s*[!.](?:duck)(\s+.*|$)`)
-
-// Timeout on HTTP requests.
-var timeout = 15 * time.Second
-
 // Debug mode toggle. If enabled we will save responses to debugFile
 // and if that file exists use its content instead of making additional
 // HTTP requests.
 var debug = false
 var debugFile = "/tmp/ddg.out"
 
-// init registers us to receive IRC messages.
+// init registers our commands.
 func init() {
-	godrop.Hooks = append(godrop.Hooks, Hook)
-}
-
-// Hook fires when an IRC message of some kind occurs.
-//
-// This can let us know whether to do anything or not.
-func Hook(c *godrop.Client, message irc.Message) {
-	if message.Command != "PRIVMSG" {
-		return
-	}
-
-	if matches := ddgTriggerRe.FindStringSubmatch(
-		message.Params[1]); matches != nil {
-		hookDDG(c, message.Params[0], matches[1])
-		return
-	}
-
-	if matches := ddg1TriggerRe.FindStringSubmatch(
-		message.Params[1]); matches != nil {
-		hookDDG1(c, message.Params[0], matches[1])
-		return
-	}
-
-	if matches := duckTriggerRe.FindStringSubmatch(
-		message.Params[1]); matches != nil {
-		hookDuck(c, message.Params[0], matches[1])
-	}
+	godrop.Register("duckduckgo", nil)
+	godrop.RegisterCommand("duckduckgo", godrop.Command{
+		Name:    "ddg",
+		Aliases: []string{"d", "g", "google"},
+		Usage:   "<query>",
+		Help:    "Search DuckDuckGo.",
+		MinArgs: 1,
+		Run:     hookDDG,
+	})
+	godrop.RegisterCommand("duckduckgo", godrop.Command{
+		Name:    "ddg1",
+		Aliases: []string{"d1", "g1"},
+		Usage:   "<query>",
+		Help:    "Search DuckDuckGo and show the top result.",
+		MinArgs: 1,
+		Run:     hookDDG1,
+	})
+	godrop.RegisterCommand("duckduckgo", godrop.Command{
+		Name:    "duck",
+		Usage:   "<query>",
+		Help:    "Look up a DuckDuckGo instant answer.",
+		MinArgs: 1,
+		Run:     hookDuck,
+	})
 }
 
 // hookDDG handles !ddg
-func hookDDG(c *godrop.Client, target string, args string) {
-	query := strings.TrimSpace(args)
-	if len(query) == 0 {
-		_ = c.Message(target, "Usage: !ddg <query>")
-		return
-	}
-
-	search(c, target, query, 4)
+func hookDDG(c *godrop.Client, m irc.Message, args []string) error {
+	search(c, godrop.ReplyTarget(m), strings.Join(args, " "), 4)
+	return nil
 }
 
-// hookDDG handles !ddg1
-func hookDDG1(c *godrop.Client, target string, args string) {
-	query := strings.TrimSpace(args)
-	if len(query) == 0 {
-		_ = c.Message(target, "Usage: !ddg1 <query>")
-		return
-	}
-
-	search(c, target, query, 1)
+// hookDDG1 handles !ddg1
+func hookDDG1(c *godrop.Client, m irc.Message, args []string) error {
+	search(c, godrop.ReplyTarget(m), strings.Join(args, " "), 1)
+	return nil
 }
 
 // hookDuck handles !duck
-//
-// We look up an instant answer and respond to the target.
-func hookDuck(c *godrop.Client, target string, args string) {
-	query := strings.TrimSpace(args)
-	if len(query) == 0 {
-		_ = c.Message(target, "Usage: !duck <query>")
-		return
-	}
+func hookDuck(c *godrop.Client, m irc.Message, args []string) error {
+	duck(c, godrop.ReplyTarget(m), strings.Join(args, " "))
+	return nil
+}
 
-	answer, err := getInstantAnswer(query)
+// duck looks up an instant answer and responds to the target.
+func duck(c *godrop.Client, target, query string) {
+	answer, err := getInstantAnswer(c.Context(), c.Web(), c.Log(), query)
 	if err != nil {
 		_ = c.Message(target, fmt.Sprintf("Failure: %s", err))
 		return
@@ -216,7 +192,8 @@ func hookDuck(c *godrop.Client, target string, args string) {
 // For definitions
 //
 // Definition
-func getInstantAnswer(query string) (Answer, error) {
+func getInstantAnswer(ctx context.Context, web *godrop.WebClient,
+	logger godrop.Logger, query string) (Answer, error) {
 	// I want to set headers, so I need to build and make the request this way.
 
 	values := url.Values{}
@@ -234,26 +211,19 @@ func getInstantAnswer(query string) (Answer, error) {
 		return Answer{}, fmt.Errorf("preparing request: %s", err)
 	}
 
-	client := http.Client{Timeout: timeout}
+	logger.Debug("Making request", "plugin", "duckduckgo", "query", query,
+		"url", apiURL)
 
-	log.Printf("Making request... [%s] (URL %s)", query, apiURL)
-
-	resp, err := client.Do(request)
+	_, body, err := web.Fetch(request.WithContext(ctx))
 	if err != nil {
 		return Answer{}, fmt.Errorf("failed to perform HTTP request: %s", err)
 	}
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		_ = resp.Body.Close()
-		return Answer{}, fmt.Errorf("read failure: %s", err)
-	}
-	_ = resp.Body.Close()
-
 	answer := Answer{}
 	err = json.Unmarshal(body, &answer)
 	if err != nil {
-		log.Printf("Body: %s", body)
+		logger.Debug("Unable to decode response", "plugin", "duckduckgo",
+			"body", string(body))
 		return Answer{}, fmt.Errorf("unable to decode: %s", err)
 	}
 
@@ -264,7 +234,7 @@ func getInstantAnswer(query string) (Answer, error) {
 
 // search looks up search results and outputs them to the target.
 func search(c *godrop.Client, target string, query string, result int) {
-	body, err := getRawSearchResults(query)
+	body, err := getRawSearchResults(c.Context(), c.Web(), c.Log(), query)
 	if err != nil {
 		_ = c.Message(target, fmt.Sprintf("Query failure: %s", err))
 		return
@@ -290,7 +260,8 @@ func search(c *godrop.Client, target string, query string, result int) {
 // getRawSearchResults retrieves the results as an HTML document.
 //
 // We make an HTTP request (unless in debug mode, and then we may not).
-func getRawSearchResults(query string) ([]byte, error) {
+func getRawSearchResults(ctx context.Context, web *godrop.WebClient,
+	logger godrop.Logger, query string) ([]byte, error) {
 	// In debug mode we use the saved response if it is present rather than
 	// making a new HTTP request.
 	if debug {
@@ -300,7 +271,8 @@ func getRawSearchResults(query string) ([]byte, error) {
 			if err != nil {
 				return nil, fmt.Errorf("debug file exists but could not read: %s", err)
 			}
-			log.Printf("Debug mode. Read %s", debugFile)
+			logger.Debug("Debug mode. Read saved results", "plugin", "duckduckgo",
+				"file", debugFile)
 			return body, nil
 		}
 	}
@@ -322,22 +294,13 @@ func getRawSearchResults(query string) ([]byte, error) {
 	request.Header.Set("User-Agent", userAgent)
 	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
-	client := http.Client{Timeout: timeout}
+	logger.Debug("Making request", "plugin", "duckduckgo", "query", query)
 
-	log.Printf("Making request... [%s]", query)
-
-	resp, err := client.Do(request)
+	_, body, err := web.Fetch(request.WithContext(ctx))
 	if err != nil {
 		return nil, fmt.Errorf("failed to perform HTTP request: %s", err)
 	}
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		_ = resp.Body.Close()
-		return nil, fmt.Errorf("read failure: %s", err)
-	}
-	_ = resp.Body.Close()
-
 	// In debug mode we save the response to disk.
 	// This is because I don't want to repeatedly hit the site when debugging
 	// if I can help it.
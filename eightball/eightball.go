@@ -0,0 +1,159 @@
+// Package eightball makes the client answer questions like a Magic 8-Ball.
+//
+// Usage:
+// - !8ball <question>
+//
+// Configuration options:
+// - 8ball-answers - Optional. A | separated list of answers to use instead of
+//   the classic 20.
+// - 8ball-cooldown - Optional. How long a user must wait between questions,
+//   such as 10s. The default is 10 seconds.
+// - 8ball-consistent - Optional. If true, asking the same question again
+//   gives the same answer until the client restarts.
+package eightball
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/horgh/godrop"
+	"github.com/horgh/irc"
+)
+
+func init() {
+	godrop.Register("eightball", nil)
+	godrop.RegisterConfig("eightball",
+		godrop.ConfigKey{Name: "8ball-consistent", Kind: godrop.ConfigBool},
+	)
+	godrop.RegisterCommand("eightball", godrop.Command{
+		Name:    "8ball",
+		Usage:   "<question>",
+		Help:    "Ask the Magic 8-Ball a question.",
+		MinArgs: 1,
+		Run:     trigger8Ball,
+	})
+	rand.Seed(time.Now().UnixNano())
+	sessionSeed = rand.Uint32()
+}
+
+var defaultAnswers = []string{
+	"It is certain.",
+	"It is decidedly so.",
+	"Without a doubt.",
+	"Yes definitely.",
+	"You may rely on it.",
+	"As I see it, yes.",
+	"Most likely.",
+	"Outlook good.",
+	"Yes.",
+	"Signs point to yes.",
+	"Reply hazy, try again.",
+	"Ask again later.",
+	"Better not tell you now.",
+	"Cannot predict now.",
+	"Concentrate and ask again.",
+	"Don't count on it.",
+	"My reply is no.",
+	"My sources say no.",
+	"Outlook not so good.",
+	"Very doubtful.",
+}
+
+const defaultCooldown = 10 * time.Second
+
+// sessionSeed makes consistent answers differ between sessions.
+var sessionSeed uint32
+
+var (
+	mutex     sync.Mutex
+	lastAsked = map[string]time.Time{}
+)
+
+// trigger8Ball handles !8ball
+func trigger8Ball(c *godrop.Client, m irc.Message, words []string) error {
+	target := godrop.ReplyTarget(m)
+	nick := godrop.SourceNick(m)
+	question := strings.Join(words, " ")
+
+	if !checkCooldown(c, nick) {
+		return nil
+	}
+
+	answers := getAnswers(c.Conf())
+
+	var answer string
+	if c.Conf().GetBool("8ball-consistent", false) {
+		answer = answers[consistentIndex(question, len(answers))]
+	} else {
+		answer = answers[rand.Intn(len(answers))]
+	}
+
+	return c.Message(target, fmt.Sprintf("%s: %s", nick, answer))
+}
+
+// checkCooldown reports whether the nick may ask a question now. If they may,
+// we record that they asked.
+func checkCooldown(c *godrop.Client, nick string) bool {
+	cooldown := c.Conf().GetDuration("8ball-cooldown", defaultCooldown)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	now := time.Now()
+	key := strings.ToLower(nick)
+
+	if now.Sub(lastAsked[key]) < cooldown {
+		return false
+	}
+
+	// Forget anyone whose cooldown is over so this does not grow forever.
+	for k, t := range lastAsked {
+		if now.Sub(t) >= cooldown {
+			delete(lastAsked, k)
+		}
+	}
+	lastAsked[key] = now
+
+	return true
+}
+
+func getAnswers(config map[string]string) []string {
+	var answers []string
+	for _, a := range strings.Split(config["8ball-answers"], "|") {
+		a = strings.TrimSpace(a)
+		if a != "" {
+			answers = append(answers, a)
+		}
+	}
+
+	if len(answers) == 0 {
+		return defaultAnswers
+	}
+	return answers
+}
+
+// consistentIndex chooses an answer based on the question so the same
+// question gets the same answer for the rest of the session.
+//
+// We ignore case, whitespace, and punctuation so trivially different
+// phrasings count as the same question.
+func consistentIndex(question string, count int) int {
+	var normalized strings.Builder
+	for _, r := range strings.ToLower(question) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			_, _ = normalized.WriteRune(r)
+		}
+	}
+
+	h := fnv.New32a()
+	_, _ = h.Write([]byte{byte(sessionSeed >> 24), byte(sessionSeed >> 16),
+		byte(sessionSeed >> 8), byte(sessionSeed)})
+	_, _ = h.Write([]byte(normalized.String()))
+
+	return int(h.Sum32() % uint32(count))
+}
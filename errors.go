@@ -0,0 +1,192 @@
+package godrop
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// errorDedupWindow is how long we hold back repeats of an error we
+	// reported.
+	errorDedupWindow = 10 * time.Minute
+
+	// errorReportPeriod and errorReportBurst limit how many errors we report.
+	// We report at most errorReportBurst in any errorReportPeriod.
+	errorReportPeriod = time.Minute
+	errorReportBurst  = 5
+
+	// maxPendingErrors is how many errors we hold while we're not registered.
+	maxPendingErrors = 20
+
+	// maxErrorLength is how long an error we report can be. We cut off the
+	// rest so each report is one line.
+	maxErrorLength = 300
+)
+
+// errorReports tracks errors we report to the error target.
+type errorReports struct {
+	// seen holds errors we reported within errorDedupWindow keyed by their
+	// text.
+	seen map[string]*seenError
+
+	// sent holds when we reported errors within errorReportPeriod.
+	sent []time.Time
+
+	// dropped counts errors we didn't report because we reported too many.
+	dropped int
+
+	// pending holds reports waiting for us to register.
+	pending []string
+}
+
+type seenError struct {
+	time time.Time
+
+	// repeats counts times it happened again that we didn't report.
+	repeats int
+}
+
+// SetErrorTarget sets a channel or nick to report errors to, such as a debug
+// channel or the bot owner. Errors include plugin errors, plugin panics, and
+// anything reported with ReportError.
+//
+// To avoid flooding we don't report an error again for a while. We also
+// limit how many we report each minute. Errors that happen while we're not
+// registered are reported once we are.
+//
+// We don't join the channel. Set the client up to join it.
+func (c *Client) SetErrorTarget(target string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.errorTarget = target
+}
+
+// ReportError logs an error and reports it to the error target if there is
+// one. source says where it happened, such as a plugin's name.
+func (c *Client) ReportError(source string, err error) {
+	c.Log().Error(source, "error", err)
+	c.forwardError(fmt.Sprintf("%s: %s", source, err))
+}
+
+// forwardError reports an error to the error target if there is one.
+func (c *Client) forwardError(text string) {
+	text = strings.Join(strings.Fields(text), " ")
+	if len(text) > maxErrorLength {
+		text = text[:maxErrorLength] + "..."
+	}
+
+	now := time.Now()
+
+	c.mutex.Lock()
+	if c.errorTarget == "" {
+		c.mutex.Unlock()
+		return
+	}
+
+	r := &c.errorReports
+	if r.seen == nil {
+		r.seen = map[string]*seenError{}
+	}
+
+	repeats := 0
+	if s, ok := r.seen[text]; ok {
+		if now.Sub(s.time) < errorDedupWindow {
+			s.repeats++
+			c.mutex.Unlock()
+			return
+		}
+		repeats = s.repeats
+	}
+
+	for len(r.sent) > 0 && now.Sub(r.sent[0]) >= errorReportPeriod {
+		r.sent = r.sent[1:]
+	}
+	if len(r.sent) >= errorReportBurst {
+		r.dropped++
+		c.mutex.Unlock()
+		return
+	}
+
+	r.seen[text] = &seenError{time: now}
+	r.sent = append(r.sent, now)
+
+	report := "Error: " + text
+	if repeats > 0 {
+		report += fmt.Sprintf(" (repeated %d times since last reported)",
+			repeats)
+	}
+	if r.dropped > 0 {
+		report += fmt.Sprintf(" (%d other errors not reported)", r.dropped)
+		r.dropped = 0
+	}
+
+	if c.state.nick == "" {
+		r.pending = append(r.pending, report)
+		if len(r.pending) > maxPendingErrors {
+			r.pending = r.pending[len(r.pending)-maxPendingErrors:]
+		}
+		c.mutex.Unlock()
+		return
+	}
+
+	target := c.errorTarget
+	c.mutex.Unlock()
+
+	c.sendErrorReport(target, report)
+}
+
+// expireErrors reports how many times errors repeated once we stop holding
+// them back.
+func (c *Client) expireErrors() {
+	now := time.Now()
+
+	c.mutex.Lock()
+	target := c.errorTarget
+	if target == "" || c.state.nick == "" {
+		c.mutex.Unlock()
+		return
+	}
+
+	r := &c.errorReports
+	var reports []string
+	for text, s := range r.seen {
+		if now.Sub(s.time) < errorDedupWindow {
+			continue
+		}
+		if s.repeats > 0 {
+			reports = append(reports, fmt.Sprintf("Error repeated %d times: %s",
+				s.repeats, text))
+		}
+		delete(r.seen, text)
+	}
+	c.mutex.Unlock()
+
+	for _, report := range reports {
+		c.sendErrorReport(target, report)
+	}
+}
+
+// sendPendingErrors reports errors that happened while we weren't
+// registered.
+func (c *Client) sendPendingErrors() {
+	c.mutex.Lock()
+	pending := c.errorReports.pending
+	c.errorReports.pending = nil
+	target := c.errorTarget
+	c.mutex.Unlock()
+
+	for _, report := range pending {
+		c.sendErrorReport(target, report)
+	}
+}
+
+// sendErrorReport sends a report to the error target.
+//
+// If it fails we only log. Reporting it would try to send again.
+func (c *Client) sendErrorReport(target, report string) {
+	if err := c.MessageWithPriority(target, report, PriorityLow); err != nil {
+		c.Log().Warn("Unable to report error", "error", err)
+	}
+}
@@ -0,0 +1,253 @@
+package godrop
+
+import (
+	"strings"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+// Event is a message from the server along with information about it.
+type Event struct {
+	irc.Message
+
+	// Tags are the message's IRCv3 tags. Tags without a value have an empty
+	// value.
+	Tags map[string]string
+
+	// Time is when the message happened.
+	//
+	// If the server told us (via the server-time capability), this is that
+	// time. Otherwise it is when we received the message. The server's time is
+	// more accurate, especially when a bouncer plays back old messages.
+	Time time.Time
+
+	// ServerTime is true if Time came from the server.
+	ServerTime bool
+
+	// Historical is true if the message is history we requested with
+	// ChatHistory rather than something happening now. We don't call Hooks
+	// for these, only EventHooks.
+	Historical bool
+
+	// Kind says what type of event this is for the events we decode further.
+	Kind EventKind
+
+	// Account is the source's account name for EventAccount and EventJoin.
+	// With the account-tag capability we also set it for other messages from
+	// users. It is empty if they are not logged in or we don't know.
+	Account string
+
+	// Realname is the source's realname for EventJoin if we know it.
+	Realname string
+
+	// Away is true for EventAway if the source went away, and false if they
+	// came back. AwayMessage is their away message.
+	Away        bool
+	AwayMessage string
+
+	// Netsplit is set for QUITs due to a netsplit and JOINs of people
+	// rejoining after one. Plugins may want to ignore these. It's also set for
+	// EventNetsplit and EventNetjoin.
+	Netsplit *Netsplit
+
+	// Channels are the channels we share with the source of a QUIT or NICK.
+	// We look them up before the user leaves them, so they're the channels
+	// the user quit.
+	Channels []string
+
+	// secret is true if the message is the server echoing one we sent with
+	// SendSecret.
+	secret bool
+}
+
+// EventKind is a type of event.
+type EventKind int
+
+const (
+	// EventOther is any event we don't decode further.
+	EventOther EventKind = iota
+
+	// EventJoin is a JOIN. With the extended-join capability it includes the
+	// account and realname.
+	EventJoin
+
+	// EventAway is a user going away or coming back. We see these for users
+	// on our channels with the away-notify capability.
+	EventAway
+
+	// EventAccount is a user logging in or out. We see these for users on our
+	// channels with the account-notify capability.
+	EventAccount
+
+	// EventSelfMessage is a PRIVMSG or NOTICE we sent. The server sends these
+	// back to us with the echo-message capability. We don't call Hooks for
+	// these, only EventHooks.
+	EventSelfMessage
+
+	// EventTagMessage is a TAGMSG. These are messages with only tags, such as
+	// typing notifications (+typing) and reactions (+draft/react). We see
+	// these with the message-tags capability.
+	EventTagMessage
+
+	// EventResync happens after we reconnect and restore our channels and
+	// modes. Plugins can restore their own state when they see it. Its command
+	// is RESYNC. It doesn't come from the server.
+	EventResync
+
+	// EventNetsplit summarizes a netsplit once it's over. Its Netsplit says
+	// who quit. Its command is NETSPLIT. It doesn't come from the server.
+	EventNetsplit
+
+	// EventNetjoin summarizes people rejoining after a netsplit. Its Netsplit
+	// says who rejoined. Its command is NETJOIN. It doesn't come from the
+	// server.
+	EventNetjoin
+
+	// EventReload happens after SetConfig replaces the config, such as when
+	// it's reloaded. Plugins can apply their new settings when they see it.
+	// Its command is RELOAD. It doesn't come from the server.
+	EventReload
+
+	// EventShutdown happens when Shutdown is called. Plugins with an event
+	// hook see it, even without RegisterAllEventsHook, and can store what they
+	// hold. Its command is SHUTDOWN. It doesn't come from the server.
+	EventShutdown
+)
+
+// EventHooks are functions to call for each message, like Hooks. They
+// receive the Event rather than only the message, so they have access to
+// message tags and the message's time.
+//
+// Every client calls these, as we read each message. Plugins should use
+// RegisterEventHook, or RegisterAllEventsHook if they need our own messages
+// or history.
+var EventHooks []func(*Client, Event)
+
+// MsgID retrieves the message's ID from its msgid tag. It's empty if the
+// server didn't send one. Replies and reactions (see React) refer to messages
+// by ID.
+func (e Event) MsgID() string {
+	return e.Tags["msgid"]
+}
+
+// newEvent creates an Event from a message and its tags.
+func newEvent(m irc.Message, tags map[string]string, received time.Time) Event {
+	e := Event{
+		Message: m,
+		Tags:    tags,
+		Time:    received,
+	}
+
+	if v, ok := tags["time"]; ok {
+		if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			e.Time = t
+			e.ServerTime = true
+		}
+	}
+
+	switch m.Command {
+	case "JOIN":
+		e.Kind = EventJoin
+		// Extended JOIN: <channel> <account> :<realname>
+		if len(m.Params) >= 3 {
+			e.Account = accountName(m.Params[1])
+			e.Realname = m.Params[2]
+		}
+
+	case "AWAY":
+		e.Kind = EventAway
+		if len(m.Params) > 0 && m.Params[0] != "" {
+			e.Away = true
+			e.AwayMessage = m.Params[0]
+		}
+
+	case "TAGMSG":
+		e.Kind = EventTagMessage
+
+	case "ACCOUNT":
+		e.Kind = EventAccount
+		if len(m.Params) > 0 {
+			e.Account = accountName(m.Params[0])
+		}
+
+	default:
+		e.Account = tags["account"]
+	}
+
+	return e
+}
+
+// accountName converts an account parameter to a name. Servers send * to mean
+// not logged in.
+func accountName(account string) string {
+	if account == "*" {
+		return ""
+	}
+	return account
+}
+
+// splitTags separates the IRCv3 tags from a line. It returns the parsed tags
+// (nil if there are none) and the rest of the line.
+func splitTags(line string) (map[string]string, string) {
+	if !strings.HasPrefix(line, "@") {
+		return nil, line
+	}
+
+	i := strings.IndexByte(line, ' ')
+	if i == -1 {
+		return nil, line
+	}
+
+	tags := map[string]string{}
+	for _, tag := range strings.Split(line[1:i], ";") {
+		if tag == "" {
+			continue
+		}
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) == 1 {
+			tags[kv[0]] = ""
+			continue
+		}
+		tags[kv[0]] = unescapeTagValue(kv[1])
+	}
+
+	return tags, strings.TrimLeft(line[i:], " ")
+}
+
+// unescapeTagValue unescapes a tag value as the message-tags specification
+// describes.
+func unescapeTagValue(v string) string {
+	if strings.IndexByte(v, '\\') == -1 {
+		return v
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(v); i++ {
+		if v[i] != '\\' {
+			_ = b.WriteByte(v[i])
+			continue
+		}
+
+		// A trailing backslash is dropped.
+		if i+1 == len(v) {
+			break
+		}
+
+		i++
+		switch v[i] {
+		case ':':
+			_ = b.WriteByte(';')
+		case 's':
+			_ = b.WriteByte(' ')
+		case 'r':
+			_ = b.WriteByte('\r')
+		case 'n':
+			_ = b.WriteByte('\n')
+		default:
+			_ = b.WriteByte(v[i])
+		}
+	}
+
+	return b.String()
+}
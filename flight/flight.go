@@ -0,0 +1,220 @@
+// Package flight provides a way to look up the status of flights.
+//
+// Flight information comes from the aviationstack API
+// (https://aviationstack.com).
+//
+// Setup:
+// - Sign up for an aviationstack account and get an access key.
+// - Set the key in the configuration with key "flight-api-key".
+//
+// Configuration options:
+// - flight-api-key - Your aviationstack access key.
+// - flight-api-url - Optional. The API base URL. The default is
+//   http://api.aviationstack.com/v1. The free plan does not support HTTPS, so
+//   set this to the https:// URL if your plan allows it.
+package flight
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/horgh/godrop"
+	"github.com/horgh/irc"
+)
+
+func init() {
+	godrop.Register("flight", nil)
+	godrop.RegisterCommand("flight", godrop.Command{
+		Name:    "flight",
+		Usage:   "<flight number, e.g. AC123>",
+		Help:    "Look up a flight.",
+		MinArgs: 1,
+		Run:     triggerFlight,
+	})
+}
+
+// flightRE matches a flight number such as AC123 or AAL 100.
+var flightRE = regexp.MustCompile(`(?i)^([a-z0-9]{2,3})\s*([0-9]{1,4}[a-z]?)$`)
+
+const defaultAPIURL = "http://api.aviationstack.com/v1"
+
+// triggerFlight handles !flight
+func triggerFlight(c *godrop.Client, m irc.Message, words []string) error {
+	target := godrop.ReplyTarget(m)
+	args := strings.Join(words, " ")
+
+	matches := flightRE.FindStringSubmatch(args)
+	if matches == nil {
+		return c.Message(target, "Usage: !flight <flight number, e.g. AC123>")
+	}
+
+	number := strings.ToUpper(matches[1] + matches[2])
+
+	c.Log().Debug("Looking up flight", "plugin", "flight", "number", number)
+	flight, err := getFlight(c.Web(), c.Conf(), number)
+	if err != nil {
+		return c.Message(target, fmt.Sprintf("Unable to look up %s: %s", number,
+			err))
+	}
+
+	return c.Message(target, flight.String())
+}
+
+// Flight holds the information about a flight we care about.
+type Flight struct {
+	FlightDate   string    `json:"flight_date"`
+	FlightStatus string    `json:"flight_status"`
+	Departure    Endpoint  `json:"departure"`
+	Arrival      Endpoint  `json:"arrival"`
+	Airline      Airline   `json:"airline"`
+	Number       FlightIDs `json:"flight"`
+}
+
+// Endpoint is a departure or arrival.
+type Endpoint struct {
+	Airport   string `json:"airport"`
+	IATA      string `json:"iata"`
+	Timezone  string `json:"timezone"`
+	Delay     int    `json:"delay"`
+	Scheduled string `json:"scheduled"`
+	Estimated string `json:"estimated"`
+	Actual    string `json:"actual"`
+}
+
+// Airline describes the flight's airline.
+type Airline struct {
+	Name string `json:"name"`
+}
+
+// FlightIDs holds the flight's identifiers.
+type FlightIDs struct {
+	IATA string `json:"iata"`
+	ICAO string `json:"icao"`
+}
+
+func (f Flight) String() string {
+	name := f.Number.IATA
+	if name == "" {
+		name = f.Number.ICAO
+	}
+	if f.Airline.Name != "" {
+		name += " (" + f.Airline.Name + ")"
+	}
+
+	return fmt.Sprintf("%s %s → %s: %s. %s. %s.", name,
+		f.Departure.airportString(), f.Arrival.airportString(), f.FlightStatus,
+		f.Departure.timeString("Departure", "Departed"),
+		f.Arrival.timeString("Arrival", "Arrived"))
+}
+
+func (e Endpoint) airportString() string {
+	if e.IATA == "" {
+		return e.Airport
+	}
+	if e.Airport == "" {
+		return e.IATA
+	}
+	return fmt.Sprintf("%s %s", e.IATA, e.Airport)
+}
+
+// timeString describes when the departure/arrival happens or happened.
+//
+// The API gives times in the airport's local time (despite the +00:00 offset),
+// so we show them without converting.
+func (e Endpoint) timeString(label, pastTense string) string {
+	var s string
+	if t := parseTime(e.Actual); t != "" {
+		s = fmt.Sprintf("%s %s", pastTense, t)
+	} else if t := parseTime(e.Estimated); t != "" {
+		s = fmt.Sprintf("%s estimated %s", label, t)
+	} else if t := parseTime(e.Scheduled); t != "" {
+		s = fmt.Sprintf("%s scheduled %s", label, t)
+	} else {
+		s = fmt.Sprintf("%s time unknown", label)
+	}
+
+	if e.Delay > 0 {
+		s += fmt.Sprintf(" (delayed %s)", time.Duration(e.Delay)*time.Minute)
+	}
+
+	return s
+}
+
+func parseTime(s string) string {
+	if s == "" {
+		return ""
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return s
+	}
+	return t.Format("2006-01-02 15:04")
+}
+
+// getFlight looks up the most recent flight with the given number.
+func getFlight(web *godrop.WebClient, config map[string]string,
+	number string) (Flight, error) {
+	key := strings.TrimSpace(config["flight-api-key"])
+	if key == "" {
+		return Flight{}, fmt.Errorf("no API key configured")
+	}
+
+	apiURL := strings.TrimRight(strings.TrimSpace(config["flight-api-url"]), "/")
+	if apiURL == "" {
+		apiURL = defaultAPIURL
+	}
+
+	vals := url.Values{}
+	vals.Set("access_key", key)
+	vals.Set("flight_iata", number)
+	if len(number) > 2 && number[2] >= 'A' && number[2] <= 'Z' {
+		// Three letter airline codes are ICAO.
+		vals.Del("flight_iata")
+		vals.Set("flight_icao", number)
+	}
+
+	u := apiURL + "/flights?" + vals.Encode()
+
+	resp, body, err := web.Get(u)
+	if err != nil {
+		// Don't include the error as it contains the URL, and so the key.
+		return Flight{}, fmt.Errorf("failed to perform HTTP request")
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return Flight{}, fmt.Errorf("unsuccessful request: %s", resp.Status)
+	}
+
+	var response struct {
+		Data  []Flight
+		Error *struct {
+			Message string
+		}
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return Flight{}, fmt.Errorf("unable to decode: %s", err)
+	}
+
+	if response.Error != nil {
+		return Flight{}, fmt.Errorf("API error: %s", response.Error.Message)
+	}
+
+	if len(response.Data) == 0 {
+		return Flight{}, fmt.Errorf("flight not found")
+	}
+
+	// There may be several days of flights. Take the most recent.
+	flight := response.Data[0]
+	for _, f := range response.Data[1:] {
+		if f.FlightDate > flight.FlightDate {
+			flight = f
+		}
+	}
+
+	return flight, nil
+}
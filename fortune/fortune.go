@@ -0,0 +1,230 @@
+// Package fortune makes the client respond with random fortunes.
+//
+// Fortunes come from fortune files in the usual format: Entries separated by
+// lines containing only %. Each file is a category named after the file.
+//
+// Usage:
+// - !fortune - A fortune from any category.
+// - !fortune <category> - A fortune from the category.
+// - !fortune list - List the categories.
+//
+// Configuration options:
+// - fortune-dir - The directory containing fortune files. For example,
+//   /usr/share/games/fortunes.
+// - fortune-max-length - Optional. Only choose fortunes at most this many
+//   characters long. The default is 300.
+package fortune
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/horgh/godrop"
+	"github.com/horgh/irc"
+)
+
+func init() {
+	godrop.Register("fortune", nil)
+	godrop.RegisterConfig("fortune",
+		godrop.ConfigKey{Name: "fortune-dir", Kind: godrop.ConfigDir,
+			Required: true},
+		godrop.ConfigKey{Name: "fortune-max-length", Kind: godrop.ConfigInt},
+	)
+	godrop.RegisterCommand("fortune", godrop.Command{
+		Name:  "fortune",
+		Usage: "[category or list]",
+		Help:  "Show a random fortune.",
+		Run:   triggerFortune,
+	})
+	rand.Seed(time.Now().UnixNano())
+}
+
+const (
+	defaultMaxLength = 300
+
+	// Fortunes may have several lines. We send each as its own message. Don't
+	// send more than this many.
+	maxLines = 4
+)
+
+// triggerFortune handles !fortune
+func triggerFortune(c *godrop.Client, m irc.Message, args []string) error {
+	target := godrop.ReplyTarget(m)
+	category := strings.ToLower(strings.Join(args, " "))
+
+	dir := c.Conf().GetString("fortune-dir")
+	if dir == "" {
+		return c.Message(target, "No fortune directory configured.")
+	}
+
+	maxLength := c.Conf().GetInt("fortune-max-length", defaultMaxLength)
+	if maxLength <= 0 {
+		return c.Message(target, "Invalid fortune-max-length.")
+	}
+
+	categories, err := getCategories(dir)
+	if err != nil {
+		return c.Message(target, fmt.Sprintf("Unable to read fortunes: %s", err))
+	}
+
+	if len(categories) == 0 {
+		return c.Message(target, "There are no fortunes.")
+	}
+
+	if category == "list" {
+		return c.Message(target, fmt.Sprintf("Categories: %s",
+			strings.Join(categories, ", ")))
+	}
+
+	if category != "" {
+		found := false
+		for _, cat := range categories {
+			if strings.ToLower(cat) == category {
+				categories = []string{cat}
+				found = true
+				break
+			}
+		}
+		if !found {
+			return c.Message(target, fmt.Sprintf(
+				"Unknown category: %s. Use !fortune list to see them.", category))
+		}
+	}
+
+	var candidates []string
+	for _, cat := range categories {
+		fortunes, err := getFortunes(filepath.Join(dir, cat))
+		if err != nil {
+			return c.Message(target, fmt.Sprintf("Unable to read fortunes: %s", err))
+		}
+
+		for _, f := range fortunes {
+			if len(f) <= maxLength && strings.Count(f, "\n") < maxLines {
+				candidates = append(candidates, f)
+			}
+		}
+	}
+
+	if len(candidates) == 0 {
+		return c.Message(target, "There are no fortunes short enough.")
+	}
+
+	fortune := candidates[rand.Intn(len(candidates))]
+	for _, line := range strings.Split(fortune, "\n") {
+		_ = c.Message(target, line)
+	}
+	return nil
+}
+
+// getCategories lists the fortune files in the directory.
+func getCategories(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var categories []string
+	for _, info := range infos {
+		name := info.Name()
+		if !info.Mode().IsRegular() || strings.HasPrefix(name, ".") {
+			continue
+		}
+
+		// Skip strfile(1) index files and the like.
+		if strings.Contains(name, ".") {
+			continue
+		}
+
+		categories = append(categories, name)
+	}
+
+	sort.Strings(categories)
+	return categories, nil
+}
+
+type cachedFile struct {
+	modTime  time.Time
+	fortunes []string
+}
+
+var (
+	cacheMutex sync.Mutex
+	cache      = map[string]cachedFile{}
+)
+
+// getFortunes reads the fortunes in a file.
+//
+// We cache the fortunes until the file changes.
+func getFortunes(file string) ([]string, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+
+	cacheMutex.Lock()
+	cached, ok := cache[file]
+	cacheMutex.Unlock()
+	if ok && cached.modTime.Equal(info.ModTime()) {
+		return cached.fortunes, nil
+	}
+
+	fh, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+
+	fortunes, err := parseFortunes(fh)
+	if err != nil {
+		_ = fh.Close()
+		return nil, fmt.Errorf("error reading %s: %s", file, err)
+	}
+
+	if err := fh.Close(); err != nil {
+		return nil, err
+	}
+
+	cacheMutex.Lock()
+	cache[file] = cachedFile{modTime: info.ModTime(), fortunes: fortunes}
+	cacheMutex.Unlock()
+
+	return fortunes, nil
+}
+
+// parseFortunes splits a fortune file into its fortunes.
+func parseFortunes(fh *os.File) ([]string, error) {
+	var fortunes []string
+	var lines []string
+
+	flush := func() {
+		f := strings.TrimSpace(strings.Join(lines, "\n"))
+		if f != "" {
+			fortunes = append(fortunes, f)
+		}
+		lines = nil
+	}
+
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "%" {
+			flush()
+			continue
+		}
+		// Tabs don't display well on IRC.
+		lines = append(lines, strings.Replace(line, "\t", "    ", -1))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	flush()
+
+	return fortunes, nil
+}
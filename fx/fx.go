@@ -0,0 +1,187 @@
+// Package fx provides currency conversion using European Central Bank
+// reference rates.
+//
+// Rates come from the Frankfurter API (https://www.frankfurter.app) which
+// republishes the ECB's daily reference rates. The ECB only publishes once per
+// business day, so we cache rates per day and base currency.
+//
+// Usage:
+// - !fx 100 USD to EUR
+// - !fx 100 USD to EUR GBP JPY (or EUR,GBP,JPY)
+// - !fx 100 USD to EUR on 2023-01-01
+package fx
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/horgh/godrop"
+	"github.com/horgh/irc"
+)
+
+func init() {
+	godrop.Register("fx", nil)
+	godrop.RegisterCommand("fx", godrop.Command{
+		Name:    "fx",
+		Usage:   "[amount] <from> to <currency> [currency...] [on YYYY-MM-DD]",
+		Help:    "Convert between currencies.",
+		MinArgs: 2,
+		Run:     triggerFX,
+	})
+}
+
+// queryRE matches the arguments to the trigger. The amount is optional.
+var queryRE = regexp.MustCompile(
+	`(?i)^(?:([0-9][0-9,]*(?:\.[0-9]+)?)\s+)?([a-z]{3})\s+(?:to\s+|in\s+)?([a-z]{3}(?:[\s,]+[a-z]{3})*)(?:\s+on\s+(\d{4}-\d{2}-\d{2}))?$`)
+
+// triggerFX handles !fx
+func triggerFX(c *godrop.Client, m irc.Message, args []string) error {
+	target := godrop.ReplyTarget(m)
+
+	matches := queryRE.FindStringSubmatch(strings.Join(args, " "))
+	if matches == nil {
+		return c.Message(target,
+			"Usage: !fx [amount] <from> to <currency> [currency...] [on YYYY-MM-DD]")
+	}
+
+	amount := 1.0
+	if matches[1] != "" {
+		a, err := strconv.ParseFloat(strings.Replace(matches[1], ",", "", -1), 64)
+		if err != nil {
+			return c.Message(target, fmt.Sprintf("Invalid amount: %s", matches[1]))
+		}
+		amount = a
+	}
+
+	from := strings.ToUpper(matches[2])
+
+	var to []string
+	for _, cur := range strings.FieldsFunc(matches[3], func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	}) {
+		to = append(to, strings.ToUpper(cur))
+	}
+
+	date := matches[4]
+	if date != "" {
+		if _, err := time.Parse("2006-01-02", date); err != nil {
+			return c.Message(target, fmt.Sprintf("Invalid date: %s", date))
+		}
+	}
+
+	rates, err := getRates(c.Web(), c.Log(), from, date)
+	if err != nil {
+		return fmt.Errorf("unable to look up rates: %s", err)
+	}
+
+	var converted []string
+	for _, cur := range to {
+		if cur == from {
+			converted = append(converted, formatAmount(amount, cur))
+			continue
+		}
+		rate, ok := rates.Rates[cur]
+		if !ok {
+			converted = append(converted, fmt.Sprintf("%s unknown", cur))
+			continue
+		}
+		converted = append(converted, formatAmount(amount*rate, cur))
+	}
+
+	return c.Message(target, fmt.Sprintf("%s = %s (ECB rate for %s)",
+		formatAmount(amount, from), strings.Join(converted, ", "), rates.Date))
+}
+
+func formatAmount(amount float64, currency string) string {
+	if amount != 0 && amount < 0.01 {
+		return fmt.Sprintf("%.6f %s", amount, currency)
+	}
+	return fmt.Sprintf("%.2f %s", amount, currency)
+}
+
+// Rates holds the exchange rates for a base currency on a day.
+type Rates struct {
+	Base  string
+	Date  string
+	Rates map[string]float64
+}
+
+var (
+	cacheMutex sync.Mutex
+	cache      = map[string]Rates{}
+	cacheDay   string
+)
+
+// getRates retrieves the rates for the base currency.
+//
+// If date is blank we retrieve the latest rates. Otherwise we retrieve the
+// rates for that day.
+//
+// We cache responses until the day changes.
+func getRates(web *godrop.WebClient, logger godrop.Logger, base,
+	date string) (Rates, error) {
+	today := time.Now().UTC().Format("2006-01-02")
+
+	key := base + " " + date
+	if date == "" {
+		key = base + " latest"
+	}
+
+	cacheMutex.Lock()
+	if cacheDay != today {
+		cache = map[string]Rates{}
+		cacheDay = today
+	}
+	rates, ok := cache[key]
+	cacheMutex.Unlock()
+	if ok {
+		return rates, nil
+	}
+
+	path := "latest"
+	if date != "" {
+		path = date
+	}
+
+	vals := url.Values{}
+	vals.Set("from", base)
+
+	u := "https://api.frankfurter.app/" + path + "?" + vals.Encode()
+
+	logger.Debug("Making request", "plugin", "fx", "url", u)
+
+	resp, body, err := web.Get(u)
+	if err != nil {
+		return Rates{}, fmt.Errorf("failed to perform HTTP request: %s", err)
+	}
+
+	if resp.StatusCode == http.StatusNotFound ||
+		resp.StatusCode == http.StatusUnprocessableEntity {
+		return Rates{}, fmt.Errorf("no rates found for %s", base)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return Rates{}, fmt.Errorf("unsuccessful request: %s", resp.Status)
+	}
+
+	if err := json.Unmarshal(body, &rates); err != nil {
+		return Rates{}, fmt.Errorf("unable to decode: %s", err)
+	}
+
+	if len(rates.Rates) == 0 {
+		return Rates{}, fmt.Errorf("no rates found for %s", base)
+	}
+
+	cacheMutex.Lock()
+	cache[key] = rates
+	cacheMutex.Unlock()
+
+	return rates, nil
+}
@@ -0,0 +1,401 @@
+// Package github announces activity in GitHub repositories and looks them
+// up.
+//
+// We poll the repositories in github-repos and announce new releases, issues,
+// and pull requests to the channels each maps to.
+//
+// Usage:
+// - !gh <owner/repo> - Show a repository's description, stars, and latest
+//   release.
+//
+// Configuration options:
+// - github-repos - Space separated repositories and the channels to announce
+//   them to, such as horgh/godrop=#godrop,#dev horgh/irc=#godrop.
+// - github-events - Space separated kinds of activity to announce: releases,
+//   issues, and pulls. Default all of them.
+// - github-interval - How often to poll. Default 5m.
+// - github-token - A personal access token. Without one GitHub allows few
+//   requests, and we can't see private repositories.
+//
+// Announcements use the templates release, issue, and pull. Their data is an
+// Activity. !gh uses the template repo. Its data is a Repo.
+package github
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/horgh/godrop"
+	"github.com/horgh/irc"
+)
+
+func init() {
+	godrop.Register("github", Hook)
+	godrop.RegisterConfig("github",
+		godrop.ConfigKey{Name: "github-repos", Check: checkRepos},
+		godrop.ConfigKey{Name: "github-events", Check: checkEvents},
+		godrop.ConfigKey{Name: "github-interval", Kind: godrop.ConfigDuration},
+		godrop.ConfigKey{Name: "github-token"},
+	)
+	godrop.RegisterTemplate("github", "release",
+		"[{{.Repo}}] {{.Author}} released {{.Title}} {{.URL}}")
+	godrop.RegisterTemplate("github", "issue",
+		"[{{.Repo}}] {{.Author}} opened issue #{{.Number}}: {{.Title}} {{.URL}}")
+	godrop.RegisterTemplate("github", "pull",
+		"[{{.Repo}}] {{.Author}} opened pull request #{{.Number}}: {{.Title}} "+
+			"{{.URL}}")
+	godrop.RegisterTemplate("github", "repo",
+		"{{.Name}}{{if .Description}}: {{.Description}}{{end}} "+
+			"({{.Stars}} stars{{if .Release}}, latest release {{.Release}}{{end}}) "+
+			"{{.URL}}")
+	godrop.RegisterCommand("github", godrop.Command{
+		Name:    "gh",
+		Aliases: []string{"github"},
+		Usage:   "<owner/repo>",
+		Help:    "Look up a GitHub repository.",
+		MinArgs: 1,
+		Run:     triggerRepo,
+	})
+}
+
+const (
+	apiURL = "https://api.github.com"
+
+	defaultInterval = 5 * time.Minute
+
+	// perPage is how many releases and issues we ask for each poll. If there
+	// are more new ones between polls we miss the older ones.
+	perPage = 10
+)
+
+// Kinds of activity.
+const (
+	eventReleases = "releases"
+	eventIssues   = "issues"
+	eventPulls    = "pulls"
+)
+
+var repoRE = regexp.MustCompile(`^[A-Za-z0-9_.-]+/[A-Za-z0-9_.-]+$`)
+
+func checkRepos(s string) error {
+	_, err := parseRepos(s)
+	return err
+}
+
+func checkEvents(s string) error {
+	for _, e := range strings.Fields(s) {
+		if e != eventReleases && e != eventIssues && e != eventPulls {
+			return fmt.Errorf("unknown event %s: must be %s, %s, or %s", e,
+				eventReleases, eventIssues, eventPulls)
+		}
+	}
+	return nil
+}
+
+// parseRepos parses github-repos into the channels to announce each
+// repository to keyed by repository.
+func parseRepos(s string) (map[string][]string, error) {
+	repos := map[string][]string{}
+	for _, field := range strings.Fields(s) {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 || !repoRE.MatchString(parts[0]) {
+			return nil, fmt.Errorf("%s is not owner/repo=#channel[,#channel]",
+				field)
+		}
+		for _, ch := range strings.Split(parts[1], ",") {
+			if !godrop.IsChannel(ch) {
+				return nil, fmt.Errorf("%s is not a channel", ch)
+			}
+			repos[parts[0]] = append(repos[parts[0]], ch)
+		}
+	}
+	return repos, nil
+}
+
+// Activity is a new release, issue, or pull request.
+type Activity struct {
+	Repo   string
+	Author string
+
+	// Number is the issue or pull request's number.
+	Number int
+
+	// Title is the issue or pull request's title, or the release's name.
+	Title string
+	URL   string
+}
+
+// Repo is information about a repository.
+type Repo struct {
+	Name        string
+	Description string
+	Stars       int
+
+	// Release is the latest release's tag. It's blank if there are none.
+	Release string
+	URL     string
+}
+
+// seen is the newest activity we know of in a repository.
+type seen struct {
+	release int64
+	issue   int
+}
+
+var (
+	pollMutex    sync.Mutex
+	lastPollTime time.Time
+
+	// known holds the newest activity we know of keyed by repository. We
+	// announce activity newer than this. Repositories we haven't polled yet
+	// aren't in it, and the first time we poll one we announce nothing.
+	known = map[string]seen{}
+)
+
+// Hook fires when an IRC message of some kind occurs.
+func Hook(c *godrop.Client, m irc.Message) {
+	poll(c)
+}
+
+// poll checks the repositories for new activity if it's been long enough
+// since we last did.
+func poll(c *godrop.Client) {
+	repos, err := parseRepos(c.Conf()["github-repos"])
+	if err != nil || len(repos) == 0 {
+		return
+	}
+
+	pollMutex.Lock()
+	defer pollMutex.Unlock()
+
+	interval := c.Conf().GetDuration("github-interval", defaultInterval)
+	if time.Since(lastPollTime) < interval {
+		return
+	}
+	lastPollTime = time.Now()
+
+	events := c.Conf().GetStringSlice("github-events")
+	if len(events) == 0 {
+		events = []string{eventReleases, eventIssues, eventPulls}
+	}
+	wants := map[string]bool{}
+	for _, e := range events {
+		wants[e] = true
+	}
+
+	token := c.Conf().GetString("github-token")
+	for repo, channels := range repos {
+		activity, err := pollRepo(c.Web(), token, repo, wants)
+		if err != nil {
+			c.PluginError("github", fmt.Errorf("unable to poll %s: %s", repo, err))
+			continue
+		}
+
+		for _, a := range activity {
+			for _, ch := range channels {
+				_ = c.Message(ch, c.Format("github", a.kind, ch, a.Activity))
+			}
+		}
+	}
+}
+
+// kindActivity is activity along with the template to announce it with.
+type kindActivity struct {
+	Activity
+	kind string
+}
+
+// pollRepo finds activity in the repository newer than what we know of,
+// oldest first.
+//
+// The caller must hold pollMutex.
+func pollRepo(web *godrop.WebClient, token, repo string,
+	wants map[string]bool) ([]kindActivity, error) {
+	prev, polled := known[repo]
+	next := prev
+	var activity []kindActivity
+
+	if wants[eventReleases] {
+		var releases []struct {
+			ID      int64  `json:"id"`
+			Name    string `json:"name"`
+			TagName string `json:"tag_name"`
+			HTMLURL string `json:"html_url"`
+			Draft   bool   `json:"draft"`
+			Author  struct {
+				Login string `json:"login"`
+			} `json:"author"`
+		}
+		if err := get(web, token, fmt.Sprintf("/repos/%s/releases?per_page=%d",
+			repo, perPage), &releases); err != nil {
+			return nil, err
+		}
+
+		// Releases come newest first.
+		for i := len(releases) - 1; i >= 0; i-- {
+			r := releases[i]
+			if r.Draft || r.ID <= prev.release {
+				continue
+			}
+			if r.ID > next.release {
+				next.release = r.ID
+			}
+			title := r.Name
+			if title == "" {
+				title = r.TagName
+			}
+			activity = append(activity, kindActivity{
+				Activity: Activity{
+					Repo:   repo,
+					Author: r.Author.Login,
+					Title:  title,
+					URL:    r.HTMLURL,
+				},
+				kind: "release",
+			})
+		}
+	}
+
+	if wants[eventIssues] || wants[eventPulls] {
+		// Pull requests are issues too.
+		var issues []struct {
+			Number  int    `json:"number"`
+			Title   string `json:"title"`
+			HTMLURL string `json:"html_url"`
+			User    struct {
+				Login string `json:"login"`
+			} `json:"user"`
+			PullRequest *struct{} `json:"pull_request"`
+		}
+		if err := get(web, token, fmt.Sprintf(
+			"/repos/%s/issues?state=all&sort=created&direction=desc&per_page=%d",
+			repo, perPage), &issues); err != nil {
+			return nil, err
+		}
+
+		for i := len(issues) - 1; i >= 0; i-- {
+			issue := issues[i]
+			if issue.Number <= prev.issue {
+				continue
+			}
+			if issue.Number > next.issue {
+				next.issue = issue.Number
+			}
+			kind := "issue"
+			if issue.PullRequest != nil {
+				kind = "pull"
+			}
+			if (kind == "issue" && !wants[eventIssues]) ||
+				(kind == "pull" && !wants[eventPulls]) {
+				continue
+			}
+			activity = append(activity, kindActivity{
+				Activity: Activity{
+					Repo:   repo,
+					Author: issue.User.Login,
+					Number: issue.Number,
+					Title:  issue.Title,
+					URL:    issue.HTMLURL,
+				},
+				kind: kind,
+			})
+		}
+	}
+
+	known[repo] = next
+
+	// The first time, we only learn what's there.
+	if !polled {
+		return nil, nil
+	}
+	return activity, nil
+}
+
+// triggerRepo handles !gh
+func triggerRepo(c *godrop.Client, m irc.Message, args []string) error {
+	target := godrop.ReplyTarget(m)
+	name := strings.TrimSuffix(strings.TrimPrefix(args[0],
+		"https://github.com/"), "/")
+	if !repoRE.MatchString(name) {
+		return c.Message(target, "Usage: !gh <owner/repo>")
+	}
+
+	web := c.Web()
+	token := c.Conf().GetString("github-token")
+
+	var repo struct {
+		FullName    string `json:"full_name"`
+		Description string `json:"description"`
+		Stars       int    `json:"stargazers_count"`
+		HTMLURL     string `json:"html_url"`
+	}
+	if err := get(web, token, "/repos/"+name, &repo); err != nil {
+		if err == errNotFound {
+			return c.Message(target, fmt.Sprintf("%s: No such repository: %s",
+				godrop.SourceNick(m), name))
+		}
+		return err
+	}
+
+	// This is 404 if there are no releases.
+	var release struct {
+		TagName string `json:"tag_name"`
+	}
+	if err := get(web, token, "/repos/"+name+"/releases/latest",
+		&release); err != nil && err != errNotFound {
+		return err
+	}
+
+	return c.Message(target, c.Format("github", "repo", target, Repo{
+		Name:        repo.FullName,
+		Description: repo.Description,
+		Stars:       repo.Stars,
+		Release:     release.TagName,
+		URL:         repo.HTMLURL,
+	}))
+}
+
+// errNotFound means what we requested doesn't exist.
+var errNotFound = fmt.Errorf("not found")
+
+// get requests the API path and decodes the response into v.
+func get(web *godrop.WebClient, token, path string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, apiURL+path, nil)
+	if err != nil {
+		return fmt.Errorf("unable to create request: %s", err)
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, body, err := web.Fetch(req)
+	if err != nil {
+		return fmt.Errorf("failed to perform HTTP request: %s", err)
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		return errNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		var response struct {
+			Message string `json:"message"`
+		}
+		if err := json.Unmarshal(body, &response); err == nil &&
+			response.Message != "" {
+			return fmt.Errorf("unsuccessful request: %s: %s", resp.Status,
+				response.Message)
+		}
+		return fmt.Errorf("unsuccessful request: %s", resp.Status)
+	}
+
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("unable to decode: %s", err)
+	}
+	return nil
+}
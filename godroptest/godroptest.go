@@ -0,0 +1,34 @@
+// Package godroptest helps test plugins against real IRC traffic.
+//
+// Save a transcript (see godrop.Client.SetTranscriptDir) showing the traffic
+// you want to test, such as a strange numeric or a command that made a
+// plugin misbehave. Then check the client still responds the same way:
+//
+//	func TestWeirdNumeric(t *testing.T) {
+//		c := godrop.New("bot", "bot", "bot", "irc.example.com", 6667, false)
+//		godroptest.CheckTranscript(t, c, "testdata/weird-numeric.log")
+//	}
+//
+// Edit the lines the transcript shows we sent to what you expect.
+package godroptest
+
+import (
+	"testing"
+
+	"github.com/horgh/godrop"
+)
+
+// CheckTranscript replays the lines the transcript shows we received and
+// checks the client sends the lines the transcript shows we sent.
+func CheckTranscript(t testing.TB, c *godrop.Client, file string) {
+	t.Helper()
+
+	result, err := c.ReplayTranscript(file)
+	if err != nil {
+		t.Fatalf("unable to replay %s: %s", file, err)
+	}
+
+	if diff := result.Diff(); diff != "" {
+		t.Errorf("%s: %s", file, diff)
+	}
+}
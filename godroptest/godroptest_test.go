@@ -0,0 +1,12 @@
+package godroptest
+
+import (
+	"testing"
+
+	"github.com/horgh/godrop"
+)
+
+func TestCheckTranscript(t *testing.T) {
+	c := godrop.New("bot", "Bot", "bot", "irc.example.com", 6667, false)
+	CheckTranscript(t, c, "testdata/register.log")
+}
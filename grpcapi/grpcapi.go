@@ -0,0 +1,607 @@
+// Package grpcapi provides a gRPC API to control the client.
+//
+// It can send messages, join and part channels, show the connection's status,
+// look at channel state, list plugins, reload the config, and stream the
+// messages the client receives.
+// control.proto describes the service. Messages are JSON encoded rather than
+// protobuf encoded, so clients need to use the json codec.
+//
+// Requests must have the metadata "authorization: Bearer <token>".
+//
+// Requests control the client whose server they reach. If the settings change
+// when reloading the config, we listen again with the new ones.
+//
+// Configuration options:
+// - grpc-listen - The address to listen on, such as 127.0.0.1:9090. If this is
+//   not set, we don't listen.
+// - grpc-token - The token requests must have. Required.
+// - grpc-cert, grpc-key - The TLS certificate and key to use. Required.
+package grpcapi
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/horgh/godrop"
+	"github.com/horgh/irc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func init() {
+	godrop.RegisterAllEventsHook("grpcapi", Hook)
+	godrop.RegisterConfig("grpcapi",
+		godrop.ConfigKey{Name: "grpc-listen", Required: true},
+		godrop.ConfigKey{Name: "grpc-token", Required: true},
+		godrop.ConfigKey{Name: "grpc-cert", Kind: godrop.ConfigFile,
+			Required: true},
+		godrop.ConfigKey{Name: "grpc-key", Kind: godrop.ConfigFile,
+			Required: true},
+	)
+	encoding.RegisterCodec(jsonCodec{})
+}
+
+// Reload is called by the ReloadConfig method. Programs that can reload their
+// config should set it.
+var Reload func() error
+
+var mutex sync.Mutex
+
+// servers holds the server we run for each client.
+var servers = map[*godrop.Client]*server{}
+
+// subscriberBuffer is how many events we buffer for each stream. If a stream
+// falls further behind, we drop events for it.
+const subscriberBuffer = 100
+
+// settings are what we listen with.
+type settings struct {
+	listen   string
+	token    string
+	certFile string
+	keyFile  string
+}
+
+// server is the gRPC server for a client.
+type server struct {
+	c        *godrop.Client
+	settings settings
+
+	// grpc is nil if we're not listening, such as if the settings are
+	// incomplete.
+	grpc *grpc.Server
+
+	// subscribers are the channels of the Events streams.
+	subscribers map[chan Event]struct{}
+}
+
+// start starts listening for the client if we're not already. If the
+// settings changed since we started, we stop and listen with the new ones.
+func start(c *godrop.Client) {
+	cur := settings{
+		listen:   strings.TrimSpace(c.Conf().GetString("grpc-listen")),
+		token:    strings.TrimSpace(c.Conf().GetString("grpc-token")),
+		certFile: strings.TrimSpace(c.Conf().GetString("grpc-cert")),
+		keyFile:  strings.TrimSpace(c.Conf().GetString("grpc-key")),
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if s, ok := servers[c]; ok {
+		if s.settings == cur {
+			return
+		}
+		// Stopping waits on the streams, which need the mutex.
+		if gs := s.detach(); gs != nil {
+			go gs.Stop()
+		}
+	}
+
+	// We remember the settings even if we can't listen with them so we don't
+	// try again until they change.
+	s := &server{
+		c:           c,
+		settings:    cur,
+		subscribers: map[chan Event]struct{}{},
+	}
+	servers[c] = s
+
+	if cur.listen == "" {
+		return
+	}
+
+	if cur.token == "" || cur.certFile == "" || cur.keyFile == "" {
+		c.Log().Warn("grpc-token, grpc-cert, and grpc-key must be set",
+			"plugin", "grpcapi")
+		return
+	}
+
+	creds, err := credentials.NewServerTLSFromFile(cur.certFile, cur.keyFile)
+	if err != nil {
+		c.Log().Error("Unable to load certificate", "plugin", "grpcapi",
+			"error", err)
+		return
+	}
+
+	gs := grpc.NewServer(
+		grpc.Creds(creds),
+		grpc.UnaryInterceptor(s.unaryAuth),
+		grpc.StreamInterceptor(s.streamAuth),
+	)
+	gs.RegisterService(&serviceDesc, &controlServer{c: c, server: s})
+	s.grpc = gs
+
+	c.Go("grpcapi", func() error {
+		ln, err := net.Listen("tcp", cur.listen)
+		if err != nil {
+			return fmt.Errorf("unable to listen: %s", err)
+		}
+
+		c.Log().Info("Listening", "plugin", "grpcapi", "addr", cur.listen)
+		if err := gs.Serve(ln); err != nil && err != grpc.ErrServerStopped {
+			return fmt.Errorf("unable to serve: %s", err)
+		}
+		return nil
+	})
+}
+
+// detach forgets the server. If it's listening, stop the gRPC server it
+// returns to stop.
+//
+// The caller must hold the mutex.
+func (s *server) detach() *grpc.Server {
+	gs := s.grpc
+	s.grpc = nil
+	delete(servers, s.c)
+	return gs
+}
+
+// Hook fires when an IRC message of some kind occurs.
+//
+// We pass events to the client's Events streams, including our own messages.
+// We stop listening once the client shuts down.
+func Hook(c *godrop.Client, e godrop.Event) {
+	if e.Kind == godrop.EventShutdown {
+		mutex.Lock()
+		s, ok := servers[c]
+		var gs *grpc.Server
+		if ok {
+			gs = s.detach()
+		}
+		mutex.Unlock()
+
+		if gs != nil {
+			gs.Stop()
+		}
+		return
+	}
+
+	start(c)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	s, ok := servers[c]
+	if !ok || len(s.subscribers) == 0 {
+		return
+	}
+
+	ev := Event{
+		Prefix:  e.Prefix,
+		Command: e.Command,
+		Params:  e.Params,
+		Tags:    e.Tags,
+		Time:    e.Time.Format(time.RFC3339Nano),
+	}
+
+	for ch := range s.subscribers {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// authorize checks the request has the token.
+func (s *server) authorize(ctx context.Context) error {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return status.Error(codes.Unauthenticated, "missing token")
+	}
+
+	for _, v := range md.Get("authorization") {
+		got, ok := bearerToken(v)
+		token := s.settings.token
+		if token != "" && ok &&
+			subtle.ConstantTimeCompare([]byte(token), []byte(got)) == 1 {
+			return nil
+		}
+	}
+
+	return status.Error(codes.Unauthenticated, "invalid token")
+}
+
+// bearerToken retrieves the token from authorization metadata. It reports
+// false if it isn't a bearer token. The scheme may be in any case.
+func bearerToken(v string) (string, bool) {
+	const scheme = "Bearer "
+	if len(v) < len(scheme) || !strings.EqualFold(v[:len(scheme)], scheme) {
+		return "", false
+	}
+	return strings.TrimSpace(v[len(scheme):]), true
+}
+
+func (s *server) unaryAuth(ctx context.Context, req interface{},
+	info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := s.authorize(ctx); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (s *server) streamAuth(srv interface{}, ss grpc.ServerStream,
+	info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := s.authorize(ss.Context()); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+// jsonCodec encodes messages as JSON.
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) { return json.Marshal(v) }
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (jsonCodec) Name() string { return "json" }
+
+// Empty is a message with nothing in it.
+type Empty struct{}
+
+// SendMessageRequest is a request to send a message.
+type SendMessageRequest struct {
+	Target string `json:"target"`
+	Text   string `json:"text"`
+}
+
+// JoinRequest is a request to join a channel.
+type JoinRequest struct {
+	Channel string `json:"channel"`
+	Key     string `json:"key"`
+}
+
+// PartRequest is a request to leave a channel.
+type PartRequest struct {
+	Channel string `json:"channel"`
+	Reason  string `json:"reason"`
+}
+
+// ListChannelsResponse lists the channels the client is on.
+type ListChannelsResponse struct {
+	Channels []string `json:"channels"`
+}
+
+// GetChannelRequest is a request for a channel's state.
+type GetChannelRequest struct {
+	Channel string `json:"channel"`
+}
+
+// Member is a user on a channel.
+type Member struct {
+	Nick  string `json:"nick"`
+	Modes string `json:"modes"`
+}
+
+// Channel is a channel's state.
+type Channel struct {
+	Name    string   `json:"name"`
+	Members []Member `json:"members"`
+}
+
+// Status describes the client's connection.
+type Status struct {
+	Nick       string `json:"nick"`
+	Server     string `json:"server"`
+	Connected  bool   `json:"connected"`
+	Registered bool   `json:"registered"`
+}
+
+// ListPluginsResponse lists the registered plugins.
+type ListPluginsResponse struct {
+	Plugins []string `json:"plugins"`
+}
+
+// Event is a message the client received.
+type Event struct {
+	Prefix  string            `json:"prefix"`
+	Command string            `json:"command"`
+	Params  []string          `json:"params"`
+	Tags    map[string]string `json:"tags"`
+	Time    string            `json:"time"`
+}
+
+// controlServer implements the Control service for a client.
+type controlServer struct {
+	c      *godrop.Client
+	server *server
+}
+
+func (s *controlServer) SendMessage(ctx context.Context,
+	req *SendMessageRequest) (*Empty, error) {
+	c := s.c
+
+	if !validName(req.Target) || strings.TrimSpace(req.Text) == "" {
+		return nil, status.Error(codes.InvalidArgument,
+			"target and text are required")
+	}
+
+	if err := c.Message(req.Target, req.Text); err != nil {
+		return nil, status.Errorf(codes.Unavailable, "unable to send: %s", err)
+	}
+	return &Empty{}, nil
+}
+
+func (s *controlServer) Join(ctx context.Context,
+	req *JoinRequest) (*Empty, error) {
+	c := s.c
+
+	if !validName(req.Channel) || !godrop.IsChannel(req.Channel) {
+		return nil, status.Error(codes.InvalidArgument, "invalid channel")
+	}
+
+	params := []string{req.Channel}
+	if req.Key != "" {
+		params = append(params, req.Key)
+	}
+
+	if err := c.WriteMessage(irc.Message{
+		Command: "JOIN",
+		Params:  params,
+	}); err != nil {
+		return nil, status.Errorf(codes.Unavailable, "unable to join: %s", err)
+	}
+	return &Empty{}, nil
+}
+
+func (s *controlServer) Part(ctx context.Context,
+	req *PartRequest) (*Empty, error) {
+	c := s.c
+
+	if !validName(req.Channel) || !godrop.IsChannel(req.Channel) {
+		return nil, status.Error(codes.InvalidArgument, "invalid channel")
+	}
+
+	if err := c.Part(req.Channel, req.Reason); err != nil {
+		return nil, status.Errorf(codes.Unavailable, "unable to part: %s", err)
+	}
+	return &Empty{}, nil
+}
+
+func (s *controlServer) ListChannels(ctx context.Context,
+	req *Empty) (*ListChannelsResponse, error) {
+	c := s.c
+
+	return &ListChannelsResponse{Channels: c.Channels()}, nil
+}
+
+func (s *controlServer) GetChannel(ctx context.Context,
+	req *GetChannelRequest) (*Channel, error) {
+	c := s.c
+
+	ch, ok := c.Channel(req.Channel)
+	if !ok {
+		return nil, status.Error(codes.NotFound, "not on channel")
+	}
+
+	resp := &Channel{Name: ch.Name}
+	for _, m := range ch.Members {
+		resp.Members = append(resp.Members, Member{Nick: m.Nick, Modes: m.Modes})
+	}
+	sort.Slice(resp.Members, func(i, j int) bool {
+		return resp.Members[i].Nick < resp.Members[j].Nick
+	})
+	return resp, nil
+}
+
+func (s *controlServer) GetStatus(ctx context.Context,
+	req *Empty) (*Status, error) {
+	c := s.c
+
+	return &Status{
+		Nick:       c.GetNick(),
+		Server:     c.CurrentServer().String(),
+		Connected:  c.IsConnected(),
+		Registered: c.IsRegistered(),
+	}, nil
+}
+
+func (s *controlServer) ListPlugins(ctx context.Context,
+	req *Empty) (*ListPluginsResponse, error) {
+	return &ListPluginsResponse{Plugins: godrop.Plugins()}, nil
+}
+
+func (s *controlServer) ReloadConfig(ctx context.Context,
+	req *Empty) (*Empty, error) {
+	if Reload == nil {
+		return nil, status.Error(codes.Unimplemented, "reloading is not supported")
+	}
+
+	if err := Reload(); err != nil {
+		return nil, status.Errorf(codes.Internal, "unable to reload: %s", err)
+	}
+	return &Empty{}, nil
+}
+
+func (s *controlServer) Events(req *Empty, stream grpc.ServerStream) error {
+	ch := make(chan Event, subscriberBuffer)
+
+	mutex.Lock()
+	s.server.subscribers[ch] = struct{}{}
+	mutex.Unlock()
+
+	defer func() {
+		mutex.Lock()
+		delete(s.server.subscribers, ch)
+		mutex.Unlock()
+	}()
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case ev := <-ch:
+			if err := stream.SendMsg(&ev); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// validName checks a target or channel name is something we can send.
+func validName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, " ,\r\n\x00")
+}
+
+// controlService is the interface the service descriptor requires.
+type controlService interface {
+	SendMessage(context.Context, *SendMessageRequest) (*Empty, error)
+	Join(context.Context, *JoinRequest) (*Empty, error)
+	Part(context.Context, *PartRequest) (*Empty, error)
+	ListChannels(context.Context, *Empty) (*ListChannelsResponse, error)
+	GetChannel(context.Context, *GetChannelRequest) (*Channel, error)
+	GetStatus(context.Context, *Empty) (*Status, error)
+	ListPlugins(context.Context, *Empty) (*ListPluginsResponse, error)
+	ReloadConfig(context.Context, *Empty) (*Empty, error)
+	Events(*Empty, grpc.ServerStream) error
+}
+
+// serviceDesc describes the service for gRPC. It matches control.proto. We
+// write it by hand since we don't use protobuf encoding.
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: "godrop.Control",
+	HandlerType: (*controlService)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "SendMessage",
+			Handler: unaryHandler("SendMessage",
+				func() interface{} { return &SendMessageRequest{} },
+				func(ctx context.Context, s controlService, req interface{}) (interface{}, error) {
+					return s.SendMessage(ctx, req.(*SendMessageRequest))
+				}),
+		},
+		{
+			MethodName: "Join",
+			Handler: unaryHandler("Join",
+				func() interface{} { return &JoinRequest{} },
+				func(ctx context.Context, s controlService, req interface{}) (interface{}, error) {
+					return s.Join(ctx, req.(*JoinRequest))
+				}),
+		},
+		{
+			MethodName: "Part",
+			Handler: unaryHandler("Part",
+				func() interface{} { return &PartRequest{} },
+				func(ctx context.Context, s controlService, req interface{}) (interface{}, error) {
+					return s.Part(ctx, req.(*PartRequest))
+				}),
+		},
+		{
+			MethodName: "ListChannels",
+			Handler: unaryHandler("ListChannels",
+				func() interface{} { return &Empty{} },
+				func(ctx context.Context, s controlService, req interface{}) (interface{}, error) {
+					return s.ListChannels(ctx, req.(*Empty))
+				}),
+		},
+		{
+			MethodName: "GetChannel",
+			Handler: unaryHandler("GetChannel",
+				func() interface{} { return &GetChannelRequest{} },
+				func(ctx context.Context, s controlService, req interface{}) (interface{}, error) {
+					return s.GetChannel(ctx, req.(*GetChannelRequest))
+				}),
+		},
+		{
+			MethodName: "GetStatus",
+			Handler: unaryHandler("GetStatus",
+				func() interface{} { return &Empty{} },
+				func(ctx context.Context, s controlService, req interface{}) (interface{}, error) {
+					return s.GetStatus(ctx, req.(*Empty))
+				}),
+		},
+		{
+			MethodName: "ListPlugins",
+			Handler: unaryHandler("ListPlugins",
+				func() interface{} { return &Empty{} },
+				func(ctx context.Context, s controlService, req interface{}) (interface{}, error) {
+					return s.ListPlugins(ctx, req.(*Empty))
+				}),
+		},
+		{
+			MethodName: "ReloadConfig",
+			Handler: unaryHandler("ReloadConfig",
+				func() interface{} { return &Empty{} },
+				func(ctx context.Context, s controlService, req interface{}) (interface{}, error) {
+					return s.ReloadConfig(ctx, req.(*Empty))
+				}),
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName: "Events",
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				req := &Empty{}
+				if err := stream.RecvMsg(req); err != nil {
+					return err
+				}
+				return srv.(controlService).Events(req, stream)
+			},
+			ServerStreams: true,
+		},
+	},
+	Metadata: "control.proto",
+}
+
+// unaryHandler builds the handler gRPC calls for a unary method.
+func unaryHandler(
+	method string,
+	newRequest func() interface{},
+	call func(context.Context, controlService, interface{}) (interface{}, error),
+) func(interface{}, context.Context, func(interface{}) error,
+	grpc.UnaryServerInterceptor) (interface{}, error) {
+	return func(srv interface{}, ctx context.Context, dec func(interface{}) error,
+		interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+		req := newRequest()
+		if err := dec(req); err != nil {
+			return nil, err
+		}
+
+		if interceptor == nil {
+			return call(ctx, srv.(controlService), req)
+		}
+
+		info := &grpc.UnaryServerInfo{
+			Server:     srv,
+			FullMethod: "/godrop.Control/" + method,
+		}
+		return interceptor(ctx, req, info,
+			func(ctx context.Context, req interface{}) (interface{}, error) {
+				return call(ctx, srv.(controlService), req)
+			})
+	}
+}
@@ -0,0 +1,157 @@
+package godrop
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+// Handler handles IRC messages for a client. Plugins registered with Register
+// are Handlers. Programs can also add their own to a client with AddHandler
+// rather than registering them for every client.
+type Handler interface {
+	// Name identifies the handler. Each of a client's handlers must have a
+	// different name.
+	Name() string
+
+	// OnMessage is called with each message. ctx is done once the connection
+	// the message came on ends.
+	OnMessage(ctx context.Context, c *Client, m irc.Message)
+}
+
+// EventHandler is a Handler that wants each message as an Event, with its
+// tags and time. We call OnEvent rather than OnMessage.
+type EventHandler interface {
+	Handler
+
+	// OnEvent is called with each message. ctx is done once the connection
+	// the message came on ends.
+	OnEvent(ctx context.Context, c *Client, e Event)
+}
+
+// hookHandler is a Handler that calls a hook function.
+type hookHandler struct {
+	name string
+	hook func(*Client, irc.Message)
+}
+
+// HandlerFunc makes a Handler from a name and a hook like those passed to
+// Register.
+func HandlerFunc(name string, hook func(*Client, irc.Message)) Handler {
+	return hookHandler{name: name, hook: hook}
+}
+
+func (h hookHandler) Name() string { return h.name }
+
+func (h hookHandler) OnMessage(ctx context.Context, c *Client,
+	m irc.Message) {
+	if h.hook != nil {
+		h.hook(c, m)
+	}
+}
+
+// eventHookHandler is an EventHandler that calls a hook function.
+type eventHookHandler struct {
+	name string
+	hook func(*Client, Event)
+}
+
+// EventHandlerFunc makes an EventHandler from a name and a hook like those
+// passed to RegisterEventHook.
+func EventHandlerFunc(name string, hook func(*Client, Event)) EventHandler {
+	return eventHookHandler{name: name, hook: hook}
+}
+
+func (h eventHookHandler) Name() string { return h.name }
+
+func (h eventHookHandler) OnMessage(ctx context.Context, c *Client,
+	m irc.Message) {
+	h.OnEvent(ctx, c, Event{Message: m, Time: time.Now()})
+}
+
+func (h eventHookHandler) OnEvent(ctx context.Context, c *Client, e Event) {
+	if h.hook != nil {
+		h.hook(c, e)
+	}
+}
+
+// AddHandler adds a handler to the client. It starts getting messages with
+// the next one we read. It returns an error if the client already has a
+// handler with the same name.
+//
+// Calling SetPlugins afterwards replaces the client's handlers with the
+// chosen plugins.
+func (c *Client) AddHandler(h Handler) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	plugins := c.enabledPluginsLocked()
+	for _, p := range plugins {
+		if p.name == h.Name() {
+			return fmt.Errorf("handler %s already added", h.Name())
+		}
+	}
+
+	// Copy so we don't change a slice a reader may be using.
+	c.plugins = append(append([]*plugin(nil), plugins...),
+		&plugin{name: h.Name(), handler: h})
+	c.pluginsSet = true
+	return nil
+}
+
+// RemoveHandler removes a handler, or a plugin, from the client. It reports
+// whether the client had it.
+func (c *Client) RemoveHandler(name string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	plugins := c.enabledPluginsLocked()
+	var kept []*plugin
+	found := false
+	for _, p := range plugins {
+		if p.name == name {
+			found = true
+			continue
+		}
+		kept = append(kept, p)
+	}
+	if !found {
+		return false
+	}
+
+	c.plugins = kept
+	c.pluginsSet = true
+	return true
+}
+
+// Context retrieves a context that's done once the current connection ends
+// or the context given to LoopContext is done. Plugins can use it to cancel
+// work such as HTTP requests (see WebClient's GetContext) that's no use once
+// we disconnect.
+func (c *Client) Context() context.Context {
+	return c.connContext()
+}
+
+// connContext retrieves the context for the current connection.
+func (c *Client) connContext() context.Context {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.connCtx == nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		c.connCtx, c.cancelConn = ctx, cancel
+	}
+	return c.connCtx
+}
+
+// endConnContext ends the context for the current connection.
+//
+// The caller must hold the mutex.
+func (c *Client) endConnContext() {
+	if c.cancelConn != nil {
+		c.cancelConn()
+	}
+	c.connCtx, c.cancelConn = nil, nil
+}
@@ -0,0 +1,449 @@
+// Package highlight forwards highlights to the bot's owner while they're
+// away.
+//
+// When someone in a channel says the owner's nick or one of the keywords and
+// the owner is away or offline, we send them the line along with the lines
+// before it.
+//
+// We know the owner is offline if the server supports MONITOR. We know they
+// are away if we share a channel with them and the server supports
+// away-notify. Otherwise we ask with WHOIS.
+//
+// Forwarding by private message while the owner is offline keeps the memo in
+// persistent storage until they come back. This requires storage-file to be
+// set.
+//
+// Configuration options:
+// - highlight-owner - The owner's nick.
+// - highlight-keywords - Space separated words that also count as
+//   highlights.
+// - highlight-via - How to forward highlights: pm, email, or push. Default
+//   pm.
+// - highlight-context - How many lines before the highlight to include.
+//   Default 2.
+// - highlight-smtp - The SMTP server to send email with, as host:port.
+// - highlight-smtp-username, highlight-smtp-password - How to log in to the
+//   SMTP server, if it needs it.
+// - highlight-email-from, highlight-email-to - Who the email is from and to.
+// - highlight-push-url - Where to POST push notifications, such as
+//   https://ntfy.sh/<topic>. The body is the lines and there is a Title
+//   header.
+package highlight
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/horgh/godrop"
+	"github.com/horgh/irc"
+)
+
+func init() {
+	godrop.Register("highlight", Hook)
+	godrop.RegisterConfig("highlight",
+		godrop.ConfigKey{Name: "highlight-owner", Required: true},
+		godrop.ConfigKey{Name: "highlight-keywords"},
+		godrop.ConfigKey{Name: "highlight-via", Check: checkVia},
+		godrop.ConfigKey{
+			Name:  "highlight-context",
+			Kind:  godrop.ConfigInt,
+			Check: checkContext,
+		},
+		godrop.ConfigKey{Name: "highlight-smtp"},
+		godrop.ConfigKey{Name: "highlight-smtp-username"},
+		godrop.ConfigKey{Name: "highlight-smtp-password"},
+		godrop.ConfigKey{Name: "highlight-email-from"},
+		godrop.ConfigKey{Name: "highlight-email-to"},
+		godrop.ConfigKey{Name: "highlight-push-url"},
+		godrop.ConfigKey{Name: "storage-file"},
+	)
+}
+
+const (
+	// bucket holds memos for the owner while they're offline. They're under
+	// memosKey.
+	bucket   = "highlight"
+	memosKey = "memos"
+
+	defaultContext = 2
+	maxContext     = 10
+
+	// maxMemos is how many memos we keep while the owner is offline. We drop
+	// the oldest.
+	maxMemos = 50
+)
+
+// Memo is a highlight to forward.
+type Memo struct {
+	Channel string
+	Nick    string
+	Time    time.Time
+
+	// Lines are the context lines and then the highlight.
+	Lines []string
+}
+
+var mutex sync.Mutex
+
+// offline is true if MONITOR told us the owner is offline or we saw them
+// quit.
+var offline bool
+
+// Hook fires when an IRC message of some kind occurs.
+func Hook(c *godrop.Client, m irc.Message) {
+	owner := c.Conf().GetString("highlight-owner")
+	if owner == "" {
+		return
+	}
+
+	switch m.Command {
+	case "376", "422":
+		// RPL_ENDOFMOTD or ERR_NOMOTD. We've seen ISUPPORT by now.
+		if c.SupportsMonitor() {
+			_ = c.Send(irc.Message{
+				Command: "MONITOR",
+				Params:  []string{"+", owner},
+			}, godrop.PriorityLow)
+		}
+	case "730":
+		// RPL_MONONLINE: <me> <nick!user@host[,...]>
+		if len(m.Params) >= 2 && monitored(m.Params[1], owner) {
+			setOffline(false)
+			deliver(c, owner)
+		}
+	case "731":
+		// RPL_MONOFFLINE: <me> <nick[,...]>
+		if len(m.Params) >= 2 && monitored(m.Params[1], owner) {
+			setOffline(true)
+		}
+	case "JOIN", "NICK":
+		// Without MONITOR this is how we notice they're back.
+		nick := godrop.SourceNick(m)
+		if m.Command == "NICK" && len(m.Params) >= 1 {
+			nick = m.Params[0]
+		}
+		if godrop.Canonicalize(nick) == godrop.Canonicalize(owner) {
+			setOffline(false)
+			deliver(c, owner)
+		}
+	case "QUIT":
+		if godrop.Canonicalize(godrop.SourceNick(m)) ==
+			godrop.Canonicalize(owner) {
+			setOffline(true)
+		}
+	case "PRIVMSG":
+		if len(m.Params) != 2 || !godrop.IsChannel(m.Params[0]) {
+			return
+		}
+		nick := godrop.SourceNick(m)
+		if godrop.Canonicalize(nick) == godrop.Canonicalize(owner) ||
+			godrop.Canonicalize(nick) == godrop.Canonicalize(c.GetNick()) {
+			return
+		}
+		if !isHighlight(m.Params[1], owner,
+			c.Conf().GetString("highlight-keywords")) {
+			return
+		}
+
+		memo := Memo{
+			Channel: m.Params[0],
+			Nick:    nick,
+			Time:    time.Now(),
+			Lines:   contextLines(c, m),
+		}
+		checkAndForward(c, owner, memo)
+	}
+}
+
+// checkAndForward forwards the memo if the owner is away or offline.
+func checkAndForward(c *godrop.Client, owner string, memo Memo) {
+	if isOffline() {
+		forward(c, owner, memo, true)
+		return
+	}
+
+	if u, ok := c.LookupUser(owner); ok && c.HasCap("away-notify") {
+		if u.Away {
+			forward(c, owner, memo, false)
+		}
+		return
+	}
+
+	if err := c.Whois(owner, func(c *godrop.Client, reply godrop.WhoisReply,
+		err error) {
+		if err != nil {
+			// Most likely they don't exist right now.
+			forward(c, owner, memo, true)
+			return
+		}
+		if reply.Away != "" {
+			forward(c, owner, memo, false)
+		}
+	}); err != nil {
+		c.PluginError("highlight", fmt.Errorf("unable to look up %s: %s", owner,
+			err))
+	}
+}
+
+// forward sends the memo the configured way.
+func forward(c *godrop.Client, owner string, memo Memo, ownerOffline bool) {
+	switch via(c.Conf()) {
+	case "email":
+		go func() {
+			if err := sendEmail(c.Conf(), memo); err != nil {
+				c.PluginError("highlight", err)
+			}
+		}()
+	case "push":
+		go func() {
+			if err := sendPush(c.Web(),
+				c.Conf().GetString("highlight-push-url"),
+				memo); err != nil {
+				c.PluginError("highlight", err)
+			}
+		}()
+	default:
+		if ownerOffline {
+			if err := queue(c, memo); err != nil {
+				c.PluginError("highlight", fmt.Errorf("unable to keep memo: %s",
+					err))
+			}
+			return
+		}
+		sendPM(c, owner, memo)
+	}
+}
+
+// sendPM sends the memo to the owner.
+func sendPM(c *godrop.Client, owner string, memo Memo) {
+	_ = c.Message(owner, subject(memo)+":")
+	for _, line := range memo.Lines {
+		_ = c.Message(owner, line)
+	}
+}
+
+// sendEmail emails the memo.
+func sendEmail(config godrop.Config, memo Memo) error {
+	server := config.GetString("highlight-smtp")
+	from := config.GetString("highlight-email-from")
+	to := config.GetString("highlight-email-to")
+	if server == "" || from == "" || to == "" {
+		return fmt.Errorf("highlight-smtp, highlight-email-from, and " +
+			"highlight-email-to must be set to send email")
+	}
+
+	var auth smtp.Auth
+	if username := config.GetString("highlight-smtp-username"); username != "" {
+		host, _, err := net.SplitHostPort(server)
+		if err != nil {
+			return fmt.Errorf("invalid SMTP server %s: %s", server, err)
+		}
+		auth = smtp.PlainAuth("", username,
+			config.GetString("highlight-smtp-password"),
+			host)
+	}
+
+	msg := "From: " + from + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + subject(memo) + "\r\n" +
+		"Date: " + memo.Time.Format(time.RFC1123Z) + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" +
+		strings.Join(memo.Lines, "\r\n") + "\r\n"
+
+	if err := smtp.SendMail(server, auth, from, []string{to},
+		[]byte(msg)); err != nil {
+		return fmt.Errorf("unable to send email: %s", err)
+	}
+	return nil
+}
+
+// sendPush POSTs the memo to a push notification service.
+func sendPush(web *godrop.WebClient, u string, memo Memo) error {
+	u = strings.TrimSpace(u)
+	if u == "" {
+		return fmt.Errorf("highlight-push-url must be set to send push " +
+			"notifications")
+	}
+
+	req, err := http.NewRequest(http.MethodPost, u,
+		bytes.NewBufferString(strings.Join(memo.Lines, "\n")))
+	if err != nil {
+		return fmt.Errorf("preparing request: %s", err)
+	}
+	req.Header.Set("Title", subject(memo))
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+
+	resp, _, err := web.Fetch(req)
+	if err != nil {
+		return fmt.Errorf("failed to perform HTTP request: %s", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status sending push notification: %s",
+			resp.Status)
+	}
+	return nil
+}
+
+// queue keeps a memo until the owner comes back.
+func queue(c *godrop.Client, memo Memo) error {
+	s, err := c.Storage()
+	if err != nil {
+		return err
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	var memos []Memo
+	if _, err := s.Get(bucket, memosKey, &memos); err != nil {
+		return err
+	}
+	memos = append(memos, memo)
+	if len(memos) > maxMemos {
+		memos = memos[len(memos)-maxMemos:]
+	}
+	return s.Put(bucket, memosKey, memos)
+}
+
+// deliver sends the owner the memos we kept while they were offline.
+func deliver(c *godrop.Client, owner string) {
+	s, err := c.Storage()
+	if err != nil {
+		return
+	}
+
+	mutex.Lock()
+	var memos []Memo
+	ok, err := s.Get(bucket, memosKey, &memos)
+	if err == nil && ok {
+		err = s.Delete(bucket, memosKey)
+	}
+	mutex.Unlock()
+
+	if err != nil {
+		c.PluginError("highlight", fmt.Errorf("unable to retrieve memos: %s",
+			err))
+		return
+	}
+
+	for _, memo := range memos {
+		sendPM(c, owner, memo)
+	}
+}
+
+// contextLines retrieves the lines before the highlight and the highlight
+// itself.
+func contextLines(c *godrop.Client, m irc.Message) []string {
+	// The highlight is the latest message in the history.
+	events := c.History(m.Params[0], contextSize(c.Conf())+1)
+	if len(events) > 0 {
+		events = events[:len(events)-1]
+	}
+
+	var lines []string
+	for _, e := range events {
+		if e.Command != "PRIVMSG" || len(e.Params) != 2 {
+			continue
+		}
+		lines = append(lines, formatLine(e.Time, godrop.SourceNick(e.Message),
+			e.Params[1]))
+	}
+	return append(lines, formatLine(time.Now(), godrop.SourceNick(m),
+		m.Params[1]))
+}
+
+func formatLine(t time.Time, nick, text string) string {
+	return fmt.Sprintf("[%s] <%s> %s", t.Format("15:04"), nick, text)
+}
+
+func subject(memo Memo) string {
+	return fmt.Sprintf("Highlight in %s from %s", memo.Channel, memo.Nick)
+}
+
+// isHighlight checks whether the text has the owner's nick or a keyword as a
+// whole word.
+func isHighlight(text, owner, keywords string) bool {
+	for _, word := range append([]string{owner}, strings.Fields(keywords)...) {
+		re, err := regexp.Compile(`(?i)(?:^|[^\w\[\]\\^{}|-])` +
+			regexp.QuoteMeta(word) + `(?:$|[^\w\[\]\\^{}|-])`)
+		if err != nil {
+			continue
+		}
+		if re.MatchString(text) {
+			return true
+		}
+	}
+	return false
+}
+
+// monitored checks whether the owner is in a MONITOR reply's list.
+func monitored(targets, owner string) bool {
+	for _, target := range strings.Split(targets, ",") {
+		nick := target
+		if i := strings.Index(target, "!"); i != -1 {
+			nick = target[:i]
+		}
+		if godrop.Canonicalize(nick) == godrop.Canonicalize(owner) {
+			return true
+		}
+	}
+	return false
+}
+
+func setOffline(v bool) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	offline = v
+}
+
+func isOffline() bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	return offline
+}
+
+func via(config godrop.Config) string {
+	v := strings.ToLower(config.GetString("highlight-via"))
+	if v == "" {
+		return "pm"
+	}
+	return v
+}
+
+func contextSize(config godrop.Config) int {
+	n := config.GetInt("highlight-context", defaultContext)
+	if n < 0 {
+		return defaultContext
+	}
+	if n > maxContext {
+		return maxContext
+	}
+	return n
+}
+
+func checkVia(value string) error {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "pm", "email", "push":
+		return nil
+	}
+	return fmt.Errorf("expected pm, email, or push")
+}
+
+func checkContext(value string) error {
+	n, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || n < 0 || n > maxContext {
+		return fmt.Errorf("expected a number from 0 to %d", maxContext)
+	}
+	return nil
+}
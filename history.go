@@ -0,0 +1,283 @@
+package godrop
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+// ChatHistoryOptions controls what history ChatHistory requests.
+type ChatHistoryOptions struct {
+	// Limit is how many messages to request. If it is zero we request
+	// defaultChatHistoryLimit. The server may send fewer.
+	Limit int
+
+	// Before requests messages before this time.
+	Before time.Time
+
+	// After requests messages after this time. We use this only if Before is
+	// not set.
+	After time.Time
+}
+
+// defaultChatHistoryLimit is how many messages we request if the caller
+// doesn't say.
+const defaultChatHistoryLimit = 50
+
+// ChatHistory requests history for a channel or nick using the
+// draft/chathistory extension.
+//
+// If there are no times in the options, we request the latest messages.
+//
+// The messages arrive later like any other message. They are marked as
+// Historical and only EventHooks see them. This way plugins that keep logs
+// can backfill without commands triggering a second time.
+func (c *Client) ChatHistory(target string, opts ChatHistoryOptions) error {
+	if !c.supportsChatHistory() {
+		return fmt.Errorf("server does not support chathistory")
+	}
+
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = defaultChatHistoryLimit
+	}
+
+	c.mutex.Lock()
+	if max := c.state.chatHistoryMax; max > 0 && limit > max {
+		limit = max
+	}
+	c.mutex.Unlock()
+
+	params := []string{"LATEST", target, "*", strconv.Itoa(limit)}
+	if !opts.Before.IsZero() {
+		params = []string{"BEFORE", target, historyTimestamp(opts.Before),
+			strconv.Itoa(limit)}
+	} else if !opts.After.IsZero() {
+		params = []string{"AFTER", target, historyTimestamp(opts.After),
+			strconv.Itoa(limit)}
+	}
+
+	return c.WriteMessage(irc.Message{
+		Command: "CHATHISTORY",
+		Params:  params,
+	})
+}
+
+// SetChatHistoryOnJoin sets how many messages of history to request each time
+// we join a channel. Zero (the default) means not to request any.
+func (c *Client) SetChatHistoryOnJoin(limit int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.historyOnJoin = limit
+}
+
+// supportsChatHistory checks whether we negotiated what we need to request
+// history.
+func (c *Client) supportsChatHistory() bool {
+	return (c.HasCap("draft/chathistory") || c.HasCap("chathistory")) &&
+		c.HasCap("batch")
+}
+
+func historyTimestamp(t time.Time) string {
+	return "timestamp=" + t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+// trackBatch records batches the server starts and ends and reports whether
+// the event is part of a chathistory batch.
+func (c *Client) trackBatch(e Event) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// BATCH +<reference> <type> [params]
+	// BATCH -<reference>
+	if e.Command == "BATCH" && len(e.Params) > 0 && len(e.Params[0]) > 1 {
+		ref := e.Params[0][1:]
+		if e.Params[0][0] == '+' && len(e.Params) > 1 {
+			batchType := e.Params[1]
+			// A batch nested in a chathistory batch is historical too.
+			if parent, ok := e.Tags["batch"]; ok &&
+				isHistoryBatch(c.batches[parent]) {
+				batchType = "chathistory"
+			}
+			c.batches[ref] = batchType
+		}
+		if e.Params[0][0] == '-' {
+			delete(c.batches, ref)
+		}
+		return false
+	}
+
+	ref, ok := e.Tags["batch"]
+	if !ok {
+		return false
+	}
+	return isHistoryBatch(c.batches[ref])
+}
+
+func isHistoryBatch(batchType string) bool {
+	return batchType == "chathistory" || batchType == "draft/chathistory"
+}
+
+// requestHistoryOnJoin requests history for a channel we joined if we're set
+// to.
+func (c *Client) requestHistoryOnJoin(m irc.Message) error {
+	if m.Command != "JOIN" || len(m.Params) == 0 ||
+		Canonicalize(SourceNick(m)) != Canonicalize(c.GetNick()) {
+		return nil
+	}
+
+	c.mutex.Lock()
+	limit := c.historyOnJoin
+	c.mutex.Unlock()
+
+	if limit <= 0 || !c.supportsChatHistory() {
+		return nil
+	}
+
+	return c.ChatHistory(m.Params[0], ChatHistoryOptions{Limit: limit})
+}
+
+// defaultHistorySize is how many messages we keep for each channel and
+// private conversation by default.
+const defaultHistorySize = 100
+
+// maxPrivateHistories is how many private conversations we keep history for.
+// If there are more we forget the one that's been quiet the longest.
+const maxPrivateHistories = 100
+
+// SetHistorySize sets how many messages we keep for each channel and private
+// conversation. Zero means not to keep any.
+func (c *Client) SetHistorySize(n int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if n < 0 {
+		n = 0
+	}
+
+	c.historySize = n
+	for k, events := range c.history {
+		if len(events) > n {
+			c.history[k] = append([]Event(nil), events[len(events)-n:]...)
+		}
+	}
+}
+
+// History retrieves up to n recent messages (PRIVMSG and NOTICE) for a
+// channel or a nick we talked to privately. They are oldest first.
+//
+// This includes our own messages. We forget a channel's messages when we
+// leave it, and keep messages for only the most recent private
+// conversations.
+func (c *Client) History(target string, n int) []Event {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	events := c.history[Canonicalize(target)]
+	if n <= 0 {
+		return nil
+	}
+	if n < len(events) {
+		events = events[len(events)-n:]
+	}
+	return append([]Event(nil), events...)
+}
+
+// recordHistory adds a message to the history if it is one we keep. If we
+// left a channel, we forget its history.
+func (c *Client) recordHistory(e Event) {
+	if e.Command == "PART" || e.Command == "KICK" {
+		c.forgetHistory(e)
+		return
+	}
+
+	if (e.Command != "PRIVMSG" && e.Command != "NOTICE") ||
+		len(e.Params) != 2 {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.historySize <= 0 {
+		return
+	}
+
+	// Private messages go with the other person.
+	target := e.Params[0]
+	if !IsChannel(target) {
+		source := SourceNick(e.Message)
+		if source != "" && Canonicalize(source) != Canonicalize(c.currentNick()) {
+			target = source
+		}
+	}
+
+	key := Canonicalize(target)
+	_, known := c.history[key]
+	c.history[key] = append(c.history[key], e)
+	if len(c.history[key]) > c.historySize {
+		c.history[key] = c.history[key][len(c.history[key])-c.historySize:]
+	}
+
+	if !known && !IsChannel(target) {
+		c.limitPrivateHistories()
+	}
+}
+
+// forgetHistory forgets the history of channels we part or are kicked from.
+// History we requested doesn't count since it's not us leaving now.
+func (c *Client) forgetHistory(e Event) {
+	if e.Historical || len(e.Params) == 0 {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	us := Canonicalize(c.currentNick())
+	switch e.Command {
+	case "PART":
+		if Canonicalize(SourceNick(e.Message)) != us {
+			return
+		}
+	case "KICK":
+		if len(e.Params) < 2 || Canonicalize(e.Params[1]) != us {
+			return
+		}
+	}
+
+	for _, channel := range strings.Split(e.Params[0], ",") {
+		delete(c.history, Canonicalize(channel))
+	}
+}
+
+// limitPrivateHistories forgets the private conversations that have been
+// quiet the longest if we have too many.
+//
+// The caller must hold the mutex.
+func (c *Client) limitPrivateHistories() {
+	for {
+		count := 0
+		oldest := ""
+		var oldestTime time.Time
+		for key, events := range c.history {
+			if IsChannel(key) || len(events) == 0 {
+				continue
+			}
+			count++
+			last := events[len(events)-1].Time
+			if oldest == "" || last.Before(oldestTime) {
+				oldest, oldestTime = key, last
+			}
+		}
+
+		if count <= maxPrivateHistories {
+			return
+		}
+		delete(c.history, oldest)
+	}
+}
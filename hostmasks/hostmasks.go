@@ -0,0 +1,311 @@
+// Package hostmasks records the nick!user@host of everyone we see so
+// operators can see who's who over time.
+//
+// We record masks when people join, speak, or change nick, and from WHO
+// replies. We send WHO for our channels every so often so we learn about
+// people who stay quiet.
+//
+// Usage:
+// - !hosts <nick> - Show the user@hosts someone has used.
+// - !nicks <host> - Show the nicks used from a host. This also takes a
+//   user@host or a full mask, in which case we use its host.
+//
+// Only administrators and people matching hostmasks-trusted may use these.
+// We always respond privately.
+//
+// Configuration options:
+// - hostmasks-trusted - Space separated nick!user@host masks and $a:account
+//   entries for people who may look up masks in addition to administrators.
+// - hostmasks-who-interval - How often to send WHO for our channels. Default
+//   30m. 0 disables it.
+//
+// Masks are kept in persistent storage. This requires storage-file to be
+// set.
+package hostmasks
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/horgh/godrop"
+	"github.com/horgh/irc"
+)
+
+func init() {
+	godrop.Register("hostmasks", Hook)
+	godrop.RegisterConfig("hostmasks",
+		godrop.ConfigKey{Name: "storage-file", Required: true},
+		godrop.ConfigKey{Name: "hostmasks-trusted"},
+		godrop.ConfigKey{Name: "hostmasks-who-interval",
+			Kind: godrop.ConfigDuration},
+	)
+	godrop.RegisterCommand("hostmasks", godrop.Command{
+		Name:  "hosts",
+		Usage: "<nick>",
+		Help:  "Show the user@hosts someone has used.",
+		Run:   triggerHosts,
+	})
+	godrop.RegisterCommand("hostmasks", godrop.Command{
+		Name:  "nicks",
+		Usage: "<host>",
+		Help:  "Show the nicks used from a host.",
+		Run:   triggerNicks,
+	})
+}
+
+const (
+	// nickBucket holds the user@hosts each nick used keyed by canonicalized
+	// nick. hostBucket holds the nicks used from each host keyed by lowercased
+	// host.
+	nickBucket = "hostmasks-nicks"
+	hostBucket = "hostmasks-hosts"
+
+	// maxEntries is how many user@hosts we keep for a nick and nicks for a
+	// host. We forget those we saw least recently first.
+	maxEntries = 50
+
+	// updateInterval is how often we store that we saw a mask again. Storing
+	// every message would be a lot of writing for little benefit.
+	updateInterval = time.Hour
+
+	// maxRecorded is how many masks we remember storing before we forget
+	// those we stored long enough ago.
+	maxRecorded = 10000
+
+	// defaultWhoInterval is how often we send WHO by default.
+	defaultWhoInterval = 30 * time.Minute
+
+	// maxResults is how many entries we show.
+	maxResults = 10
+)
+
+// Sighting is when we saw a nick or user@host.
+type Sighting struct {
+	// Name is a user@host or nick, depending on the bucket.
+	Name      string
+	FirstSeen time.Time
+	LastSeen  time.Time
+}
+
+var (
+	mutex sync.Mutex
+
+	// recorded holds when we last stored each mask keyed by lowercased mask.
+	recorded = map[string]time.Time{}
+
+	// lastWho is when we last sent WHO.
+	lastWho time.Time
+)
+
+// Hook fires when an IRC message of some kind occurs.
+func Hook(c *godrop.Client, m irc.Message) {
+	pollWho(c)
+
+	switch m.Command {
+	case "JOIN", "NICK", "NOTICE":
+		record(c, godrop.SourceNick(m), m.Prefix)
+	case "PRIVMSG":
+		record(c, godrop.SourceNick(m), m.Prefix)
+	case "352":
+		// RPL_WHOREPLY: <me> <channel> <user> <host> <server> <nick> <flags>
+		// :<hops> <realname>
+		if len(m.Params) >= 6 {
+			record(c, m.Params[5], m.Params[5]+"!"+m.Params[2]+"@"+m.Params[3])
+		}
+	}
+
+	// Someone who changed nick is using the new one from the same host.
+	if m.Command == "NICK" && len(m.Params) >= 1 {
+		if i := strings.Index(m.Prefix, "!"); i != -1 {
+			record(c, m.Params[0], m.Params[0]+m.Prefix[i:])
+		}
+	}
+}
+
+// pollWho sends WHO for our channels if it's time.
+func pollWho(c *godrop.Client) {
+	interval := c.Conf().GetDuration("hostmasks-who-interval",
+		defaultWhoInterval)
+	if interval <= 0 {
+		return
+	}
+
+	mutex.Lock()
+	if time.Since(lastWho) < interval {
+		mutex.Unlock()
+		return
+	}
+	lastWho = time.Now()
+	mutex.Unlock()
+
+	for _, channel := range c.Channels() {
+		_ = c.Send(irc.Message{
+			Command: "WHO",
+			Params:  []string{channel},
+		}, godrop.PriorityLow)
+	}
+}
+
+// record stores that we saw a mask.
+func record(c *godrop.Client, nick, mask string) {
+	bang := strings.Index(mask, "!")
+	at := strings.LastIndex(mask, "@")
+	if nick == "" || bang == -1 || at < bang {
+		return
+	}
+	userHost := mask[bang+1:]
+	host := mask[at+1:]
+
+	now := time.Now()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	key := strings.ToLower(nick + "!" + userHost)
+	if t, ok := recorded[key]; ok && now.Sub(t) < updateInterval {
+		return
+	}
+
+	if err := update(c, nickBucket, godrop.Canonicalize(nick), userHost,
+		now); err != nil {
+		c.PluginError("hostmasks", fmt.Errorf("unable to record %s: %s", mask,
+			err))
+		return
+	}
+	if err := update(c, hostBucket, strings.ToLower(host), nick,
+		now); err != nil {
+		c.PluginError("hostmasks", fmt.Errorf("unable to record %s: %s", mask,
+			err))
+		return
+	}
+
+	recorded[key] = now
+
+	// Forget masks we haven't seen in a while so this doesn't grow forever.
+	if len(recorded) > maxRecorded {
+		for k, t := range recorded {
+			if now.Sub(t) >= updateInterval {
+				delete(recorded, k)
+			}
+		}
+	}
+}
+
+// update records a sighting of name in the key's list.
+//
+// The caller must hold the mutex.
+func update(c *godrop.Client, bucket, key, name string, now time.Time) error {
+	store, err := c.Storage()
+	if err != nil {
+		return err
+	}
+
+	var sightings []Sighting
+	if _, err := store.Get(bucket, key, &sightings); err != nil {
+		return err
+	}
+
+	found := false
+	for i := range sightings {
+		if strings.EqualFold(sightings[i].Name, name) {
+			sightings[i].Name = name
+			sightings[i].LastSeen = now
+			found = true
+			break
+		}
+	}
+	if !found {
+		sightings = append(sightings, Sighting{
+			Name:      name,
+			FirstSeen: now,
+			LastSeen:  now,
+		})
+	}
+
+	sortSightings(sightings)
+	if len(sightings) > maxEntries {
+		sightings = sightings[:maxEntries]
+	}
+
+	return store.Put(bucket, key, sightings)
+}
+
+// triggerHosts handles !hosts
+func triggerHosts(c *godrop.Client, m irc.Message, args []string) error {
+	return lookup(c, m, args, true)
+}
+
+// triggerNicks handles !nicks
+func triggerNicks(c *godrop.Client, m irc.Message, args []string) error {
+	return lookup(c, m, args, false)
+}
+
+// lookup looks up the nick's user@hosts if hosts is true, and otherwise the
+// host's nicks.
+func lookup(c *godrop.Client, m irc.Message, fields []string,
+	hosts bool) error {
+	nick := godrop.SourceNick(m)
+
+	if !c.IsAdmin(m) && !c.Identify(m).MatchesAny(c.Conf()["hostmasks-trusted"]) {
+		return c.Message(nick,
+			"Only administrators and trusted people may do that.")
+	}
+
+	if len(fields) != 1 {
+		if hosts {
+			return c.Message(nick, "Usage: !hosts <nick>")
+		}
+		return c.Message(nick, "Usage: !nicks <host>")
+	}
+	arg := fields[0]
+
+	bucket, key := nickBucket, godrop.Canonicalize(arg)
+	if !hosts {
+		if i := strings.LastIndex(arg, "@"); i != -1 {
+			arg = arg[i+1:]
+		}
+		bucket, key = hostBucket, strings.ToLower(arg)
+	}
+
+	store, err := c.Storage()
+	if err != nil {
+		return c.Message(nick, fmt.Sprintf("Unable to look up %s: %s", arg, err))
+	}
+
+	var sightings []Sighting
+	mutex.Lock()
+	_, err = store.Get(bucket, key, &sightings)
+	mutex.Unlock()
+	if err != nil {
+		return c.Message(nick, fmt.Sprintf("Unable to look up %s: %s", arg, err))
+	}
+
+	if len(sightings) == 0 {
+		return c.Message(nick, fmt.Sprintf("I haven't seen %s.", arg))
+	}
+
+	sortSightings(sightings)
+	_ = c.Message(nick, fmt.Sprintf("%s: %d seen, most recent first:", arg,
+		len(sightings)))
+
+	settings := c.ChannelSettings(nick)
+	for i, s := range sightings {
+		if i == maxResults {
+			_ = c.Message(nick, fmt.Sprintf("(%d more)", len(sightings)-maxResults))
+			break
+		}
+		_ = c.Message(nick, fmt.Sprintf("%s (first %s, last %s)", s.Name,
+			settings.FormatTime(s.FirstSeen), settings.FormatTime(s.LastSeen)))
+	}
+	return nil
+}
+
+// sortSightings puts the most recently seen first.
+func sortSightings(sightings []Sighting) {
+	sort.SliceStable(sightings, func(i, j int) bool {
+		return sightings[i].LastSeen.After(sightings[j].LastSeen)
+	})
+}
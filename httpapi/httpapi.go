@@ -0,0 +1,325 @@
+// Package httpapi provides an HTTP API so other programs can use the client.
+//
+// For example, cron jobs can send messages through the bot without speaking
+// IRC.
+//
+// Endpoints:
+// - POST /message - Send a message. The body is JSON with the keys target and
+//   text, or a form with those fields.
+// - GET /metrics - Metrics about the client and each plugin in the Prometheus
+//   text format.
+//
+// Requests must have the header "Authorization: Bearer <token>".
+//
+// Configuration options:
+// - http-listen - The address to listen on, such as 127.0.0.1:8080. If this is
+//   not set, we don't listen.
+// - http-token - The token requests must have. If this is not set, the
+//   endpoints requiring it are disabled.
+// - http-cert, http-key - A TLS certificate and key. If these are set, we
+//   serve HTTPS.
+//
+// Requests act on the client whose server they reach. If http-listen changes
+// when reloading the config, we listen again on the new address.
+//
+// Other packages may add their own handlers to the server with Handle. They
+// find the client a request is for with Client.
+package httpapi
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/horgh/godrop"
+)
+
+func init() {
+	godrop.RegisterAllEventsHook("httpapi", Hook)
+	godrop.RegisterConfig("httpapi",
+		godrop.ConfigKey{Name: "http-listen", Required: true},
+		godrop.ConfigKey{Name: "http-token"},
+		godrop.ConfigKey{Name: "http-cert", Kind: godrop.ConfigFile},
+		godrop.ConfigKey{Name: "http-key", Kind: godrop.ConfigFile},
+	)
+	Handle("/message", RequireToken(http.HandlerFunc(messageHandler)))
+	Handle("/metrics", RequireToken(http.HandlerFunc(metricsHandler)))
+}
+
+var mux = http.NewServeMux()
+
+var mutex sync.Mutex
+
+// servers holds the server we run for each client and the settings it
+// listens with.
+var servers = map[*godrop.Client]*server{}
+
+type server struct {
+	settings settings
+	http     *http.Server
+}
+
+// settings are what we listen with.
+type settings struct {
+	listen   string
+	certFile string
+	keyFile  string
+}
+
+// clientKey is the request context key holding the client.
+type clientKey struct{}
+
+// Hook fires when an IRC message of some kind occurs.
+//
+// We start listening if we're not already, and listen again if our settings
+// changed. We stop once the client shuts down.
+func Hook(c *godrop.Client, e godrop.Event) {
+	cur := settings{
+		listen:   strings.TrimSpace(c.Conf().GetString("http-listen")),
+		certFile: strings.TrimSpace(c.Conf().GetString("http-cert")),
+		keyFile:  strings.TrimSpace(c.Conf().GetString("http-key")),
+	}
+	if e.Kind == godrop.EventShutdown {
+		cur = settings{}
+	}
+
+	mutex.Lock()
+	old, ok := servers[c]
+	if ok && old.settings == cur {
+		mutex.Unlock()
+		return
+	}
+	delete(servers, c)
+
+	var srv *server
+	if cur.listen != "" {
+		srv = &server{
+			settings: cur,
+			http: &http.Server{
+				Addr: cur.listen,
+				Handler: http.HandlerFunc(func(w http.ResponseWriter,
+					r *http.Request) {
+					mux.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(),
+						clientKey{}, c)))
+				}),
+				ReadTimeout:  30 * time.Second,
+				WriteTimeout: 30 * time.Second,
+			},
+		}
+		servers[c] = srv
+	}
+	mutex.Unlock()
+
+	if ok && old.http != nil {
+		if err := old.http.Close(); err != nil {
+			c.Log().Warn("Unable to stop listening", "plugin", "httpapi",
+				"error", err)
+		}
+	}
+
+	if srv == nil {
+		return
+	}
+
+	c.Go("httpapi", func() error {
+		c.Log().Info("Listening", "plugin", "httpapi", "addr", cur.listen)
+		var err error
+		if cur.certFile != "" || cur.keyFile != "" {
+			err = srv.http.ListenAndServeTLS(cur.certFile, cur.keyFile)
+		} else {
+			err = srv.http.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			return fmt.Errorf("unable to serve: %s", err)
+		}
+		return nil
+	})
+}
+
+// Handle adds a handler to the server.
+//
+// Packages should call this from an init() function.
+func Handle(pattern string, handler http.Handler) {
+	mux.Handle(pattern, handler)
+}
+
+// Client retrieves the client the request is for. This is the client whose
+// server received it.
+func Client(r *http.Request) *godrop.Client {
+	c, _ := r.Context().Value(clientKey{}).(*godrop.Client)
+	return c
+}
+
+// RequireToken wraps a handler so requests must have the token set by
+// http-token.
+func RequireToken(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := Client(r)
+		token := c.Conf().GetString("http-token")
+		got, ok := bearerToken(r.Header.Get("Authorization"))
+
+		if token == "" || !ok ||
+			subtle.ConstantTimeCompare([]byte(token), []byte(got)) != 1 {
+			writeError(w, r, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// bearerToken retrieves the token from an Authorization header. It reports
+// false if the header isn't a bearer token. The scheme may be in any case.
+func bearerToken(header string) (string, bool) {
+	const scheme = "Bearer "
+	if len(header) < len(scheme) ||
+		!strings.EqualFold(header[:len(scheme)], scheme) {
+		return "", false
+	}
+	return strings.TrimSpace(header[len(scheme):]), true
+}
+
+// messageRequest is the body of a request to send a message.
+type messageRequest struct {
+	Target string `json:"target"`
+	Text   string `json:"text"`
+}
+
+func messageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var req messageRequest
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body,
+			1<<16)).Decode(&req); err != nil {
+			writeError(w, r, http.StatusBadRequest,
+				fmt.Sprintf("invalid JSON: %s", err))
+			return
+		}
+	} else {
+		req.Target = r.PostFormValue("target")
+		req.Text = r.PostFormValue("text")
+	}
+
+	req.Target = strings.TrimSpace(req.Target)
+	if req.Target == "" || strings.ContainsAny(req.Target, " \r\n") {
+		writeError(w, r, http.StatusBadRequest, "invalid target")
+		return
+	}
+
+	if strings.TrimSpace(req.Text) == "" {
+		writeError(w, r, http.StatusBadRequest, "text is required")
+		return
+	}
+
+	if err := Client(r).Message(req.Target, req.Text); err != nil {
+		writeError(w, r, http.StatusServiceUnavailable,
+			fmt.Sprintf("unable to send message: %s", err))
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, map[string]string{"status": "sent"})
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	c := Client(r)
+	buf := &bytes.Buffer{}
+
+	writeMetric(buf, "godrop_connected", "gauge",
+		"Whether we're connected to a server.", boolMetric(c.IsConnected()))
+	writeMetric(buf, "godrop_registered", "gauge",
+		"Whether we're registered with the server.",
+		boolMetric(c.IsRegistered()))
+	writeMetric(buf, "godrop_lag_seconds", "gauge",
+		"Our most recent lag to the server.", c.Lag().Seconds())
+	writeMetric(buf, "godrop_suppressed_duplicates_total", "counter",
+		"Messages dropped because they repeated a recent message.",
+		float64(c.SuppressedDuplicates()))
+
+	statuses := c.PluginStatuses()
+	pluginMetrics := []struct {
+		name  string
+		kind  string
+		help  string
+		value func(godrop.PluginStatus) float64
+	}{
+		{"godrop_plugin_calls_total", "counter", "Calls to the plugin's hook.",
+			func(s godrop.PluginStatus) float64 { return float64(s.Calls) }},
+		{"godrop_plugin_seconds_total", "counter",
+			"Time spent in the plugin's hook.",
+			func(s godrop.PluginStatus) float64 { return s.TotalTime.Seconds() }},
+		{"godrop_plugin_max_seconds", "gauge",
+			"Time the slowest call to the plugin's hook took.",
+			func(s godrop.PluginStatus) float64 { return s.MaxTime.Seconds() }},
+		{"godrop_plugin_errors_total", "counter",
+			"Errors the plugin reported.",
+			func(s godrop.PluginStatus) float64 { return float64(s.Errors) }},
+		{"godrop_plugin_panics_total", "counter",
+			"Times the plugin's hook panicked.",
+			func(s godrop.PluginStatus) float64 { return float64(s.Panics) }},
+		{"godrop_plugin_restarts_total", "counter",
+			"Times we restarted the plugin's goroutines.",
+			func(s godrop.PluginStatus) float64 { return float64(s.Restarts) }},
+		{"godrop_plugin_dropped_total", "counter",
+			"Messages dropped because the plugin was too far behind.",
+			func(s godrop.PluginStatus) float64 { return float64(s.Dropped) }},
+	}
+	for _, pm := range pluginMetrics {
+		fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", pm.name, pm.help,
+			pm.name, pm.kind)
+		for _, s := range statuses {
+			fmt.Fprintf(buf, "%s{plugin=%q} %g\n", pm.name, s.Name, pm.value(s))
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		logError(r, "Unable to write response", err)
+	}
+}
+
+// writeMetric writes a metric in the Prometheus text format.
+func writeMetric(buf *bytes.Buffer, name, kind, help string, value float64) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n%s %g\n", name, help, name,
+		kind, name, value)
+}
+
+func boolMetric(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// logError logs an error with the Logger of the request's client.
+func logError(r *http.Request, msg string, err error) {
+	Client(r).Log().Error(msg, "plugin", "httpapi", "error", err)
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, status int,
+	message string) {
+	writeJSON(w, r, status, map[string]string{"error": message})
+}
+
+func writeJSON(w http.ResponseWriter, r *http.Request, status int,
+	v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logError(r, "Unable to write response", err)
+	}
+}
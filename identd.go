@@ -0,0 +1,133 @@
+package godrop
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// identdTimeout is how long we wait on an ident query.
+const identdTimeout = 10 * time.Second
+
+// SetIdentd turns on answering ident (RFC 1413) queries while we connect.
+// Servers ask the host we connect from who we are. If nothing answers, they
+// show our ident with a ~ in front. This is useful on hosts without an ident
+// server.
+//
+// addr is where to listen, usually :113. We listen only while connecting and
+// registering, and we only answer about our own connection.
+func (c *Client) SetIdentd(addr string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.identdAddr = addr
+}
+
+// startIdentd starts listening for ident queries if we're set to.
+func (c *Client) startIdentd() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.identdAddr == "" || c.identdListener != nil {
+		return
+	}
+
+	ln, err := net.Listen("tcp", c.identdAddr)
+	if err != nil {
+		c.Log().Error("Unable to listen for ident queries", "error", err)
+		return
+	}
+
+	c.identdListener = ln
+	go c.identdLoop(ln)
+}
+
+// stopIdentd stops listening for ident queries.
+//
+// The caller must hold the mutex.
+func (c *Client) stopIdentd() {
+	if c.identdListener == nil {
+		return
+	}
+
+	if err := c.identdListener.Close(); err != nil {
+		c.Log().Error("Unable to close ident listener", "error", err)
+	}
+	c.identdListener = nil
+}
+
+// identdLoop answers ident queries until the listener closes.
+func (c *Client) identdLoop(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go c.answerIdent(conn)
+	}
+}
+
+// answerIdent answers an ident query.
+//
+// The query is <port on our side>, <port on the querier's side>. If those are
+// our connection's ports we reply with our ident.
+func (c *Client) answerIdent(conn net.Conn) {
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	if err := conn.SetDeadline(time.Now().Add(identdTimeout)); err != nil {
+		return
+	}
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return
+	}
+
+	ports := strings.Split(strings.TrimSpace(line), ",")
+	if len(ports) != 2 {
+		return
+	}
+
+	localPort, err := strconv.Atoi(strings.TrimSpace(ports[0]))
+	if err != nil {
+		return
+	}
+	remotePort, err := strconv.Atoi(strings.TrimSpace(ports[1]))
+	if err != nil {
+		return
+	}
+
+	c.mutex.Lock()
+	ours := localPort == c.localPort && remotePort == c.remotePort
+	c.mutex.Unlock()
+
+	reply := fmt.Sprintf("%d, %d : ERROR : NO-USER\r\n", localPort, remotePort)
+	if ours {
+		reply = fmt.Sprintf("%d, %d : USERID : UNIX : %s\r\n", localPort,
+			remotePort, c.ident)
+	}
+
+	if _, err := conn.Write([]byte(reply)); err != nil {
+		c.Log().Warn("Unable to answer ident query", "error", err)
+	}
+}
+
+// setConnPorts records our connection's ports so we can answer ident queries
+// about it.
+//
+// The caller must hold the mutex.
+func (c *Client) setConnPorts(conn net.Conn) {
+	c.localPort, c.remotePort = 0, 0
+
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		c.localPort = addr.Port
+	}
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		c.remotePort = addr.Port
+	}
+}
@@ -0,0 +1,277 @@
+package godrop
+
+import (
+	"strings"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+const (
+	// nickChangeMemory is how long we remember nick changes.
+	nickChangeMemory = 6 * time.Hour
+
+	// maxNickChanges is how many nick changes we remember at most.
+	maxNickChanges = 1000
+)
+
+// NickChange describes someone changing their nick.
+type NickChange struct {
+	Old string
+	New string
+
+	// Mask is their user@host when they changed it if we know it.
+	Mask string
+
+	Time time.Time
+}
+
+// identityEvent is a nick change or a quit. Quits end a chain of nick
+// changes since someone else may use the nick afterwards.
+type identityEvent struct {
+	change NickChange
+	quit   bool
+}
+
+// trackIdentity records nick changes and quits.
+func (c *Client) trackIdentity(m irc.Message) {
+	if (m.Command != "NICK" && m.Command != "QUIT") || m.Prefix == "" {
+		return
+	}
+
+	// People come back from netsplits with the same nick.
+	if IsNetsplitQuit(m) {
+		return
+	}
+
+	e := identityEvent{
+		change: NickChange{
+			Old:  SourceNick(m),
+			Mask: userHost(m.Prefix),
+			Time: time.Now(),
+		},
+		quit: m.Command == "QUIT",
+	}
+	if m.Command == "NICK" {
+		if len(m.Params) == 0 {
+			return
+		}
+		e.change.New = m.Params[0]
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.identities = append(c.identities, e)
+
+	i := 0
+	for i < len(c.identities) &&
+		(len(c.identities)-i > maxNickChanges ||
+			time.Since(c.identities[i].change.Time) > nickChangeMemory) {
+		i++
+	}
+	if i > 0 {
+		c.identities = append([]identityEvent(nil), c.identities[i:]...)
+	}
+}
+
+// userHost returns the user@host part of a nick!user@host mask. If it
+// doesn't have one, it returns a blank string.
+func userHost(mask string) string {
+	i := strings.IndexByte(mask, '!')
+	if i == -1 || strings.IndexByte(mask[i:], '@') == -1 {
+		return ""
+	}
+	return mask[i+1:]
+}
+
+// NickChanges retrieves the nick changes that led to someone having the nick,
+// most recent first. For example if alice changed their nick to alice_ and then
+// to alice_away, NickChanges("alice_away") gives alice_ to alice_away and then
+// alice to alice_.
+//
+// We remember nick changes for a few hours. A chain stops at a quit and where
+// the user@host differs, since then it is likely someone else.
+func (c *Client) NickChanges(nick string) []NickChange {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	mask := ""
+	if u, ok := c.state.users[Canonicalize(nick)]; ok && u.Host != "" {
+		mask = u.Ident + "@" + u.Host
+	}
+
+	var changes []NickChange
+	current := Canonicalize(nick)
+	for i := len(c.identities) - 1; i >= 0; i-- {
+		e := c.identities[i]
+
+		if !e.quit && Canonicalize(e.change.New) == current {
+			if mask != "" && e.change.Mask != "" && e.change.Mask != mask {
+				break
+			}
+			changes = append(changes, e.change)
+			current = Canonicalize(e.change.Old)
+			if e.change.Mask != "" {
+				mask = e.change.Mask
+			}
+			continue
+		}
+
+		// Someone left the nick. Whoever has it now got it some other way.
+		if Canonicalize(e.change.Old) == current {
+			break
+		}
+	}
+
+	return changes
+}
+
+// PreviousNicks retrieves the nicks someone with the nick had before, most
+// recent first. See NickChanges.
+func (c *Client) PreviousNicks(nick string) []string {
+	var nicks []string
+	for _, change := range c.NickChanges(nick) {
+		nicks = append(nicks, change.Old)
+	}
+	return nicks
+}
+
+// CurrentNick follows nick changes to find the nick someone who had the nick
+// has now. It reports whether we know they still have it. This is false if
+// they quit.
+//
+// If we don't know them changing from the nick, this returns the nick.
+func (c *Client) CurrentNick(nick string) (string, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// Start from when someone last left the nick.
+	start := -1
+	for i := len(c.identities) - 1; i >= 0; i-- {
+		if Canonicalize(c.identities[i].change.Old) == Canonicalize(nick) {
+			start = i
+			break
+		}
+	}
+	if start == -1 {
+		return nick, true
+	}
+
+	// If someone took the nick since, they're who has it.
+	for _, e := range c.identities[start+1:] {
+		if !e.quit && Canonicalize(e.change.New) == Canonicalize(nick) {
+			return nick, true
+		}
+	}
+
+	current := nick
+	for _, e := range c.identities[start:] {
+		if Canonicalize(e.change.Old) != Canonicalize(current) {
+			continue
+		}
+		if e.quit {
+			return current, false
+		}
+		current = e.change.New
+	}
+
+	return current, true
+}
+
+// Identity is who sent a message.
+type Identity struct {
+	Nick string
+
+	// Account is the services account they're logged in to. It is empty if
+	// they're not logged in or we can't know reliably.
+	Account string
+
+	// Mask is their nick!user@host.
+	Mask string
+}
+
+// Identify determines who sent a message.
+//
+// We know accounts of users on our channels if the server supports the
+// account-tag capability, or both the account-notify and extended-join
+// capabilities. Otherwise accounts may be out of date so we don't use them.
+func (c *Client) Identify(m irc.Message) Identity {
+	id := Identity{
+		Nick: SourceNick(m),
+		Mask: m.Prefix,
+	}
+
+	if !c.HasCap("account-tag") &&
+		(!c.HasCap("account-notify") || !c.HasCap("extended-join")) {
+		return id
+	}
+
+	if u, ok := c.LookupUser(id.Nick); ok {
+		id.Account = u.Account
+	}
+	return id
+}
+
+// IdentifyEvent is like Identify, but uses the account on the event if it has
+// one, such as from the account tag. This way we know the accounts of users
+// we don't share a channel with, such as in private messages.
+func (c *Client) IdentifyEvent(e Event) Identity {
+	id := c.Identify(e.Message)
+	if e.Account != "" {
+		id.Account = e.Account
+	}
+	return id
+}
+
+// Key is a stable way to refer to the identity, such as to store data about
+// them. It is $a:<account> if they're logged in to an account. Otherwise it
+// is *!user@host. Nicks can't be trusted so it doesn't include one.
+//
+// The key is also a pattern that matches the identity. See Matches.
+func (i Identity) Key() string {
+	if i.Account != "" {
+		return "$a:" + Canonicalize(i.Account)
+	}
+	if uh := userHost(i.Mask); uh != "" {
+		return "*!" + Canonicalize(uh)
+	}
+	return Canonicalize(i.Mask)
+}
+
+// Matches checks whether the identity matches a pattern. The pattern is
+// either $a:<account>, which matches the account, or a nick!user@host mask.
+// Both may contain the wildcards * and ?.
+func (i Identity) Matches(pattern string) bool {
+	if strings.HasPrefix(pattern, "$a:") {
+		return i.Account != "" && MatchMask(pattern[3:], i.Account)
+	}
+	return i.Mask != "" && MatchMask(pattern, i.Mask)
+}
+
+// MatchesAny checks whether the identity matches any of the space separated
+// patterns. See Matches.
+func (i Identity) MatchesAny(patterns string) bool {
+	for _, pattern := range strings.Fields(patterns) {
+		if i.Matches(pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// trackAccountTag records the account a user is logged in to from the
+// account tag on their messages. With the account-tag capability a message
+// without it means they're not logged in.
+func (c *Client) trackAccountTag(e Event) {
+	if !strings.Contains(e.Prefix, "!") || !c.HasCap("account-tag") {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if u, ok := c.state.users[Canonicalize(SourceNick(e.Message))]; ok {
+		u.Account = e.Tags["account"]
+	}
+}
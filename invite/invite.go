@@ -0,0 +1,195 @@
+// Package invite helps with invite only (+i) channels.
+//
+// If we can't join a channel because it's invite only, we ask for an invite.
+// When we're invited to a channel we want to be on, we join it.
+//
+// When someone knocks on a channel where we're an operator, we invite them if
+// they're allowed. Otherwise we tell the channel's operators.
+//
+// Usage:
+// - !invite <nick> - Invite someone to the channel. On a private message use
+//   !invite <nick> <channel>. Only administrators, channel operators, and
+//   people matching invite-trusted may do this.
+//
+// Configuration options:
+// - invite-request - How to ask for an invite: chanserv (ask ChanServ), knock
+//   (send KNOCK), or none. Default chanserv.
+// - invite-allow - Space separated nick!user@host masks and $a:account
+//   entries. People matching these who knock get invited.
+// - invite-trusted - Space separated masks and $a:account entries for people
+//   who may use !invite.
+package invite
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/horgh/godrop"
+	"github.com/horgh/irc"
+)
+
+func init() {
+	godrop.Register("invite", Hook)
+	godrop.RegisterConfig("invite",
+		godrop.ConfigKey{Name: "invite-request", Check: checkRequest},
+		godrop.ConfigKey{Name: "invite-allow"},
+		godrop.ConfigKey{Name: "invite-trusted"},
+	)
+	godrop.RegisterCommand("invite", godrop.Command{
+		Name:    "invite",
+		Usage:   "<nick> [channel]",
+		Help:    "Invite someone to a channel.",
+		MinArgs: 1,
+		Run:     triggerInvite,
+	})
+}
+
+// requestInterval is how long we wait before asking for an invite to the
+// same channel again.
+const requestInterval = 5 * time.Minute
+
+var (
+	mutex sync.Mutex
+
+	// requested holds when we asked for invites to channels keyed by
+	// canonicalized channel.
+	requested = map[string]time.Time{}
+)
+
+// Hook fires when an IRC message of some kind occurs.
+func Hook(c *godrop.Client, m irc.Message) {
+	switch m.Command {
+	case "473":
+		// ERR_INVITEONLYCHAN: <me> <channel> :Cannot join channel (+i)
+		if len(m.Params) >= 2 {
+			requestInvite(c, m.Params[1])
+		}
+	case "INVITE":
+		// :inviter INVITE <nick> <channel>
+		if len(m.Params) >= 2 &&
+			godrop.Canonicalize(m.Params[0]) == godrop.Canonicalize(c.GetNick()) {
+			acceptInvite(c, m.Params[1])
+		}
+	case "710":
+		// RPL_KNOCK: <me> <channel> <nick!user@host> :has asked for an invite
+		if len(m.Params) >= 3 {
+			handleKnock(c, m.Params[1], m.Params[2])
+		}
+	}
+}
+
+// requestInvite asks for an invite to a channel we couldn't join.
+func requestInvite(c *godrop.Client, channel string) {
+	mutex.Lock()
+	if t, ok := requested[godrop.Canonicalize(channel)]; ok &&
+		time.Since(t) < requestInterval {
+		mutex.Unlock()
+		return
+	}
+	requested[godrop.Canonicalize(channel)] = time.Now()
+	mutex.Unlock()
+
+	var err error
+	switch strings.ToLower(c.Conf().GetString("invite-request")) {
+	case "", "chanserv":
+		err = c.Message("ChanServ", "INVITE "+channel)
+	case "knock":
+		err = c.Knock(channel, "")
+	default:
+		return
+	}
+	if err != nil {
+		c.PluginError("invite", fmt.Errorf("unable to ask for an invite to %s: %s",
+			channel, err))
+	}
+}
+
+// acceptInvite joins a channel we were invited to if we want to be on it.
+func acceptInvite(c *godrop.Client, channel string) {
+	mutex.Lock()
+	_, ok := requested[godrop.Canonicalize(channel)]
+	delete(requested, godrop.Canonicalize(channel))
+	mutex.Unlock()
+
+	ch, autojoin := c.AutojoinChannel(channel)
+	if !ok && !autojoin {
+		return
+	}
+
+	if err := c.JoinWithKey(channel, ch.Key); err != nil {
+		c.PluginError("invite", fmt.Errorf("unable to join %s: %s", channel, err))
+	}
+}
+
+// handleKnock invites someone who knocked if they're allowed. Otherwise we
+// tell the channel's operators.
+func handleKnock(c *godrop.Client, channel, mask string) {
+	if !c.IsOp(channel) {
+		return
+	}
+
+	m := irc.Message{Prefix: mask}
+	nick := godrop.SourceNick(m)
+
+	if c.Identify(m).MatchesAny(c.Conf()["invite-allow"]) {
+		if err := c.Invite(nick, channel); err != nil {
+			c.PluginError("invite", fmt.Errorf("unable to invite %s to %s: %s",
+				nick, channel, err))
+		}
+		return
+	}
+
+	_ = c.Send(irc.Message{
+		Command: "NOTICE",
+		Params: []string{"@" + channel, fmt.Sprintf(
+			"%s asked for an invite to %s. Use !invite %s to let them in.", mask,
+			channel, nick)},
+	}, godrop.PriorityNormal)
+}
+
+// triggerInvite handles !invite
+func triggerInvite(c *godrop.Client, m irc.Message, args []string) error {
+	target := godrop.ReplyTarget(m)
+	source := godrop.SourceNick(m)
+
+	channel := m.Params[0]
+	if !godrop.IsChannel(channel) {
+		if len(args) != 2 {
+			return c.Message(target, "Usage: !invite <nick> <channel>")
+		}
+		channel = args[1]
+	} else if len(args) != 1 {
+		return c.Message(target, "Usage: !invite <nick>")
+	}
+	nick := args[0]
+
+	member, _ := c.Member(channel, source)
+	if !c.IsAdmin(m) && !member.IsOp() &&
+		!c.Identify(m).MatchesAny(c.Conf()["invite-trusted"]) {
+		return c.Message(target, fmt.Sprintf(
+			"%s: Only administrators and trusted people may do that.", source))
+	}
+
+	if !c.IsOp(channel) {
+		return c.Message(target, fmt.Sprintf("%s: I'm not an operator on %s.",
+			source, channel))
+	}
+
+	if err := c.Invite(nick, channel); err != nil {
+		return c.Message(target, fmt.Sprintf("%s: Unable to invite %s: %s", source,
+			nick, err))
+	}
+
+	return c.Message(target, fmt.Sprintf("%s: Invited %s to %s.", source, nick,
+		channel))
+}
+
+func checkRequest(value string) error {
+	switch strings.ToLower(value) {
+	case "chanserv", "knock", "none":
+		return nil
+	}
+	return fmt.Errorf("expected chanserv, knock, or none")
+}
@@ -0,0 +1,589 @@
+// Package klines keeps track of K-Lines and D-Lines so they don't outlive
+// their welcome.
+//
+// We record the bans we set and the ones operators set (from server notices).
+// Before a ban expires we remind the staff channel, and when it's up we can
+// remove it. ircd-ratbox forgets temporary bans when it restarts, so we set
+// permanent ones and remove them ourselves.
+//
+// Usage:
+// - !kline <duration> <user@host> <reason> - Set a K-Line. Duration is
+//   something like 1h or 2d, or perm for one that doesn't expire.
+// - !dline <duration> <ip> <reason> - Set a D-Line.
+// - !unkline <mask> - Remove a K-Line or D-Line.
+// - !klines - List the bans we know about.
+//
+// Only administrators and people matching klines-trusted may use these. We
+// must be an operator (see the oper plugin).
+//
+// Configuration options:
+// - klines-channel - The staff channel to remind. Required.
+// - klines-trusted - Space separated nick!user@host masks and $a:account
+//   entries for people who may use the commands in addition to
+//   administrators.
+// - klines-opers - Space separated nick!user@host masks of operators whose
+//   bans we record from server notices. Default all operators.
+// - klines-remind - How long before a ban expires to remind the channel.
+//   Default 10m.
+// - klines-auto-remove - Whether to remove bans when they expire. Default
+//   true. If false we only say they're up.
+//
+// The server notices are ircd-ratbox specific. Bans are kept in persistent
+// storage. This requires storage-file to be set.
+package klines
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/horgh/godrop"
+	"github.com/horgh/irc"
+)
+
+func init() {
+	godrop.Register("klines", Hook)
+	godrop.RegisterConfig("klines",
+		godrop.ConfigKey{Name: "storage-file", Required: true},
+		godrop.ConfigKey{Name: "klines-channel", Required: true},
+		godrop.ConfigKey{Name: "klines-trusted"},
+		godrop.ConfigKey{Name: "klines-opers"},
+		godrop.ConfigKey{Name: "klines-remind", Kind: godrop.ConfigDuration},
+		godrop.ConfigKey{Name: "klines-auto-remove", Kind: godrop.ConfigBool},
+	)
+	godrop.RegisterCommand("klines", godrop.Command{
+		Name:    "kline",
+		Usage:   "<duration> <user@host> <reason>",
+		Help:    "Set a K-Line.",
+		MinArgs: 3,
+		Run:     trusted(triggerKline),
+	})
+	godrop.RegisterCommand("klines", godrop.Command{
+		Name:    "dline",
+		Usage:   "<duration> <ip> <reason>",
+		Help:    "Set a D-Line.",
+		MinArgs: 3,
+		Run:     trusted(triggerDline),
+	})
+	godrop.RegisterCommand("klines", godrop.Command{
+		Name:    "unkline",
+		Usage:   "<mask>",
+		Help:    "Remove a K-Line or D-Line.",
+		MinArgs: 1,
+		Run:     trusted(triggerRemove),
+	})
+	godrop.RegisterCommand("klines", godrop.Command{
+		Name: "klines",
+		Help: "List the bans we know about.",
+		Run:  trusted(triggerList),
+	})
+}
+
+// addedRE and removedRE match ircd-ratbox's notices about bans, such as:
+// *** Notice -- nick!user@host{server} added temporary 60 min. K-Line for
+// [*@192.0.2.1] [spam]
+// *** Notice -- nick!user@host{server} has removed the K-Line for:
+// [*@192.0.2.1]
+var addedRE = regexp.MustCompile(`^\*\*\* Notice -- (\S+) added ` +
+	`(?:temporary (\d+) min\. )?([KD])-Line for \[([^\]]+)\] \[(.*)\]$`)
+var removedRE = regexp.MustCompile(`^\*\*\* Notice -- (\S+) has removed the ` +
+	`(?:temporary )?([KD])-Line for: \[([^\]]+)\]$`)
+
+const (
+	// bucket is the storage bucket holding bans keyed by kind and lowercased
+	// mask.
+	bucket = "klines"
+
+	defaultRemind = 10 * time.Minute
+)
+
+// Ban is a K-Line or D-Line.
+type Ban struct {
+	// Kind is K or D.
+	Kind   string
+	Mask   string
+	Reason string
+	SetBy  string
+	Set    time.Time
+
+	// Expires is when the ban should end. It's zero if it doesn't.
+	Expires time.Time
+
+	// Temporary is true if the server expires the ban itself.
+	Temporary bool
+
+	// Reminded is true once we've reminded the channel it's expiring.
+	Reminded bool
+}
+
+// key is the ban's storage key.
+func (b Ban) key() string {
+	return b.Kind + ":" + strings.ToLower(b.Mask)
+}
+
+// name describes the kind of ban.
+func (b Ban) name() string {
+	return b.Kind + "-Line"
+}
+
+var (
+	mutex sync.Mutex
+
+	// scheduled holds the checks we've scheduled keyed by client and ban key.
+	// Each client schedules its own since a client that's shut down doesn't
+	// run them.
+	scheduled = map[scheduleKey]*time.Timer{}
+)
+
+// scheduleKey identifies a check a client scheduled.
+type scheduleKey struct {
+	c   *godrop.Client
+	key string
+}
+
+// Hook fires when an IRC message of some kind occurs.
+func Hook(c *godrop.Client, m irc.Message) {
+	// We can only remove bans as an operator, so wait until we are one. We do
+	// this each time we oper.
+	if m.Command == irc.ReplyYoureOper {
+		restoreBans(c)
+		return
+	}
+
+	if m.Command == "NOTICE" && len(m.Params) == 2 &&
+		!strings.Contains(m.Prefix, "!") {
+		serverNotice(c, m.Params[1])
+	}
+}
+
+// serverNotice records bans operators add and forgets ones they remove.
+func serverNotice(c *godrop.Client, notice string) {
+	if matches := addedRE.FindStringSubmatch(notice); matches != nil {
+		setBy := operName(matches[1])
+		if !fromOper(c, setBy) {
+			return
+		}
+
+		b := Ban{
+			Kind:   matches[3],
+			Mask:   matches[4],
+			Reason: matches[5],
+			SetBy:  setBy,
+			Set:    time.Now(),
+		}
+		if matches[2] != "" {
+			minutes, err := strconv.Atoi(matches[2])
+			if err != nil {
+				return
+			}
+			b.Expires = b.Set.Add(time.Duration(minutes) * time.Minute)
+			b.Temporary = true
+		}
+
+		// If we set it, we already know about it and when it should expire.
+		if _, ok, err := getBan(c, b.key()); err != nil || ok {
+			if err != nil {
+				c.PluginError("klines", err)
+			}
+			return
+		}
+
+		if err := putBan(c, b); err != nil {
+			c.PluginError("klines", err)
+			return
+		}
+		schedule(c, b)
+		return
+	}
+
+	if matches := removedRE.FindStringSubmatch(notice); matches != nil {
+		b := Ban{Kind: matches[2], Mask: matches[3]}
+		if err := deleteBan(c, b.key()); err != nil {
+			c.PluginError("klines", err)
+		}
+	}
+}
+
+// trusted wraps a command so only administrators and people matching
+// klines-trusted may use it.
+func trusted(run func(*godrop.Client, irc.Message, []string) error) func(
+	*godrop.Client, irc.Message, []string) error {
+	return func(c *godrop.Client, m irc.Message, args []string) error {
+		if !c.IsAdmin(m) &&
+			!c.Identify(m).MatchesAny(c.Conf()["klines-trusted"]) {
+			return c.Message(godrop.ReplyTarget(m), fmt.Sprintf(
+				"%s: Only administrators and trusted people may do that.",
+				godrop.SourceNick(m)))
+		}
+		return run(c, m, args)
+	}
+}
+
+// triggerKline handles !kline
+func triggerKline(c *godrop.Client, m irc.Message, args []string) error {
+	return triggerBan(c, m, "K", args)
+}
+
+// triggerDline handles !dline
+func triggerDline(c *godrop.Client, m irc.Message, args []string) error {
+	return triggerBan(c, m, "D", args)
+}
+
+// triggerBan sets a ban of the kind, K or D.
+func triggerBan(c *godrop.Client, m irc.Message, kind string,
+	args []string) error {
+	target := godrop.ReplyTarget(m)
+	source := godrop.SourceNick(m)
+
+	b := Ban{
+		Kind:   kind,
+		Mask:   args[1],
+		Reason: strings.Join(args[2:], " "),
+		SetBy:  m.Prefix,
+		Set:    time.Now(),
+	}
+
+	if !strings.EqualFold(args[0], "perm") {
+		d, err := godrop.ParseDuration(args[0])
+		if err != nil || d <= 0 {
+			return c.Message(target, fmt.Sprintf(
+				"%s: Invalid duration %s, try something like 1h or 2d.", source,
+				args[0]))
+		}
+		b.Expires = b.Set.Add(d)
+	}
+
+	command := "KLINE"
+	if kind == "K" {
+		if !strings.Contains(b.Mask, "@") {
+			b.Mask = "*@" + b.Mask
+		}
+	} else {
+		command = "DLINE"
+		if net.ParseIP(b.Mask) == nil {
+			if _, _, err := net.ParseCIDR(b.Mask); err != nil {
+				return c.Message(target, fmt.Sprintf("%s: %s is not an IP or CIDR.",
+					source, b.Mask))
+			}
+		}
+	}
+
+	if err := putBan(c, b); err != nil {
+		return c.Message(target, fmt.Sprintf("%s: Unable to record the %s: %s",
+			source, b.name(), err))
+	}
+
+	if err := c.Send(irc.Message{
+		Command: command,
+		Params:  []string{b.Mask, b.Reason},
+	}, godrop.PriorityHigh); err != nil {
+		_ = deleteBan(c, b.key())
+		return c.Message(target, fmt.Sprintf("%s: Unable to set the %s: %s", source,
+			b.name(), err))
+	}
+
+	schedule(c, b)
+
+	return c.Message(target, fmt.Sprintf("%s: Set a %s on %s%s.", source,
+		b.name(), b.Mask, describeExpiry(c.ChannelSettings(target), b)))
+}
+
+// triggerRemove handles !unkline
+func triggerRemove(c *godrop.Client, m irc.Message, args []string) error {
+	target := godrop.ReplyTarget(m)
+	source := godrop.SourceNick(m)
+
+	if len(args) != 1 {
+		return c.Message(target, "Usage: !unkline <mask>")
+	}
+
+	b, ok := findBan(c, args[0])
+	if !ok {
+		// We don't know about it. Guess what it is from what it looks like.
+		b = Ban{Kind: "K", Mask: args[0]}
+		if !strings.Contains(args[0], "@") {
+			b.Kind = "D"
+		}
+	}
+
+	if err := removeBan(c, b); err != nil {
+		return c.Message(target, fmt.Sprintf("%s: Unable to remove the %s: %s",
+			source, b.name(), err))
+	}
+
+	return c.Message(target, fmt.Sprintf("%s: Removed the %s on %s.", source,
+		b.name(), b.Mask))
+}
+
+// triggerList handles !klines
+func triggerList(c *godrop.Client, m irc.Message, args []string) error {
+	target := godrop.ReplyTarget(m)
+
+	bans, err := getAllBans(c)
+	if err != nil {
+		return c.Message(target, fmt.Sprintf("Unable to look up bans: %s", err))
+	}
+
+	if len(bans) == 0 {
+		return c.Message(target, "I don't know about any bans.")
+	}
+
+	settings := c.ChannelSettings(target)
+	for _, b := range bans {
+		_ = c.MessageWithPriority(target, fmt.Sprintf("%s on %s by %s: %s%s",
+			b.name(), b.Mask, godrop.SourceNick(irc.Message{Prefix: b.SetBy}),
+			b.Reason, describeExpiry(settings, b)), godrop.PriorityLow)
+	}
+	return nil
+}
+
+// describeExpiry says when a ban expires.
+func describeExpiry(settings godrop.ChannelSettings, b Ban) string {
+	if b.Expires.IsZero() {
+		return " (permanent)"
+	}
+	return fmt.Sprintf(" (expires %s, in %s)", settings.FormatTime(b.Expires),
+		time.Until(b.Expires).Round(time.Minute))
+}
+
+// restoreBans schedules every stored ban.
+func restoreBans(c *godrop.Client) {
+	bans, err := getAllBans(c)
+	if err != nil {
+		c.PluginError("klines", fmt.Errorf("unable to restore bans: %s", err))
+		return
+	}
+
+	for _, b := range bans {
+		schedule(c, b)
+	}
+}
+
+// schedule arranges to check the ban when it's time to remind the channel
+// about it or it expires.
+func schedule(c *godrop.Client, b Ban) {
+	if b.Expires.IsZero() {
+		return
+	}
+
+	at := b.Expires
+	if !b.Reminded {
+		at = b.Expires.Add(-remindBefore(c.Conf()))
+	}
+
+	d := time.Until(at)
+	if d < 0 {
+		d = 0
+	}
+
+	key := b.key()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if t, ok := scheduled[scheduleKey{c, key}]; ok {
+		t.Stop()
+	}
+	scheduled[scheduleKey{c, key}] = c.After("klines", d,
+		func(c *godrop.Client) {
+			check(c, key)
+		})
+}
+
+// check reminds the channel about a ban or removes it as appropriate.
+func check(c *godrop.Client, key string) {
+	mutex.Lock()
+	delete(scheduled, scheduleKey{c, key})
+	mutex.Unlock()
+
+	// Look it up again in case it was removed.
+	b, ok, err := getBan(c, key)
+	if err != nil {
+		c.PluginError("klines", err)
+		return
+	}
+	if !ok || b.Expires.IsZero() {
+		return
+	}
+
+	channel := c.Conf().GetString("klines-channel")
+
+	if time.Now().Before(b.Expires) {
+		if !b.Reminded {
+			if err := c.Message(channel, fmt.Sprintf(
+				"The %s on %s (%s) expires in %s.", b.name(), b.Mask, b.Reason,
+				time.Until(b.Expires).Round(time.Minute))); err != nil {
+				// We'll try again next time we oper.
+				return
+			}
+			b.Reminded = true
+			if err := putBan(c, b); err != nil {
+				c.PluginError("klines", err)
+				return
+			}
+		}
+		schedule(c, b)
+		return
+	}
+
+	if b.Temporary {
+		_ = c.Message(channel, fmt.Sprintf("The %s on %s has expired.", b.name(),
+			b.Mask))
+		if err := deleteBan(c, key); err != nil {
+			c.PluginError("klines", err)
+		}
+		return
+	}
+
+	if !autoRemove(c.Conf()) {
+		_ = c.Message(channel, fmt.Sprintf("The %s on %s is up. Remove it with "+
+			"!unkline %s.", b.name(), b.Mask, b.Mask))
+		if err := deleteBan(c, key); err != nil {
+			c.PluginError("klines", err)
+		}
+		return
+	}
+
+	if err := removeBan(c, b); err != nil {
+		c.PluginError("klines", fmt.Errorf("unable to remove the %s on %s: %s",
+			b.name(), b.Mask, err))
+		return
+	}
+	_ = c.Message(channel, fmt.Sprintf("Removed the expired %s on %s.",
+		b.name(), b.Mask))
+}
+
+// removeBan sends UNKLINE or UNDLINE and forgets the ban.
+func removeBan(c *godrop.Client, b Ban) error {
+	command := "UNKLINE"
+	if b.Kind == "D" {
+		command = "UNDLINE"
+	}
+
+	if err := c.Send(irc.Message{
+		Command: command,
+		Params:  []string{b.Mask},
+	}, godrop.PriorityHigh); err != nil {
+		return err
+	}
+
+	mutex.Lock()
+	if t, ok := scheduled[scheduleKey{c, b.key()}]; ok {
+		t.Stop()
+		delete(scheduled, scheduleKey{c, b.key()})
+	}
+	mutex.Unlock()
+
+	return deleteBan(c, b.key())
+}
+
+// findBan looks up a ban by its mask.
+func findBan(c *godrop.Client, mask string) (Ban, bool) {
+	for _, kind := range []string{"K", "D"} {
+		b, ok, err := getBan(c, Ban{Kind: kind, Mask: mask}.key())
+		if err == nil && ok {
+			return b, true
+		}
+	}
+	return Ban{}, false
+}
+
+func getBan(c *godrop.Client, key string) (Ban, bool, error) {
+	store, err := c.Storage()
+	if err != nil {
+		return Ban{}, false, err
+	}
+
+	var b Ban
+	ok, err := store.Get(bucket, key, &b)
+	if err != nil {
+		return Ban{}, false, fmt.Errorf("unable to look up ban %s: %s", key, err)
+	}
+	return b, ok, nil
+}
+
+func getAllBans(c *godrop.Client) ([]Ban, error) {
+	store, err := c.Storage()
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := store.Keys(bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	var bans []Ban
+	for _, key := range keys {
+		var b Ban
+		if _, err := store.Get(bucket, key, &b); err != nil {
+			return nil, err
+		}
+		bans = append(bans, b)
+	}
+
+	return bans, nil
+}
+
+func putBan(c *godrop.Client, b Ban) error {
+	store, err := c.Storage()
+	if err != nil {
+		return err
+	}
+
+	if err := store.Put(bucket, b.key(), b); err != nil {
+		return fmt.Errorf("unable to store ban %s: %s", b.key(), err)
+	}
+	return nil
+}
+
+func deleteBan(c *godrop.Client, key string) error {
+	store, err := c.Storage()
+	if err != nil {
+		return err
+	}
+
+	if err := store.Delete(bucket, key); err != nil {
+		return fmt.Errorf("unable to delete ban %s: %s", key, err)
+	}
+	return nil
+}
+
+// operName removes the server from an operator's name, such as
+// nick!user@host{server}.
+func operName(name string) string {
+	if i := strings.Index(name, "{"); i != -1 {
+		return name[:i]
+	}
+	return name
+}
+
+// fromOper checks whether we record bans set by the operator.
+func fromOper(c *godrop.Client, name string) bool {
+	opers := c.Conf().GetStringSlice("klines-opers")
+	if len(opers) == 0 {
+		return true
+	}
+	for _, mask := range opers {
+		if godrop.MatchMask(mask, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func remindBefore(config godrop.Config) time.Duration {
+	d := config.GetDuration("klines-remind", defaultRemind)
+	if d < 0 {
+		return defaultRemind
+	}
+	return d
+}
+
+func autoRemove(config godrop.Config) bool {
+	return config.GetBool("klines-auto-remove", true)
+}
@@ -0,0 +1,208 @@
+package godrop
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+const (
+	// lagCheckInterval is how often we ping the server to measure lag.
+	lagCheckInterval = time.Minute
+
+	// lagPingPrefix starts the token we ping with so we recognize the reply.
+	lagPingPrefix = "godrop-lag-"
+
+	// lagThreshold is how much lag is normal. Beyond this we slow down sending.
+	lagThreshold = 2 * time.Second
+
+	// maxSendInterval is the slowest we'll send queued messages.
+	maxSendInterval = 10 * time.Second
+
+	// echoTimeout is how long we wait for the server to echo a message back.
+	// If it doesn't by then we assume it never will. For example, we might not
+	// be allowed to send to the channel.
+	echoTimeout = time.Minute
+)
+
+// lagState tracks how lagged our connection is.
+type lagState struct {
+	// lag is the most recent measurement.
+	lag time.Duration
+
+	// pingSent is when we sent the ping we're waiting on a reply to. It's zero
+	// if we're not waiting.
+	pingSent time.Time
+
+	// echoSent holds when we sent each message we're waiting for the server
+	// to echo back, oldest first.
+	echoSent []time.Time
+}
+
+// Lag returns how lagged our connection to the server is.
+//
+// We measure this by pinging the server periodically. If the server supports
+// echo-message we also measure how long our messages take to come back.
+func (c *Client) Lag() time.Duration {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.currentLag(time.Now())
+}
+
+// currentLag returns the lag. If a ping is outstanding longer than the last
+// measurement, we're at least that lagged.
+//
+// The caller must hold the mutex.
+func (c *Client) currentLag(now time.Time) time.Duration {
+	lag := c.lag.lag
+	if !c.lag.pingSent.IsZero() {
+		if d := now.Sub(c.lag.pingSent); d > lag {
+			lag = d
+		}
+	}
+	return lag
+}
+
+// sendDelay decides how long to wait between queued messages given how long
+// we'd wait if we weren't lagged. The more lagged we are, the slower we go.
+// Otherwise messages pile up in the server's send queue for us and it may
+// disconnect us.
+func (c *Client) sendDelay(interval time.Duration) time.Duration {
+	lag := c.Lag()
+	if lag <= lagThreshold {
+		return interval
+	}
+
+	d := time.Duration(float64(interval) * float64(lag) /
+		float64(lagThreshold))
+	if d > maxSendInterval {
+		return maxSendInterval
+	}
+	return d
+}
+
+// lagLoop pings the server periodically until the connection closes.
+func (c *Client) lagLoop(done <-chan struct{}) {
+	for {
+		if err := c.pingForLag(); err != nil {
+			c.Log().Warn("Unable to check lag", "error", err)
+		}
+
+		select {
+		case <-time.After(lagCheckInterval):
+		case <-done:
+			return
+		}
+	}
+}
+
+// startLagCheck starts measuring lag on the current connection.
+func (c *Client) startLagCheck() {
+	c.mutex.Lock()
+	q := c.sendq
+	replaying := c.replaying
+	c.mutex.Unlock()
+
+	if q == nil || replaying {
+		return
+	}
+
+	go c.lagLoop(q.done)
+}
+
+// pingForLag sends a ping to measure lag. If we're still waiting on a reply
+// to the last one we don't send another.
+func (c *Client) pingForLag() error {
+	now := time.Now()
+
+	c.mutex.Lock()
+	if !c.lag.pingSent.IsZero() {
+		c.mutex.Unlock()
+		return nil
+	}
+	c.lag.pingSent = now
+	c.mutex.Unlock()
+
+	token := lagPingPrefix + strconv.FormatInt(now.UnixNano(), 10)
+
+	return c.WriteMessage(irc.Message{
+		Command: "PING",
+		Params:  []string{token},
+	})
+}
+
+// handleLagPong records lag if the message is a reply to one of our pings.
+func (c *Client) handleLagPong(m irc.Message) {
+	if m.Command != "PONG" || len(m.Params) == 0 {
+		return
+	}
+
+	token := m.Params[len(m.Params)-1]
+	if !strings.HasPrefix(token, lagPingPrefix) {
+		return
+	}
+
+	sent, err := strconv.ParseInt(strings.TrimPrefix(token, lagPingPrefix), 10,
+		64)
+	if err != nil {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.lag.lag = time.Since(time.Unix(0, sent))
+	c.lag.pingSent = time.Time{}
+}
+
+// recordEchoSent notes we sent a message the server will echo back.
+func (c *Client) recordEchoSent(line string) {
+	if strings.HasPrefix(line, "@") {
+		i := strings.Index(line, " ")
+		if i == -1 {
+			return
+		}
+		line = line[i+1:]
+	}
+
+	if !strings.HasPrefix(line, "PRIVMSG ") {
+		return
+	}
+
+	if !c.HasCap("echo-message") {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.lag.echoSent = append(c.lag.echoSent, time.Now())
+}
+
+// handleEcho measures how long the server took to echo one of our messages.
+func (c *Client) handleEcho(e Event) {
+	if e.Kind != EventSelfMessage || e.Command != "PRIVMSG" {
+		return
+	}
+
+	now := time.Now()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// Forget messages the server won't echo.
+	for len(c.lag.echoSent) > 0 &&
+		now.Sub(c.lag.echoSent[0]) > echoTimeout {
+		c.lag.echoSent = c.lag.echoSent[1:]
+	}
+
+	if len(c.lag.echoSent) == 0 {
+		return
+	}
+
+	c.lag.lag = now.Sub(c.lag.echoSent[0])
+	c.lag.echoSent = c.lag.echoSent[1:]
+}
@@ -0,0 +1,178 @@
+package godrop
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Logger records what the client and its plugins do.
+//
+// Each method takes a message and then fields as alternating keys and
+// values, such as Info("Joined channel", "channel", "#godrop").
+type Logger interface {
+	// Debug is for detail only useful when tracking down a problem, such as
+	// each raw line we send and receive.
+	Debug(msg string, keyvals ...interface{})
+
+	// Info is for things happening as they should, such as connecting.
+	Info(msg string, keyvals ...interface{})
+
+	// Warn is for problems we can recover from, such as invalid settings we
+	// ignore.
+	Warn(msg string, keyvals ...interface{})
+
+	// Error is for failures, such as being unable to store data.
+	Error(msg string, keyvals ...interface{})
+}
+
+// LogLevel is how important a log message is.
+type LogLevel int
+
+// The log levels from least to most important.
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	}
+	return fmt.Sprintf("LogLevel(%d)", int(l))
+}
+
+// ParseLogLevel parses a level such as debug or info.
+func ParseLogLevel(s string) (LogLevel, error) {
+	for _, l := range []LogLevel{LevelDebug, LevelInfo, LevelWarn,
+		LevelError} {
+		if strings.EqualFold(s, l.String()) {
+			return l, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid log level: %s", s)
+}
+
+// stdLogger is a Logger that writes with the standard log package.
+type stdLogger struct {
+	level LogLevel
+}
+
+// NewLogger creates a Logger that writes messages at the level or above with
+// the standard log package. Lines look like:
+//
+//	INFO Joined channel channel=#godrop
+func NewLogger(level LogLevel) Logger {
+	return stdLogger{level: level}
+}
+
+func (l stdLogger) Debug(msg string, keyvals ...interface{}) {
+	l.log(LevelDebug, msg, keyvals)
+}
+
+func (l stdLogger) Info(msg string, keyvals ...interface{}) {
+	l.log(LevelInfo, msg, keyvals)
+}
+
+func (l stdLogger) Warn(msg string, keyvals ...interface{}) {
+	l.log(LevelWarn, msg, keyvals)
+}
+
+func (l stdLogger) Error(msg string, keyvals ...interface{}) {
+	l.log(LevelError, msg, keyvals)
+}
+
+func (l stdLogger) log(level LogLevel, msg string, keyvals []interface{}) {
+	if level < l.level {
+		return
+	}
+	log.Print(level.String() + " " + msg + formatFields(keyvals))
+}
+
+// formatFields formats fields as key=value pairs, each after a space. We
+// quote values with spaces or quotes.
+func formatFields(keyvals []interface{}) string {
+	var b strings.Builder
+	for i := 0; i < len(keyvals); i += 2 {
+		b.WriteString(" ")
+		b.WriteString(fmt.Sprint(keyvals[i]))
+		b.WriteString("=")
+
+		if i+1 == len(keyvals) {
+			b.WriteString("(missing)")
+			break
+		}
+		v := fmt.Sprint(keyvals[i+1])
+		if v == "" || strings.ContainsAny(v, " \t\r\n\"=") {
+			v = fmt.Sprintf("%q", v)
+		}
+		b.WriteString(v)
+	}
+	return b.String()
+}
+
+// defaultLogger is the Logger clients use unless told otherwise. It doesn't
+// log debug messages, so it doesn't log the raw lines we send and receive.
+var defaultLogger = NewLogger(LevelInfo)
+
+// SetLogger sets the Logger the client and its plugins use. By default they
+// log at LevelInfo and above with the standard log package.
+func (c *Client) SetLogger(l Logger) {
+	c.logMutex.Lock()
+	defer c.logMutex.Unlock()
+
+	c.logger = l
+}
+
+// Log retrieves the client's Logger. Plugins should log with it. If the
+// client is in a Manager, each message says which network it's for.
+//
+// It's safe to call while holding the client's mutex.
+func (c *Client) Log() Logger {
+	c.logMutex.Lock()
+	defer c.logMutex.Unlock()
+
+	l := c.logger
+	if l == nil {
+		l = defaultLogger
+	}
+	if c.network == "" {
+		return l
+	}
+	return networkLogger{logger: l, network: c.network}
+}
+
+// networkLogger adds the network to each message.
+type networkLogger struct {
+	logger  Logger
+	network string
+}
+
+func (l networkLogger) Debug(msg string, keyvals ...interface{}) {
+	l.logger.Debug(msg, append(keyvals[:len(keyvals):len(keyvals)], "network",
+		l.network)...)
+}
+
+func (l networkLogger) Info(msg string, keyvals ...interface{}) {
+	l.logger.Info(msg, append(keyvals[:len(keyvals):len(keyvals)], "network",
+		l.network)...)
+}
+
+func (l networkLogger) Warn(msg string, keyvals ...interface{}) {
+	l.logger.Warn(msg, append(keyvals[:len(keyvals):len(keyvals)], "network",
+		l.network)...)
+}
+
+func (l networkLogger) Error(msg string, keyvals ...interface{}) {
+	l.logger.Error(msg, append(keyvals[:len(keyvals):len(keyvals)], "network",
+		l.network)...)
+}
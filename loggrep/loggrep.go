@@ -0,0 +1,228 @@
+// Package loggrep searches what was said on a channel.
+//
+// Usage:
+// - !grep [-n count] [-d age] <pattern> - Show messages on the channel
+//   matching the pattern, a case insensitive regular expression.
+// - !lastlog [-n count] [-d age] <nick> - Show what someone said on the
+//   channel. This includes what they said using nicks they recently changed
+//   from.
+//
+// -n limits how many messages to show. The default is 5 and the most is 20.
+// -d shows only messages newer than the age, such as 30m or 2h.
+//
+// We search the channel's logs if the chanlog plugin writes them. Otherwise we
+// search the messages the client remembers for the channel. How many it
+// remembers is set by history-size. Results go to the person asking rather
+// than the channel. If there are more than a few and a paste service is set
+// up (see the paste plugin), we send a link to them instead.
+package loggrep
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/horgh/godrop"
+	"github.com/horgh/godrop/chanlog"
+	"github.com/horgh/irc"
+)
+
+func init() {
+	godrop.Register("loggrep", nil)
+	godrop.RegisterCommand("loggrep", godrop.Command{
+		Name:  "grep",
+		Usage: "[-n count] [-d age] <pattern>",
+		Help:  "Search what was recently said on the channel.",
+		Run:   triggerGrep,
+	})
+	godrop.RegisterCommand("loggrep", godrop.Command{
+		Name:  "lastlog",
+		Usage: "[-n count] [-d age] <nick>",
+		Help:  "Show what someone recently said on the channel.",
+		Run:   triggerLastlog,
+	})
+}
+
+const (
+	defaultCount = 5
+	maxCount     = 20
+
+	// maxLines is how many results we send as messages. If there are more, we
+	// paste them if we can.
+	maxLines = 5
+)
+
+// errUsage means the person didn't say what to search for.
+var errUsage = fmt.Errorf("nothing to search for")
+
+// options are what the person asked for.
+type options struct {
+	count int
+	age   time.Duration
+	arg   string
+}
+
+// triggerGrep handles !grep
+func triggerGrep(c *godrop.Client, m irc.Message, args []string) error {
+	return triggerSearch(c, m, true)
+}
+
+// triggerLastlog handles !lastlog
+func triggerLastlog(c *godrop.Client, m irc.Message, args []string) error {
+	return triggerSearch(c, m, false)
+}
+
+// triggerSearch searches the channel's history. If grep is true we match a
+// pattern, and otherwise a nick.
+func triggerSearch(c *godrop.Client, m irc.Message, grep bool) error {
+	channel := m.Params[0]
+	nick := godrop.SourceNick(m)
+
+	if !godrop.IsChannel(channel) {
+		return c.Message(nick, "Use this on a channel.")
+	}
+
+	opts, err := parseOptions(c.CommandText(m))
+	if err == errUsage {
+		return c.Message(nick, "Usage: !grep [-n count] [-d age] <pattern> or "+
+			"!lastlog [-n count] [-d age] <nick>")
+	}
+	if err != nil {
+		return c.Message(nick, fmt.Sprintf("Unable to search: %s", err))
+	}
+
+	var match func(godrop.Event) bool
+	if grep {
+		re, err := regexp.Compile("(?i)" + opts.arg)
+		if err != nil {
+			return c.Message(nick, fmt.Sprintf("Invalid pattern: %s", err))
+		}
+		match = func(e godrop.Event) bool { return re.MatchString(e.Params[1]) }
+	} else {
+		nicks := append([]string{opts.arg}, c.PreviousNicks(opts.arg)...)
+		match = func(e godrop.Event) bool {
+			for _, n := range nicks {
+				if godrop.Canonicalize(godrop.SourceNick(e.Message)) ==
+					godrop.Canonicalize(n) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+
+	results, err := search(c, channel, opts, match)
+	if err != nil {
+		return fmt.Errorf("unable to search: %s", err)
+	}
+	if len(results) == 0 {
+		return c.Message(nick, fmt.Sprintf("Nothing found on %s.", channel))
+	}
+
+	settings := c.ChannelSettings(channel)
+	var lines []string
+	for _, e := range results {
+		lines = append(lines, fmt.Sprintf("[%s] <%s> %s",
+			settings.FormatTime(e.Time), godrop.SourceNick(e.Message),
+			e.Params[1]))
+	}
+
+	if len(lines) > maxLines {
+		if url, err := c.Paste(strings.Join(lines, "\n")); err == nil {
+			return c.Message(nick, fmt.Sprintf("%d messages on %s: %s", len(lines),
+				channel, url))
+		}
+	}
+
+	for _, line := range lines {
+		_ = c.Message(nick, line)
+	}
+	return nil
+}
+
+// parseOptions parses the arguments.
+func parseOptions(args string) (options, error) {
+	opts := options{count: defaultCount}
+
+	fields := strings.Fields(args)
+	for len(fields) > 1 && (fields[0] == "-n" || fields[0] == "-d") {
+		switch fields[0] {
+		case "-n":
+			n, err := strconv.Atoi(fields[1])
+			if err != nil || n < 1 {
+				return opts, fmt.Errorf("invalid count: %s", fields[1])
+			}
+			if n > maxCount {
+				n = maxCount
+			}
+			opts.count = n
+		case "-d":
+			d, err := time.ParseDuration(fields[1])
+			if err != nil || d <= 0 {
+				return opts, fmt.Errorf("invalid age %s, try something like 2h",
+					fields[1])
+			}
+			opts.age = d
+		}
+		fields = fields[2:]
+	}
+
+	opts.arg = strings.Join(fields, " ")
+	if opts.arg == "" {
+		return opts, errUsage
+	}
+
+	return opts, nil
+}
+
+// search finds the most recent messages on the channel that match. They're
+// oldest first.
+//
+// We search the channel's logs if chanlog writes them, and otherwise the
+// messages the client remembers.
+func search(c *godrop.Client, channel string, opts options,
+	match func(godrop.Event) bool) ([]godrop.Event, error) {
+	var results []godrop.Event
+	visit := func(e godrop.Event) bool {
+		if e.Command != "PRIVMSG" || len(e.Params) != 2 {
+			return true
+		}
+
+		if opts.age > 0 && time.Since(e.Time) > opts.age {
+			return false
+		}
+
+		// Don't find searches.
+		if name, _, ok := c.ParseCommand(e.Params[1]); ok &&
+			(name == "grep" || name == "lastlog") {
+			return true
+		}
+
+		if match(e) {
+			results = append(results, e)
+		}
+		return len(results) < opts.count
+	}
+
+	if chanlog.Logs(c, channel) {
+		var since time.Time
+		if opts.age > 0 {
+			since = time.Now().Add(-opts.age)
+		}
+		if err := chanlog.Messages(c, channel, since, visit); err != nil {
+			return nil, err
+		}
+	} else {
+		history := c.History(channel, math.MaxInt32)
+		for i := len(history) - 1; i >= 0 && visit(history[i]); i-- {
+		}
+	}
+
+	for i, j := 0, len(results)-1; i < j; i, j = i+1, j-1 {
+		results[i], results[j] = results[j], results[i]
+	}
+	return results, nil
+}
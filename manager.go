@@ -0,0 +1,196 @@
+package godrop
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Manager runs several clients, such as one for each network, and keeps them
+// running.
+//
+// Each client has its own config and plugins (see SetPlugins), so a plugin
+// can run on one network and not another. Plugins can reach the other
+// clients with Manager, such as to relay messages between networks.
+type Manager struct {
+	mutex sync.Mutex
+
+	// clients holds the clients keyed by network name.
+	clients map[string]*Client
+
+	// ctx is the context Run is running with, if it is. Clients added while
+	// it's running start right away. wg tracks the running clients.
+	ctx context.Context
+	wg  sync.WaitGroup
+}
+
+// managerRestartDelay is how long we wait before running a client again
+// after it gives up reconnecting.
+const managerRestartDelay = 10 * time.Minute
+
+// NewManager creates a Manager with no clients.
+func NewManager() *Manager {
+	return &Manager{clients: map[string]*Client{}}
+}
+
+// Add adds a client for the network. The name is how plugins find the client
+// with Client. If Run is running, the client starts right away.
+//
+// It returns an error if there is already a client for the network or the
+// client belongs to another Manager.
+func (m *Manager) Add(network string, c *Client) error {
+	if network == "" {
+		return fmt.Errorf("network name is blank")
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.clients[network]; ok {
+		return fmt.Errorf("network %s already has a client", network)
+	}
+
+	c.mutex.Lock()
+	if c.manager != nil {
+		c.mutex.Unlock()
+		return fmt.Errorf("client already belongs to a manager")
+	}
+	c.manager = m
+	c.mutex.Unlock()
+
+	c.logMutex.Lock()
+	c.network = network
+	c.logMutex.Unlock()
+
+	m.clients[network] = c
+	if m.ctx != nil {
+		m.start(m.ctx, network, c)
+	}
+	return nil
+}
+
+// Client looks up the client for a network. It reports whether there is one.
+func (m *Manager) Client(network string) (*Client, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	c, ok := m.clients[network]
+	return c, ok
+}
+
+// Networks lists the names of the networks sorted.
+func (m *Manager) Networks() []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var networks []string
+	for network := range m.clients {
+		networks = append(networks, network)
+	}
+	sort.Strings(networks)
+	return networks
+}
+
+// Message sends a message to a channel or nick on a network. Plugins use it
+// to relay between networks.
+func (m *Manager) Message(network, target, message string) error {
+	c, ok := m.Client(network)
+	if !ok {
+		return fmt.Errorf("unknown network: %s", network)
+	}
+	return c.Message(target, message)
+}
+
+// Run runs each client with RunContext until it quits. If a client gives up
+// reconnecting, we log it and run it again after managerRestartDelay.
+//
+// It returns once every client quits or the context is done. If the context
+// is done, it returns its error.
+func (m *Manager) Run(ctx context.Context) error {
+	m.mutex.Lock()
+	if m.ctx != nil {
+		m.mutex.Unlock()
+		return fmt.Errorf("manager is already running")
+	}
+	m.ctx = ctx
+	for network, c := range m.clients {
+		m.start(ctx, network, c)
+	}
+	m.mutex.Unlock()
+
+	m.wg.Wait()
+
+	m.mutex.Lock()
+	m.ctx = nil
+	m.mutex.Unlock()
+
+	return ctx.Err()
+}
+
+// Quit tells each client to quit.
+func (m *Manager) Quit(message string) {
+	m.mutex.Lock()
+	var clients []*Client
+	for _, c := range m.clients {
+		clients = append(clients, c)
+	}
+	m.mutex.Unlock()
+
+	for _, c := range clients {
+		if err := c.Quit(message); err != nil {
+			c.Log().Error("Unable to quit", "error", err)
+		}
+	}
+}
+
+// start runs the client in its own goroutine.
+//
+// The caller must hold the mutex.
+func (m *Manager) start(ctx context.Context, network string, c *Client) {
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		m.run(ctx, network, c)
+	}()
+}
+
+// run runs the client until it quits or the context is done.
+func (m *Manager) run(ctx context.Context, network string, c *Client) {
+	for {
+		err := c.RunContext(ctx)
+		if err == nil || ctx.Err() != nil {
+			return
+		}
+
+		c.Log().Error("Network stopped. Running it again later", "error", err,
+			"delay", managerRestartDelay)
+		select {
+		case <-time.After(managerRestartDelay):
+		case <-ctx.Done():
+			return
+		}
+		if c.isQuitting() {
+			return
+		}
+	}
+}
+
+// Manager retrieves the Manager running the client. It's nil if the client
+// isn't in one.
+func (c *Client) Manager() *Manager {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.manager
+}
+
+// Network retrieves the name of the client's network in its Manager. It's
+// blank if the client isn't in one.
+func (c *Client) Network() string {
+	c.logMutex.Lock()
+	defer c.logMutex.Unlock()
+
+	return c.network
+}
@@ -0,0 +1,34 @@
+package godrop
+
+import (
+	"strings"
+
+	"github.com/horgh/irc"
+)
+
+// SourceNick retrieves the nick from a message's prefix.
+//
+// If the prefix has no nick portion (such as when it is a server name), we
+// return the entire prefix.
+func SourceNick(m irc.Message) string {
+	if i := strings.Index(m.Prefix, "!"); i != -1 {
+		return m.Prefix[:i]
+	}
+	return m.Prefix
+}
+
+// IsChannel checks whether the target is a channel name.
+func IsChannel(target string) bool {
+	return strings.IndexAny(target, "#&+!") == 0
+}
+
+// ReplyTarget determines where to send a reply to a PRIVMSG or NOTICE.
+//
+// For messages sent to a channel this is the channel. For private messages
+// this is the sender.
+func ReplyTarget(m irc.Message) string {
+	if len(m.Params) > 0 && IsChannel(m.Params[0]) {
+		return m.Params[0]
+	}
+	return SourceNick(m)
+}
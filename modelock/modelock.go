@@ -0,0 +1,223 @@
+// Package modelock keeps channels' modes the way they're meant to be.
+//
+// Each channel may have a mode lock such as +nt-k. When someone changes the
+// channel's modes so they don't match and we're a channel operator, we
+// change them back.
+//
+// Configuration options:
+// - modelock - Space separated channel=modes pairs, such as #example=+nt-k.
+//   Locks may set modes that don't take a parameter and unset any mode
+//   except lists such as b.
+// - modelock-warn - Whether to tell people who change locked modes about the
+//   lock. Default false.
+// - modelock-exempt - Space separated nick!user@host masks and $a:account
+//   entries for people who may change locked modes. We don't revert their
+//   changes.
+package modelock
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/horgh/godrop"
+	"github.com/horgh/irc"
+)
+
+func init() {
+	godrop.Register("modelock", Hook)
+	godrop.RegisterConfig("modelock",
+		godrop.ConfigKey{Name: "modelock", Check: checkLocks},
+		godrop.ConfigKey{Name: "modelock-warn", Kind: godrop.ConfigBool},
+		godrop.ConfigKey{Name: "modelock-exempt"},
+	)
+}
+
+// Lock is the modes a channel must and must not have.
+type Lock struct {
+	On  string
+	Off string
+}
+
+// String shows the lock like +nt-k.
+func (l Lock) String() string {
+	s := ""
+	if l.On != "" {
+		s += "+" + l.On
+	}
+	if l.Off != "" {
+		s += "-" + l.Off
+	}
+	return s
+}
+
+// Hook fires when an IRC message of some kind occurs.
+func Hook(c *godrop.Client, m irc.Message) {
+	switch m.Command {
+	case "JOIN":
+		// Ask for the channel's modes when we join so we know them.
+		if len(m.Params) >= 1 && godrop.Canonicalize(godrop.SourceNick(m)) ==
+			godrop.Canonicalize(c.GetNick()) {
+			if _, ok := lockFor(c.Conf(), m.Params[0]); ok {
+				_ = c.Send(irc.Message{
+					Command: "MODE",
+					Params:  []string{m.Params[0]},
+				}, godrop.PriorityLow)
+			}
+		}
+	case "324":
+		// RPL_CHANNELMODEIS: <me> <channel> <modes> [params]
+		if len(m.Params) >= 3 {
+			enforce(c, m.Params[1])
+		}
+	case "MODE":
+		if len(m.Params) < 2 || !godrop.IsChannel(m.Params[0]) {
+			return
+		}
+
+		// Don't fight with servers, ourselves, or people who may change them.
+		if !strings.Contains(m.Prefix, "!") ||
+			godrop.Canonicalize(godrop.SourceNick(m)) ==
+				godrop.Canonicalize(c.GetNick()) {
+			// We may have just become an operator.
+			enforce(c, m.Params[0])
+			return
+		}
+		if c.Identify(m).MatchesAny(c.Conf().GetString("modelock-exempt")) {
+			return
+		}
+
+		if enforce(c, m.Params[0]) && warn(c.Conf()) {
+			lock, _ := lockFor(c.Conf(), m.Params[0])
+			if !strings.ContainsAny(m.Params[1], lock.On+lock.Off) {
+				return
+			}
+			_ = c.Send(irc.Message{
+				Command: "NOTICE",
+				Params: []string{godrop.SourceNick(m), fmt.Sprintf(
+					"%s has a mode lock of %s.", m.Params[0], lock)},
+			}, godrop.PriorityNormal)
+		}
+	}
+}
+
+// enforce changes the channel's modes to match its lock if they don't and
+// we can. It reports whether it changed them.
+func enforce(c *godrop.Client, channel string) bool {
+	lock, ok := lockFor(c.Conf(), channel)
+	if !ok || !c.IsOp(channel) {
+		return false
+	}
+
+	ch, ok := c.Channel(channel)
+	if !ok {
+		return false
+	}
+
+	var on, off string
+	var params []string
+	for _, mode := range lock.On {
+		if !strings.ContainsRune(ch.Modes, mode) {
+			on += string(mode)
+		}
+	}
+	for _, mode := range lock.Off {
+		if mode == 'k' {
+			if ch.Key != "" {
+				off += "k"
+				params = append(params, ch.Key)
+			}
+			continue
+		}
+		if strings.ContainsRune(ch.Modes, mode) {
+			off += string(mode)
+		}
+	}
+
+	if on == "" && off == "" {
+		return false
+	}
+
+	modes := Lock{On: on, Off: off}.String()
+	if err := c.Send(irc.Message{
+		Command: "MODE",
+		Params:  append([]string{ch.Name, modes}, params...),
+	}, godrop.PriorityHigh); err != nil {
+		c.PluginError("modelock", fmt.Errorf("unable to set %s %s: %s", ch.Name,
+			modes, err))
+		return false
+	}
+
+	return true
+}
+
+// lockFor finds the channel's lock.
+func lockFor(config godrop.Config, channel string) (Lock, bool) {
+	locks, err := parseLocks(config.GetString("modelock"))
+	if err != nil {
+		return Lock{}, false
+	}
+	lock, ok := locks[godrop.Canonicalize(channel)]
+	return lock, ok
+}
+
+// parseLocks parses modelock. It returns the locks keyed by canonicalized
+// channel.
+func parseLocks(value string) (map[string]Lock, error) {
+	locks := map[string]Lock{}
+	for _, field := range strings.Fields(value) {
+		i := strings.LastIndex(field, "=")
+		if i < 1 || !godrop.IsChannel(field[:i]) {
+			return nil, fmt.Errorf("invalid mode lock %s, expected channel=modes",
+				field)
+		}
+
+		lock, err := parseLock(field[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid mode lock %s: %s", field, err)
+		}
+		locks[godrop.Canonicalize(field[:i])] = lock
+	}
+	return locks, nil
+}
+
+// parseLock parses modes like +nt-k.
+func parseLock(modes string) (Lock, error) {
+	var lock Lock
+	adding := true
+	for _, mode := range modes {
+		switch {
+		case mode == '+':
+			adding = true
+		case mode == '-':
+			adding = false
+		case strings.ContainsRune("beIqaohv", mode):
+			return Lock{}, fmt.Errorf("can't lock %c", mode)
+		case adding && strings.ContainsRune("kl", mode):
+			return Lock{}, fmt.Errorf("can't set %c since it takes a parameter",
+				mode)
+		case (mode < 'a' || mode > 'z') && (mode < 'A' || mode > 'Z'):
+			return Lock{}, fmt.Errorf("unknown mode %c", mode)
+		default:
+			lock.On = strings.Replace(lock.On, string(mode), "", -1)
+			lock.Off = strings.Replace(lock.Off, string(mode), "", -1)
+			if adding {
+				lock.On += string(mode)
+			} else {
+				lock.Off += string(mode)
+			}
+		}
+	}
+	if lock.On == "" && lock.Off == "" {
+		return Lock{}, fmt.Errorf("no modes")
+	}
+	return lock, nil
+}
+
+func warn(config godrop.Config) bool {
+	return config.GetBool("modelock-warn", false)
+}
+
+func checkLocks(value string) error {
+	_, err := parseLocks(value)
+	return err
+}
@@ -0,0 +1,332 @@
+// Package mqtt bridges IRC and MQTT. It publishes what happens on channels to
+// MQTT topics, and it sends messages published to topics to channels. For
+// example, a home automation system can announce the doorbell on a channel.
+//
+// Configuration options:
+// - mqtt-broker - The broker to connect to, such as tcp://127.0.0.1:1883 or
+//   ssl://mqtt.example.com:8883. Required.
+// - mqtt-client-id - Our client ID. Default godrop.
+// - mqtt-username, mqtt-password - Credentials to connect with, if needed.
+// - mqtt-publish-channels - Space separated channels to publish events for.
+// - mqtt-publish-events - Space separated kinds of events to publish. These
+//   are message, join, part, kick, and topic. Default message.
+// - mqtt-topic-prefix - The start of the topics we publish to. Default
+//   godrop. Events go to <prefix>/<channel>/<kind> with the channel's # etc
+//   removed, such as godrop/example/message.
+// - mqtt-subscribe - Space separated topic=channel pairs, such as
+//   home/doorbell=#home. We send each line of what's published to the topic
+//   to the channel. Topics may use the wildcards + and #.
+//
+// Events are published as JSON with the keys kind, nick, channel, text, and
+// time.
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/horgh/godrop"
+	"github.com/horgh/irc"
+)
+
+func init() {
+	godrop.Register("mqtt", Hook)
+	godrop.RegisterConfig("mqtt",
+		godrop.ConfigKey{Name: "mqtt-broker", Required: true},
+		godrop.ConfigKey{Name: "mqtt-client-id"},
+		godrop.ConfigKey{Name: "mqtt-username"},
+		godrop.ConfigKey{Name: "mqtt-password"},
+		godrop.ConfigKey{Name: "mqtt-publish-channels"},
+		godrop.ConfigKey{Name: "mqtt-publish-events", Check: checkEvents},
+		godrop.ConfigKey{Name: "mqtt-topic-prefix"},
+		godrop.ConfigKey{Name: "mqtt-subscribe", Check: checkSubscriptions},
+	)
+}
+
+// Event is what we publish.
+type Event struct {
+	Kind    string `json:"kind"`
+	Nick    string `json:"nick"`
+	Channel string `json:"channel"`
+	Text    string `json:"text,omitempty"`
+	Time    string `json:"time"`
+}
+
+// kinds are the kinds of events we can publish keyed by command.
+var kinds = map[string]string{
+	"PRIVMSG": "message",
+	"NOTICE":  "message",
+	"JOIN":    "join",
+	"PART":    "part",
+	"KICK":    "kick",
+	"TOPIC":   "topic",
+}
+
+const (
+	// timeout is how long we wait for the broker.
+	timeout = 30 * time.Second
+
+	// maxLines is how many lines of a payload we send to a channel.
+	maxLines = 5
+)
+
+// disconnectWait is how long we wait for work to finish when we disconnect
+// from the broker, in milliseconds.
+const disconnectWait = 250
+
+var (
+	mutex sync.Mutex
+
+	// started holds the clients we started connecting to the broker for.
+	started = map[*godrop.Client]bool{}
+
+	// clients holds each client's connection to the broker once it has one.
+	clients = map[*godrop.Client]paho.Client{}
+)
+
+// Hook fires when an IRC message of some kind occurs.
+//
+// We connect to the broker if we haven't, and publish the message if we're
+// set to. Each client connects itself, and disconnects once it's shut down.
+func Hook(c *godrop.Client, m irc.Message) {
+	mutex.Lock()
+	if !started[c] {
+		started[c] = true
+		c.Go("mqtt", func() error { return connect(c) })
+	}
+	mc := clients[c]
+	mutex.Unlock()
+
+	if mc == nil || !mc.IsConnected() {
+		return
+	}
+
+	e, ok := convert(c.Conf(), m)
+	if !ok {
+		return
+	}
+
+	payload, err := json.Marshal(e)
+	if err != nil {
+		c.PluginError("mqtt", fmt.Errorf("unable to encode event: %s", err))
+		return
+	}
+
+	topic := topicPrefix(c.Conf()) + "/" + topicName(e.Channel) + "/" + e.Kind
+
+	// Don't hold up other plugins waiting for the broker.
+	token := mc.Publish(topic, 0, false, payload)
+	go func() {
+		if token.WaitTimeout(timeout) && token.Error() != nil {
+			c.PluginError("mqtt", fmt.Errorf("unable to publish to %s: %s", topic,
+				token.Error()))
+		}
+	}()
+}
+
+// connect connects to the broker. Once connected, the client reconnects by
+// itself if it loses the connection. We stay connected until the client is
+// shut down.
+func connect(c *godrop.Client) error {
+	clientID := c.Conf().GetString("mqtt-client-id")
+	if clientID == "" {
+		clientID = "godrop"
+	}
+
+	opts := paho.NewClientOptions().
+		AddBroker(c.Conf().GetString("mqtt-broker")).
+		SetClientID(clientID).
+		SetUsername(c.Conf().GetString("mqtt-username")).
+		SetPassword(c.Conf().GetString("mqtt-password")).
+		SetAutoReconnect(true).
+		SetConnectTimeout(timeout).
+		SetOnConnectHandler(func(mc paho.Client) {
+			c.Log().Info("Connected", "plugin", "mqtt", "broker",
+				c.Conf().GetString("mqtt-broker"))
+			subscribe(c, mc)
+		}).
+		SetConnectionLostHandler(func(mc paho.Client, err error) {
+			c.PluginError("mqtt", fmt.Errorf("lost connection: %s", err))
+		})
+
+	mc := paho.NewClient(opts)
+	token := mc.Connect()
+	if !token.WaitTimeout(timeout) {
+		return fmt.Errorf("timed out connecting to %s",
+			c.Conf().GetString("mqtt-broker"))
+	}
+	if err := token.Error(); err != nil {
+		return fmt.Errorf("unable to connect to %s: %s",
+			c.Conf().GetString("mqtt-broker"),
+			err)
+	}
+
+	mutex.Lock()
+	clients[c] = mc
+	mutex.Unlock()
+
+	<-c.Done()
+
+	mutex.Lock()
+	delete(clients, c)
+	delete(started, c)
+	mutex.Unlock()
+
+	mc.Disconnect(disconnectWait)
+	return nil
+}
+
+// subscribe subscribes to the topics we send to channels. We do this each
+// time we connect.
+func subscribe(c *godrop.Client, mc paho.Client) {
+	subs, err := parseSubscriptions(c.Conf().GetString("mqtt-subscribe"))
+	if err != nil {
+		c.PluginError("mqtt", err)
+		return
+	}
+
+	for topic, channel := range subs {
+		channel := channel
+		token := mc.Subscribe(topic, 0, func(_ paho.Client, msg paho.Message) {
+			relay(c, channel, msg.Payload())
+		})
+		if !token.WaitTimeout(timeout) {
+			c.PluginError("mqtt", fmt.Errorf("timed out subscribing to %s", topic))
+			continue
+		}
+		if err := token.Error(); err != nil {
+			c.PluginError("mqtt", fmt.Errorf("unable to subscribe to %s: %s", topic,
+				err))
+		}
+	}
+}
+
+// relay sends a payload to a channel.
+func relay(c *godrop.Client, channel string, payload []byte) {
+	var lines []string
+	for _, line := range strings.Split(string(payload), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	if len(lines) > maxLines {
+		lines = append(lines[:maxLines-1], fmt.Sprintf("(%d more lines)",
+			len(lines)-maxLines+1))
+	}
+
+	for _, line := range lines {
+		if err := c.Message(channel, line); err != nil {
+			c.PluginError("mqtt", fmt.Errorf("unable to send to %s: %s", channel,
+				err))
+			return
+		}
+	}
+}
+
+// convert makes an Event from the message if we publish it.
+func convert(config godrop.Config, m irc.Message) (Event, bool) {
+	kind, ok := kinds[m.Command]
+	if !ok || len(m.Params) == 0 || !godrop.IsChannel(m.Params[0]) {
+		return Event{}, false
+	}
+
+	e := Event{
+		Kind:    kind,
+		Nick:    godrop.SourceNick(m),
+		Channel: m.Params[0],
+		Time:    time.Now().UTC().Format(time.RFC3339),
+	}
+
+	switch m.Command {
+	case "PRIVMSG", "NOTICE", "PART", "TOPIC":
+		if len(m.Params) > 1 {
+			e.Text = m.Params[1]
+		}
+	case "KICK":
+		if len(m.Params) > 1 {
+			e.Text = m.Params[1]
+		}
+		if len(m.Params) > 2 {
+			e.Text += ": " + m.Params[2]
+		}
+	}
+
+	if !contains(config.GetStringSlice("mqtt-publish-channels"), e.Channel) {
+		return Event{}, false
+	}
+
+	events := config.GetStringSlice("mqtt-publish-events")
+	if len(events) == 0 {
+		events = []string{"message"}
+	}
+	if !contains(events, e.Kind) {
+		return Event{}, false
+	}
+
+	return e, true
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if godrop.Canonicalize(n) == godrop.Canonicalize(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func topicPrefix(config godrop.Config) string {
+	prefix := strings.Trim(config.GetString("mqtt-topic-prefix"), "/")
+	if prefix == "" {
+		return "godrop"
+	}
+	return prefix
+}
+
+// topicName makes a channel name usable in a topic. Topics we publish to
+// can't have the wildcards + and #, and / separates levels.
+func topicName(channel string) string {
+	name := strings.ToLower(strings.TrimLeft(channel, "#&+!"))
+	return strings.NewReplacer("+", "_", "#", "_", "/", "_").Replace(name)
+}
+
+// parseSubscriptions parses mqtt-subscribe. It returns the channels keyed by
+// topic.
+func parseSubscriptions(value string) (map[string]string, error) {
+	subs := map[string]string{}
+	for _, field := range strings.Fields(value) {
+		i := strings.LastIndex(field, "=")
+		if i < 1 || !godrop.IsChannel(field[i+1:]) {
+			return nil, fmt.Errorf("invalid subscription %s, expected topic=channel",
+				field)
+		}
+		subs[field[:i]] = field[i+1:]
+	}
+	return subs, nil
+}
+
+func checkSubscriptions(value string) error {
+	_, err := parseSubscriptions(value)
+	return err
+}
+
+func checkEvents(value string) error {
+	for _, k := range strings.Fields(value) {
+		found := false
+		for _, kind := range kinds {
+			if strings.EqualFold(k, kind) {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown event %s", k)
+		}
+	}
+	return nil
+}
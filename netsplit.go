@@ -0,0 +1,228 @@
+package godrop
+
+import (
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+const (
+	// netsplitQuiet is how long after the last quit or join of a netsplit
+	// before we consider it done and tell EventHooks about it.
+	netsplitQuiet = 5 * time.Second
+
+	// netsplitMemory is how long after a netsplit we recognize joins as
+	// people coming back from it.
+	netsplitMemory = 30 * time.Minute
+)
+
+// Netsplit describes a netsplit or people rejoining after one.
+type Netsplit struct {
+	// Servers are the two servers that split. The first is the one closer to
+	// us.
+	Servers [2]string
+
+	// Nicks are the users who quit or rejoined.
+	Nicks []string
+
+	// Time is when it started.
+	Time time.Time
+}
+
+// netsplitState tracks netsplits.
+type netsplitState struct {
+	// splits collects quits of splits still happening keyed by quit reason.
+	splits map[string]*Netsplit
+
+	// joins collects joins of people rejoining keyed by quit reason.
+	joins map[string]*Netsplit
+
+	// last holds when we last saw a quit or join for each split in splits and
+	// joins, keyed the same.
+	lastSplit map[string]time.Time
+	lastJoin  map[string]time.Time
+
+	// nicks are the nicks who quit in a netsplit keyed by canonicalized nick.
+	// The values are the quit reasons.
+	nicks map[string]splitNick
+}
+
+type splitNick struct {
+	reason string
+	time   time.Time
+}
+
+func newNetsplitState() *netsplitState {
+	return &netsplitState{
+		splits:    map[string]*Netsplit{},
+		joins:     map[string]*Netsplit{},
+		lastSplit: map[string]time.Time{},
+		lastJoin:  map[string]time.Time{},
+		nicks:     map[string]splitNick{},
+	}
+}
+
+// netsplitQuitRE matches the quit reason of a netsplit: The two servers.
+// Users can't quit with a reason like this since servers add a prefix such
+// as "Quit: ".
+var netsplitQuitRE = regexp.MustCompile(`^([^\s.]+\.[^\s]+) ([^\s.]+\.[^\s]+)$`)
+
+// IsNetsplitQuit checks whether a message is a QUIT due to a netsplit.
+//
+// Plugins can use this to ignore these quits. During a netsplit there may be
+// many of them.
+func IsNetsplitQuit(m irc.Message) bool {
+	_, ok := netsplitServers(m)
+	return ok
+}
+
+// netsplitServers returns the servers that split if the message is a QUIT
+// due to a netsplit.
+func netsplitServers(m irc.Message) ([2]string, bool) {
+	if m.Command != "QUIT" || len(m.Params) == 0 {
+		return [2]string{}, false
+	}
+
+	matches := netsplitQuitRE.FindStringSubmatch(m.Params[0])
+	if matches == nil || strings.EqualFold(matches[1], matches[2]) {
+		return [2]string{}, false
+	}
+
+	return [2]string{matches[1], matches[2]}, true
+}
+
+// IsNetjoin checks whether a message is a JOIN by someone rejoining after a
+// netsplit.
+//
+// Plugins can use this to avoid treating these as new arrivals.
+func (c *Client) IsNetjoin(m irc.Message) bool {
+	if m.Command != "JOIN" {
+		return false
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	_, ok := c.netsplits.nicks[Canonicalize(SourceNick(m))]
+	return ok
+}
+
+// trackNetsplit notes quits and joins that are part of a netsplit. If the
+// event is one, we set its Netsplit to the netsplit.
+func (c *Client) trackNetsplit(e *Event) {
+	now := time.Now()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	s := c.netsplits
+	nick := SourceNick(e.Message)
+
+	if servers, ok := netsplitServers(e.Message); ok {
+		reason := e.Params[0]
+		split, ok := s.splits[reason]
+		if !ok {
+			split = &Netsplit{Servers: servers, Time: e.Time}
+			s.splits[reason] = split
+		}
+		split.Nicks = append(split.Nicks, nick)
+		s.lastSplit[reason] = now
+		s.nicks[Canonicalize(nick)] = splitNick{reason: reason, time: now}
+		e.Netsplit = split
+		return
+	}
+
+	if e.Command != "JOIN" {
+		return
+	}
+
+	sn, ok := s.nicks[Canonicalize(nick)]
+	if !ok {
+		return
+	}
+
+	join, ok := s.joins[sn.reason]
+	if !ok {
+		join = &Netsplit{Time: e.Time}
+		if split, ok := s.splits[sn.reason]; ok {
+			join.Servers = split.Servers
+		} else if servers, ok := netsplitServers(irc.Message{
+			Command: "QUIT",
+			Params:  []string{sn.reason},
+		}); ok {
+			join.Servers = servers
+		}
+		s.joins[sn.reason] = join
+	}
+
+	// They rejoin each channel they were on. List them once.
+	found := false
+	for _, n := range join.Nicks {
+		if Canonicalize(n) == Canonicalize(nick) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		join.Nicks = append(join.Nicks, nick)
+	}
+
+	s.lastJoin[sn.reason] = now
+	e.Netsplit = join
+}
+
+// netsplitEvents returns events for netsplits and rejoins that are over. We
+// consider them over once there's been no activity for a little while.
+func (c *Client) netsplitEvents() []Event {
+	now := time.Now()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	s := c.netsplits
+	var events []Event
+
+	for reason, split := range s.splits {
+		if now.Sub(s.lastSplit[reason]) < netsplitQuiet {
+			continue
+		}
+		events = append(events, netsplitEvent(EventNetsplit, "NETSPLIT", split))
+		delete(s.splits, reason)
+		delete(s.lastSplit, reason)
+	}
+
+	for reason, join := range s.joins {
+		if now.Sub(s.lastJoin[reason]) < netsplitQuiet {
+			continue
+		}
+		events = append(events, netsplitEvent(EventNetjoin, "NETJOIN", join))
+		delete(s.joins, reason)
+		delete(s.lastJoin, reason)
+
+		for _, nick := range join.Nicks {
+			delete(s.nicks, Canonicalize(nick))
+		}
+	}
+
+	for nick, sn := range s.nicks {
+		if now.Sub(sn.time) > netsplitMemory {
+			delete(s.nicks, nick)
+		}
+	}
+
+	return events
+}
+
+func netsplitEvent(kind EventKind, command string, split *Netsplit) Event {
+	return Event{
+		Message: irc.Message{
+			Command: command,
+			Params:  []string{split.Servers[0], split.Servers[1]},
+		},
+		Time:     split.Time,
+		Kind:     kind,
+		Netsplit: split,
+	}
+}
@@ -0,0 +1,245 @@
+package godrop
+
+import (
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+const (
+	// nickCheckInterval is how often we check whether our nick is free if the
+	// server doesn't support MONITOR.
+	nickCheckInterval = 30 * time.Second
+
+	// maxAltNickLength is the longest alternate nick we make by adding
+	// characters. Servers commonly allow at least this long.
+	maxAltNickLength = 15
+)
+
+// handleNick keeps us on our nick.
+//
+// If our nick is taken when we register, we use another. We try those set
+// with SetAltNicks first, then add to our nick. Once registered we try to get
+// our nick back. If we have a NickServ password we ask NickServ to disconnect
+// whoever is using it. Then we watch for it to become free, using
+// MONITOR if the server supports it and ISON if not. We start once the MOTD
+// ends since servers send RPL_ISUPPORT after RPL_WELCOME.
+func (c *Client) handleNick(m irc.Message) error {
+	switch m.Command {
+	case "433", "436", "437":
+		// ERR_NICKNAMEINUSE, ERR_NICKCOLLISION, ERR_UNAVAILRESOURCE
+		return c.useAltNick(m)
+
+	case "376", "422":
+		// RPL_ENDOFMOTD, ERR_NOMOTD. We know whether the server supports MONITOR
+		// by now.
+		c.mutex.Lock()
+		c.state.motdEnded = true
+		c.mutex.Unlock()
+		return c.reclaimNick()
+
+	case "NICK":
+		return c.reclaimNick()
+
+	case "731":
+		// RPL_MONOFFLINE: <nick> <target>{,<target>}
+		if len(m.Params) < 2 {
+			return nil
+		}
+		for _, target := range strings.Split(m.Params[1], ",") {
+			// Targets may be nick!user@host.
+			nick := strings.SplitN(target, "!", 2)[0]
+			if Canonicalize(nick) == Canonicalize(c.nick) {
+				return c.takeNick()
+			}
+		}
+
+	case "303":
+		// RPL_ISON: <nick> :<nick>{ <nick>}
+		if len(m.Params) < 2 {
+			return nil
+		}
+		for _, nick := range strings.Fields(m.Params[1]) {
+			if Canonicalize(nick) == Canonicalize(c.nick) {
+				return nil
+			}
+		}
+		if c.wantNick() {
+			return c.takeNick()
+		}
+	}
+
+	return nil
+}
+
+// SetAltNicks sets nicks to try in order if ours is taken when we register.
+// If they're all taken too we make up others. We keep trying to get our own
+// nick back either way.
+func (c *Client) SetAltNicks(nicks []string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.altNicks = nicks
+}
+
+// useAltNick picks another nick when the one we asked for is unavailable
+// while we're registering.
+func (c *Client) useAltNick(m irc.Message) error {
+	c.mutex.Lock()
+	if c.state.nick != "" {
+		// We're registered. This is about an attempt to get our nick back. We'll
+		// try again later.
+		c.mutex.Unlock()
+		return nil
+	}
+
+	tried := c.state.attemptedNick
+	if tried == "" {
+		tried = c.nick
+	}
+
+	base := tried
+	if c.state.altNicksTried > 0 && c.state.altNicksTried <= len(c.altNicks) &&
+		tried == c.altNicks[c.state.altNicksTried-1] {
+		// We're done with the alternate nicks. Add to ours instead.
+		base = c.nick
+	}
+
+	var alt string
+	if c.state.altNicksTried < len(c.altNicks) {
+		alt = c.altNicks[c.state.altNicksTried]
+		c.state.altNicksTried++
+	} else {
+		alt = base + "_"
+		if len(alt) > maxAltNickLength {
+			prefix := c.nick
+			if len(prefix) > maxAltNickLength-3 {
+				prefix = prefix[:maxAltNickLength-3]
+			}
+			alt = prefix + strconv.Itoa(rand.Intn(1000))
+		}
+	}
+	c.state.attemptedNick = alt
+	c.mutex.Unlock()
+
+	c.Log().Info("Nick is unavailable. Trying another", "nick", tried,
+		"alt", alt)
+
+	return c.WriteMessage(irc.Message{
+		Command: "NICK",
+		Params:  []string{alt},
+	})
+}
+
+// wantNick checks whether we're registered but not on our nick.
+func (c *Client) wantNick() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.state.nick != "" &&
+		Canonicalize(c.state.nick) != Canonicalize(c.nick)
+}
+
+// reclaimNick starts trying to get our nick back if we're not on it. We wait
+// until the end of the MOTD so we know whether we can use MONITOR.
+func (c *Client) reclaimNick() error {
+	c.mutex.Lock()
+	if c.state.nick == "" || !c.state.motdEnded {
+		c.mutex.Unlock()
+		return nil
+	}
+
+	if Canonicalize(c.state.nick) == Canonicalize(c.nick) {
+		// We have it. Stop watching for it. If we're using ISON, the loop stops
+		// on its own.
+		monitoring := c.state.monitoringNick
+		if monitoring {
+			c.state.monitoringNick = false
+			c.state.reclaiming = false
+		}
+		c.mutex.Unlock()
+
+		if !monitoring {
+			return nil
+		}
+		return c.WriteMessage(irc.Message{
+			Command: "MONITOR",
+			Params:  []string{"-", c.nick},
+		})
+	}
+
+	if c.state.reclaiming {
+		c.mutex.Unlock()
+		return nil
+	}
+	c.state.reclaiming = true
+	monitor := c.state.monitor
+	c.state.monitoringNick = monitor
+	password := c.nickServPassword
+	var done <-chan struct{}
+	if c.sendq != nil {
+		done = c.sendq.done
+	}
+	c.mutex.Unlock()
+
+	c.Log().Info("We're not on our nick. Trying to get it back", "nick", c.nick)
+
+	if password != "" {
+		if err := c.SendSecret(irc.Message{
+			Command: "PRIVMSG",
+			Params:  []string{"NickServ", "GHOST " + c.nick + " " + password},
+		}, PriorityHigh); err != nil {
+			return err
+		}
+	}
+
+	// The server tells us right away whether it's online and again each time
+	// that changes.
+	if monitor {
+		return c.WriteMessage(irc.Message{
+			Command: "MONITOR",
+			Params:  []string{"+", c.nick},
+		})
+	}
+
+	if done != nil {
+		go c.nickCheckLoop(done)
+	}
+
+	return nil
+}
+
+// nickCheckLoop asks the server whether our nick is in use periodically
+// until we're on it or the connection closes.
+func (c *Client) nickCheckLoop(done <-chan struct{}) {
+	for {
+		select {
+		case <-time.After(nickCheckInterval):
+		case <-done:
+			return
+		}
+
+		if !c.wantNick() {
+			c.mutex.Lock()
+			c.state.reclaiming = false
+			c.mutex.Unlock()
+			return
+		}
+
+		if err := c.WriteMessage(irc.Message{
+			Command: "ISON",
+			Params:  []string{c.nick},
+		}); err != nil {
+			c.Log().Warn("Unable to check nick", "error", err)
+		}
+	}
+}
+
+// takeNick changes to our nick.
+func (c *Client) takeNick() error {
+	c.Log().Info("Nick is free. Taking it", "nick", c.nick)
+	return c.Nick()
+}
@@ -0,0 +1,237 @@
+// Package notes provides a private memo pad.
+//
+// People can store notes to themselves and look at them from any client.
+// We always respond privately, even if the trigger was on a channel.
+//
+// Usage:
+// - !note <text> - Add a note.
+// - !note del <number> - Delete a note.
+// - !notes - List your most recent notes.
+// - !notes search <text> - Search your notes.
+//
+// Notes are kept in persistent storage. This requires storage-file to be set.
+package notes
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/horgh/godrop"
+	"github.com/horgh/irc"
+)
+
+func init() {
+	godrop.Register("notes", nil)
+	godrop.RegisterConfig("notes",
+		godrop.ConfigKey{Name: "storage-file", Required: true},
+	)
+	godrop.RegisterCommand("notes", godrop.Command{
+		Name:  "note",
+		Usage: "<text> or del <number>",
+		Help:  "Add or delete a note to yourself.",
+		Run:   triggerNote,
+	})
+	godrop.RegisterCommand("notes", godrop.Command{
+		Name:  "notes",
+		Usage: "[search <text>]",
+		Help:  "List or search your notes.",
+		Run:   triggerNotes,
+	})
+}
+
+var delRE = regexp.MustCompile(`(?i)^del\s+([0-9]+)$`)
+var searchRE = regexp.MustCompile(`(?i)^search\s+(.+)$`)
+
+const (
+	// bucket is the storage bucket holding notes.
+	bucket = "notes"
+
+	// Limit how many notes each person may have.
+	maxNotes = 100
+
+	// How many notes to show when listing.
+	listCount = 10
+)
+
+// Note is a memo.
+type Note struct {
+	Text  string
+	Added time.Time
+}
+
+var mutex sync.Mutex
+
+// triggerNote handles !note
+func triggerNote(c *godrop.Client, m irc.Message, args []string) error {
+	nick := godrop.SourceNick(m)
+	text := strings.TrimSpace(c.CommandText(m))
+
+	if matches := delRE.FindStringSubmatch(text); matches != nil {
+		deleteNote(c, nick, matches[1])
+		return nil
+	}
+	addNote(c, nick, text)
+	return nil
+}
+
+// triggerNotes handles !notes
+func triggerNotes(c *godrop.Client, m irc.Message, args []string) error {
+	nick := godrop.SourceNick(m)
+	text := strings.TrimSpace(c.CommandText(m))
+
+	if matches := searchRE.FindStringSubmatch(text); matches != nil {
+		searchNotes(c, nick, strings.TrimSpace(matches[1]))
+		return nil
+	}
+	listNotes(c, nick)
+	return nil
+}
+
+func getNotes(c *godrop.Client, nick string) ([]Note, error) {
+	store, err := c.Storage()
+	if err != nil {
+		return nil, err
+	}
+
+	var notes []Note
+	if _, err := store.Get(bucket, godrop.Canonicalize(nick), &notes); err != nil {
+		return nil, err
+	}
+
+	return notes, nil
+}
+
+func putNotes(c *godrop.Client, nick string, notes []Note) error {
+	store, err := c.Storage()
+	if err != nil {
+		return err
+	}
+
+	if len(notes) == 0 {
+		return store.Delete(bucket, godrop.Canonicalize(nick))
+	}
+
+	return store.Put(bucket, godrop.Canonicalize(nick), notes)
+}
+
+func addNote(c *godrop.Client, nick, text string) {
+	if text == "" {
+		_ = c.Message(nick, "Usage: !note <text> | !note del <number>")
+		return
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	notes, err := getNotes(c, nick)
+	if err != nil {
+		_ = c.Message(nick, fmt.Sprintf("Unable to look up notes: %s", err))
+		return
+	}
+
+	if len(notes) >= maxNotes {
+		_ = c.Message(nick, fmt.Sprintf(
+			"You have %d notes. Delete some before adding more.", len(notes)))
+		return
+	}
+
+	notes = append(notes, Note{Text: text, Added: time.Now()})
+
+	if err := putNotes(c, nick, notes); err != nil {
+		_ = c.Message(nick, fmt.Sprintf("Unable to store note: %s", err))
+		return
+	}
+
+	_ = c.Message(nick, fmt.Sprintf("Added note #%d.", len(notes)))
+}
+
+func deleteNote(c *godrop.Client, nick, number string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	notes, err := getNotes(c, nick)
+	if err != nil {
+		_ = c.Message(nick, fmt.Sprintf("Unable to look up notes: %s", err))
+		return
+	}
+
+	n, err := strconv.Atoi(number)
+	if err != nil || n < 1 || n > len(notes) {
+		_ = c.Message(nick, "No such note.")
+		return
+	}
+
+	notes = append(notes[:n-1], notes[n:]...)
+
+	if err := putNotes(c, nick, notes); err != nil {
+		_ = c.Message(nick, fmt.Sprintf("Unable to delete note: %s", err))
+		return
+	}
+
+	_ = c.Message(nick, fmt.Sprintf(
+		"Deleted note #%d. Notes after it have moved up one.", n))
+}
+
+func listNotes(c *godrop.Client, nick string) {
+	notes, err := getNotes(c, nick)
+	if err != nil {
+		_ = c.Message(nick, fmt.Sprintf("Unable to look up notes: %s", err))
+		return
+	}
+
+	if len(notes) == 0 {
+		_ = c.Message(nick, "You have no notes.")
+		return
+	}
+
+	start := 0
+	if len(notes) > listCount {
+		start = len(notes) - listCount
+		_ = c.Message(nick, fmt.Sprintf(
+			"You have %d notes. Showing the most recent %d.", len(notes),
+			listCount))
+	}
+
+	settings := c.ChannelSettings(nick)
+	for i := start; i < len(notes); i++ {
+		_ = c.Message(nick, formatNote(settings, i+1, notes[i]))
+	}
+}
+
+func searchNotes(c *godrop.Client, nick, query string) {
+	notes, err := getNotes(c, nick)
+	if err != nil {
+		_ = c.Message(nick, fmt.Sprintf("Unable to look up notes: %s", err))
+		return
+	}
+
+	query = strings.ToLower(query)
+
+	settings := c.ChannelSettings(nick)
+	found := 0
+	for i, n := range notes {
+		if !strings.Contains(strings.ToLower(n.Text), query) {
+			continue
+		}
+		found++
+		if found > listCount {
+			_ = c.Message(nick, "There are more matches. Try a narrower search.")
+			return
+		}
+		_ = c.Message(nick, formatNote(settings, i+1, n))
+	}
+
+	if found == 0 {
+		_ = c.Message(nick, "No notes match.")
+	}
+}
+
+func formatNote(settings godrop.ChannelSettings, number int,
+	n Note) string {
+	return fmt.Sprintf("#%d [%s] %s", number, settings.FormatTime(n.Added),
+		n.Text)
+}
@@ -2,14 +2,17 @@
 package oper
 
 import (
-	"log"
-
 	"github.com/horgh/godrop"
 	"github.com/horgh/irc"
 )
 
 func init() {
-	godrop.Hooks = append(godrop.Hooks, Hook)
+	godrop.Register("oper", Hook)
+	godrop.RegisterConfig("oper",
+		godrop.ConfigKey{Name: "oper-name", Required: true},
+		godrop.ConfigKey{Name: "oper-password", Required: true},
+		godrop.ConfigKey{Name: "oper-umodes"},
+	)
 }
 
 // Hook fires when an IRC message of some kind occurs.
@@ -17,31 +20,25 @@ func init() {
 func Hook(c *godrop.Client, message irc.Message) {
 	if message.Command == irc.ReplyWelcome {
 		// Try to oper if we have both an oper name and password.
-		operName, exists := c.Config["oper-name"]
-		if !exists {
-			return
-		}
-		operPass, exists := c.Config["oper-password"]
-		if !exists {
-			return
-		}
-		if len(operName) == 0 || len(operPass) == 0 {
+		operName := c.Conf().GetString("oper-name")
+		operPass := c.Conf().GetString("oper-password")
+		if operName == "" || operPass == "" {
 			return
 		}
 
 		if err := c.Oper(operName, operPass); err != nil {
-			log.Printf("Unable to send OPER: %s", err)
+			c.Log().Error("Unable to send OPER", "plugin", "oper", "error", err)
 			return
 		}
 
-		log.Printf("Sent OPER")
+		c.Log().Info("Sent OPER", "plugin", "oper")
 		return
 	}
 
 	// Successful oper. Apply user modes.
 	if message.Command == irc.ReplyYoureOper {
 		if err := sendUmode(c); err != nil {
-			log.Printf("Problem sending MODE: %s", err)
+			c.Log().Error("Unable to send MODE", "plugin", "oper", "error", err)
 			return
 		}
 		return
@@ -50,8 +47,8 @@ func Hook(c *godrop.Client, message irc.Message) {
 
 // sendUmode sends the oper umodes with the MODE command.
 func sendUmode(c *godrop.Client) error {
-	operUmodes, exists := c.Config["oper-umodes"]
-	if !exists {
+	operUmodes := c.Conf().GetString("oper-umodes")
+	if operUmodes == "" {
 		return nil
 	}
 
@@ -59,6 +56,6 @@ func sendUmode(c *godrop.Client) error {
 		return err
 	}
 
-	log.Printf("Sent MODE")
+	c.Log().Info("Sent MODE", "plugin", "oper")
 	return nil
 }
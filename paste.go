@@ -0,0 +1,90 @@
+package godrop
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// pasteSummaryLength is roughly how much of a pasted message we send along
+// with the link.
+const pasteSummaryLength = 100
+
+// Paster uploads text to a paste service and returns its URL.
+type Paster func(text string) (string, error)
+
+// SetPaster sets how to upload long messages. If a message would take more
+// than maxLines lines to a channel, Message uploads it and sends the start of
+// it and the link instead. This keeps long output from flooding channels.
+// Private messages are sent as usual since they flood no one else, and what
+// we send privately may not be something to publish. If uploading fails we
+// send the message as usual.
+func (c *Client) SetPaster(p Paster, maxLines int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.paster = p
+	c.pasteMaxLines = maxLines
+}
+
+// pasteMessage uploads the message if it's too many lines for a channel. It
+// returns the line to send in its place. If it returns false, send the
+// message as usual.
+func (c *Client) pasteMessage(target, message string,
+	lines int) (string, bool) {
+	if !IsChannel(target) {
+		return "", false
+	}
+
+	c.mutex.Lock()
+	paster := c.paster
+	maxLines := c.pasteMaxLines
+	c.mutex.Unlock()
+
+	if paster == nil || lines <= maxLines {
+		return "", false
+	}
+
+	url, err := paster(message)
+	if err != nil {
+		c.Log().Error("Unable to paste message", "error", err)
+		return "", false
+	}
+
+	// Cut it between words if we can.
+	s := ""
+	for _, word := range strings.Fields(message) {
+		if len(s)+len(word) > pasteSummaryLength {
+			break
+		}
+		s += word + " "
+	}
+	if s == "" {
+		s = truncate(message, pasteSummaryLength) + " "
+	}
+
+	return s + "... Full text: " + url, true
+}
+
+// truncate shortens s to at most n bytes without splitting a character.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// Paste uploads text using the Paster set with SetPaster and returns its URL.
+func (c *Client) Paste(text string) (string, error) {
+	c.mutex.Lock()
+	paster := c.paster
+	c.mutex.Unlock()
+
+	if paster == nil {
+		return "", fmt.Errorf("no paste service configured")
+	}
+	return paster(text)
+}
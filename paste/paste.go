@@ -0,0 +1,119 @@
+// Package paste uploads long messages to a paste service. Rather than sending
+// a message over many lines to a channel, the client sends the start of it
+// and a link. Private messages are sent as usual.
+//
+// This works with services taking the text as a multipart form upload and
+// responding with the URL, such as https://0x0.st.
+//
+// Configuration options:
+// - paste-url - The URL to upload to. If it's not set, we don't upload.
+// - paste-field - The name of the form field holding the text. The default is
+//   file.
+// - paste-max-lines - Messages longer than this many lines get uploaded. The
+//   default is 3.
+package paste
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/horgh/godrop"
+	"github.com/horgh/irc"
+)
+
+func init() {
+	godrop.Register("paste", Hook)
+	godrop.RegisterConfig("paste",
+		godrop.ConfigKey{Name: "paste-url", Required: true},
+		godrop.ConfigKey{Name: "paste-field"},
+		godrop.ConfigKey{Name: "paste-max-lines", Kind: godrop.ConfigInt},
+	)
+}
+
+// Timeout on HTTP requests. Sending the message waits on this.
+var timeout = 10 * time.Second
+
+const (
+	defaultField    = "file"
+	defaultMaxLines = 3
+)
+
+// Hook fires when an IRC message of some kind occurs.
+func Hook(c *godrop.Client, m irc.Message) {
+	// Set up once we're connected. The config may have changed.
+	if m.Command != irc.ReplyWelcome {
+		return
+	}
+
+	url := c.Conf().GetString("paste-url")
+	if url == "" {
+		return
+	}
+
+	field := defaultField
+	if c.Conf()["paste-field"] != "" {
+		field = c.Conf()["paste-field"]
+	}
+
+	maxLines := c.Conf().GetInt("paste-max-lines", defaultMaxLines)
+	if maxLines < 1 {
+		c.Log().Warn("Invalid paste-max-lines", "plugin", "paste", "value",
+			maxLines)
+		return
+	}
+
+	c.SetPaster(func(text string) (string, error) {
+		return upload(c.Web(), url, field, text)
+	}, maxLines)
+}
+
+// upload uploads the text and returns the URL of the paste.
+func upload(web *godrop.WebClient, url, field, text string) (string, error) {
+	body := &bytes.Buffer{}
+	w := multipart.NewWriter(body)
+
+	part, err := w.CreateFormFile(field, "paste.txt")
+	if err != nil {
+		return "", fmt.Errorf("unable to create form: %s", err)
+	}
+
+	if _, err := io.WriteString(part, text); err != nil {
+		return "", fmt.Errorf("unable to create form: %s", err)
+	}
+
+	if err := w.Close(); err != nil {
+		return "", fmt.Errorf("unable to create form: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, "POST", url, body)
+	if err != nil {
+		return "", fmt.Errorf("preparing request: %s", err)
+	}
+	request.Header.Set("Content-Type", w.FormDataContentType())
+
+	resp, respBody, err := web.Fetch(request)
+	if err != nil {
+		return "", fmt.Errorf("failed to perform HTTP request: %s", err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	pasteURL := strings.TrimSpace(string(respBody))
+	if !strings.HasPrefix(pasteURL, "http://") &&
+		!strings.HasPrefix(pasteURL, "https://") {
+		return "", fmt.Errorf("unexpected response: %s", pasteURL)
+	}
+
+	return pasteURL, nil
+}
@@ -0,0 +1,124 @@
+// Package pluginstatus shows how plugins are doing.
+//
+// This helps to spot a plugin that is slow or failing.
+//
+// Usage:
+// - !plugins - Show each plugin's calls, average time, errors, and panics,
+//   slowest first.
+// - !plugins <name> - Show details about a plugin including its most recent
+//   error and panic.
+//
+// Only administrators may use these. Administrators are set by the admins
+// config key.
+package pluginstatus
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/horgh/godrop"
+	"github.com/horgh/irc"
+)
+
+func init() {
+	godrop.Register("pluginstatus", nil)
+	godrop.RegisterCommand("pluginstatus", godrop.Command{
+		Name:  "plugins",
+		Usage: "[name]",
+		Help:  "Show how plugins are doing.",
+		Admin: true,
+		Run:   triggerPlugins,
+	})
+}
+
+// triggerPlugins handles !plugins
+func triggerPlugins(c *godrop.Client, m irc.Message, args []string) error {
+	target := godrop.ReplyTarget(m)
+
+	name := strings.Join(args, " ")
+	if name == "" {
+		return c.Message(target, summary(c.PluginStatuses()))
+	}
+
+	for _, s := range c.PluginStatuses() {
+		if strings.EqualFold(s.Name, name) {
+			for _, line := range details(s) {
+				_ = c.Message(target, line)
+			}
+			return nil
+		}
+	}
+
+	return c.Message(target, fmt.Sprintf("No plugin named %s.", name))
+}
+
+// summary describes every plugin that's been called, spending the most time
+// first.
+func summary(statuses []godrop.PluginStatus) string {
+	sort.SliceStable(statuses, func(i, j int) bool {
+		return statuses[i].TotalTime > statuses[j].TotalTime
+	})
+
+	var parts []string
+	for _, s := range statuses {
+		if s.Calls == 0 {
+			continue
+		}
+		part := fmt.Sprintf("%s: %d calls, %s avg", s.Name, s.Calls,
+			round(s.AverageTime()))
+		if s.Errors > 0 {
+			part += fmt.Sprintf(", %d errors", s.Errors)
+		}
+		if s.Panics > 0 {
+			part += fmt.Sprintf(", %d panics", s.Panics)
+		}
+		parts = append(parts, part)
+	}
+
+	if len(parts) == 0 {
+		return "No plugins have run yet."
+	}
+	return strings.Join(parts, "; ")
+}
+
+// details describes a plugin in full.
+func details(s godrop.PluginStatus) []string {
+	lines := []string{
+		fmt.Sprintf("%s: %d calls, %s total, %s avg, %s max, %d errors, %d panics",
+			s.Name, s.Calls, round(s.TotalTime), round(s.AverageTime()),
+			round(s.MaxTime), s.Errors, s.Panics),
+	}
+
+	if s.Errors > 0 {
+		lines = append(lines, fmt.Sprintf("Last error (%s ago): %s",
+			round(time.Since(s.LastErrorTime)), s.LastError))
+	}
+	if s.Panics > 0 {
+		lines = append(lines, fmt.Sprintf("Last panic (%s ago): %s",
+			round(time.Since(s.LastPanicTime)), s.LastPanic))
+	}
+	if s.Restarts > 0 {
+		lines = append(lines, fmt.Sprintf("Restarted goroutines %d times",
+			s.Restarts))
+	}
+	if s.Dropped > 0 {
+		lines = append(lines, fmt.Sprintf("Dropped %d messages while behind",
+			s.Dropped))
+	}
+
+	return lines
+}
+
+// round makes durations shorter to show.
+func round(d time.Duration) time.Duration {
+	switch {
+	case d >= time.Minute:
+		return d.Round(time.Second)
+	case d >= time.Second:
+		return d.Round(10 * time.Millisecond)
+	default:
+		return d.Round(time.Microsecond)
+	}
+}
@@ -0,0 +1,388 @@
+// Package prices shows cryptocurrency and stock prices.
+//
+// Usage:
+// - !btc - Show the price of Bitcoin.
+// - !crypto <symbol> - Show the price of a cryptocurrency, such as eth.
+// - !stock <ticker> - Show the price of a stock, such as AAPL.
+//
+// We show prices in the channel's currency. Set channel-currency or use
+// !chanset currency to change it. See godrop's ChannelSettings.
+//
+// Cryptocurrency prices come from CoinGecko. Stock prices come from the
+// configured provider. Providers give stock prices in US dollars, so we
+// convert them using European Central Bank rates from the Frankfurter API.
+//
+// Configuration options:
+// - prices-stock-provider - Where to get stock prices: finnhub (the default)
+//   or alphavantage.
+// - prices-stock-api-key - The API key for the stock provider. Required for
+//   !stock.
+//
+// Replies use the template price. Its data is a Price.
+package prices
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/horgh/godrop"
+	"github.com/horgh/irc"
+)
+
+func init() {
+	godrop.Register("prices", nil)
+	godrop.RegisterConfig("prices",
+		godrop.ConfigKey{Name: "prices-stock-provider", Check: checkProvider},
+		godrop.ConfigKey{Name: "prices-stock-api-key"},
+	)
+	godrop.RegisterTemplate("prices", "price",
+		"{{.Name}} ({{.Symbol}}): {{.Price}} {{.Currency}} "+
+			"({{.Change}} {{.Period}})")
+	godrop.RegisterCommand("prices", godrop.Command{
+		Name: "btc",
+		Help: "Show the price of Bitcoin.",
+		Run: func(c *godrop.Client, m irc.Message, args []string) error {
+			return triggerCrypto(c, m, []string{"btc"})
+		},
+	})
+	godrop.RegisterCommand("prices", godrop.Command{
+		Name:    "crypto",
+		Usage:   "<symbol>",
+		Help:    "Show the price of a cryptocurrency.",
+		MinArgs: 1,
+		Run:     triggerCrypto,
+	})
+	godrop.RegisterCommand("prices", godrop.Command{
+		Name:    "stock",
+		Usage:   "<ticker>",
+		Help:    "Show the price of a stock.",
+		MinArgs: 1,
+		Run:     triggerStock,
+	})
+}
+
+// Stock providers.
+const (
+	providerFinnhub      = "finnhub"
+	providerAlphaVantage = "alphavantage"
+)
+
+func checkProvider(s string) error {
+	if s != providerFinnhub && s != providerAlphaVantage {
+		return fmt.Errorf("must be %s or %s", providerFinnhub,
+			providerAlphaVantage)
+	}
+	return nil
+}
+
+// coins are the CoinGecko IDs and names of popular coins keyed by symbol.
+// We search for others.
+var coins = map[string]struct{ id, name string }{
+	"btc":  {"bitcoin", "Bitcoin"},
+	"eth":  {"ethereum", "Ethereum"},
+	"usdt": {"tether", "Tether"},
+	"bnb":  {"binancecoin", "BNB"},
+	"sol":  {"solana", "Solana"},
+	"xrp":  {"ripple", "XRP"},
+	"usdc": {"usd-coin", "USDC"},
+	"ada":  {"cardano", "Cardano"},
+	"doge": {"dogecoin", "Dogecoin"},
+	"dot":  {"polkadot", "Polkadot"},
+	"ltc":  {"litecoin", "Litecoin"},
+	"xmr":  {"monero", "Monero"},
+}
+
+// Price is the price of something.
+type Price struct {
+	Name   string
+	Symbol string
+
+	// Price is formatted with thousands separators, such as 12,345.67.
+	Price    string
+	Currency string
+
+	// Change is the percent change over the period, such as +1.23%.
+	Change string
+
+	// Period is what Change is over, such as 24h or today.
+	Period string
+}
+
+// triggerCrypto handles !btc and !crypto
+func triggerCrypto(c *godrop.Client, m irc.Message, args []string) error {
+	target := godrop.ReplyTarget(m)
+	source := godrop.SourceNick(m)
+	symbol := strings.ToLower(args[0])
+	currency := c.ChannelSettings(target).CurrencyCode()
+
+	web := c.Web()
+
+	id, name, err := findCoin(web, symbol)
+	if err != nil {
+		return err
+	}
+	if id == "" {
+		return c.Message(target, fmt.Sprintf("%s: Unknown cryptocurrency: %s",
+			source, args[0]))
+	}
+
+	price, change, err := getCoinPrice(web, id, currency)
+	if err != nil {
+		return err
+	}
+
+	return c.Message(target, c.Format("prices", "price", target, Price{
+		Name:     name,
+		Symbol:   strings.ToUpper(symbol),
+		Price:    formatPrice(price),
+		Currency: currency,
+		Change:   formatChange(change),
+		Period:   "24h",
+	}))
+}
+
+// triggerStock handles !stock
+func triggerStock(c *godrop.Client, m irc.Message, args []string) error {
+	target := godrop.ReplyTarget(m)
+	source := godrop.SourceNick(m)
+	ticker := strings.ToUpper(args[0])
+	currency := c.ChannelSettings(target).CurrencyCode()
+
+	key := c.Conf().GetString("prices-stock-api-key")
+	if key == "" {
+		return fmt.Errorf("no prices-stock-api-key configured")
+	}
+
+	web := c.Web()
+
+	var price, change float64
+	var found bool
+	var err error
+	if c.Conf().GetString("prices-stock-provider") == providerAlphaVantage {
+		price, change, found, err = getAlphaVantageQuote(web, key, ticker)
+	} else {
+		price, change, found, err = getFinnhubQuote(web, key, ticker)
+	}
+	if err != nil {
+		return err
+	}
+	if !found {
+		return c.Message(target, fmt.Sprintf("%s: Unknown ticker: %s", source,
+			ticker))
+	}
+
+	if currency != "USD" {
+		rate, err := getRate(web, "USD", currency)
+		if err != nil {
+			return err
+		}
+		price *= rate
+	}
+
+	return c.Message(target, c.Format("prices", "price", target, Price{
+		Name:     ticker,
+		Symbol:   ticker,
+		Price:    formatPrice(price),
+		Currency: currency,
+		Change:   formatChange(change),
+		Period:   "today",
+	}))
+}
+
+// findCoin finds the CoinGecko ID and name of the coin with the symbol. The
+// ID is blank if there's no such coin.
+func findCoin(web *godrop.WebClient, symbol string) (string, string,
+	error) {
+	if coin, ok := coins[symbol]; ok {
+		return coin.id, coin.name, nil
+	}
+
+	var response struct {
+		Coins []struct {
+			ID     string `json:"id"`
+			Name   string `json:"name"`
+			Symbol string `json:"symbol"`
+		} `json:"coins"`
+	}
+	if err := getJSON(web, "https://api.coingecko.com/api/v3/search?query="+
+		url.QueryEscape(symbol), &response); err != nil {
+		return "", "", err
+	}
+
+	// Results are ordered by market cap, so the first with the symbol is
+	// likely the one people mean.
+	for _, coin := range response.Coins {
+		if strings.EqualFold(coin.Symbol, symbol) {
+			return coin.ID, coin.Name, nil
+		}
+	}
+	return "", "", nil
+}
+
+// getCoinPrice retrieves the price of the coin in the currency and its
+// percent change over 24 hours.
+func getCoinPrice(web *godrop.WebClient, id, currency string) (float64,
+	float64, error) {
+	vs := strings.ToLower(currency)
+
+	vals := url.Values{}
+	vals.Set("ids", id)
+	vals.Set("vs_currencies", vs)
+	vals.Set("include_24hr_change", "true")
+
+	var response map[string]map[string]float64
+	if err := getJSON(web, "https://api.coingecko.com/api/v3/simple/price?"+
+		vals.Encode(), &response); err != nil {
+		return 0, 0, err
+	}
+
+	price, ok := response[id][vs]
+	if !ok {
+		return 0, 0, fmt.Errorf("no price in %s", currency)
+	}
+	return price, response[id][vs+"_24h_change"], nil
+}
+
+// getFinnhubQuote retrieves a stock's price in US dollars and its percent
+// change today from Finnhub. It reports whether there's such a stock.
+func getFinnhubQuote(web *godrop.WebClient, key, ticker string) (float64,
+	float64, bool, error) {
+	vals := url.Values{}
+	vals.Set("symbol", ticker)
+	vals.Set("token", key)
+
+	var response struct {
+		Current       float64 `json:"c"`
+		PercentChange float64 `json:"dp"`
+	}
+	if err := getJSON(web, "https://finnhub.io/api/v1/quote?"+vals.Encode(),
+		&response); err != nil {
+		return 0, 0, false, redact(err, key)
+	}
+
+	// Unknown tickers have a price of 0.
+	if response.Current == 0 {
+		return 0, 0, false, nil
+	}
+	return response.Current, response.PercentChange, true, nil
+}
+
+// getAlphaVantageQuote retrieves a stock's price in US dollars and its
+// percent change today from Alpha Vantage. It reports whether there's such
+// a stock.
+func getAlphaVantageQuote(web *godrop.WebClient, key,
+	ticker string) (float64, float64, bool, error) {
+	vals := url.Values{}
+	vals.Set("function", "GLOBAL_QUOTE")
+	vals.Set("symbol", ticker)
+	vals.Set("apikey", key)
+
+	var response struct {
+		Quote struct {
+			Price         string `json:"05. price"`
+			ChangePercent string `json:"10. change percent"`
+		} `json:"Global Quote"`
+
+		// Note explains why we got no quote, such as being rate limited.
+		Note string `json:"Note"`
+	}
+	if err := getJSON(web, "https://www.alphavantage.co/query?"+vals.Encode(),
+		&response); err != nil {
+		return 0, 0, false, redact(err, key)
+	}
+
+	if response.Note != "" {
+		return 0, 0, false, fmt.Errorf("no quote: %s", response.Note)
+	}
+	if response.Quote.Price == "" {
+		return 0, 0, false, nil
+	}
+
+	price, err := strconv.ParseFloat(response.Quote.Price, 64)
+	if err != nil {
+		return 0, 0, false, fmt.Errorf("invalid price: %s", response.Quote.Price)
+	}
+	change, _ := strconv.ParseFloat(
+		strings.TrimSuffix(response.Quote.ChangePercent, "%"), 64)
+	return price, change, true, nil
+}
+
+// getRate retrieves the exchange rate between two currencies from the
+// Frankfurter API.
+func getRate(web *godrop.WebClient, from, to string) (float64, error) {
+	vals := url.Values{}
+	vals.Set("from", from)
+	vals.Set("to", to)
+
+	var response struct {
+		Rates map[string]float64 `json:"rates"`
+	}
+	if err := getJSON(web, "https://api.frankfurter.app/latest?"+
+		vals.Encode(), &response); err != nil {
+		return 0, err
+	}
+
+	rate, ok := response.Rates[to]
+	if !ok {
+		return 0, fmt.Errorf("no exchange rate for %s", to)
+	}
+	return rate, nil
+}
+
+func getJSON(web *godrop.WebClient, u string, v interface{}) error {
+	resp, body, err := web.Get(u)
+	if err != nil {
+		return fmt.Errorf("failed to perform HTTP request: %s", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unsuccessful request: %s", resp.Status)
+	}
+
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("unable to decode: %s", err)
+	}
+	return nil
+}
+
+// redact removes the API key from an error. HTTP errors include the URL.
+func redact(err error, key string) error {
+	return fmt.Errorf("%s", strings.Replace(err.Error(), key, "<key>", -1))
+}
+
+// formatPrice formats a price with thousands separators, such as 12,345.67.
+// We show more decimal places for prices under 1.
+func formatPrice(price float64) string {
+	if price != 0 && math.Abs(price) < 1 {
+		return strconv.FormatFloat(price, 'f', 6, 64)
+	}
+
+	s := strconv.FormatFloat(price, 'f', 2, 64)
+	whole, frac := s[:len(s)-3], s[len(s)-3:]
+
+	neg := strings.HasPrefix(whole, "-")
+	whole = strings.TrimPrefix(whole, "-")
+
+	var b strings.Builder
+	if neg {
+		b.WriteString("-")
+	}
+	for i, r := range whole {
+		if i > 0 && (len(whole)-i)%3 == 0 {
+			b.WriteRune(',')
+		}
+		b.WriteRune(r)
+	}
+	b.WriteString(frac)
+	return b.String()
+}
+
+// formatChange formats a percent change with its sign, such as +1.23%.
+func formatChange(change float64) string {
+	return fmt.Sprintf("%+.2f%%", change)
+}
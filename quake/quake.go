@@ -0,0 +1,305 @@
+// Package quake provides earthquake alerts and lookups using the USGS
+// earthquake feeds (https://earthquake.usgs.gov/earthquakes/feed/).
+//
+// There are two main features:
+// - Poll the USGS feed and announce earthquakes above a magnitude to channels.
+//   Optionally only announce earthquakes near configured regions.
+// - A channel trigger (!quake) to show the most recent significant earthquakes.
+//
+// Configuration options:
+// - quake-channels - A space separated list of channels to announce
+//   earthquakes to.
+// - quake-min-magnitude - Only announce earthquakes at least this strong. The
+//   default is 5.0.
+// - quake-regions - Optional. A space separated list of regions in the form
+//   latitude,longitude,radius (radius in km). If set, only announce
+//   earthquakes within one of the regions. For example:
+//   49.28,-123.12,500 35.68,139.69,300
+//
+// Output uses the templates alert (announcements) and quake (!quake). Their
+// data is a Quake with .Text describing it. See godrop's Format to override
+// them.
+package quake
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/horgh/godrop"
+	"github.com/horgh/irc"
+)
+
+func init() {
+	godrop.Register("quake", Hook)
+	godrop.RegisterConfig("quake",
+		godrop.ConfigKey{Name: "quake-channels", Required: true},
+		godrop.ConfigKey{Name: "quake-min-magnitude", Kind: godrop.ConfigFloat},
+		godrop.ConfigKey{Name: "quake-regions", Check: func(s string) error {
+			_, err := parseRegions(s)
+			return err
+		}},
+	)
+	godrop.RegisterTemplate("quake", "alert", "Earthquake! {{.Text}}")
+	godrop.RegisterTemplate("quake", "quake", "{{.Text}}")
+	godrop.RegisterCommand("quake", godrop.Command{
+		Name:    "quake",
+		Aliases: []string{"quakes"},
+		Help:    "Show recent significant earthquakes.",
+		Run:     triggerQuake,
+	})
+}
+
+const (
+	feedURL        = "https://earthquake.usgs.gov/earthquakes/feed/v1.0/summary/2.5_day.geojson"
+	significantURL = "https://earthquake.usgs.gov/earthquakes/feed/v1.0/summary/significant_month.geojson"
+
+	defaultMinMagnitude = 5.0
+
+	// How many earthquakes to show with !quake.
+	quakeCount = 3
+)
+
+// Hook fires when an IRC message of some kind occurs.
+func Hook(c *godrop.Client, m irc.Message) {
+	pollQuakes(c)
+}
+
+// triggerQuake handles !quake
+func triggerQuake(c *godrop.Client, m irc.Message, args []string) error {
+	target := godrop.ReplyTarget(m)
+
+	quakes, err := getQuakes(c.Web(), significantURL)
+	if err != nil {
+		return c.Message(target, fmt.Sprintf("Unable to look up earthquakes: %s",
+			err))
+	}
+
+	if len(quakes) == 0 {
+		return c.Message(target, "No significant earthquakes in the past month.")
+	}
+
+	for i := 0; i < quakeCount && i < len(quakes); i++ {
+		_ = c.Message(target, c.Format("quake", "quake", target,
+			quakeLine{Quake: quakes[i],
+				Text: quakes[i].describe(c.ChannelSettings(target))}))
+	}
+	return nil
+}
+
+var (
+	pollMutex            sync.Mutex
+	lastPollTime         time.Time
+	durationBetweenPolls = 5 * time.Minute
+	seen                 map[string]bool
+)
+
+// pollQuakes checks the feed and announces new earthquakes that match our
+// criteria.
+func pollQuakes(c *godrop.Client) {
+	channels := c.Conf().GetStringSlice("quake-channels")
+	if len(channels) == 0 {
+		return
+	}
+
+	pollMutex.Lock()
+	defer pollMutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(lastPollTime) < durationBetweenPolls {
+		return
+	}
+	lastPollTime = now
+
+	minMagnitude := c.Conf().GetFloat("quake-min-magnitude",
+		defaultMinMagnitude)
+
+	regions, err := parseRegions(c.Conf().GetString("quake-regions"))
+	if err != nil {
+		c.Log().Warn("Invalid quake-regions", "plugin", "quake", "error", err)
+		return
+	}
+
+	quakes, err := getQuakes(c.Web(), feedURL)
+	if err != nil {
+		c.PluginError("quake",
+			fmt.Errorf("unable to look up earthquakes: %s", err))
+		return
+	}
+
+	// Remember only what is currently in the feed so this does not grow
+	// forever.
+	previous := seen
+	seen = map[string]bool{}
+	for _, q := range quakes {
+		seen[q.ID] = true
+	}
+
+	// If this is the first time, don't notify. Otherwise we'd announce
+	// everything in the feed each time we start.
+	if previous == nil {
+		return
+	}
+
+	for _, q := range quakes {
+		if previous[q.ID] {
+			continue
+		}
+
+		if q.Properties.Mag < minMagnitude {
+			continue
+		}
+
+		if len(regions) > 0 && !q.inRegions(regions) {
+			continue
+		}
+
+		for _, ch := range channels {
+			_ = c.Message(ch, c.Format("quake", "alert", ch,
+				quakeLine{Quake: q, Text: q.describe(c.ChannelSettings(ch))}))
+		}
+	}
+}
+
+// Region is an area around a point.
+type Region struct {
+	Latitude  float64
+	Longitude float64
+	RadiusKM  float64
+}
+
+func parseRegions(s string) ([]Region, error) {
+	var regions []Region
+
+	for _, field := range strings.Fields(s) {
+		pieces := strings.Split(field, ",")
+		if len(pieces) != 3 {
+			return nil, fmt.Errorf("region must be latitude,longitude,radius: %s",
+				field)
+		}
+
+		var vals []float64
+		for _, p := range pieces {
+			v, err := strconv.ParseFloat(p, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number in region: %s: %s", field, err)
+			}
+			vals = append(vals, v)
+		}
+
+		regions = append(regions, Region{
+			Latitude:  vals[0],
+			Longitude: vals[1],
+			RadiusKM:  vals[2],
+		})
+	}
+
+	return regions, nil
+}
+
+// Quake is a GeoJSON feature describing an earthquake.
+type Quake struct {
+	ID         string `json:"id"`
+	Properties struct {
+		Mag     float64 `json:"mag"`
+		Place   string  `json:"place"`
+		Time    int64   `json:"time"`
+		URL     string  `json:"url"`
+		Tsunami int     `json:"tsunami"`
+	} `json:"properties"`
+	Geometry struct {
+		// Longitude, latitude, depth (km).
+		Coordinates []float64 `json:"coordinates"`
+	} `json:"geometry"`
+}
+
+// quakeLine is the data for the templates.
+type quakeLine struct {
+	Quake
+	Text string
+}
+
+// Time is when the earthquake happened.
+func (q Quake) Time() time.Time {
+	return time.Unix(0, q.Properties.Time*int64(time.Millisecond))
+}
+
+// describe describes the earthquake. We show times using the settings.
+func (q Quake) describe(settings godrop.ChannelSettings) string {
+	s := fmt.Sprintf("M%.1f %s at %s", q.Properties.Mag, q.Properties.Place,
+		settings.FormatTime(q.Time()))
+
+	if len(q.Geometry.Coordinates) == 3 {
+		s += fmt.Sprintf(", depth %.0f km", q.Geometry.Coordinates[2])
+	}
+
+	if q.Properties.Tsunami != 0 {
+		s += " (tsunami warning issued)"
+	}
+
+	if q.Properties.URL != "" {
+		s += fmt.Sprintf(" (%s)", q.Properties.URL)
+	}
+
+	return s
+}
+
+func (q Quake) inRegions(regions []Region) bool {
+	if len(q.Geometry.Coordinates) < 2 {
+		return false
+	}
+
+	lon := q.Geometry.Coordinates[0]
+	lat := q.Geometry.Coordinates[1]
+
+	for _, r := range regions {
+		if distanceKM(lat, lon, r.Latitude, r.Longitude) <= r.RadiusKM {
+			return true
+		}
+	}
+
+	return false
+}
+
+// distanceKM calculates the great circle distance between two points using
+// the haversine formula.
+func distanceKM(lat1, lon1, lat2, lon2 float64) float64 {
+	const earthRadiusKM = 6371.0
+
+	rad := func(deg float64) float64 { return deg * math.Pi / 180 }
+
+	dLat := rad(lat2 - lat1)
+	dLon := rad(lon2 - lon1)
+
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(rad(lat1))*math.Cos(rad(lat2))*math.Sin(dLon/2)*math.Sin(dLon/2)
+
+	return earthRadiusKM * 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+}
+
+// getQuakes retrieves the earthquakes in a feed. They are ordered most recent
+// first.
+func getQuakes(web *godrop.WebClient, u string) ([]Quake, error) {
+	resp, body, err := web.Get(u)
+	if err != nil {
+		return nil, fmt.Errorf("failed to perform HTTP request: %s", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unsuccessful request: %s", resp.Status)
+	}
+
+	var feed struct {
+		Features []Quake `json:"features"`
+	}
+	if err := json.Unmarshal(body, &feed); err != nil {
+		return nil, fmt.Errorf("unable to decode: %s", err)
+	}
+
+	return feed.Features, nil
+}
@@ -0,0 +1,156 @@
+package godrop
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// ReconnectPolicy controls how Run reconnects.
+type ReconnectPolicy struct {
+	// Delay is how long to wait before reconnecting. Each time in a row we
+	// fail to connect and register we wait twice as long, up to MaxDelay.
+	// If they're zero we use defaultReconnectDelay and defaultMaxReconnectDelay.
+	Delay    time.Duration
+	MaxDelay time.Duration
+
+	// MaxRetries is how many times in a row we may fail to connect and
+	// register before giving up. Zero means never to give up.
+	MaxRetries int
+}
+
+const (
+	// defaultReconnectDelay is how long we wait before reconnecting if the
+	// policy doesn't say.
+	defaultReconnectDelay = 30 * time.Second
+
+	// defaultMaxReconnectDelay is the longest we wait before reconnecting if
+	// the policy doesn't say.
+	defaultMaxReconnectDelay = 10 * time.Minute
+)
+
+// SetReconnectPolicy sets how Run reconnects.
+func (c *Client) SetReconnectPolicy(p ReconnectPolicy) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.reconnect = p
+}
+
+// Run connects, registers, and reads from the server until we Quit. If the
+// connection ends some other way, we reconnect, moving on to the next server
+// if there are several. Once registered again we rejoin our channels (see
+// restoreAfterConnect).
+//
+// We wait longer between attempts the more times in a row we fail. See
+// ReconnectPolicy.
+//
+// It returns nil once we Quit, or an error if we give up.
+func (c *Client) Run() error {
+	return c.RunContext(context.Background())
+}
+
+// RunContext is like Run. Once the context is done we quit (see LoopContext)
+// and return its error.
+func (c *Client) RunContext(ctx context.Context) error {
+	c.mutex.Lock()
+	c.quitting = false
+	c.stopRun = make(chan struct{})
+	stop := c.stopRun
+	policy := c.reconnect
+	c.mutex.Unlock()
+
+	// failures is how many times in a row we failed to connect and register.
+	failures := 0
+
+	for {
+		registered, err := c.runConnection(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if c.isQuitting() {
+			return nil
+		}
+
+		if err != nil {
+			c.ReportError(fmt.Sprintf("Connection to %s failed",
+				c.CurrentServer()), err)
+		}
+
+		// Reconnect right away with TLS.
+		if err == ErrSTSUpgrade {
+			continue
+		}
+
+		if registered {
+			failures = 0
+		} else {
+			failures++
+		}
+
+		if policy.MaxRetries > 0 && failures > policy.MaxRetries {
+			return fmt.Errorf("giving up after failing to connect %d times",
+				failures)
+		}
+
+		delay := policy.delay(failures)
+		server := c.NextServer()
+		c.Log().Info("Reconnecting", "server", server, "delay", delay)
+		select {
+		case <-time.After(delay):
+		case <-stop:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// runConnection connects and stays connected until the connection ends. It
+// reports whether we registered.
+func (c *Client) runConnection(ctx context.Context) (bool, error) {
+	defer func() {
+		_ = c.Close()
+	}()
+
+	if err := c.ConnectContext(ctx); err != nil {
+		return false, fmt.Errorf("unable to connect: %s", err)
+	}
+
+	if err := c.Register(); err != nil {
+		return false, fmt.Errorf("unable to register: %s", err)
+	}
+
+	err := c.LoopContext(ctx)
+	return c.IsRegistered(), err
+}
+
+// isQuitting checks whether we sent QUIT since Run started.
+func (c *Client) isQuitting() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.quitting
+}
+
+// delay decides how long to wait before reconnecting after failing some
+// number of times in a row.
+func (p ReconnectPolicy) delay(failures int) time.Duration {
+	d := p.Delay
+	if d <= 0 {
+		d = defaultReconnectDelay
+	}
+	max := p.MaxDelay
+	if max <= 0 {
+		max = defaultMaxReconnectDelay
+	}
+
+	for i := 1; i < failures && d < max; i++ {
+		d *= 2
+	}
+
+	if d > max {
+		return max
+	}
+	return d
+}
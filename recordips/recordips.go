@@ -9,8 +9,6 @@ package recordips
 
 import (
 	"fmt"
-	"log"
-	"strings"
 	"time"
 
 	"github.com/horgh/godrop"
@@ -19,51 +17,34 @@ import (
 )
 
 func init() {
-	godrop.Hooks = append(godrop.Hooks, Hook)
+	godrop.Register("recordips", Hook)
+	godrop.RegisterConfig("recordips",
+		godrop.ConfigKey{Name: "record-ip-file", Required: true},
+	)
 }
 
 // Hook fires when an IRC message of some kind occurs.
 //
-// We look for CLICONN notices and record the IP.
-//
-// The notices look like:
-// :irc.example.com NOTICE * :*** Notice -- CLICONN will will example.com 192.168.1.2 opers will 192.168.1.2 0 will
-//
-// Note this is ircd-ratbox specific.
+// We look for CLICONN notices and record the IP. See
+// godrop.ParseClientConnect.
 func Hook(c *godrop.Client, message irc.Message) {
-	if message.Command != "NOTICE" {
+	cc, ok := godrop.ParseClientConnect(message)
+	if !ok {
 		return
 	}
 
-	// 2 parameters. * and the full notice as a single parameter.
-	if len(message.Params) != 2 {
-		return
-	}
-
-	noticePieces := strings.Fields(message.Params[1])
-
-	if len(noticePieces) < 8 {
-		return
-	}
-
-	if noticePieces[3] != "CLICONN" {
-		return
-	}
-
-	ipFile, exists := c.Config["record-ip-file"]
+	ipFile, exists := c.Conf()["record-ip-file"]
 	if !exists {
 		return
 	}
 
-	nick := noticePieces[4]
-	ip := noticePieces[7]
-
-	comment := fmt.Sprintf("IRC: %s", nick)
+	comment := fmt.Sprintf("IRC: %s", cc.Nick)
 
-	if err := cidrlist.RecordIP(ipFile, ip, comment, time.Now()); err != nil {
-		log.Printf("recordips: Unable to record IP: %s", err)
+	if err := cidrlist.RecordIP(ipFile, cc.IP, comment, time.Now()); err != nil {
+		c.PluginError("recordips", fmt.Errorf("unable to record IP: %s", err))
 		return
 	}
 
-	log.Printf("recordips: Recorded IP: %s (%s)", ip, nick)
+	c.Log().Info("Recorded IP", "plugin", "recordips", "ip", cc.IP,
+		"nick", cc.Nick)
 }
@@ -0,0 +1,342 @@
+package godrop
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+// plugin is a registered plugin.
+type plugin struct {
+	name    string
+	handler Handler
+
+	// allEvents is true if the plugin sees the events only EventHooks see
+	// otherwise. See RegisterAllEventsHook.
+	allEvents bool
+}
+
+// pluginHealth is how a plugin is doing on a client.
+type pluginHealth struct {
+	calls         int64
+	totalTime     time.Duration
+	maxTime       time.Duration
+	errors        int64
+	lastError     string
+	lastErrorTime time.Time
+	panics        int64
+	lastPanic     string
+	lastPanicTime time.Time
+	restarts      int64
+	dropped       int64
+
+	// dropping is how many messages we dropped since the plugin's queue last
+	// had room.
+	dropping int64
+}
+
+// registry holds the plugins packages registered.
+var registry = struct {
+	sync.Mutex
+	plugins map[string]*plugin
+}{plugins: map[string]*plugin{}}
+
+// PluginStatus describes a plugin's health on a client.
+type PluginStatus struct {
+	Name string
+
+	// Calls is how many times we called the plugin's hook.
+	Calls int64
+
+	// TotalTime is how long the plugin's hook took over all calls. MaxTime is
+	// how long the slowest call took.
+	TotalTime time.Duration
+	MaxTime   time.Duration
+
+	// Errors is how many errors the plugin reported with PluginError.
+	// LastError and LastErrorTime describe the most recent one.
+	Errors        int64
+	LastError     string
+	LastErrorTime time.Time
+
+	// Panics is how many times the plugin's hook panicked. LastPanic and
+	// LastPanicTime describe the most recent one.
+	Panics        int64
+	LastPanic     string
+	LastPanicTime time.Time
+
+	// Restarts is how many times we restarted goroutines the plugin runs with
+	// Go.
+	Restarts int64
+
+	// Dropped is how many messages we didn't give the plugin because it was
+	// too far behind.
+	Dropped int64
+}
+
+// Register makes a plugin available under a name. Packages call this from an
+// init() function.
+//
+// By default clients call every registered plugin's hook with every message.
+// Use SetPlugins to choose which run, or AddHandler and RemoveHandler to
+// change them while running.
+//
+// The hook may be nil if the plugin only has commands (see RegisterCommand).
+//
+// It panics if a plugin with the name is already registered.
+func Register(name string, hook func(*Client, irc.Message)) {
+	registry.Lock()
+	defer registry.Unlock()
+
+	if _, ok := registry.plugins[name]; ok {
+		panic(fmt.Sprintf("plugin %s registered twice", name))
+	}
+	registry.plugins[name] = &plugin{
+		name:    name,
+		handler: HandlerFunc(name, hook),
+	}
+}
+
+// RegisterEventHook is like Register, but the hook gets each message as an
+// Event. This gives it the message's tags, such as msgid, the time the
+// server says it happened (server-time), and the sender's account
+// (account-tag).
+//
+// Unlike hooks in EventHooks, it runs only on clients that run the plugin,
+// in the plugin's own goroutine, and it doesn't see our own messages or
+// history.
+func RegisterEventHook(name string, hook func(*Client, Event)) {
+	registry.Lock()
+	defer registry.Unlock()
+
+	if _, ok := registry.plugins[name]; ok {
+		panic(fmt.Sprintf("plugin %s registered twice", name))
+	}
+	registry.plugins[name] = &plugin{
+		name:    name,
+		handler: EventHandlerFunc(name, hook),
+	}
+}
+
+// RegisterAllEventsHook is like RegisterEventHook, but the hook also sees
+// what only EventHooks see otherwise: our own messages, history, and events
+// that don't come from the server, such as EventReload. This is for plugins
+// that pass on everything, such as to other IRC clients.
+//
+// We don't run commands in our own messages or history.
+func RegisterAllEventsHook(name string, hook func(*Client, Event)) {
+	registry.Lock()
+	defer registry.Unlock()
+
+	if _, ok := registry.plugins[name]; ok {
+		panic(fmt.Sprintf("plugin %s registered twice", name))
+	}
+	registry.plugins[name] = &plugin{
+		name:      name,
+		handler:   EventHandlerFunc(name, hook),
+		allEvents: true,
+	}
+}
+
+// Plugins lists the names of the registered plugins.
+func Plugins() []string {
+	registry.Lock()
+	defer registry.Unlock()
+
+	var names []string
+	for name := range registry.plugins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// PluginStatuses describes the health of each registered plugin on the
+// client.
+func (c *Client) PluginStatuses() []PluginStatus {
+	c.healthMutex.Lock()
+	defer c.healthMutex.Unlock()
+
+	var statuses []PluginStatus
+	for _, name := range Plugins() {
+		h, ok := c.health[name]
+		if !ok {
+			statuses = append(statuses, PluginStatus{Name: name})
+			continue
+		}
+		statuses = append(statuses, PluginStatus{
+			Name:          name,
+			Calls:         h.calls,
+			TotalTime:     h.totalTime,
+			MaxTime:       h.maxTime,
+			Errors:        h.errors,
+			LastError:     h.lastError,
+			LastErrorTime: h.lastErrorTime,
+			Panics:        h.panics,
+			LastPanic:     h.lastPanic,
+			LastPanicTime: h.lastPanicTime,
+			Restarts:      h.restarts,
+			Dropped:       h.dropped,
+		})
+	}
+	return statuses
+}
+
+// pluginHealth finds the health of the plugin on the client.
+//
+// The caller must hold healthMutex.
+func (c *Client) pluginHealth(name string) *pluginHealth {
+	if c.health == nil {
+		c.health = map[string]*pluginHealth{}
+	}
+	h, ok := c.health[name]
+	if !ok {
+		h = &pluginHealth{}
+		c.health[name] = h
+	}
+	return h
+}
+
+// AverageTime is how long a call to the plugin's hook takes on average.
+func (s PluginStatus) AverageTime() time.Duration {
+	if s.Calls == 0 {
+		return 0
+	}
+	return s.TotalTime / time.Duration(s.Calls)
+}
+
+// PluginError records an error in a plugin. Plugins call this with errors
+// they can't report any other way, such as failing to poll an API. We log it,
+// count it in the plugin's health, and report it to the error target (see
+// SetErrorTarget).
+func (c *Client) PluginError(name string, err error) {
+	c.ReportError("Plugin "+name, err)
+
+	c.healthMutex.Lock()
+	defer c.healthMutex.Unlock()
+
+	h := c.pluginHealth(name)
+	h.errors++
+	h.lastError = err.Error()
+	h.lastErrorTime = time.Now()
+}
+
+// SetPlugins chooses which registered plugins the client runs. It returns an
+// error if any are not registered.
+func (c *Client) SetPlugins(names []string) error {
+	registry.Lock()
+	var plugins []*plugin
+	for _, name := range names {
+		p, ok := registry.plugins[name]
+		if !ok {
+			registry.Unlock()
+			return fmt.Errorf("unknown plugin: %s", name)
+		}
+		plugins = append(plugins, p)
+	}
+	registry.Unlock()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.plugins = plugins
+	c.pluginsSet = true
+	return nil
+}
+
+// EnabledPlugins lists the names of the plugins the client runs, including
+// handlers added with AddHandler.
+func (c *Client) EnabledPlugins() []string {
+	var names []string
+	for _, p := range c.enabledPlugins() {
+		names = append(names, p.name)
+	}
+	return names
+}
+
+// enabledPlugins returns the plugins the client runs.
+func (c *Client) enabledPlugins() []*plugin {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.enabledPluginsLocked()
+}
+
+// enabledPluginsLocked returns the plugins the client runs.
+//
+// The caller must hold the mutex.
+func (c *Client) enabledPluginsLocked() []*plugin {
+	if c.pluginsSet {
+		return c.plugins
+	}
+
+	registry.Lock()
+	defer registry.Unlock()
+
+	var plugins []*plugin
+	for _, p := range registry.plugins {
+		plugins = append(plugins, p)
+	}
+	sort.Slice(plugins, func(i, j int) bool {
+		return plugins[i].name < plugins[j].name
+	})
+	return plugins
+}
+
+// runPlugin runs the plugin's command in the message, if any, and calls its
+// handler.
+//
+// If the hook panics, we log it, record it in the plugin's health, and report
+// it to the error target rather than crashing.
+func (c *Client) runPlugin(p *plugin, e Event) {
+	start := time.Now()
+
+	defer func() {
+		d := time.Since(start)
+
+		c.healthMutex.Lock()
+		h := c.pluginHealth(p.name)
+		h.calls++
+		h.totalTime += d
+		if d > h.maxTime {
+			h.maxTime = d
+		}
+		c.healthMutex.Unlock()
+
+		if r := recover(); r != nil {
+			c.pluginPanicked(p.name, r)
+		}
+	}()
+
+	if !hidden(e) {
+		c.runCommand(p, e)
+	}
+	if h, ok := p.handler.(EventHandler); ok {
+		h.OnEvent(c.connContext(), c, e)
+		return
+	}
+	p.handler.OnMessage(c.connContext(), c, e.Message)
+}
+
+// pluginPanicked records a panic in a plugin. We log it, record it in the
+// plugin's health, and report it to the error target.
+//
+// Call this from the deferred function that recovered so the stack trace
+// shows where it happened.
+func (c *Client) pluginPanicked(name string, r interface{}) {
+	c.Log().Error("Plugin panicked", "plugin", name, "panic", r, "stack",
+		string(debug.Stack()))
+	c.forwardError(fmt.Sprintf("Plugin %s panicked: %v", name, r))
+
+	c.healthMutex.Lock()
+	defer c.healthMutex.Unlock()
+
+	h := c.pluginHealth(name)
+	h.panics++
+	h.lastPanic = fmt.Sprintf("%v", r)
+	h.lastPanicTime = time.Now()
+}
@@ -0,0 +1,421 @@
+// Package remind provides reminders.
+//
+// Usage:
+// - !remind me in <duration> [to] <message> - Remind yourself after a while.
+//   Duration is something like 10m, 1h30m, or 2d.
+// - !remind <nick> at [YYYY-MM-DD] <HH:MM> [to] <message> - Remind someone at
+//   a time. The time is in the channel's timezone (see godrop's
+//   ChannelSettings). Without a date it's the next time it's that time.
+// - !reminders - List reminders you set or that are for you.
+// - !remind cancel <number> - Cancel a reminder. The number is the one shown
+//   by !reminders.
+//
+// When a reminder is due we mention the person on the channel it was set on
+// if they're there. Otherwise, or if it was set privately, we message them.
+//
+// Reminders are kept in persistent storage so they survive restarts. This
+// requires storage-file to be set.
+package remind
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/horgh/godrop"
+	"github.com/horgh/irc"
+)
+
+func init() {
+	godrop.Register("remind", Hook)
+	godrop.RegisterConfig("remind",
+		godrop.ConfigKey{Name: "storage-file", Required: true},
+	)
+	godrop.RegisterCommand("remind", godrop.Command{
+		Name:    "remind",
+		Usage:   "<me|nick> <in <duration>|at [date] <HH:MM>> [to] <message>",
+		Help:    "Set a reminder.",
+		MinArgs: 2,
+		Run:     triggerRemind,
+	})
+	godrop.RegisterCommand("remind", godrop.Command{
+		Name: "reminders",
+		Help: "List reminders you set or that are for you.",
+		Run:  triggerReminders,
+	})
+}
+
+var remindRE = regexp.MustCompile(
+	`(?i)^(\S+)\s+(?:in\s+(\S+)|at\s+(?:(\d{4}-\d{2}-\d{2})\s+)?` +
+		`(\d{1,2}:\d{2}))\s+(?:to\s+)?(.+)$`)
+
+const (
+	// bucket is the storage bucket holding reminders keyed by ID.
+	bucket = "reminders"
+
+	// Limit how many reminders each person may set.
+	maxRemindersPerNick = 20
+
+	// Limit how far away reminders may be.
+	maxDuration = 365 * 24 * time.Hour
+)
+
+// Reminder is a message to send someone later.
+type Reminder struct {
+	ID string
+
+	// From is who set it. Nick is who it's for.
+	From string
+	Nick string
+
+	// Target is where it was set.
+	Target  string
+	Message string
+	Due     time.Time
+}
+
+var (
+	mutex sync.Mutex
+
+	// scheduled holds the reminders we've scheduled keyed by client and ID.
+	// Each client schedules its own since a client that's shut down doesn't
+	// send them.
+	scheduled = map[scheduleKey]*time.Timer{}
+)
+
+// scheduleKey identifies a reminder a client scheduled.
+type scheduleKey struct {
+	c  *godrop.Client
+	id string
+}
+
+// Hook fires when an IRC message of some kind occurs.
+func Hook(c *godrop.Client, m irc.Message) {
+	// Schedule reminders from storage once we're connected. We do this on every
+	// connect. Anything that failed to send while we were disconnected gets
+	// tried again.
+	if m.Command == irc.ReplyWelcome {
+		restoreReminders(c)
+	}
+}
+
+// triggerRemind handles !remind
+func triggerRemind(c *godrop.Client, m irc.Message, args []string) error {
+	target := godrop.ReplyTarget(m)
+	source := godrop.SourceNick(m)
+
+	if strings.EqualFold(args[0], "cancel") && len(args) == 2 {
+		return cancelReminder(c, target, source, args[1])
+	}
+
+	matches := remindRE.FindStringSubmatch(strings.Join(args, " "))
+	if matches == nil {
+		return c.Message(target, "Usage: !remind <me|nick> "+
+			"<in <duration>|at [date] <HH:MM>> [to] <message>")
+	}
+
+	nick := matches[1]
+	if strings.EqualFold(nick, "me") {
+		nick = source
+	}
+
+	now := time.Now()
+	var due time.Time
+	if matches[2] != "" {
+		d, err := godrop.ParseDuration(matches[2])
+		if err != nil || d <= 0 {
+			return c.Message(target, fmt.Sprintf(
+				"%s: Invalid duration: %s. Try something like 10m or 1h30m.",
+				source, matches[2]))
+		}
+		due = now.Add(d)
+	} else {
+		var err error
+		due, err = parseTime(matches[3], matches[4],
+			c.ChannelSettings(target).Location(), now)
+		if err != nil {
+			return c.Message(target, fmt.Sprintf("%s: %s", source, err))
+		}
+	}
+
+	if due.Sub(now) > maxDuration {
+		return c.Message(target, fmt.Sprintf(
+			"%s: Reminders may be at most %d days away.", source,
+			maxDuration/(24*time.Hour)))
+	}
+
+	reminders, err := getReminders(c, source, true)
+	if err != nil {
+		return fmt.Errorf("unable to look up reminders: %s", err)
+	}
+	if len(reminders) >= maxRemindersPerNick {
+		return c.Message(target, fmt.Sprintf("%s: You have too many reminders.",
+			source))
+	}
+
+	store, err := c.Storage()
+	if err != nil {
+		return err
+	}
+
+	r := Reminder{
+		ID:      strconv.FormatInt(now.UnixNano(), 10),
+		From:    source,
+		Nick:    nick,
+		Target:  target,
+		Message: strings.TrimSpace(matches[5]),
+		Due:     due,
+	}
+	if err := store.Put(bucket, r.ID, r); err != nil {
+		return fmt.Errorf("unable to store reminder: %s", err)
+	}
+
+	schedule(c, r)
+
+	who := "you"
+	if godrop.Canonicalize(nick) != godrop.Canonicalize(source) {
+		who = nick
+	}
+	return c.Message(target, fmt.Sprintf("%s: I'll remind %s at %s.", source,
+		who, c.ChannelSettings(target).FormatTime(due)))
+}
+
+// triggerReminders handles !reminders
+func triggerReminders(c *godrop.Client, m irc.Message, args []string) error {
+	target := godrop.ReplyTarget(m)
+	source := godrop.SourceNick(m)
+
+	reminders, err := getReminders(c, source, false)
+	if err != nil {
+		return fmt.Errorf("unable to look up reminders: %s", err)
+	}
+
+	if len(reminders) == 0 {
+		return c.Message(target, fmt.Sprintf("%s: You have no reminders.",
+			source))
+	}
+
+	settings := c.ChannelSettings(target)
+	for i, r := range reminders {
+		if err := c.Message(target, fmt.Sprintf("%s: #%d: %s for %s from %s: %s",
+			source, i+1, settings.FormatTime(r.Due), r.Nick, r.From,
+			r.Message)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cancelReminder cancels one of the reminders listed by !reminders.
+func cancelReminder(c *godrop.Client, target, nick, number string) error {
+	reminders, err := getReminders(c, nick, false)
+	if err != nil {
+		return fmt.Errorf("unable to look up reminders: %s", err)
+	}
+
+	n, err := strconv.Atoi(number)
+	if err != nil || n < 1 || n > len(reminders) {
+		return c.Message(target, fmt.Sprintf("%s: No such reminder.", nick))
+	}
+
+	r := reminders[n-1]
+
+	store, err := c.Storage()
+	if err != nil {
+		return err
+	}
+
+	if err := store.Delete(bucket, r.ID); err != nil {
+		return fmt.Errorf("unable to delete reminder: %s", err)
+	}
+
+	mutex.Lock()
+	if t, ok := scheduled[scheduleKey{c, r.ID}]; ok {
+		t.Stop()
+		delete(scheduled, scheduleKey{c, r.ID})
+	}
+	mutex.Unlock()
+
+	return c.Message(target, fmt.Sprintf("%s: Reminder #%d cancelled.", nick,
+		n))
+}
+
+// getReminders retrieves the reminders the nick set ordered by when they are
+// due. Unless onlySet is true, this includes reminders for them. We include
+// ones from nicks they recently changed from.
+func getReminders(c *godrop.Client, nick string,
+	onlySet bool) ([]Reminder, error) {
+	reminders, err := getAllReminders(c)
+	if err != nil {
+		return nil, err
+	}
+
+	nicks := map[string]struct{}{godrop.Canonicalize(nick): {}}
+	for _, n := range c.PreviousNicks(nick) {
+		nicks[godrop.Canonicalize(n)] = struct{}{}
+	}
+
+	var nickReminders []Reminder
+	for _, r := range reminders {
+		if _, ok := nicks[godrop.Canonicalize(r.From)]; ok {
+			nickReminders = append(nickReminders, r)
+			continue
+		}
+		if _, ok := nicks[godrop.Canonicalize(r.Nick)]; ok && !onlySet {
+			nickReminders = append(nickReminders, r)
+		}
+	}
+
+	return nickReminders, nil
+}
+
+// getAllReminders retrieves every reminder from storage ordered by when they
+// are due.
+func getAllReminders(c *godrop.Client) ([]Reminder, error) {
+	store, err := c.Storage()
+	if err != nil {
+		return nil, err
+	}
+
+	ids, err := store.Keys(bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	var reminders []Reminder
+	for _, id := range ids {
+		var r Reminder
+		ok, err := store.Get(bucket, id, &r)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		reminders = append(reminders, r)
+	}
+
+	sort.Slice(reminders, func(i, j int) bool {
+		return reminders[i].Due.Before(reminders[j].Due)
+	})
+
+	return reminders, nil
+}
+
+// restoreReminders schedules every stored reminder that is not yet scheduled.
+func restoreReminders(c *godrop.Client) {
+	reminders, err := getAllReminders(c)
+	if err != nil {
+		c.PluginError("remind", fmt.Errorf("unable to restore reminders: %s",
+			err))
+		return
+	}
+
+	for _, r := range reminders {
+		schedule(c, r)
+	}
+}
+
+// schedule arranges for the reminder to be sent. If it is already scheduled
+// we do nothing.
+func schedule(c *godrop.Client, r Reminder) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if _, ok := scheduled[scheduleKey{c, r.ID}]; ok {
+		return
+	}
+
+	d := time.Until(r.Due)
+	if d < 0 {
+		d = 0
+	}
+
+	scheduled[scheduleKey{c, r.ID}] = c.After("remind", d,
+		func(c *godrop.Client) {
+			fire(c, r.ID)
+		})
+}
+
+// fire sends the reminder.
+func fire(c *godrop.Client, id string) {
+	mutex.Lock()
+	delete(scheduled, scheduleKey{c, id})
+	mutex.Unlock()
+
+	store, err := c.Storage()
+	if err != nil {
+		c.PluginError("remind", fmt.Errorf("unable to send reminder: %s", err))
+		return
+	}
+
+	// Look it up again in case it was cancelled.
+	var r Reminder
+	ok, err := store.Get(bucket, id, &r)
+	if err != nil {
+		c.PluginError("remind", fmt.Errorf("unable to send reminder: %s", err))
+		return
+	}
+	if !ok {
+		return
+	}
+
+	// If they changed their nick, address them by their new one.
+	nick, _ := c.CurrentNick(r.Nick)
+
+	message := "Reminder: " + r.Message
+	if godrop.Canonicalize(r.From) != godrop.Canonicalize(r.Nick) {
+		message = fmt.Sprintf("Reminder from %s: %s", r.From, r.Message)
+	}
+
+	target := nick
+	if godrop.IsChannel(r.Target) {
+		if _, ok := c.Member(r.Target, nick); ok {
+			target = r.Target
+			message = nick + ": " + message
+		}
+	}
+
+	// If we can't send it, leave it in storage. We'll try again when we next
+	// connect.
+	if err := c.Message(target, message); err != nil {
+		c.PluginError("remind", fmt.Errorf("unable to send reminder: %s", err))
+		return
+	}
+
+	if err := store.Delete(bucket, id); err != nil {
+		c.PluginError("remind", fmt.Errorf("unable to delete reminder: %s", err))
+	}
+}
+
+// parseTime parses a time of day such as 18:00 and an optional date such as
+// 2020-01-02 in the location. Without a date it's the next time it's that
+// time of day.
+func parseTime(date, clock string, loc *time.Location,
+	now time.Time) (time.Time, error) {
+	if date == "" {
+		t, err := time.ParseInLocation("15:04", clock, loc)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid time: %s", clock)
+		}
+		y, mo, d := now.In(loc).Date()
+		due := time.Date(y, mo, d, t.Hour(), t.Minute(), 0, 0, loc)
+		if !due.After(now) {
+			due = due.AddDate(0, 0, 1)
+		}
+		return due, nil
+	}
+
+	due, err := time.ParseInLocation("2006-01-02 15:04", date+" "+clock, loc)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time: %s %s", date, clock)
+	}
+	if !due.After(now) {
+		return time.Time{}, fmt.Errorf("that time has passed")
+	}
+	return due, nil
+}
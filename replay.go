@@ -0,0 +1,239 @@
+package godrop
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TranscriptLine is a line from a transcript written by SetTranscriptDir.
+type TranscriptLine struct {
+	Time time.Time
+
+	// Sent is true if we sent the line and false if we received it.
+	Sent bool
+
+	Line string
+}
+
+// ReadTranscript reads a transcript written by SetTranscriptDir.
+func ReadTranscript(r io.Reader) ([]TranscriptLine, error) {
+	var lines []TranscriptLine
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		if scanner.Text() == "" {
+			continue
+		}
+
+		// <time> <direction> <line>
+		fields := strings.SplitN(scanner.Text(), " ", 3)
+		if len(fields) != 3 || (fields[1] != "<" && fields[1] != ">") {
+			return nil, fmt.Errorf("line %d: invalid transcript line", n)
+		}
+
+		t, err := time.Parse("2006-01-02T15:04:05.000Z", fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid time: %s", n, err)
+		}
+
+		lines = append(lines, TranscriptLine{
+			Time: t,
+			Sent: fields[1] == ">",
+			Line: fields[2],
+		})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read transcript: %s", err)
+	}
+
+	return lines, nil
+}
+
+// Replay runs the client as if a server sent it the given lines. It returns
+// the lines the client sent.
+//
+// We register first as though we just connected. Messages are sent right
+// away rather than queued so they come out in a predictable order. We don't
+// ping to measure lag.
+//
+// This is for checking how the client and its plugins handle real protocol
+// traffic, such as from a transcript. Messages plugins send from their own
+// goroutines may or may not be included.
+func (c *Client) Replay(received []string) ([]string, error) {
+	buf := &bytes.Buffer{}
+	for _, line := range received {
+		buf.WriteString(strings.TrimRight(line, "\r\n") + "\r\n")
+	}
+
+	conn := &replayConn{in: buf}
+
+	c.mutex.Lock()
+	c.replaying = true
+	c.replaySecrets = map[string]bool{}
+	c.mutex.Unlock()
+
+	defer func() {
+		_ = c.Close()
+		c.mutex.Lock()
+		c.replaying = false
+		c.mutex.Unlock()
+	}()
+
+	c.setConn(conn)
+
+	if err := c.Register(); err != nil {
+		return nil, err
+	}
+
+	if err := c.Loop(); err != nil && err != io.EOF {
+		return conn.sent(), err
+	}
+
+	return conn.sent(), nil
+}
+
+// ReplayResult is the result of ReplayTranscript.
+type ReplayResult struct {
+	// Sent holds the lines the client sent.
+	Sent []string
+
+	// Want holds the lines the transcript shows we sent.
+	Want []string
+}
+
+// ReplayTranscript replays the lines a transcript shows we received. See
+// Replay.
+//
+// Lines that depend on when they were sent, such as pings to measure lag,
+// are left out of the result. Passwords are redacted the same as in
+// transcripts.
+func (c *Client) ReplayTranscript(file string) (*ReplayResult, error) {
+	fh, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open transcript: %s", err)
+	}
+	defer func() {
+		_ = fh.Close()
+	}()
+
+	lines, err := ReadTranscript(fh)
+	if err != nil {
+		return nil, err
+	}
+
+	var received []string
+	result := &ReplayResult{}
+	for _, l := range lines {
+		if !l.Sent {
+			received = append(received, l.Line)
+			continue
+		}
+		if !isLagPing(l.Line) {
+			result.Want = append(result.Want, l.Line)
+		}
+	}
+
+	sent, err := c.Replay(received)
+
+	c.mutex.Lock()
+	secrets := c.replaySecrets
+	c.mutex.Unlock()
+
+	for _, line := range sent {
+		if secrets[line] {
+			result.Sent = append(result.Sent, redactSecret(line))
+			continue
+		}
+		result.Sent = append(result.Sent, redactLine(line))
+	}
+
+	return result, err
+}
+
+// Diff describes how what we sent differs from what the transcript shows.
+// It's blank if they're the same.
+func (r *ReplayResult) Diff() string {
+	for i := 0; i < len(r.Sent) || i < len(r.Want); i++ {
+		switch {
+		case i >= len(r.Sent):
+			return fmt.Sprintf("line %d: sent nothing, want %q", i+1, r.Want[i])
+		case i >= len(r.Want):
+			return fmt.Sprintf("line %d: sent %q, want nothing", i+1, r.Sent[i])
+		case r.Sent[i] != r.Want[i]:
+			return fmt.Sprintf("line %d: sent %q, want %q", i+1, r.Sent[i],
+				r.Want[i])
+		}
+	}
+	return ""
+}
+
+// recordReplaySecret remembers that we sent a line with SendSecret while
+// replaying so ReplayTranscript redacts it the same as the transcript does.
+func (c *Client) recordReplaySecret(line string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.replaying {
+		c.replaySecrets[strings.TrimRight(line, "\r\n")] = true
+	}
+}
+
+// isLagPing checks whether the line is one of our pings to measure lag.
+func isLagPing(line string) bool {
+	return strings.HasPrefix(line, "PING ") &&
+		strings.Contains(line, lagPingPrefix)
+}
+
+// replayConn is a connection for Replay. Reads come from a buffer and writes
+// go to another.
+type replayConn struct {
+	mutex sync.Mutex
+	in    io.Reader
+	out   bytes.Buffer
+}
+
+func (r *replayConn) Read(p []byte) (int, error) {
+	return r.in.Read(p)
+}
+
+func (r *replayConn) Write(p []byte) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.out.Write(p)
+}
+
+// sent returns the lines written.
+func (r *replayConn) sent() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var lines []string
+	for _, line := range strings.Split(r.out.String(), "\r\n") {
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func (r *replayConn) Close() error                     { return nil }
+func (r *replayConn) LocalAddr() net.Addr              { return replayAddr{} }
+func (r *replayConn) RemoteAddr() net.Addr             { return replayAddr{} }
+func (r *replayConn) SetDeadline(time.Time) error      { return nil }
+func (r *replayConn) SetReadDeadline(time.Time) error  { return nil }
+func (r *replayConn) SetWriteDeadline(time.Time) error { return nil }
+
+type replayAddr struct{}
+
+func (replayAddr) Network() string { return "replay" }
+func (replayAddr) String() string  { return "replay" }
@@ -0,0 +1,199 @@
+// Package restart lets owners restart and upgrade the bot.
+//
+// Usage:
+// - !restart - Quit and start the program again.
+// - !upgrade - Run the upgrade command and then restart if it succeeds.
+//
+// Only owners may use these. Owners are set by the owners config key.
+//
+// Restarting runs the program's binary again, so if the binary changed we run
+// the new one. Plugin data in storage stays as it is. Once we're back we tell
+// the error-target (such as a debug channel) the old and new versions.
+//
+// The program must set Restart, Version, and PreviousVersion for this to
+// work.
+//
+// Configuration options:
+// - owners - Space separated nick!user@host masks and $a:account entries of
+//   who may use these, like admins. Required.
+// - restart-upgrade-command - A shell command to run for !upgrade, such as
+//   cd /home/bot/godrop && git pull && go install ./cmd/godrop.
+// - restart-upgrade-timeout - How long the upgrade command may take. Default
+//   5m.
+package restart
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/horgh/godrop"
+	"github.com/horgh/irc"
+)
+
+func init() {
+	godrop.Register("restart", Hook)
+	godrop.RegisterConfig("restart",
+		godrop.ConfigKey{Name: "owners", Required: true},
+		godrop.ConfigKey{Name: "restart-upgrade-command"},
+		godrop.ConfigKey{
+			Name: "restart-upgrade-timeout",
+			Kind: godrop.ConfigDuration,
+		},
+	)
+	godrop.RegisterCommand("restart", godrop.Command{
+		Name:  "restart",
+		Help:  "Quit and start the program again.",
+		Owner: true,
+		Run:   restart,
+	})
+	godrop.RegisterCommand("restart", godrop.Command{
+		Name:  "upgrade",
+		Help:  "Upgrade and restart.",
+		Owner: true,
+		Run:   startUpgrade,
+	})
+}
+
+// Restart is called to restart. Programs that can restart themselves should
+// set it.
+var Restart func() error
+
+// Version is the version of the running program. PreviousVersion is the
+// version that ran before we restarted, if we did.
+var Version, PreviousVersion string
+
+const defaultUpgradeTimeout = 5 * time.Minute
+
+var mutex sync.Mutex
+
+// upgrading is true while the upgrade command runs.
+var upgrading bool
+
+// reported is true once we told the error target about restarting.
+var reported bool
+
+// Hook fires when an IRC message of some kind occurs.
+//
+// We report restarting on the first message we see. Reports made before we
+// register are held until we have, so they go out after we rejoin.
+func Hook(c *godrop.Client, m irc.Message) {
+	reportRestart(c)
+}
+
+// restart runs !restart.
+func restart(c *godrop.Client, m irc.Message, args []string) error {
+	if Restart == nil {
+		return fmt.Errorf("restarting is not supported")
+	}
+
+	_ = c.Message(godrop.ReplyTarget(m), fmt.Sprintf("%s: Restarting.",
+		godrop.SourceNick(m)))
+	return Restart()
+}
+
+// startUpgrade runs !upgrade.
+func startUpgrade(c *godrop.Client, m irc.Message,
+	args []string) error {
+	if Restart == nil {
+		return fmt.Errorf("restarting is not supported")
+	}
+
+	command := c.Conf().GetString("restart-upgrade-command")
+	if command == "" {
+		return fmt.Errorf("no restart-upgrade-command configured")
+	}
+
+	mutex.Lock()
+	if upgrading {
+		mutex.Unlock()
+		return fmt.Errorf("already upgrading")
+	}
+	upgrading = true
+	mutex.Unlock()
+
+	target := godrop.ReplyTarget(m)
+	source := godrop.SourceNick(m)
+	_ = c.Message(target, fmt.Sprintf("%s: Upgrading.", source))
+
+	// The command may take a while. Don't hold up other plugins.
+	go func() {
+		defer func() {
+			mutex.Lock()
+			upgrading = false
+			mutex.Unlock()
+		}()
+
+		if err := upgrade(command, upgradeTimeout(c.Conf())); err != nil {
+			c.PluginError("restart", err)
+			_ = c.Message(target, fmt.Sprintf("%s: Unable to upgrade: %s", source,
+				err))
+			return
+		}
+
+		_ = c.Message(target, fmt.Sprintf("%s: Upgraded. Restarting.", source))
+		if err := Restart(); err != nil {
+			_ = c.Message(target, fmt.Sprintf("%s: Unable to restart: %s", source,
+				err))
+		}
+	}()
+	return nil
+}
+
+// upgrade runs the upgrade command.
+func upgrade(command string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var output bytes.Buffer
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("upgrade command timed out after %s", timeout)
+		}
+		return fmt.Errorf("upgrade command failed: %s: %s", err,
+			lastLine(output.String()))
+	}
+	return nil
+}
+
+// reportRestart tells the error target we restarted and the versions.
+func reportRestart(c *godrop.Client) {
+	mutex.Lock()
+	if reported || PreviousVersion == "" {
+		mutex.Unlock()
+		return
+	}
+	reported = true
+	mutex.Unlock()
+
+	if PreviousVersion == Version {
+		c.ReportError("restart", fmt.Errorf("restarted. Still running %s",
+			Version))
+		return
+	}
+	c.ReportError("restart", fmt.Errorf("restarted. Upgraded from %s to %s",
+		PreviousVersion, Version))
+}
+
+// lastLine finds the last line of output that isn't blank. Errors are usually
+// there.
+func lastLine(output string) string {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+func upgradeTimeout(config godrop.Config) time.Duration {
+	d := config.GetDuration("restart-upgrade-timeout", defaultUpgradeTimeout)
+	if d <= 0 {
+		return defaultUpgradeTimeout
+	}
+	return d
+}
@@ -0,0 +1,201 @@
+package godrop
+
+import (
+	"strings"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+// restoreState is what we had before a connection ended. We restore it after
+// we reconnect.
+type restoreState struct {
+	// channels we were on and their keys.
+	channels []Channel
+
+	// userModes we had.
+	userModes string
+}
+
+// serverUserModes are user modes we can't set ourselves. For example, only
+// the server sets the mode for connecting with TLS, and becoming an operator
+// requires OPER.
+const serverUserModes = "oOrzZSa"
+
+// SetNickServPassword sets a password to identify to NickServ with after we
+// connect.
+//
+// This isn't needed if we authenticate with SASL.
+func (c *Client) SetNickServPassword(password string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.nickServPassword = password
+}
+
+// saveRestoreState remembers our channels and modes so we can restore them
+// after reconnecting.
+//
+// The caller must hold the mutex.
+func (c *Client) saveRestoreState() {
+	// If we never registered, keep what we had from before.
+	if c.state.nick == "" {
+		return
+	}
+
+	// If we were waiting to join, keep what we were waiting to restore.
+	if c.joinsReleased != nil {
+		c.restore = c.heldRestore
+		c.heldRestore = nil
+		c.joinsReleased = nil
+		return
+	}
+
+	r := &restoreState{userModes: c.state.userModes}
+	for _, ch := range c.state.channels {
+		r.channels = append(r.channels, Channel{Name: ch.Name, Key: ch.Key})
+	}
+	c.restore = r
+}
+
+// HoldJoins makes us wait to join channels after we connect until
+// ReleaseJoins is called or the timeout passes. This is for handlers that
+// identify to services themselves (see the services package) so we join
+// channels that require it only once identified. While joins are held we
+// leave identifying to them rather than using the NickServ password.
+//
+// We don't wait if we authenticated with SASL. A timeout of zero stops
+// holding joins.
+func (c *Client) HoldJoins(timeout time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.joinHold = timeout
+}
+
+// ReleaseJoins lets us join channels if we're waiting to (see HoldJoins).
+func (c *Client) ReleaseJoins() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.joinsReleased != nil {
+		close(c.joinsReleased)
+		c.joinsReleased = nil
+	}
+}
+
+// restoreAfterConnect restores our state once we register.
+//
+// We identify to services and join the autojoin channels (see SetAutojoin)
+// each time we connect. If this isn't the first connection, we also rejoin
+// the channels we were on, set our user modes again, and tell EventHooks (see
+// eventHooks) with an EventResync event so plugins can restore their own
+// state.
+//
+// If joins are held (see HoldJoins) we do all but identifying once they're
+// released.
+func (c *Client) restoreAfterConnect() error {
+	c.mutex.Lock()
+	r := c.restore
+	c.restore = nil
+	password := c.nickServPassword
+	sasl := c.caps.authenticated
+	hold := c.joinHold
+	c.mutex.Unlock()
+
+	if hold > 0 && !sasl {
+		c.waitToJoin(r, hold)
+		return nil
+	}
+
+	if password != "" && !sasl {
+		if err := c.SendSecret(irc.Message{
+			Command: "PRIVMSG",
+			Params:  []string{"NickServ", "IDENTIFY " + password},
+		}, PriorityHigh); err != nil {
+			return err
+		}
+	}
+
+	return c.rejoin(r)
+}
+
+// waitToJoin rejoins once joins are released or the timeout passes.
+func (c *Client) waitToJoin(r *restoreState, timeout time.Duration) {
+	released := make(chan struct{})
+	ctx := c.connContext()
+
+	c.mutex.Lock()
+	c.joinsReleased = released
+	c.heldRestore = r
+	c.mutex.Unlock()
+
+	go func() {
+		select {
+		case <-released:
+		case <-time.After(timeout):
+			c.Log().Warn("Timed out waiting to identify. Joining channels anyway")
+		case <-ctx.Done():
+			// saveRestoreState keeps what we were waiting to restore.
+			return
+		}
+
+		c.mutex.Lock()
+		if c.joinsReleased == released {
+			c.joinsReleased = nil
+		}
+		r := c.heldRestore
+		c.heldRestore = nil
+		c.mutex.Unlock()
+
+		if err := c.rejoin(r); err != nil {
+			c.Log().Error("Unable to join channels", "error", err)
+		}
+	}()
+}
+
+// rejoin joins the autojoin channels and restores what we had before
+// reconnecting, if anything.
+func (c *Client) rejoin(r *restoreState) error {
+	var rejoining []Channel
+	if r != nil {
+		rejoining = r.channels
+	}
+	if err := c.joinAutojoin(rejoining); err != nil {
+		return err
+	}
+
+	if r == nil {
+		return nil
+	}
+
+	for _, ch := range r.channels {
+		if err := c.JoinWithKey(ch.Name, ch.Key); err != nil {
+			return err
+		}
+	}
+
+	modes := ""
+	for i := 0; i < len(r.userModes); i++ {
+		if strings.IndexByte(serverUserModes, r.userModes[i]) == -1 {
+			modes += string(r.userModes[i])
+		}
+	}
+	if modes != "" {
+		if err := c.UserMode(c.GetNick(), "+"+modes); err != nil {
+			return err
+		}
+	}
+
+	c.Log().Info("Restored channels after reconnecting", "channels",
+		len(r.channels))
+
+	e := Event{
+		Message: irc.Message{Command: "RESYNC"},
+		Time:    time.Now(),
+		Kind:    EventResync,
+	}
+	c.eventHooks(e)
+
+	return nil
+}
@@ -0,0 +1,310 @@
+// Package roulette provides chance games: Russian roulette and duels.
+//
+// Usage:
+// - !roulette - Pull the trigger. The revolver has six chambers and one
+//   bullet. After it fires, it is reloaded.
+// - !duel <nick> - Challenge someone on the channel. One of you wins.
+// - !roulette stats [nick] - Show wins and losses.
+//
+// Records are kept in persistent storage. This requires storage-file to be
+// set.
+//
+// Configuration options:
+// - roulette-cooldown - Optional. How long a channel must wait between games,
+//   such as 30s. The default is 15 seconds.
+// - roulette-kick-channels - Optional. A space separated list of channels
+//   where losers get kicked. We only kick if we are a channel operator.
+package roulette
+
+import (
+	"fmt"
+	"math/rand"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/horgh/godrop"
+	"github.com/horgh/irc"
+)
+
+func init() {
+	godrop.RegisterEventHook("roulette", Hook)
+	godrop.RegisterConfig("roulette",
+		godrop.ConfigKey{Name: "storage-file", Required: true},
+		godrop.ConfigKey{Name: "roulette-cooldown", Kind: godrop.ConfigDuration},
+		godrop.ConfigKey{Name: "roulette-kick-channels"},
+	)
+	godrop.RegisterCommand("roulette", godrop.Command{
+		Name:  "roulette",
+		Usage: "[stats [nick]]",
+		Help:  "Play Russian roulette.",
+		Run:   triggerRoulette,
+	})
+	godrop.RegisterCommand("roulette", godrop.Command{
+		Name:  "duel",
+		Usage: "<nick>",
+		Help:  "Challenge someone to a duel.",
+		Run:   triggerDuel,
+	})
+	rand.Seed(time.Now().UnixNano())
+}
+
+var statsRE = regexp.MustCompile(`(?i)^stats(?:\s+(\S+))?$`)
+
+const (
+	// bucket is the storage bucket holding records.
+	bucket = "roulette"
+
+	defaultCooldown = 15 * time.Second
+
+	chambers = 6
+)
+
+// Record is a player's history.
+type Record struct {
+	Nick   string
+	Wins   int
+	Losses int
+}
+
+// revolver is the state of a channel's revolver.
+type revolver struct {
+	// bullet is which chamber the bullet is in.
+	bullet int
+
+	// chamber is the chamber that will fire next.
+	chamber int
+}
+
+var (
+	mutex sync.Mutex
+
+	// revolvers holds each channel's revolver keyed by client and then by
+	// canonicalized channel.
+	revolvers = map[*godrop.Client]map[string]*revolver{}
+
+	// lastGame holds when each channel last played keyed by client and then by
+	// canonicalized channel.
+	lastGame = map[*godrop.Client]map[string]time.Time{}
+)
+
+// Hook fires when an IRC event occurs. We forget the client's games once it
+// shuts down.
+func Hook(c *godrop.Client, e godrop.Event) {
+	if e.Kind != godrop.EventShutdown {
+		return
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	delete(revolvers, c)
+	delete(lastGame, c)
+}
+
+// triggerRoulette handles !roulette. Games are played on channels, so we
+// ignore it and !duel in private.
+func triggerRoulette(c *godrop.Client, m irc.Message, args []string) error {
+	if !godrop.IsChannel(m.Params[0]) {
+		return nil
+	}
+
+	channel := m.Params[0]
+	nick := godrop.SourceNick(m)
+
+	text := strings.Join(args, " ")
+	if matches := statsRE.FindStringSubmatch(text); matches != nil {
+		who := matches[1]
+		if who == "" {
+			who = nick
+		}
+		showStats(c, channel, who)
+		return nil
+	}
+
+	spin(c, channel, nick)
+	return nil
+}
+
+// spin pulls the trigger of the channel's revolver.
+func spin(c *godrop.Client, channel, nick string) {
+	if !checkCooldown(c, channel) {
+		return
+	}
+
+	key := godrop.Canonicalize(channel)
+
+	mutex.Lock()
+	if revolvers[c] == nil {
+		revolvers[c] = map[string]*revolver{}
+	}
+	r, ok := revolvers[c][key]
+	if !ok {
+		r = &revolver{bullet: rand.Intn(chambers)}
+		revolvers[c][key] = r
+	}
+	fired := r.chamber == r.bullet
+	r.chamber++
+	if fired {
+		delete(revolvers[c], key)
+	}
+	mutex.Unlock()
+
+	if !fired {
+		_ = c.Message(channel, fmt.Sprintf("%s: *click*", nick))
+		record(c, nick, true)
+		return
+	}
+
+	_ = c.Message(channel, fmt.Sprintf("%s: *BANG* You're dead. Reloading...",
+		nick))
+	record(c, nick, false)
+	kickLoser(c, channel, nick, "BANG!")
+}
+
+// triggerDuel handles !duel
+func triggerDuel(c *godrop.Client, m irc.Message, args []string) error {
+	if !godrop.IsChannel(m.Params[0]) {
+		return nil
+	}
+
+	channel := m.Params[0]
+	nick := godrop.SourceNick(m)
+
+	if len(args) != 1 {
+		return c.Message(channel, fmt.Sprintf("Usage: %s <nick>",
+			c.FormatCommand("duel")))
+	}
+	opponent := args[0]
+
+	if godrop.Canonicalize(opponent) == godrop.Canonicalize(nick) {
+		return c.Message(channel, fmt.Sprintf("%s: You can't duel yourself.", nick))
+	}
+
+	member, ok := c.Member(channel, opponent)
+	if !ok {
+		return c.Message(channel, fmt.Sprintf("%s: %s isn't here.", nick, opponent))
+	}
+	opponent = member.Nick
+
+	if godrop.Canonicalize(opponent) == godrop.Canonicalize(c.GetNick()) {
+		return c.Message(channel, fmt.Sprintf("%s: I don't duel.", nick))
+	}
+
+	if !checkCooldown(c, channel) {
+		return nil
+	}
+
+	winner, loser := nick, opponent
+	if rand.Intn(2) == 0 {
+		winner, loser = opponent, nick
+	}
+
+	_ = c.Message(channel, fmt.Sprintf(
+		"%s and %s face each other at dawn... %s is faster! %s falls.", nick,
+		opponent, winner, loser))
+
+	record(c, winner, true)
+	record(c, loser, false)
+	kickLoser(c, channel, loser, fmt.Sprintf("Lost a duel to %s", winner))
+	return nil
+}
+
+// checkCooldown reports whether a game may be played on the channel now. If
+// it may, we record that one was.
+func checkCooldown(c *godrop.Client, channel string) bool {
+	cooldown := c.Conf().GetDuration("roulette-cooldown", defaultCooldown)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if lastGame[c] == nil {
+		lastGame[c] = map[string]time.Time{}
+	}
+
+	now := time.Now()
+	key := godrop.Canonicalize(channel)
+	if now.Sub(lastGame[c][key]) < cooldown {
+		return false
+	}
+	lastGame[c][key] = now
+	return true
+}
+
+// kickLoser kicks the loser if the channel opted in and we are able to.
+func kickLoser(c *godrop.Client, channel, nick, reason string) {
+	kick := false
+	for _, ch := range c.Conf().GetStringSlice("roulette-kick-channels") {
+		if godrop.Canonicalize(ch) == godrop.Canonicalize(channel) {
+			kick = true
+			break
+		}
+	}
+
+	if !kick || !c.IsOp(channel) {
+		return
+	}
+
+	if err := c.Kick(channel, nick, reason); err != nil {
+		c.Log().Error("Unable to kick", "plugin", "roulette", "nick", nick,
+			"error", err)
+	}
+}
+
+// record updates the player's record.
+func record(c *godrop.Client, nick string, won bool) {
+	store, err := c.Storage()
+	if err != nil {
+		c.Log().Error("Unable to record result", "plugin", "roulette",
+			"error", err)
+		return
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	key := godrop.Canonicalize(nick)
+
+	var r Record
+	if _, err := store.Get(bucket, key, &r); err != nil {
+		c.Log().Error("Unable to look up record", "plugin", "roulette",
+			"error", err)
+		return
+	}
+
+	r.Nick = nick
+	if won {
+		r.Wins++
+	} else {
+		r.Losses++
+	}
+
+	if err := store.Put(bucket, key, r); err != nil {
+		c.Log().Error("Unable to store record", "plugin", "roulette",
+			"error", err)
+	}
+}
+
+func showStats(c *godrop.Client, channel, nick string) {
+	store, err := c.Storage()
+	if err != nil {
+		_ = c.Message(channel, fmt.Sprintf("Unable to look up record: %s", err))
+		return
+	}
+
+	var r Record
+	ok, err := store.Get(bucket, godrop.Canonicalize(nick), &r)
+	if err != nil {
+		_ = c.Message(channel, fmt.Sprintf("Unable to look up record: %s", err))
+		return
+	}
+
+	if !ok {
+		_ = c.Message(channel, fmt.Sprintf("%s hasn't played.", nick))
+		return
+	}
+
+	_ = c.Message(channel, fmt.Sprintf("%s: %d wins, %d losses", r.Nick, r.Wins,
+		r.Losses))
+}
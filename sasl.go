@@ -0,0 +1,128 @@
+package godrop
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/horgh/irc"
+)
+
+// SetClientCertificate sets a TLS client certificate to connect with.
+//
+// If the server supports SASL, we authenticate with the EXTERNAL mechanism.
+// This means services identify us by the certificate's fingerprint (CertFP)
+// rather than a password. We log the fingerprint so you can register it with
+// services.
+func (c *Client) SetClientCertificate(certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("unable to load client certificate: %s", err)
+	}
+
+	if len(cert.Certificate) == 0 {
+		return fmt.Errorf("client certificate is empty")
+	}
+
+	sum := sha256.Sum256(cert.Certificate[0])
+	c.Log().Info("Loaded client certificate", "sha256",
+		hex.EncodeToString(sum[:]))
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.cert = &cert
+	return nil
+}
+
+// clientCertificates returns the client certificates to connect with.
+func (c *Client) clientCertificates() []tls.Certificate {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.cert == nil {
+		return nil
+	}
+	return []tls.Certificate{*c.cert}
+}
+
+// SASLAuthenticated checks whether we authenticated with SASL on this
+// connection. If so we're already identified to services.
+func (c *Client) SASLAuthenticated() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.caps.authenticated
+}
+
+// wantSASL checks whether we should request the sasl capability.
+//
+// We need a client certificate and the server must offer EXTERNAL. Servers
+// supporting CAP 302 list the mechanisms they offer. Otherwise we try it.
+//
+// The caller must hold the mutex.
+func (c *Client) wantSASL() bool {
+	if c.cert == nil || !c.tls {
+		return false
+	}
+
+	mechanisms, ok := c.caps.available["sasl"]
+	if !ok {
+		return false
+	}
+	if mechanisms == "" {
+		return true
+	}
+
+	for _, m := range strings.Split(mechanisms, ",") {
+		if strings.EqualFold(m, "EXTERNAL") {
+			return true
+		}
+	}
+	return false
+}
+
+// startSASL begins authenticating.
+func (c *Client) startSASL() error {
+	return c.WriteMessage(irc.Message{
+		Command: "AUTHENTICATE",
+		Params:  []string{"EXTERNAL"},
+	})
+}
+
+// handleSASL deals with messages during SASL authentication.
+//
+// We end capability negotiation once authentication finishes, whether or not
+// it succeeded.
+func (c *Client) handleSASL(m irc.Message) error {
+	switch m.Command {
+	case "AUTHENTICATE":
+		// The server is ready for our credentials. With EXTERNAL they come from
+		// the certificate so we send nothing.
+		if len(m.Params) > 0 && m.Params[0] == "+" {
+			return c.WriteMessage(irc.Message{
+				Command: "AUTHENTICATE",
+				Params:  []string{"+"},
+			})
+		}
+
+	case "903":
+		// RPL_SASLSUCCESS
+		c.Log().Info("SASL authentication succeeded")
+		c.mutex.Lock()
+		c.caps.authenticated = true
+		c.mutex.Unlock()
+		return c.capEnd()
+
+	case "902", "904", "905", "906", "907", "908":
+		// ERR_NICKLOCKED, ERR_SASLFAIL, ERR_SASLTOOLONG, ERR_SASLABORTED,
+		// ERR_SASLALREADY, RPL_SASLMECHS
+		c.Log().Warn("SASL authentication failed", "reply",
+			strings.Join(m.Params, " "))
+		return c.capEnd()
+	}
+
+	return nil
+}
@@ -0,0 +1,188 @@
+package godrop
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// After calls the function in its own goroutine after the duration elapses.
+//
+// The function may send messages. Since the client may not be connected when
+// it runs, it should be prepared for sending to fail.
+//
+// The timer may be used to cancel the call.
+//
+// name is the plugin scheduling it. If the function panics, we report it to
+// the error target rather than crashing, and count it in the plugin's health
+// (see PluginStatuses). It doesn't run if the client was shut down (see
+// Shutdown).
+func (c *Client) After(name string, d time.Duration,
+	fn func(*Client)) *time.Timer {
+	return time.AfterFunc(d, func() {
+		c.runScheduled(name, fn)
+	})
+}
+
+// runScheduled calls a function the plugin scheduled unless the client was
+// shut down. If it panics we recover and report it.
+func (c *Client) runScheduled(name string, fn func(*Client)) {
+	if c.isShutdown() {
+		return
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			c.pluginPanicked(name, r)
+		}
+	}()
+
+	fn(c)
+}
+
+// Job is a function we call repeatedly. See Every and At.
+type Job struct {
+	mutex   sync.Mutex
+	timer   *time.Timer
+	stopped bool
+
+	// name is the plugin that scheduled the job.
+	name string
+
+	// next finds when to call the function next after the given time. If
+	// there's no next time it's zero.
+	next func(time.Time) time.Time
+}
+
+// Every calls the function in its own goroutine each time the interval
+// elapses, starting one interval from now. This is for polling and such,
+// which shouldn't wait for messages to arrive.
+//
+// We start timing the next call after a call finishes, so calls don't
+// overlap. Like After, calls keep happening whether we're connected or not.
+// If a call panics we report it and keep calling. Stop the job to stop the
+// calls.
+//
+// name is the plugin scheduling it, as with After. The interval must be
+// positive.
+func (c *Client) Every(name string, d time.Duration, fn func(*Client)) *Job {
+	if d <= 0 {
+		panic("non-positive interval for Every")
+	}
+
+	j := &Job{
+		name: name,
+		next: func(t time.Time) time.Time {
+			return t.Add(d)
+		},
+	}
+	j.schedule(c, fn)
+	return j
+}
+
+// At calls the function in its own goroutine each time the cron schedule
+// says to. See Schedule for how to write one. For example, "0 9 * * 1-5" is
+// 09:00 on weekdays.
+//
+// Times are in the local timezone. The schedule may start with TZ=<zone> to
+// give another, such as "TZ=America/Vancouver @daily".
+//
+// If a call is still running when the next time comes, we skip that time.
+// Like Every, calls happen whether we're connected or not, and continue if
+// one panics. Stop the job to stop them. name is the plugin scheduling it, as
+// with After.
+func (c *Client) At(name, spec string, fn func(*Client)) (*Job, error) {
+	loc := time.Local
+	fields := strings.Fields(spec)
+	if len(fields) > 0 && strings.HasPrefix(strings.ToUpper(fields[0]),
+		"TZ=") {
+		l, err := time.LoadLocation(fields[0][3:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid timezone: %s", fields[0][3:])
+		}
+		loc = l
+		fields = fields[1:]
+	}
+
+	s, err := ParseSchedule(strings.Join(fields, " "))
+	if err != nil {
+		return nil, err
+	}
+	if s.Next(time.Now().In(loc)).IsZero() {
+		return nil, fmt.Errorf("the schedule never happens")
+	}
+
+	j := &Job{
+		name: name,
+		next: func(t time.Time) time.Time {
+			return s.Next(t.In(loc))
+		},
+	}
+	j.schedule(c, fn)
+	return j, nil
+}
+
+// Stop stops the job. If the function is running, it finishes, but we don't
+// call it again.
+func (j *Job) Stop() {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	j.stopped = true
+	if j.timer != nil {
+		j.timer.Stop()
+	}
+}
+
+// schedule arranges the next call of the function. We stop once the client
+// is shut down.
+func (j *Job) schedule(c *Client, fn func(*Client)) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if j.stopped || c.isShutdown() {
+		return
+	}
+
+	next := j.next(time.Now())
+	if next.IsZero() {
+		return
+	}
+
+	j.timer = time.AfterFunc(time.Until(next), func() {
+		c.runScheduled(j.name, fn)
+		j.schedule(c, fn)
+	})
+}
+
+var daysRE = regexp.MustCompile(`^([0-9]+)d(.*)$`)
+
+// ParseDuration parses a duration someone gave, such as for a reminder. We
+// accept the same as time.ParseDuration as well as a leading number of days,
+// such as 2d or 1d12h.
+func ParseDuration(s string) (time.Duration, error) {
+	s = strings.ToLower(s)
+
+	var days time.Duration
+	if matches := daysRE.FindStringSubmatch(s); matches != nil {
+		n, err := strconv.Atoi(matches[1])
+		if err != nil {
+			return 0, err
+		}
+		days = time.Duration(n) * 24 * time.Hour
+		s = matches[2]
+		if s == "" {
+			return days, nil
+		}
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+
+	return days + d, nil
+}
@@ -0,0 +1,107 @@
+package godrop
+
+import (
+	"strings"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+// SendSecret queues a message holding a password or some other secret, such
+// as a command identifying to services. It's otherwise the same as Send.
+//
+// We redact the message's last parameter wherever we'd show it: the log,
+// transcripts, and taps. We don't keep it in history or to suppress
+// duplicates. If the server echoes it back to us (see echo-message) we treat
+// the echo the same way and don't pass it to hooks.
+func (c *Client) SendSecret(m irc.Message, p Priority) error {
+	return c.sendTagged(nil, m, p, true)
+}
+
+// redactSecret hides the last parameter of a line. This is where messages
+// sent with SendSecret hold their secret.
+func redactSecret(line string) string {
+	line = strings.TrimRight(line, "\r\n")
+
+	// Tags can't hold spaces, and neither can the prefix, so the first " :"
+	// starts the trailing parameter.
+	if i := strings.Index(line, " :"); i != -1 {
+		return line[:i] + " :<redacted>"
+	}
+	if i := strings.LastIndex(line, " "); i != -1 {
+		return line[:i] + " <redacted>"
+	}
+	return line
+}
+
+// expectSecretEcho remembers a secret line we sent so we recognize it if the
+// server echoes it back.
+func (c *Client) expectSecretEcho(line string) {
+	if !c.HasCap("echo-message") {
+		return
+	}
+
+	_, key, ok := parseEcho(line)
+	if !ok {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.secretEchoes == nil {
+		c.secretEchoes = map[string]time.Time{}
+	}
+	c.secretEchoes[key] = time.Now()
+}
+
+// isSecretEcho checks whether a line we read is the server echoing a secret
+// line we sent. If so we stop waiting for it.
+func (c *Client) isSecretEcho(line string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if len(c.secretEchoes) == 0 {
+		return false
+	}
+
+	now := time.Now()
+	for k, t := range c.secretEchoes {
+		if now.Sub(t) > echoTimeout {
+			delete(c.secretEchoes, k)
+		}
+	}
+
+	m, key, ok := parseEcho(line)
+	if !ok {
+		return false
+	}
+	if _, ok := c.secretEchoes[key]; !ok {
+		return false
+	}
+	if Canonicalize(SourceNick(m)) != Canonicalize(c.currentNick()) {
+		return false
+	}
+
+	delete(c.secretEchoes, key)
+	return true
+}
+
+// parseEcho parses a PRIVMSG or NOTICE and identifies it by its command,
+// target, and text. The server's echo of a message we sent has the same key
+// as the message. ok is false if the line isn't one of these.
+func parseEcho(line string) (irc.Message, string, bool) {
+	_, rest := splitTags(strings.TrimRight(line, "\r\n") + "\r\n")
+	m, err := irc.ParseMessage(rest)
+	if err != nil && err != irc.ErrTruncated {
+		return irc.Message{}, "", false
+	}
+
+	if (m.Command != "PRIVMSG" && m.Command != "NOTICE") ||
+		len(m.Params) != 2 {
+		return irc.Message{}, "", false
+	}
+
+	return m, m.Command + " " + Canonicalize(m.Params[0]) + " " + m.Params[1],
+		true
+}
@@ -0,0 +1,412 @@
+// Package seen tracks when we last saw each nick.
+//
+// Usage:
+// - !seen <nick> - Say when we last saw someone and what they were doing. On
+//   a channel we say what they last did there if we saw them there.
+//   Otherwise we say what they last did anywhere.
+//
+// We record people speaking, joining, parting, quitting, being kicked, and
+// changing nick on each channel we're on. We use the time the server says
+// something happened if it tells us, so messages a bouncer plays back are
+// accurate.
+//
+// We keep what we saw in persistent storage. This requires storage-file to be
+// set. We store what we see every saveInterval rather than with every message,
+// so if the bot stops we may forget the last minute.
+//
+// The reply uses the template seen. Its data is a Reply.
+package seen
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/horgh/godrop"
+	"github.com/horgh/irc"
+)
+
+func init() {
+	godrop.RegisterEventHook("seen", Hook)
+	godrop.RegisterConfig("seen",
+		godrop.ConfigKey{Name: "storage-file", Required: true},
+	)
+	godrop.RegisterTemplate("seen", "seen",
+		"{{.Nick}} was last seen {{.Ago}} ({{time .Time}}) on {{.Channel}} "+
+			"{{.Activity}}")
+	godrop.RegisterCommand("seen", godrop.Command{
+		Name:    "seen",
+		Usage:   "<nick>",
+		Help:    "Say when someone was last seen.",
+		MinArgs: 1,
+		Run:     triggerSeen,
+	})
+}
+
+const (
+	// bucket holds a Record for each nick keyed by canonicalized nick.
+	bucket = "seen"
+
+	// saveInterval is how long we wait after seeing something before storing
+	// it along with whatever else we see in the meantime.
+	saveInterval = time.Minute
+)
+
+// The things people do.
+const (
+	ActionMessage  = "message"
+	ActionJoin     = "join"
+	ActionPart     = "part"
+	ActionQuit     = "quit"
+	ActionKick     = "kick"
+	ActionNickTo   = "nick-to"
+	ActionNickFrom = "nick-from"
+)
+
+// Sighting is the last thing we saw someone do on a channel.
+type Sighting struct {
+	Nick    string
+	Channel string
+	Action  string
+
+	// Text is the message for ActionMessage, the reason for ActionPart,
+	// ActionQuit, and ActionKick, and the other nick for ActionNickTo and
+	// ActionNickFrom.
+	Text string
+
+	Time time.Time
+}
+
+// Record holds the last thing we saw someone do on each channel keyed by
+// canonicalized channel.
+type Record map[string]Sighting
+
+// Reply is the data for the seen template.
+type Reply struct {
+	Sighting
+
+	// Ago is how long ago it was, such as 3 hours ago.
+	Ago string
+
+	// Activity describes what they were doing, such as saying: hi
+	Activity string
+}
+
+var (
+	mutex sync.Mutex
+
+	// pending holds records we haven't stored yet keyed by client and then by
+	// canonicalized nick.
+	pending = map[*godrop.Client]map[string]Record{}
+)
+
+// Hook fires when an IRC message of some kind occurs.
+func Hook(c *godrop.Client, e godrop.Event) {
+	// Store what's waiting before the client is gone.
+	if e.Kind == godrop.EventShutdown {
+		save(c)
+		return
+	}
+
+	m := e.Message
+	nick := godrop.SourceNick(m)
+	if nick == "" {
+		return
+	}
+
+	switch m.Command {
+	case "PRIVMSG":
+		if len(m.Params) != 2 || !godrop.IsChannel(m.Params[0]) {
+			return
+		}
+		text := m.Params[1]
+		if strings.HasPrefix(text, "\x01ACTION ") {
+			text = "* " + nick + " " +
+				strings.TrimSuffix(strings.TrimPrefix(text, "\x01ACTION "), "\x01")
+		} else if strings.HasPrefix(text, "\x01") {
+			return
+		}
+		see(c, nick, m.Params[0], ActionMessage, text, e.Time)
+	case "JOIN":
+		if len(m.Params) == 0 {
+			return
+		}
+		see(c, nick, m.Params[0], ActionJoin, "", e.Time)
+	case "PART":
+		if len(m.Params) == 0 {
+			return
+		}
+		see(c, nick, m.Params[0], ActionPart, lastParam(m, 2), e.Time)
+	case "KICK":
+		if len(m.Params) < 2 {
+			return
+		}
+		see(c, m.Params[1], m.Params[0], ActionKick, lastParam(m, 3), e.Time)
+	case "QUIT":
+		seeEverywhere(c, nick, "", ActionQuit, lastParam(m, 1), e.Time)
+	case "NICK":
+		if len(m.Params) == 0 {
+			return
+		}
+		seeEverywhere(c, nick, m.Params[0], ActionNickTo, m.Params[0], e.Time)
+	}
+}
+
+// lastParam retrieves the message's nth parameter if it has n. It's for
+// optional reasons.
+func lastParam(m irc.Message, n int) string {
+	if len(m.Params) < n {
+		return ""
+	}
+	return m.Params[n-1]
+}
+
+// see records that someone did something on a channel.
+func see(c *godrop.Client, nick, channel, action, text string,
+	t time.Time) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	r, err := get(c, nick)
+	if err != nil {
+		c.PluginError("seen", err)
+		return
+	}
+
+	r[godrop.Canonicalize(channel)] = Sighting{
+		Nick:    nick,
+		Channel: channel,
+		Action:  action,
+		Text:    text,
+		Time:    t,
+	}
+	put(c, nick, r)
+}
+
+// seeEverywhere records that someone did something on every channel we saw
+// them on, such as quitting. If they changed nick, newNick is their new nick
+// and we record the change for it too.
+func seeEverywhere(c *godrop.Client, nick, newNick, action, text string,
+	t time.Time) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	r, err := get(c, nick)
+	if err != nil {
+		c.PluginError("seen", err)
+		return
+	}
+	if len(r) == 0 {
+		return
+	}
+
+	var newRecord Record
+	if newNick != "" {
+		newRecord, err = get(c, newNick)
+		if err != nil {
+			c.PluginError("seen", err)
+			return
+		}
+	}
+
+	for key, s := range r {
+		r[key] = Sighting{
+			Nick:    nick,
+			Channel: s.Channel,
+			Action:  action,
+			Text:    text,
+			Time:    t,
+		}
+		if newRecord != nil {
+			newRecord[key] = Sighting{
+				Nick:    newNick,
+				Channel: s.Channel,
+				Action:  ActionNickFrom,
+				Text:    nick,
+				Time:    t,
+			}
+		}
+	}
+
+	put(c, nick, r)
+	if newRecord != nil {
+		put(c, newNick, newRecord)
+	}
+}
+
+// get retrieves someone's record. It's empty if we've never seen them.
+//
+// The caller must hold the mutex.
+func get(c *godrop.Client, nick string) (Record, error) {
+	key := godrop.Canonicalize(nick)
+	if r, ok := pending[c][key]; ok {
+		return r, nil
+	}
+
+	s, err := c.Storage()
+	if err != nil {
+		return nil, err
+	}
+
+	r := Record{}
+	if _, err := s.Get(bucket, key, &r); err != nil {
+		return nil, fmt.Errorf("unable to look up %s: %s", nick, err)
+	}
+	if r == nil {
+		r = Record{}
+	}
+	return r, nil
+}
+
+// put holds someone's record to store later. If nothing was waiting to be
+// stored, we start waiting.
+//
+// The caller must hold the mutex.
+func put(c *godrop.Client, nick string, r Record) {
+	records, ok := pending[c]
+	if !ok {
+		records = map[string]Record{}
+		pending[c] = records
+		c.After("seen", saveInterval, save)
+	}
+	records[godrop.Canonicalize(nick)] = r
+}
+
+// save stores the records waiting to be stored.
+func save(c *godrop.Client) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	records := pending[c]
+	delete(pending, c)
+
+	s, err := c.Storage()
+	if err != nil {
+		c.PluginError("seen", err)
+		return
+	}
+
+	for key, r := range records {
+		if err := s.Put(bucket, key, r); err != nil {
+			c.PluginError("seen", fmt.Errorf("unable to store %s: %s", key, err))
+		}
+	}
+}
+
+// triggerSeen handles !seen
+func triggerSeen(c *godrop.Client, m irc.Message, args []string) error {
+	target := godrop.ReplyTarget(m)
+	source := godrop.SourceNick(m)
+	nick := args[0]
+
+	if godrop.Canonicalize(nick) == godrop.Canonicalize(c.GetNick()) {
+		return c.Message(target, fmt.Sprintf("%s: I'm right here.", source))
+	}
+	if godrop.Canonicalize(nick) == godrop.Canonicalize(source) {
+		return c.Message(target, fmt.Sprintf("%s: I see you.", source))
+	}
+	if godrop.IsChannel(target) {
+		if _, ok := c.Member(target, nick); ok {
+			return c.Message(target, fmt.Sprintf("%s: %s is here right now.",
+				source, nick))
+		}
+	}
+
+	mutex.Lock()
+	r, err := get(c, nick)
+	mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	s, ok := latest(r, target)
+	if !ok {
+		return c.Message(target, fmt.Sprintf("%s: I haven't seen %s.", source,
+			nick))
+	}
+
+	return c.Message(target, c.Format("seen", "seen", target, Reply{
+		Sighting: s,
+		Ago:      ago(time.Since(s.Time)),
+		Activity: describe(s),
+	}))
+}
+
+// latest finds what someone last did on the channel. If we never saw them
+// there, or it's not a channel, we find what they last did anywhere.
+func latest(r Record, channel string) (Sighting, bool) {
+	if godrop.IsChannel(channel) {
+		if s, ok := r[godrop.Canonicalize(channel)]; ok {
+			return s, true
+		}
+	}
+
+	var sightings []Sighting
+	for _, s := range r {
+		sightings = append(sightings, s)
+	}
+	if len(sightings) == 0 {
+		return Sighting{}, false
+	}
+	sort.Slice(sightings, func(i, j int) bool {
+		return sightings[i].Time.After(sightings[j].Time)
+	})
+	return sightings[0], true
+}
+
+// describe says what someone was doing.
+func describe(s Sighting) string {
+	var activity, reason string
+	switch s.Action {
+	case ActionMessage:
+		return "saying: " + s.Text
+	case ActionJoin:
+		return "joining"
+	case ActionNickTo:
+		return "changing nick to " + s.Text
+	case ActionNickFrom:
+		return "changing nick from " + s.Text
+	case ActionPart:
+		activity, reason = "leaving", s.Text
+	case ActionQuit:
+		activity, reason = "quitting", s.Text
+	case ActionKick:
+		activity, reason = "being kicked", s.Text
+	default:
+		return s.Action
+	}
+	if reason == "" {
+		return activity
+	}
+	return fmt.Sprintf("%s (%s)", activity, reason)
+}
+
+// ago describes how long ago something was in its largest unit, such as 3
+// hours ago.
+func ago(d time.Duration) string {
+	units := []struct {
+		d    time.Duration
+		name string
+	}{
+		{365 * 24 * time.Hour, "year"},
+		{7 * 24 * time.Hour, "week"},
+		{24 * time.Hour, "day"},
+		{time.Hour, "hour"},
+		{time.Minute, "minute"},
+		{time.Second, "second"},
+	}
+
+	for _, u := range units {
+		n := int(d / u.d)
+		if n == 0 {
+			continue
+		}
+		if n == 1 {
+			return fmt.Sprintf("1 %s ago", u.name)
+		}
+		return fmt.Sprintf("%d %ss ago", n, u.name)
+	}
+	return "just now"
+}
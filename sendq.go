@@ -0,0 +1,443 @@
+package godrop
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+// Priority says how soon to send a queued message relative to others.
+type Priority int
+
+const (
+	// PriorityLow is for bulk output, such as long lists. It waits for
+	// everything else.
+	PriorityLow Priority = iota
+
+	// PriorityNormal is the default.
+	PriorityNormal
+
+	// PriorityHigh is for messages that shouldn't wait behind other output,
+	// such as CTCP replies and replies to administrators.
+	PriorityHigh
+
+	numPriorities
+)
+
+const (
+	// defaultSendInterval is how often we may send a queued message once we've
+	// used up the burst. This keeps us from flooding off. We go slower if
+	// we're lagged.
+	defaultSendInterval = time.Second
+
+	// defaultSendBurst is how many queued messages we may send in a row
+	// before waiting.
+	defaultSendBurst = 4
+
+	// maxQueuedPerTarget limits how many messages may wait for each target.
+	maxQueuedPerTarget = 100
+
+	// flushPollInterval is how often Flush checks whether the queue is empty.
+	flushPollInterval = 100 * time.Millisecond
+)
+
+// sendQueue holds messages waiting to be sent.
+//
+// There is a queue for each target at each priority. We send from the highest
+// priority with anything waiting. Within a priority we take turns between
+// targets. This way lots of output to one channel doesn't hold up messages to
+// others.
+type sendQueue struct {
+	mutex sync.Mutex
+
+	levels [numPriorities]sendLevel
+
+	// wake tells the sender something was queued.
+	wake chan struct{}
+
+	// done is closed when the connection closes.
+	done chan struct{}
+}
+
+// sendLevel holds the queues at one priority.
+type sendLevel struct {
+	// queues holds the lines waiting for each target.
+	queues map[string][]queuedLine
+
+	// targets are the targets with lines waiting in the order we'll send to
+	// them.
+	targets []string
+}
+
+// queuedLine is a line waiting to be sent. secret is true if it was queued
+// with SendSecret.
+type queuedLine struct {
+	line   string
+	secret bool
+}
+
+func newSendQueue() *sendQueue {
+	q := &sendQueue{
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+	for i := range q.levels {
+		q.levels[i].queues = map[string][]queuedLine{}
+	}
+	return q
+}
+
+// push adds a line for the target.
+func (q *sendQueue) push(target string, line queuedLine, p Priority) error {
+	if p < PriorityLow || p >= numPriorities {
+		return fmt.Errorf("invalid priority: %d", p)
+	}
+
+	key := Canonicalize(target)
+
+	q.mutex.Lock()
+	level := &q.levels[p]
+	queue, ok := level.queues[key]
+	if len(queue) >= maxQueuedPerTarget {
+		q.mutex.Unlock()
+		return fmt.Errorf("too many messages queued for %s", target)
+	}
+	if !ok {
+		level.targets = append(level.targets, key)
+	}
+	level.queues[key] = append(queue, line)
+	q.mutex.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// pop takes the next line to send. It returns false if there is none.
+func (q *sendQueue) pop() (queuedLine, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for p := numPriorities - 1; p >= PriorityLow; p-- {
+		level := &q.levels[p]
+		if len(level.targets) == 0 {
+			continue
+		}
+
+		key := level.targets[0]
+		level.targets = level.targets[1:]
+
+		queue := level.queues[key]
+		line := queue[0]
+		if len(queue) == 1 {
+			delete(level.queues, key)
+		} else {
+			level.queues[key] = queue[1:]
+			level.targets = append(level.targets, key)
+		}
+
+		return line, true
+	}
+
+	return queuedLine{}, false
+}
+
+// len counts the lines waiting.
+func (q *sendQueue) len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	n := 0
+	for _, level := range q.levels {
+		for _, queue := range level.queues {
+			n += len(queue)
+		}
+	}
+	return n
+}
+
+// startSendQueue starts sending queued messages for a new connection.
+//
+// The caller must hold the mutex.
+func (c *Client) startSendQueue() {
+	q := newSendQueue()
+	c.sendq = q
+	go c.sendLoop(q)
+}
+
+// stopSendQueue stops sending queued messages and discards any still waiting.
+//
+// The caller must hold the mutex.
+func (c *Client) stopSendQueue() {
+	if c.sendq == nil {
+		return
+	}
+
+	if n := c.sendq.len(); n > 0 {
+		c.Log().Warn("Discarding queued messages", "count", n)
+	}
+
+	close(c.sendq.done)
+	c.sendq = nil
+}
+
+// sendBucket is a token bucket limiting how fast we send. Each message takes
+// a token. We gain a token each interval, up to burst.
+type sendBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens we gained since we last checked.
+func (b *sendBucket) refill(now time.Time, interval time.Duration,
+	burst int) {
+	b.tokens += float64(now.Sub(b.last)) / float64(interval)
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+	b.last = now
+}
+
+// wait says how long until we have a token.
+func (b *sendBucket) wait(interval time.Duration) time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) * float64(interval))
+}
+
+// sendLoop sends queued messages until the connection closes.
+func (c *Client) sendLoop(q *sendQueue) {
+	_, burst := c.sendRate()
+	bucket := &sendBucket{tokens: float64(burst), last: time.Now()}
+
+	for {
+		if q.len() == 0 {
+			select {
+			case <-q.wake:
+				continue
+			case <-q.done:
+				return
+			}
+		}
+
+		// Wait for a token before taking a line so a higher priority one queued
+		// meanwhile goes first.
+		interval, burst := c.sendRate()
+		bucket.refill(time.Now(), interval, burst)
+		if d := bucket.wait(interval); d > 0 {
+			select {
+			case <-time.After(d):
+				continue
+			case <-q.done:
+				return
+			}
+		}
+
+		line, ok := q.pop()
+		if !ok {
+			continue
+		}
+
+		// Don't send on a connection other than the one this was for.
+		select {
+		case <-q.done:
+			return
+		default:
+		}
+
+		if err := c.writeLine(line.line, line.secret); err != nil {
+			c.Log().Error("Unable to send queued message", "error", err)
+		}
+		bucket.tokens--
+	}
+}
+
+// sendRate decides how often we may send queued messages and how many we may
+// send in a row. If we're lagged we go slower and don't burst.
+func (c *Client) sendRate() (time.Duration, int) {
+	c.mutex.Lock()
+	interval := c.sendInterval
+	burst := c.sendBurst
+	c.mutex.Unlock()
+
+	if interval <= 0 {
+		interval = defaultSendInterval
+	}
+	if burst <= 0 {
+		burst = defaultSendBurst
+	}
+
+	if d := c.sendDelay(interval); d > interval {
+		return d, 1
+	}
+	return interval, burst
+}
+
+// SetSendRate sets how fast we send queued messages. We may send burst
+// messages in a row, and after that one each interval. The defaults are 4 and
+// 1s. Servers disconnect clients that send too fast ("Excess Flood"), so
+// check what yours allows before raising these. Zero means the default.
+func (c *Client) SetSendRate(interval time.Duration, burst int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.sendInterval = interval
+	c.sendBurst = burst
+}
+
+// QueueLength counts the messages waiting to be sent.
+func (c *Client) QueueLength() int {
+	c.mutex.Lock()
+	q := c.sendq
+	c.mutex.Unlock()
+
+	if q == nil {
+		return 0
+	}
+	return q.len()
+}
+
+// Flush waits until we've sent the queued messages. It returns an error if
+// some are still waiting after the timeout or the connection closes first.
+//
+// This is useful before quitting so the last replies go out.
+func (c *Client) Flush(timeout time.Duration) error {
+	c.mutex.Lock()
+	q := c.sendq
+	c.mutex.Unlock()
+
+	if q == nil {
+		return nil
+	}
+
+	deadline := time.After(timeout)
+	for q.len() > 0 {
+		select {
+		case <-time.After(flushPollInterval):
+		case <-q.done:
+			return fmt.Errorf("connection closed with %d messages queued",
+				q.len())
+		case <-deadline:
+			return fmt.Errorf("timed out with %d messages queued", q.len())
+		}
+	}
+	return nil
+}
+
+// Send queues a message to send.
+//
+// Unlike WriteMessage, which sends right away, queued messages are paced so
+// we don't flood off the server. Messages with a higher priority go first.
+// Messages to different targets take turns.
+//
+// An error means the message could not be queued. Once queued, a message
+// may still be discarded if the connection closes before we send it.
+func (c *Client) Send(m irc.Message, p Priority) error {
+	return c.sendTagged(nil, m, p, false)
+}
+
+// sendTagged queues a message with tags. secret is true for SendSecret.
+func (c *Client) sendTagged(tags map[string]string, m irc.Message,
+	p Priority, secret bool) error {
+	buf, err := m.Encode()
+	if err != nil && err != irc.ErrTruncated {
+		return fmt.Errorf("unable to encode message: %s", err)
+	}
+
+	if len(tags) > 0 {
+		buf = "@" + encodeTags(tags) + " " + buf
+	}
+
+	target := ""
+	if len(m.Params) > 0 {
+		target = m.Params[0]
+	}
+
+	// CTCP replies are time sensitive. For example, a PING reply measures lag.
+	if m.Command == "NOTICE" && len(m.Params) == 2 &&
+		strings.HasPrefix(m.Params[1], "\x01") && p < PriorityHigh {
+		p = PriorityHigh
+	}
+
+	c.mutex.Lock()
+	q := c.sendq
+	replaying := c.replaying
+	c.mutex.Unlock()
+
+	// Check we can send before remembering the line. Otherwise we'd suppress
+	// sending it again once we can.
+	if q == nil && !replaying {
+		return fmt.Errorf("not connected")
+	}
+
+	if !secret && c.isDuplicate(buf) {
+		c.Log().Debug("Suppressing duplicate message", "line",
+			strings.TrimRight(redactLine(buf), "\r\n"))
+		return nil
+	}
+
+	// Replay wants output in a predictable order.
+	if replaying {
+		return c.writeLine(buf, secret)
+	}
+
+	return q.push(target, queuedLine{line: buf, secret: secret}, p)
+}
+
+// SetDuplicateWindow turns on suppressing duplicate messages. If we're asked
+// to send a line identical to one we sent to the same target within the
+// window, we drop it. For example, this stops two plugins announcing the same
+// link. Zero turns this off, which is the default.
+func (c *Client) SetDuplicateWindow(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.duplicateWindow = d
+	c.recentLines = map[string]time.Time{}
+}
+
+// SuppressedDuplicates returns how many messages we dropped because they
+// were duplicates. See SetDuplicateWindow.
+func (c *Client) SuppressedDuplicates() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.suppressed
+}
+
+// isDuplicate checks whether we sent the line recently. If not, we remember
+// it.
+//
+// Lines with passwords (see redactLine) are never duplicates. We don't want
+// to keep passwords around, and we may need to identify again soon after, such
+// as when we reconnect.
+func (c *Client) isDuplicate(line string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.duplicateWindow <= 0 || redactLine(line) != line {
+		return false
+	}
+
+	now := time.Now()
+	for l, t := range c.recentLines {
+		if now.Sub(t) > c.duplicateWindow {
+			delete(c.recentLines, l)
+		}
+	}
+
+	if _, ok := c.recentLines[line]; ok {
+		c.suppressed++
+		return true
+	}
+
+	c.recentLines[line] = now
+	return false
+}
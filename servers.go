@@ -0,0 +1,116 @@
+package godrop
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Server is an IRC server to connect to.
+type Server struct {
+	Host string
+	Port int
+	TLS  bool
+}
+
+func (s Server) String() string {
+	port := strconv.Itoa(s.Port)
+	if s.TLS {
+		port = "+" + port
+	}
+	return net.JoinHostPort(s.Host, port)
+}
+
+// ParseServer parses a server given as host:port. If the port starts with +,
+// such as irc.example.com:+6697, the server uses TLS. Otherwise it uses TLS
+// if useTLS is true.
+func ParseServer(s string, useTLS bool) (Server, error) {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return Server{}, fmt.Errorf("invalid server: %s: %s", s, err)
+	}
+
+	if strings.HasPrefix(port, "+") {
+		useTLS = true
+		port = port[1:]
+	}
+
+	n, err := strconv.Atoi(port)
+	if err != nil || n <= 0 || n > 65535 {
+		return Server{}, fmt.Errorf("invalid port: %s", s)
+	}
+
+	if host == "" {
+		return Server{}, fmt.Errorf("invalid server: %s: missing host", s)
+	}
+
+	return Server{Host: host, Port: n, TLS: useTLS}, nil
+}
+
+// SetServers sets servers to connect to. The client connects to the first
+// one. NextServer switches to the next one.
+//
+// This replaces the server given to New.
+func (c *Client) SetServers(servers []Server) error {
+	if len(servers) == 0 {
+		return fmt.Errorf("no servers given")
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.servers = append([]Server(nil), servers...)
+	c.serverIndex = 0
+	c.useServer(c.servers[0])
+	return nil
+}
+
+// NextServer switches to the next server in the list set by SetServers. The
+// next Connect uses it. After the last server we start over with the first.
+//
+// It returns the server we switched to.
+func (c *Client) NextServer() Server {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if len(c.servers) == 0 {
+		return Server{Host: c.host, Port: c.port, TLS: c.tls}
+	}
+
+	c.serverIndex = (c.serverIndex + 1) % len(c.servers)
+	c.useServer(c.servers[c.serverIndex])
+	return c.servers[c.serverIndex]
+}
+
+// CurrentServer retrieves the server we're connected to or will connect to
+// next.
+func (c *Client) CurrentServer() Server {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return Server{Host: c.host, Port: c.port, TLS: c.tls}
+}
+
+// useServer sets the server to connect to.
+//
+// The caller must hold the mutex.
+func (c *Client) useServer(s Server) {
+	c.host = s.Host
+	c.port = s.Port
+	c.tls = s.TLS
+	c.stsUpgraded = false
+}
+
+// updateServer records a change to the current server's port or TLS, such as
+// when the server tells us to use TLS.
+//
+// The caller must hold the mutex.
+func (c *Client) updateServer() {
+	if len(c.servers) == 0 {
+		return
+	}
+
+	c.servers[c.serverIndex].Port = c.port
+	c.servers[c.serverIndex].TLS = c.tls
+}
@@ -0,0 +1,169 @@
+// Package services identifies to NickServ.
+//
+// We identify each time we connect and wait until NickServ says we're
+// identified before joining channels, so we can join channels that require
+// it. If NickServ asks us to identify again, such as after it returns from a
+// netsplit, we do.
+//
+// We don't identify if we authenticated with SASL.
+//
+// The program must call Setup before connecting for us to wait before
+// joining channels.
+//
+// Configuration options:
+// - nickserv-password - The password to identify with.
+// - services-name - Who to identify to. Default NickServ.
+// - services-account - The account to identify to, if not our nick.
+// - services-wait - How long to wait for NickServ before joining channels
+//   anyway. Default 30s.
+//
+// The command we send uses the template identify. Its data is an Identify.
+// Set template-services-identify to change it, such as to
+// LOGIN {{.Account}} {{.Password}}.
+package services
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/horgh/godrop"
+	"github.com/horgh/irc"
+)
+
+func init() {
+	godrop.Register("services", Hook)
+	godrop.RegisterConfig("services",
+		godrop.ConfigKey{Name: "nickserv-password", Required: true},
+		godrop.ConfigKey{Name: "services-name"},
+		godrop.ConfigKey{Name: "services-account"},
+		godrop.ConfigKey{Name: "services-wait", Kind: godrop.ConfigDuration},
+	)
+	godrop.RegisterTemplate("services", "identify",
+		"IDENTIFY {{if .Account}}{{.Account}} {{end}}{{.Password}}")
+}
+
+// Identify is the data for the identify template.
+type Identify struct {
+	Account  string
+	Password string
+}
+
+const (
+	defaultName = "NickServ"
+	defaultWait = 30 * time.Second
+
+	// identifyInterval is how long to wait before identifying again. Services
+	// may ask us to identify right after we did.
+	identifyInterval = 30 * time.Second
+)
+
+// These match what common services (Atheme, Anope) say.
+var (
+	identifiedRE = regexp.MustCompile(
+		`(?i)you are now (identified|logged in)|password accepted`)
+	failedRE = regexp.MustCompile(
+		`(?i)invalid password|(password|passphrase) incorrect|incorrect password`)
+	challengeRE = regexp.MustCompile(
+		`(?i)nick(name)? is registered|please identify|identify via`)
+)
+
+var mutex sync.Mutex
+
+// identified is when each client last identified.
+var identified = map[*godrop.Client]time.Time{}
+
+// Setup makes the client wait to join channels until we're identified. Call
+// it before connecting.
+func Setup(c *godrop.Client) {
+	if c.Conf().GetString("nickserv-password") == "" {
+		return
+	}
+	c.HoldJoins(wait(c.Conf()))
+}
+
+// Hook fires when an IRC message of some kind occurs.
+func Hook(c *godrop.Client, m irc.Message) {
+	switch m.Command {
+	case irc.ReplyWelcome:
+		if c.SASLAuthenticated() {
+			return
+		}
+		identify(c, true)
+
+	case "900":
+		// RPL_LOGGEDIN
+		c.ReleaseJoins()
+
+	case "NOTICE":
+		if len(m.Params) != 2 || !fromServices(c, m) {
+			return
+		}
+
+		text := m.Params[1]
+		switch {
+		case identifiedRE.MatchString(text):
+			c.Log().Info("Identified", "plugin", "services", "to",
+				godrop.SourceNick(m))
+			c.ReleaseJoins()
+		case failedRE.MatchString(text):
+			c.PluginError("services", fmt.Errorf("unable to identify: %s",
+				godrop.StripFormatting(text)))
+			c.ReleaseJoins()
+		case challengeRE.MatchString(text):
+			identify(c, false)
+		}
+	}
+}
+
+// identify sends the identify command. Unless force is set we don't if we
+// did recently.
+func identify(c *godrop.Client, force bool) {
+	password := c.Conf().GetString("nickserv-password")
+	if password == "" {
+		return
+	}
+
+	mutex.Lock()
+	if !force && time.Since(identified[c]) < identifyInterval {
+		mutex.Unlock()
+		return
+	}
+	identified[c] = time.Now()
+	mutex.Unlock()
+
+	name := serviceName(c.Conf())
+	command := c.Format("services", "identify", name, Identify{
+		Account:  c.Conf().GetString("services-account"),
+		Password: password,
+	})
+	if err := c.SendSecret(irc.Message{
+		Command: "PRIVMSG",
+		Params:  []string{name, command},
+	}, godrop.PriorityHigh); err != nil {
+		c.PluginError("services", fmt.Errorf("unable to identify: %s", err))
+	}
+}
+
+// fromServices checks whether the message is from services to us.
+func fromServices(c *godrop.Client, m irc.Message) bool {
+	return godrop.Canonicalize(godrop.SourceNick(m)) ==
+		godrop.Canonicalize(serviceName(c.Conf())) &&
+		godrop.Canonicalize(m.Params[0]) == godrop.Canonicalize(c.GetNick())
+}
+
+func serviceName(config godrop.Config) string {
+	if name := config.GetString("services-name"); name != "" {
+		return name
+	}
+	return defaultName
+}
+
+func wait(config godrop.Config) time.Duration {
+	d := config.GetDuration("services-wait", defaultWait)
+	if d <= 0 {
+		return defaultWait
+	}
+	return d
+}
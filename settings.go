@@ -0,0 +1,224 @@
+package godrop
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// channelSettingsBucket is the storage bucket holding channel settings.
+const channelSettingsBucket = "channel-settings"
+
+// ChannelSettings are how to show things such as times on a channel.
+type ChannelSettings struct {
+	// Timezone is an IANA timezone name such as America/Vancouver. If it's
+	// blank we use UTC.
+	Timezone string
+
+	// Locale is a language tag such as en-US. Plugins may use it to choose how
+	// to show things.
+	Locale string
+
+	// Clock is 12 to show times with a 12 hour clock or 24 for a 24 hour
+	// clock. If it's 0 we use 24.
+	Clock int
+
+	// Units is UnitsMetric or UnitsImperial for how to show measurements such
+	// as temperatures. If it's blank we use metric.
+	Units string
+
+	// Currency is an ISO 4217 currency code such as USD to show prices in. If
+	// it's blank we use DefaultCurrency.
+	Currency string
+}
+
+// Units for ChannelSettings.
+const (
+	UnitsMetric   = "metric"
+	UnitsImperial = "imperial"
+)
+
+// DefaultCurrency is the currency we show prices in unless a channel chooses
+// another.
+const DefaultCurrency = "USD"
+
+// ChannelSettings retrieves a channel's settings.
+//
+// Settings not set for the channel come from the config keys
+// channel-timezone, channel-locale, channel-clock, channel-units, and
+// channel-currency. Targets that aren't channels, such as nicks, get these
+// defaults.
+func (c *Client) ChannelSettings(channel string) ChannelSettings {
+	config := c.Conf()
+	s := ChannelSettings{
+		Timezone: config.GetString("channel-timezone"),
+		Locale:   config.GetString("channel-locale"),
+		Units:    config.GetString("channel-units"),
+		Currency: config.GetString("channel-currency"),
+		Clock:    config.GetInt("channel-clock", 0),
+	}
+
+	if !IsChannel(channel) {
+		return s
+	}
+
+	// Without storage there are only the defaults.
+	if _, err := c.Storage(); err != nil {
+		return s
+	}
+
+	set, err := c.StoredChannelSettings(channel)
+	if err != nil {
+		c.Log().Error("Unable to look up channel settings", "channel", channel,
+			"error", err)
+		return s
+	}
+
+	if set.Timezone != "" {
+		s.Timezone = set.Timezone
+	}
+	if set.Locale != "" {
+		s.Locale = set.Locale
+	}
+	if set.Clock != 0 {
+		s.Clock = set.Clock
+	}
+	if set.Units != "" {
+		s.Units = set.Units
+	}
+	if set.Currency != "" {
+		s.Currency = set.Currency
+	}
+	return s
+}
+
+// StoredChannelSettings retrieves the settings set for a channel. Unlike
+// ChannelSettings, these don't include the defaults.
+//
+// This requires storage (see Storage).
+func (c *Client) StoredChannelSettings(channel string) (ChannelSettings,
+	error) {
+	store, err := c.Storage()
+	if err != nil {
+		return ChannelSettings{}, err
+	}
+
+	var s ChannelSettings
+	if _, err := store.Get(channelSettingsBucket, Canonicalize(channel),
+		&s); err != nil {
+		return ChannelSettings{}, err
+	}
+	return s, nil
+}
+
+// SetChannelSettings sets a channel's settings. Blank settings use the
+// defaults. See ChannelSettings.
+//
+// This requires storage (see Storage).
+func (c *Client) SetChannelSettings(channel string,
+	s ChannelSettings) error {
+	if !IsChannel(channel) {
+		return fmt.Errorf("%s is not a channel", channel)
+	}
+
+	if s.Timezone != "" {
+		if _, err := time.LoadLocation(s.Timezone); err != nil {
+			return fmt.Errorf("unknown timezone: %s", s.Timezone)
+		}
+	}
+
+	if s.Clock != 0 && s.Clock != 12 && s.Clock != 24 {
+		return fmt.Errorf("clock must be 12 or 24")
+	}
+
+	if s.Units != "" && s.Units != UnitsMetric && s.Units != UnitsImperial {
+		return fmt.Errorf("units must be %s or %s", UnitsMetric, UnitsImperial)
+	}
+
+	if s.Currency != "" && !IsCurrencyCode(s.Currency) {
+		return fmt.Errorf("currency must be a code such as USD")
+	}
+
+	store, err := c.Storage()
+	if err != nil {
+		return err
+	}
+
+	if s == (ChannelSettings{}) {
+		return store.Delete(channelSettingsBucket, Canonicalize(channel))
+	}
+	return store.Put(channelSettingsBucket, Canonicalize(channel), s)
+}
+
+// Location is the settings' timezone. If it's invalid we use UTC.
+func (s ChannelSettings) Location() *time.Location {
+	if s.Timezone == "" {
+		return time.UTC
+	}
+
+	loc, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// FormatTime shows a date and time in the settings' timezone, clock, and
+// locale.
+//
+// By default dates look like 2006-01-02. For the locale en-US they look like
+// Jan 2, 2006, and for other locales like 2 Jan 2006.
+func (s ChannelSettings) FormatTime(t time.Time) string {
+	return t.In(s.Location()).Format(s.dateLayout() + " " + s.timeLayout() +
+		" MST")
+}
+
+// FormatClock shows a time of day in the settings' timezone and clock.
+func (s ChannelSettings) FormatClock(t time.Time) string {
+	return t.In(s.Location()).Format(s.timeLayout() + " MST")
+}
+
+// Imperial checks whether to show measurements in imperial units.
+func (s ChannelSettings) Imperial() bool {
+	return s.Units == UnitsImperial
+}
+
+// CurrencyCode is the currency to show prices in.
+func (s ChannelSettings) CurrencyCode() string {
+	if s.Currency == "" {
+		return DefaultCurrency
+	}
+	return s.Currency
+}
+
+// IsCurrencyCode checks whether the string looks like an ISO 4217 currency
+// code, three upper case letters such as USD.
+func IsCurrencyCode(s string) bool {
+	if len(s) != 3 {
+		return false
+	}
+	for _, r := range s {
+		if r < 'A' || r > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+func (s ChannelSettings) dateLayout() string {
+	switch {
+	case s.Locale == "":
+		return "2006-01-02"
+	case strings.EqualFold(s.Locale, "en-US"):
+		return "Jan 2, 2006"
+	default:
+		return "2 Jan 2006"
+	}
+}
+
+func (s ChannelSettings) timeLayout() string {
+	if s.Clock == 12 {
+		return "3:04 PM"
+	}
+	return "15:04"
+}
@@ -0,0 +1,314 @@
+// Package shorten makes long URLs short.
+//
+// Usage:
+// - !shorten <url> - Make a short URL.
+// - !expand <short url> - Show where a short URL goes.
+//
+// We can use a shortening service or shorten URLs ourselves. To do it
+// ourselves we serve redirects at /s/<slug> using the httpapi package's
+// server, so the httpapi plugin must be enabled and http-listen set. We keep
+// the slugs in persistent storage, which requires storage-file to be set.
+//
+// Configuration options:
+// - shorten-service - The URL of a shortening service, with %s where the URL
+//   to shorten goes, such as https://is.gd/create.php?format=simple&url=%s.
+//   The response must be the short URL.
+// - shorten-base-url - The URL people reach our httpapi server at, such as
+//   https://bot.example.com. If shorten-service isn't set, we make short URLs
+//   starting with this.
+package shorten
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/horgh/godrop"
+	"github.com/horgh/godrop/httpapi"
+	"github.com/horgh/irc"
+)
+
+func init() {
+	godrop.Register("shorten", nil)
+	godrop.RegisterConfig("shorten",
+		godrop.ConfigKey{Name: "shorten-service", Check: checkService},
+		godrop.ConfigKey{Name: "shorten-base-url", Check: checkURL},
+	)
+	godrop.RegisterCommand("shorten", godrop.Command{
+		Name:    "shorten",
+		Usage:   "<url>",
+		Help:    "Shorten a URL.",
+		MinArgs: 1,
+		Run:     triggerShorten,
+	})
+	godrop.RegisterCommand("shorten", godrop.Command{
+		Name:    "expand",
+		Usage:   "<short url>",
+		Help:    "Show where a short URL goes.",
+		MinArgs: 1,
+		Run:     triggerExpand,
+	})
+	httpapi.Handle("/s/", http.HandlerFunc(redirectHandler))
+}
+
+const (
+	// bucket holds links keyed by slug. urlBucket holds slugs keyed by the
+	// SHA-256 of their URL so we give the same URL the same slug. URLs can be
+	// too long to be keys.
+	bucket    = "shorten"
+	urlBucket = "shorten-urls"
+
+	// slugLength is how long the slugs we make are.
+	slugLength = 6
+
+	slugChars = "abcdefghijkmnopqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+)
+
+// Link is a URL we shortened.
+type Link struct {
+	URL     string
+	Nick    string
+	Created time.Time
+}
+
+var mutex sync.Mutex
+
+// triggerShorten handles !shorten
+func triggerShorten(c *godrop.Client, m irc.Message, args []string) error {
+	target := godrop.ReplyTarget(m)
+	source := godrop.SourceNick(m)
+
+	if len(args) != 1 {
+		return c.Message(target, "Usage: !shorten <url>")
+	}
+
+	short, err := shorten(c, source, args[0])
+	if err != nil {
+		return err
+	}
+	return c.Message(target, fmt.Sprintf("%s: %s", source, short))
+}
+
+// triggerExpand handles !expand
+func triggerExpand(c *godrop.Client, m irc.Message, args []string) error {
+	target := godrop.ReplyTarget(m)
+	source := godrop.SourceNick(m)
+
+	if len(args) != 1 {
+		return c.Message(target, "Usage: !expand <short url>")
+	}
+
+	long, err := expand(c, args[0])
+	if err != nil {
+		return err
+	}
+	return c.Message(target, fmt.Sprintf("%s: %s goes to %s", source, args[0],
+		long))
+}
+
+// shorten makes a short URL.
+func shorten(c *godrop.Client, nick, long string) (string, error) {
+	u, err := url.Parse(long)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") ||
+		u.Host == "" {
+		return "", fmt.Errorf("%s is not an http or https URL", long)
+	}
+
+	if service := c.Conf().GetString("shorten-service"); service != "" {
+		return useService(c.Web(), service, long)
+	}
+
+	base := baseURL(c.Conf())
+	if base == "" {
+		return "", fmt.Errorf("no shortening service configured")
+	}
+
+	slug, err := store(c, nick, long)
+	if err != nil {
+		return "", err
+	}
+	return base + "/s/" + slug, nil
+}
+
+// useService asks the service to shorten the URL.
+func useService(web *godrop.WebClient, service, long string) (string, error) {
+	resp, body, err := web.Get(strings.Replace(service, "%s",
+		url.QueryEscape(long), 1))
+	if err != nil {
+		return "", fmt.Errorf("failed to perform HTTP request: %s", err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	short := strings.TrimSpace(string(body))
+	if !strings.HasPrefix(short, "http://") &&
+		!strings.HasPrefix(short, "https://") {
+		return "", fmt.Errorf("unexpected response: %s", short)
+	}
+	return short, nil
+}
+
+// store stores the URL under a new slug unless it has one already. It
+// returns the slug.
+func store(c *godrop.Client, nick, long string) (string, error) {
+	s, err := c.Storage()
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.Sum256([]byte(long))
+	urlKey := hex.EncodeToString(hash[:])
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	var slug string
+	ok, err := s.Get(urlBucket, urlKey, &slug)
+	if err != nil {
+		return "", err
+	}
+	if ok {
+		return slug, nil
+	}
+
+	for {
+		slug, err = newSlug()
+		if err != nil {
+			return "", err
+		}
+		exists, err := s.Get(bucket, slug, &Link{})
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			break
+		}
+	}
+
+	if err := s.Put(bucket, slug, Link{
+		URL:     long,
+		Nick:    nick,
+		Created: time.Now(),
+	}); err != nil {
+		return "", err
+	}
+
+	if err := s.Put(urlBucket, urlKey, slug); err != nil {
+		return "", err
+	}
+
+	return slug, nil
+}
+
+// newSlug makes a random slug.
+func newSlug() (string, error) {
+	slug := ""
+	for i := 0; i < slugLength; i++ {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(slugChars))))
+		if err != nil {
+			return "", fmt.Errorf("unable to make slug: %s", err)
+		}
+		slug += string(slugChars[n.Int64()])
+	}
+	return slug, nil
+}
+
+// lookup finds where a slug goes.
+func lookup(c *godrop.Client, slug string) (Link, bool, error) {
+	s, err := c.Storage()
+	if err != nil {
+		return Link{}, false, err
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	var link Link
+	ok, err := s.Get(bucket, slug, &link)
+	return link, ok, err
+}
+
+// expand finds where a short URL goes. If it's one of ours we look it up.
+// Otherwise we follow its redirects.
+func expand(c *godrop.Client, short string) (string, error) {
+	base := baseURL(c.Conf())
+	if base != "" && strings.HasPrefix(short, base+"/s/") {
+		slug := strings.TrimPrefix(short, base+"/s/")
+		link, ok, err := lookup(c, slug)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			return "", fmt.Errorf("unknown short URL %s", short)
+		}
+		return link.URL, nil
+	}
+
+	u, err := url.Parse(short)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return "", fmt.Errorf("%s is not an http or https URL", short)
+	}
+
+	req, err := http.NewRequest(http.MethodHead, short, nil)
+	if err != nil {
+		return "", fmt.Errorf("preparing request: %s", err)
+	}
+
+	resp, err := c.Web().Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to perform HTTP request: %s", err)
+	}
+	_ = resp.Body.Close()
+
+	return resp.Request.URL.String(), nil
+}
+
+// redirectHandler sends people on to where a slug goes.
+func redirectHandler(w http.ResponseWriter, r *http.Request) {
+	c := httpapi.Client(r)
+
+	slug := strings.TrimPrefix(r.URL.Path, "/s/")
+	link, ok, err := lookup(c, slug)
+	if err != nil {
+		c.PluginError("shorten", fmt.Errorf("unable to look up %s: %s", slug,
+			err))
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	http.Redirect(w, r, link.URL, http.StatusMovedPermanently)
+}
+
+// baseURL is the start of our short URLs.
+func baseURL(config map[string]string) string {
+	return strings.TrimRight(strings.TrimSpace(config["shorten-base-url"]), "/")
+}
+
+func checkService(value string) error {
+	if !strings.Contains(value, "%s") {
+		return fmt.Errorf("expected %%s where the URL goes")
+	}
+	return checkURL(strings.Replace(value, "%s", "x", 1))
+}
+
+func checkURL(value string) error {
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") ||
+		u.Host == "" {
+		return fmt.Errorf("expected an http or https URL")
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package godrop
+
+import (
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+// Shutdown stops everything the client runs for its plugins. Call it when
+// we're done with the client, such as before replacing it with another, once
+// it's no longer connected (see Quit).
+//
+// We stop the plugins' workers and give each plugin with an event hook an
+// EventShutdown event so it can store what it holds. Functions scheduled
+// with After, Every, and At no longer run. Done is closed so goroutines
+// started with Go know to return, and we don't restart them. Then we close
+// the storage, and Storage returns an error from then on.
+//
+// Calling it more than once does nothing.
+func (c *Client) Shutdown() {
+	c.mutex.Lock()
+	if c.shutdown {
+		c.mutex.Unlock()
+		return
+	}
+	c.shutdown = true
+	if c.done == nil {
+		c.done = make(chan struct{})
+	}
+	close(c.done)
+	for p, w := range c.workers {
+		close(w.stop)
+		delete(c.workers, p)
+	}
+	c.mutex.Unlock()
+
+	e := Event{
+		Message: irc.Message{Command: "SHUTDOWN"},
+		Time:    time.Now(),
+		Kind:    EventShutdown,
+	}
+	for _, p := range c.enabledPlugins() {
+		if _, ok := p.handler.(EventHandler); ok {
+			c.runPlugin(p, e)
+		}
+	}
+	for _, hook := range EventHooks {
+		hook(c, e)
+	}
+
+	c.mutex.Lock()
+	store := c.store
+	c.store = nil
+	c.storeClosed = true
+	c.mutex.Unlock()
+
+	if store != nil {
+		if err := store.Close(); err != nil {
+			c.Log().Warn("Unable to close storage", "error", err)
+		}
+	}
+}
+
+// Done returns a channel that's closed once Shutdown is called. Goroutines
+// started with Go should return once it is.
+func (c *Client) Done() <-chan struct{} {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.done == nil {
+		c.done = make(chan struct{})
+	}
+	return c.done
+}
+
+// isShutdown checks whether Shutdown was called.
+func (c *Client) isShutdown() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.shutdown
+}
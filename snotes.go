@@ -0,0 +1,65 @@
+package godrop
+
+import (
+	"strings"
+
+	"github.com/horgh/irc"
+)
+
+// ClientConnect is a client connecting to the server as an operator sees it
+// in a server notice.
+type ClientConnect struct {
+	Nick     string
+	User     string
+	Host     string
+	IP       string
+	Class    string
+	Realname string
+}
+
+// Mask is the client's nick!user@host.
+func (cc ClientConnect) Mask() string {
+	return cc.Nick + "!" + cc.User + "@" + cc.Host
+}
+
+// ParseClientConnect parses a CLICONN server notice. It reports whether the
+// message is one.
+//
+// The notices look like:
+// :irc.example.com NOTICE * :*** Notice -- CLICONN will will example.com 192.168.1.2 opers will 192.168.1.2 0 will
+//
+// That is the nick, user, host, IP, class, a second user and IP, a 0, and
+// the realname. This is ircd-ratbox specific.
+func ParseClientConnect(m irc.Message) (ClientConnect, bool) {
+	if m.Command != "NOTICE" || len(m.Params) != 2 ||
+		strings.Contains(m.Prefix, "!") {
+		return ClientConnect{}, false
+	}
+
+	fields := strings.Fields(m.Params[1])
+	if len(fields) < 8 || fields[3] != "CLICONN" {
+		return ClientConnect{}, false
+	}
+
+	cc := ClientConnect{
+		Nick: fields[4],
+		User: fields[5],
+		Host: fields[6],
+		IP:   fields[7],
+	}
+	if len(fields) > 8 {
+		cc.Class = fields[8]
+	}
+
+	// The realname may have spaces, so take it from the notice itself.
+	if len(fields) > 12 {
+		text := m.Params[1]
+		for i := 0; i < 12; i++ {
+			text = strings.TrimLeft(text, " ")
+			text = text[strings.Index(text, " ")+1:]
+		}
+		cc.Realname = strings.TrimLeft(text, " ")
+	}
+
+	return cc, true
+}
@@ -0,0 +1,365 @@
+// Package space provides information about rocket launches and the
+// International Space Station.
+//
+// Triggers:
+// - !launch - Show the next upcoming launches with countdowns.
+// - !iss - Show the current position of the ISS, and its next visible pass
+//   over the configured location.
+//
+// Launch data comes from Launch Library 2 (https://thespacedevs.com). ISS
+// position comes from https://wheretheiss.at and pass predictions from N2YO
+// (https://www.n2yo.com).
+//
+// Configuration options:
+// - space-channels - A space separated list of channels to announce followed
+//   launches to an hour before they happen.
+// - space-follow - A space separated list of words. A launch whose name or
+//   provider contains any of them is followed. Use * to follow all launches.
+// - space-latitude, space-longitude - Location to predict ISS passes over.
+// - space-n2yo-key - N2YO API key. Required to predict ISS passes.
+//
+// Launch announcements use the template launch. Its data is a Launch with
+// .Text describing it. See godrop's Format to override it.
+package space
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/horgh/godrop"
+	"github.com/horgh/irc"
+)
+
+func init() {
+	godrop.Register("space", Hook)
+	godrop.RegisterConfig("space",
+		godrop.ConfigKey{Name: "space-latitude", Kind: godrop.ConfigFloat},
+		godrop.ConfigKey{Name: "space-longitude", Kind: godrop.ConfigFloat},
+		godrop.ConfigKey{Name: "space-n2yo-key"},
+		godrop.ConfigKey{Name: "space-channels"},
+		godrop.ConfigKey{Name: "space-follow"},
+	)
+	godrop.RegisterTemplate("space", "launch", "Launch soon! {{.Text}}")
+	godrop.RegisterCommand("space", godrop.Command{
+		Name:    "launch",
+		Aliases: []string{"launches"},
+		Help:    "Show upcoming rocket launches.",
+		Run:     triggerLaunch,
+	})
+	godrop.RegisterCommand("space", godrop.Command{
+		Name: "iss",
+		Help: "Show where the International Space Station is.",
+		Run:  triggerISS,
+	})
+}
+
+// How many launches to show with !launch.
+const launchCount = 3
+
+// Hook fires when an IRC message of some kind occurs.
+func Hook(c *godrop.Client, m irc.Message) {
+	pollLaunches(c)
+}
+
+// triggerLaunch handles !launch
+func triggerLaunch(c *godrop.Client, m irc.Message, args []string) error {
+	target := godrop.ReplyTarget(m)
+
+	launches, err := getUpcomingLaunches(c.Web(), launchCount)
+	if err != nil {
+		return c.Message(target, fmt.Sprintf("Unable to look up launches: %s", err))
+	}
+
+	if len(launches) == 0 {
+		return c.Message(target, "No upcoming launches.")
+	}
+
+	now := time.Now()
+	settings := c.ChannelSettings(target)
+	for _, l := range launches {
+		_ = c.Message(target, l.describe(now, settings))
+	}
+	return nil
+}
+
+// triggerISS handles !iss
+func triggerISS(c *godrop.Client, m irc.Message, args []string) error {
+	target := godrop.ReplyTarget(m)
+
+	pos, err := getISSPosition(c.Web())
+	if err != nil {
+		return c.Message(target, fmt.Sprintf("Unable to look up ISS position: %s",
+			err))
+	}
+
+	_ = c.Message(target, pos.String())
+
+	lat, lon, ok := configuredLocation(c.Conf())
+	if !ok || c.Conf().GetString("space-n2yo-key") == "" {
+		return nil
+	}
+
+	pass, err := getNextPass(c.Web(), c.Conf().GetString("space-n2yo-key"),
+		lat, lon)
+	if err != nil {
+		return c.Message(target, fmt.Sprintf("Unable to predict ISS pass: %s", err))
+	}
+
+	if pass.IsZero() {
+		return c.Message(target, "No visible ISS passes in the next 10 days.")
+	}
+
+	return c.Message(target, fmt.Sprintf("Next visible pass: %s (in %s)",
+		c.ChannelSettings(target).FormatTime(pass),
+		formatDuration(time.Until(pass))))
+}
+
+func configuredLocation(config godrop.Config) (float64, float64, bool) {
+	if config.GetString("space-latitude") == "" ||
+		config.GetString("space-longitude") == "" {
+		return 0, 0, false
+	}
+	return config.GetFloat("space-latitude", 0),
+		config.GetFloat("space-longitude", 0), true
+}
+
+var (
+	pollMutex            sync.Mutex
+	lastPollTime         time.Time
+	durationBetweenPolls = 15 * time.Minute
+	announced            = map[string]bool{}
+)
+
+// Announce launches this long before they happen.
+const announceBefore = time.Hour
+
+// pollLaunches checks for followed launches happening within the next hour
+// and announces them.
+func pollLaunches(c *godrop.Client) {
+	channels := c.Conf().GetStringSlice("space-channels")
+	follow := strings.Fields(strings.ToLower(
+		c.Conf().GetString("space-follow")))
+	if len(channels) == 0 || len(follow) == 0 {
+		return
+	}
+
+	pollMutex.Lock()
+	defer pollMutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(lastPollTime) < durationBetweenPolls {
+		return
+	}
+	lastPollTime = now
+
+	launches, err := getUpcomingLaunches(c.Web(), 10)
+	if err != nil {
+		c.PluginError("space",
+			fmt.Errorf("unable to look up launches: %s", err))
+		return
+	}
+
+	for _, l := range launches {
+		if announced[l.ID] || !l.isFollowed(follow) {
+			continue
+		}
+
+		until := l.NET.Sub(now)
+		if until < 0 || until > announceBefore {
+			continue
+		}
+
+		announced[l.ID] = true
+
+		for _, ch := range channels {
+			_ = c.Message(ch, c.Format("space", "launch", ch,
+				launchLine{Launch: l, Text: l.describe(now, c.ChannelSettings(ch))}))
+		}
+	}
+}
+
+// launchLine is the data for the launch template.
+type launchLine struct {
+	Launch
+	Text string
+}
+
+// Launch holds information about a launch.
+type Launch struct {
+	ID     string    `json:"id"`
+	Name   string    `json:"name"`
+	NET    time.Time `json:"net"`
+	Status struct {
+		Name string `json:"name"`
+	} `json:"status"`
+	Provider struct {
+		Name string `json:"name"`
+	} `json:"launch_service_provider"`
+	Pad struct {
+		Location struct {
+			Name string `json:"name"`
+		} `json:"location"`
+	} `json:"pad"`
+}
+
+func (l Launch) isFollowed(follow []string) bool {
+	name := strings.ToLower(l.Name + " " + l.Provider.Name)
+	for _, f := range follow {
+		if f == "*" || strings.Contains(name, f) {
+			return true
+		}
+	}
+	return false
+}
+
+// describe describes the launch. We show times using the settings.
+func (l Launch) describe(now time.Time,
+	settings godrop.ChannelSettings) string {
+	countdown := "T-" + formatDuration(l.NET.Sub(now))
+	if l.NET.Before(now) {
+		countdown = "T+" + formatDuration(now.Sub(l.NET))
+	}
+
+	s := fmt.Sprintf("%s: %s", countdown, l.Name)
+	if l.Provider.Name != "" {
+		s += fmt.Sprintf(" (%s)", l.Provider.Name)
+	}
+	if l.Pad.Location.Name != "" {
+		s += fmt.Sprintf(" from %s", l.Pad.Location.Name)
+	}
+	s += fmt.Sprintf(" at %s", settings.FormatTime(l.NET))
+	if l.Status.Name != "" {
+		s += fmt.Sprintf(" [%s]", l.Status.Name)
+	}
+	return s
+}
+
+// formatDuration formats a duration in days, hours, and minutes.
+func formatDuration(d time.Duration) string {
+	if d < 0 {
+		d = -d
+	}
+
+	days := d / (24 * time.Hour)
+	d -= days * 24 * time.Hour
+	hours := d / time.Hour
+	d -= hours * time.Hour
+	minutes := d / time.Minute
+
+	if days > 0 {
+		return fmt.Sprintf("%dd%02dh%02dm", days, hours, minutes)
+	}
+	if hours > 0 {
+		return fmt.Sprintf("%dh%02dm", hours, minutes)
+	}
+	return fmt.Sprintf("%dm", minutes)
+}
+
+func getUpcomingLaunches(web *godrop.WebClient,
+	limit int) ([]Launch, error) {
+	u := fmt.Sprintf(
+		"https://ll.thespacedevs.com/2.2.0/launch/upcoming/?mode=normal&limit=%d",
+		limit)
+
+	var response struct {
+		Results []Launch `json:"results"`
+	}
+	if err := getJSON(web, u, &response); err != nil {
+		return nil, err
+	}
+
+	return response.Results, nil
+}
+
+// ISSPosition is the current location of the ISS.
+type ISSPosition struct {
+	Latitude   float64 `json:"latitude"`
+	Longitude  float64 `json:"longitude"`
+	Altitude   float64 `json:"altitude"`
+	Velocity   float64 `json:"velocity"`
+	Visibility string  `json:"visibility"`
+}
+
+func (p ISSPosition) String() string {
+	ns := "N"
+	if p.Latitude < 0 {
+		ns = "S"
+	}
+	ew := "E"
+	if p.Longitude < 0 {
+		ew = "W"
+	}
+
+	return fmt.Sprintf(
+		"The ISS is at %.2f°%s %.2f°%s, altitude %.0f km, speed %.0f km/h (%s)",
+		math.Abs(p.Latitude), ns, math.Abs(p.Longitude), ew, p.Altitude,
+		p.Velocity, p.Visibility)
+}
+
+// The ISS's NORAD catalog number.
+const issID = 25544
+
+func getISSPosition(web *godrop.WebClient) (ISSPosition, error) {
+	var pos ISSPosition
+	if err := getJSON(web,
+		fmt.Sprintf("https://api.wheretheiss.at/v1/satellites/%d", issID),
+		&pos); err != nil {
+		return ISSPosition{}, err
+	}
+	return pos, nil
+}
+
+// getNextPass finds when the ISS next visibly passes over the location.
+//
+// If there is no pass in the prediction window we return the zero time.
+func getNextPass(web *godrop.WebClient, key string, lat,
+	lon float64) (time.Time, error) {
+	u := fmt.Sprintf(
+		"https://api.n2yo.com/rest/v1/satellite/visualpasses/%d/%f/%f/0/10/60/&apiKey=%s",
+		issID, lat, lon, strings.TrimSpace(key))
+
+	var response struct {
+		Passes []struct {
+			StartUTC int64 `json:"startUTC"`
+		} `json:"passes"`
+		Error string `json:"error"`
+	}
+	if err := getJSON(web, u, &response); err != nil {
+		return time.Time{}, err
+	}
+
+	if response.Error != "" {
+		return time.Time{}, fmt.Errorf("API error: %s", response.Error)
+	}
+
+	if len(response.Passes) == 0 {
+		return time.Time{}, nil
+	}
+
+	return time.Unix(response.Passes[0].StartUTC, 0), nil
+}
+
+// getJSON makes a GET request and decodes the JSON response into v.
+func getJSON(web *godrop.WebClient, u string, v interface{}) error {
+	resp, body, err := web.Get(u)
+	if err != nil {
+		// Don't include the error as it contains the URL, which may include an
+		// API key.
+		return fmt.Errorf("failed to perform HTTP request")
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unsuccessful request: %s", resp.Status)
+	}
+
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("unable to decode: %s", err)
+	}
+
+	return nil
+}
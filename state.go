@@ -0,0 +1,614 @@
+package godrop
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/horgh/irc"
+)
+
+// Channel holds what we know about a channel we're on.
+type Channel struct {
+	// Name is the channel's name as the server gave it.
+	Name string
+
+	// Key is the channel's key (+k) if it has one and we know it.
+	Key string
+
+	// Modes are the channel's modes that don't take a parameter or take one
+	// only when set, such as nt or l, if we know them. We learn them from
+	// mode changes and replies to MODE.
+	Modes string
+
+	// Members are the users on the channel keyed by canonicalized nick.
+	Members map[string]Member
+}
+
+// Member is a user on a channel.
+type Member struct {
+	Nick string
+
+	// Modes are the member's channel status modes such as o or v.
+	Modes string
+}
+
+// HasMode checks whether the member has the channel status mode.
+func (m Member) HasMode(mode byte) bool {
+	return strings.IndexByte(m.Modes, mode) != -1
+}
+
+// IsOp checks whether the member is a channel operator or higher.
+func (m Member) IsOp() bool {
+	return strings.IndexAny(m.Modes, "qao") != -1
+}
+
+// User holds what we know about a user on a channel we're on.
+type User struct {
+	Nick string
+
+	// Ident and Host are the user and host parts of their hostmask if we know
+	// them. We learn them from NAMES if the server supports the
+	// userhost-in-names capability, and from messages they send.
+	Ident string
+	Host  string
+
+	// Account is the account they're logged in to. It is empty if they're not
+	// logged in or we don't know. We know this reliably only if the server
+	// supports the account-notify and extended-join capabilities.
+	Account string
+
+	// Realname is their realname if we know it.
+	Realname string
+
+	// Away is whether they're away. We know this reliably only if the server
+	// supports the away-notify capability.
+	Away        bool
+	AwayMessage string
+}
+
+// state is what we track about the connection as messages arrive.
+type state struct {
+	// nick is our current nick.
+	nick string
+
+	// channels we're on keyed by canonicalized name.
+	channels map[string]*Channel
+
+	// users on channels we're on keyed by canonicalized nick.
+	users map[string]*User
+
+	// prefixModes are the channel status modes in order of rank, such as ov.
+	// prefixes are the corresponding prefixes, such as @+.
+	prefixModes string
+	prefixes    string
+
+	// chanModes are the channel modes in the four groups CHANMODES describes.
+	chanModes [4]string
+
+	// userModes are our user modes.
+	userModes string
+
+	// chatHistoryMax is the most messages the server sends for a CHATHISTORY
+	// request. Zero means no limit.
+	chatHistoryMax int
+
+	// monitor is whether the server supports MONITOR.
+	monitor bool
+
+	// motdEnded is true once the server sent the end of the MOTD, or said
+	// there isn't one. By then we've seen its RPL_ISUPPORT.
+	motdEnded bool
+
+	// attemptedNick is the nick we last tried while registering if ours was
+	// taken. altNicksTried is how many of the alternate nicks we tried.
+	attemptedNick string
+	altNicksTried int
+
+	// reclaiming is true while we're trying to get our nick back.
+	// monitoringNick is true if we're using MONITOR to do so.
+	reclaiming     bool
+	monitoringNick bool
+}
+
+func newState() *state {
+	return &state{
+		channels: map[string]*Channel{},
+		users:    map[string]*User{},
+
+		// Defaults until we see RPL_ISUPPORT.
+		prefixModes: "qaohv",
+		prefixes:    "~&@%+",
+		chanModes:   [4]string{"beI", "k", "l", "imnpst"},
+	}
+}
+
+// canonicalizer maps names to a canonical form using the rfc1459 casemapping.
+var canonicalizer = strings.NewReplacer(
+	"[", "{",
+	"]", "}",
+	"\\", "|",
+	"~", "^",
+)
+
+// Canonicalize converts a nick or channel name to a canonical form so names
+// that the server considers equal are equal.
+func Canonicalize(name string) string {
+	return canonicalizer.Replace(strings.ToLower(name))
+}
+
+// updateState updates what we know based on the message.
+func (c *Client) updateState(m irc.Message) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	s := c.state
+	source := SourceNick(m)
+	isUs := s.nick != "" && Canonicalize(source) == Canonicalize(s.nick)
+
+	// Messages from users tell us their hostmask.
+	if u, ok := s.users[Canonicalize(source)]; ok {
+		u.setHostmask(m.Prefix)
+	}
+
+	switch m.Command {
+	case irc.ReplyWelcome:
+		if len(m.Params) > 0 {
+			s.nick = m.Params[0]
+		}
+
+	case "005":
+		s.parseISupport(m.Params)
+
+	case "NICK":
+		if len(m.Params) < 1 {
+			return
+		}
+		if isUs {
+			s.nick = m.Params[0]
+		}
+		for _, ch := range s.channels {
+			member, ok := ch.Members[Canonicalize(source)]
+			if !ok {
+				continue
+			}
+			delete(ch.Members, Canonicalize(source))
+			member.Nick = m.Params[0]
+			ch.Members[Canonicalize(member.Nick)] = member
+		}
+		if u, ok := s.users[Canonicalize(source)]; ok {
+			delete(s.users, Canonicalize(source))
+			u.Nick = m.Params[0]
+			s.users[Canonicalize(u.Nick)] = u
+		}
+
+	case "JOIN":
+		if len(m.Params) < 1 {
+			return
+		}
+		if isUs {
+			key := ""
+			if ch, ok := s.channels[Canonicalize(m.Params[0])]; ok {
+				key = ch.Key
+			}
+			s.channels[Canonicalize(m.Params[0])] = &Channel{
+				Name:    m.Params[0],
+				Key:     key,
+				Members: map[string]Member{},
+			}
+		}
+		if ch, ok := s.channels[Canonicalize(m.Params[0])]; ok {
+			ch.Members[Canonicalize(source)] = Member{Nick: source}
+			u := s.user(source)
+			u.setHostmask(m.Prefix)
+			// Extended JOIN: <channel> <account> :<realname>
+			if len(m.Params) >= 3 {
+				u.Account = accountName(m.Params[1])
+				u.Realname = m.Params[2]
+			}
+		}
+
+	case "PART":
+		if len(m.Params) < 1 {
+			return
+		}
+		s.removeMember(m.Params[0], source, isUs)
+
+	case "KICK":
+		if len(m.Params) < 2 {
+			return
+		}
+		s.removeMember(m.Params[0], m.Params[1],
+			Canonicalize(m.Params[1]) == Canonicalize(s.nick))
+
+	case "QUIT":
+		for _, ch := range s.channels {
+			delete(ch.Members, Canonicalize(source))
+		}
+		delete(s.users, Canonicalize(source))
+
+	case "AWAY":
+		if u, ok := s.users[Canonicalize(source)]; ok {
+			u.Away = len(m.Params) > 0 && m.Params[0] != ""
+			u.AwayMessage = ""
+			if u.Away {
+				u.AwayMessage = m.Params[0]
+			}
+		}
+
+	case "ACCOUNT":
+		if len(m.Params) < 1 {
+			return
+		}
+		if u, ok := s.users[Canonicalize(source)]; ok {
+			u.Account = accountName(m.Params[0])
+		}
+
+	case "353":
+		// RPL_NAMREPLY: <me> <type> <channel> :<names>
+		if len(m.Params) < 4 {
+			return
+		}
+		ch, ok := s.channels[Canonicalize(m.Params[2])]
+		if !ok {
+			return
+		}
+		// With multi-prefix each name has all of the member's prefixes, not only
+		// the highest. With userhost-in-names each is a nick!user@host mask.
+		for _, name := range strings.Fields(m.Params[3]) {
+			modes := ""
+			for len(name) > 0 && strings.IndexByte(s.prefixes, name[0]) != -1 {
+				modes += string(s.prefixModes[strings.IndexByte(s.prefixes, name[0])])
+				name = name[1:]
+			}
+			mask := name
+			if i := strings.IndexByte(name, '!'); i != -1 {
+				name = name[:i]
+			}
+			if name == "" {
+				continue
+			}
+			ch.Members[Canonicalize(name)] = Member{Nick: name, Modes: modes}
+			s.user(name).setHostmask(mask)
+		}
+
+	case "MODE":
+		if len(m.Params) < 2 {
+			return
+		}
+		if ch, ok := s.channels[Canonicalize(m.Params[0])]; ok {
+			s.applyChannelModes(ch, m.Params[1], m.Params[2:])
+			return
+		}
+		if Canonicalize(m.Params[0]) == Canonicalize(s.nick) {
+			s.applyUserModes(m.Params[1])
+		}
+
+	case "221":
+		// RPL_UMODEIS: <me> <modes>
+		if len(m.Params) < 2 {
+			return
+		}
+		s.userModes = ""
+		s.applyUserModes(m.Params[1])
+
+	case "324":
+		// RPL_CHANNELMODEIS: <me> <channel> <modes> [params]
+		if len(m.Params) < 3 {
+			return
+		}
+		if ch, ok := s.channels[Canonicalize(m.Params[1])]; ok {
+			ch.Modes = ""
+			s.applyChannelModes(ch, m.Params[2], m.Params[3:])
+		}
+	}
+}
+
+func (s *state) removeMember(channel, nick string, isUs bool) {
+	if isUs {
+		delete(s.channels, Canonicalize(channel))
+		s.pruneUsers()
+		return
+	}
+	if ch, ok := s.channels[Canonicalize(channel)]; ok {
+		delete(ch.Members, Canonicalize(nick))
+	}
+	s.pruneUsers()
+}
+
+// user retrieves the user with the nick, adding them if we don't know them.
+func (s *state) user(nick string) *User {
+	u, ok := s.users[Canonicalize(nick)]
+	if !ok {
+		u = &User{Nick: nick}
+		s.users[Canonicalize(nick)] = u
+	}
+	return u
+}
+
+// setHostmask records the user and host parts of a nick!user@host mask if it
+// has them.
+func (u *User) setHostmask(mask string) {
+	i := strings.IndexByte(mask, '!')
+	j := strings.LastIndexByte(mask, '@')
+	if i == -1 || j < i {
+		return
+	}
+	u.Ident = mask[i+1 : j]
+	u.Host = mask[j+1:]
+}
+
+// Mask returns the user's nick!user@host mask. If we don't know their user
+// and host, those parts are *.
+func (u User) Mask() string {
+	ident, host := u.Ident, u.Host
+	if ident == "" {
+		ident = "*"
+	}
+	if host == "" {
+		host = "*"
+	}
+	return u.Nick + "!" + ident + "@" + host
+}
+
+// pruneUsers forgets users who are no longer on any channel we're on.
+func (s *state) pruneUsers() {
+	for k := range s.users {
+		found := false
+		for _, ch := range s.channels {
+			if _, ok := ch.Members[k]; ok {
+				found = true
+				break
+			}
+		}
+		if !found {
+			delete(s.users, k)
+		}
+	}
+}
+
+// parseISupport looks at the RPL_ISUPPORT tokens we care about.
+func (s *state) parseISupport(params []string) {
+	// The first parameter is our nick and the last is a description.
+	if len(params) < 3 {
+		return
+	}
+
+	for _, token := range params[1 : len(params)-1] {
+		if strings.HasPrefix(token, "PREFIX=(") {
+			v := strings.TrimPrefix(token, "PREFIX=(")
+			i := strings.IndexByte(v, ')')
+			if i == -1 || len(v[:i]) != len(v[i+1:]) {
+				continue
+			}
+			s.prefixModes = v[:i]
+			s.prefixes = v[i+1:]
+			continue
+		}
+
+		if strings.HasPrefix(token, "CHANMODES=") {
+			groups := strings.Split(strings.TrimPrefix(token, "CHANMODES="), ",")
+			if len(groups) < 4 {
+				continue
+			}
+			copy(s.chanModes[:], groups[:4])
+			continue
+		}
+
+		if token == "MONITOR" || strings.HasPrefix(token, "MONITOR=") {
+			s.monitor = true
+			continue
+		}
+
+		if strings.HasPrefix(token, "CHATHISTORY=") {
+			max, err := strconv.Atoi(strings.TrimPrefix(token, "CHATHISTORY="))
+			if err == nil {
+				s.chatHistoryMax = max
+			}
+		}
+	}
+}
+
+// applyChannelModes applies a mode change to the channel.
+func (s *state) applyChannelModes(ch *Channel, modes string, params []string) {
+	adding := true
+	for i := 0; i < len(modes); i++ {
+		mode := modes[i]
+		switch mode {
+		case '+':
+			adding = true
+			continue
+		case '-':
+			adding = false
+			continue
+		}
+
+		// Status modes like o and v.
+		if strings.IndexByte(s.prefixModes, mode) != -1 {
+			if len(params) == 0 {
+				return
+			}
+			nick := params[0]
+			params = params[1:]
+
+			member, ok := ch.Members[Canonicalize(nick)]
+			if !ok {
+				continue
+			}
+			member.Modes = strings.Replace(member.Modes, string(mode), "", -1)
+			if adding {
+				member.Modes = s.sortModes(member.Modes + string(mode))
+			}
+			ch.Members[Canonicalize(nick)] = member
+			continue
+		}
+
+		// Modes that always take a parameter (lists and things like k).
+		if strings.IndexByte(s.chanModes[0], mode) != -1 ||
+			strings.IndexByte(s.chanModes[1], mode) != -1 {
+			if len(params) == 0 {
+				return
+			}
+			if mode == 'k' {
+				if adding {
+					ch.Key = params[0]
+				} else {
+					ch.Key = ""
+				}
+			}
+			params = params[1:]
+			continue
+		}
+
+		// Modes that take a parameter only when set (like l).
+		if strings.IndexByte(s.chanModes[2], mode) != -1 && adding {
+			if len(params) == 0 {
+				return
+			}
+			params = params[1:]
+		}
+
+		ch.Modes = strings.Replace(ch.Modes, string(mode), "", -1)
+		if adding {
+			ch.Modes = sortString(ch.Modes + string(mode))
+		}
+	}
+}
+
+// sortString sorts the bytes in a string.
+func sortString(str string) string {
+	b := []byte(str)
+	sort.Slice(b, func(i, j int) bool { return b[i] < b[j] })
+	return string(b)
+}
+
+// applyUserModes applies a change to our user modes.
+func (s *state) applyUserModes(modes string) {
+	adding := true
+	for i := 0; i < len(modes); i++ {
+		switch modes[i] {
+		case '+':
+			adding = true
+		case '-':
+			adding = false
+		default:
+			s.userModes = strings.Replace(s.userModes, string(modes[i]), "", -1)
+			if adding {
+				s.userModes += string(modes[i])
+			}
+		}
+	}
+}
+
+// sortModes orders status modes by rank.
+func (s *state) sortModes(modes string) string {
+	b := []byte(modes)
+	sort.Slice(b, func(i, j int) bool {
+		return strings.IndexByte(s.prefixModes, b[i]) <
+			strings.IndexByte(s.prefixModes, b[j])
+	})
+	return string(b)
+}
+
+// trackSharedChannels sets the event's Channels if it's a QUIT or NICK. We
+// must do this before we update our state.
+func (c *Client) trackSharedChannels(e *Event) {
+	if e.Command != "QUIT" && e.Command != "NICK" {
+		return
+	}
+	nick := Canonicalize(SourceNick(e.Message))
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, ch := range c.state.channels {
+		if _, ok := ch.Members[nick]; ok {
+			e.Channels = append(e.Channels, ch.Name)
+		}
+	}
+	sort.Strings(e.Channels)
+}
+
+// Channels lists the names of the channels we're on.
+func (c *Client) Channels() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var names []string
+	for _, ch := range c.state.channels {
+		names = append(names, ch.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Channel retrieves what we know about a channel we're on. It reports whether
+// we're on the channel.
+//
+// The returned Channel is a copy and safe to keep.
+func (c *Client) Channel(name string) (Channel, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	ch, ok := c.state.channels[Canonicalize(name)]
+	if !ok {
+		return Channel{}, false
+	}
+
+	cp := Channel{
+		Name:    ch.Name,
+		Key:     ch.Key,
+		Modes:   ch.Modes,
+		Members: map[string]Member{},
+	}
+	for k, v := range ch.Members {
+		cp.Members[k] = v
+	}
+	return cp, true
+}
+
+// Member retrieves a user on a channel we're on. It reports whether they are
+// on the channel.
+func (c *Client) Member(channel, nick string) (Member, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	ch, ok := c.state.channels[Canonicalize(channel)]
+	if !ok {
+		return Member{}, false
+	}
+
+	member, ok := ch.Members[Canonicalize(nick)]
+	return member, ok
+}
+
+// IsOp checks whether we are a channel operator on the channel.
+func (c *Client) IsOp(channel string) bool {
+	member, ok := c.Member(channel, c.GetNick())
+	return ok && member.IsOp()
+}
+
+// LookupUser retrieves what we know about a user on a channel we're on. It
+// reports whether we know the user.
+func (c *Client) LookupUser(nick string) (User, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	u, ok := c.state.users[Canonicalize(nick)]
+	if !ok {
+		return User{}, false
+	}
+	return *u, true
+}
+
+// SupportsMonitor checks whether the server supports MONITOR. We know once
+// it sends ISUPPORT (005) after we register.
+//
+// We use MONITOR ourselves to get our nick back. Plugins may add other nicks
+// but shouldn't clear the list (MONITOR C) or remove our nick.
+func (c *Client) SupportsMonitor() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.state.monitor
+}
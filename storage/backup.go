@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// backupVersion is the version of the backup format we write.
+const backupVersion = 1
+
+// Backup is everything in a store. It's how Export writes it.
+type Backup struct {
+	Version int
+	Created time.Time
+
+	// Buckets holds the values of each bucket keyed by bucket and then key.
+	Buckets map[string]map[string]json.RawMessage
+}
+
+// Export writes everything in the store to w as JSON. Import reads it back
+// into any store, so this works for moving data between hosts or between
+// kinds of store as well as for backups.
+func Export(s Store, w io.Writer) (*Backup, error) {
+	b := &Backup{
+		Version: backupVersion,
+		Created: time.Now().UTC(),
+		Buckets: map[string]map[string]json.RawMessage{},
+	}
+
+	buckets, err := s.Buckets()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, bucket := range buckets {
+		keys, err := s.Keys(bucket)
+		if err != nil {
+			return nil, err
+		}
+
+		b.Buckets[bucket] = map[string]json.RawMessage{}
+		for _, key := range keys {
+			var raw json.RawMessage
+			ok, err := s.Get(bucket, key, &raw)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				b.Buckets[bucket][key] = raw
+			}
+		}
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(b); err != nil {
+		return nil, fmt.Errorf("error writing backup: %s", err)
+	}
+
+	return b, nil
+}
+
+// Import reads what Export wrote from r and stores it in the store. It
+// replaces keys that exist. It leaves other keys alone.
+func Import(s Store, r io.Reader) (*Backup, error) {
+	var b Backup
+	if err := json.NewDecoder(r).Decode(&b); err != nil {
+		return nil, fmt.Errorf("error reading backup: %s", err)
+	}
+
+	if b.Version != backupVersion {
+		return nil, fmt.Errorf("unsupported backup version: %d", b.Version)
+	}
+
+	for bucket, values := range b.Buckets {
+		for key, raw := range values {
+			if err := s.Put(bucket, key, raw); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return &b, nil
+}
+
+// Count is how many keys the backup holds.
+func (b *Backup) Count() int {
+	n := 0
+	for _, values := range b.Buckets {
+		n += len(values)
+	}
+	return n
+}
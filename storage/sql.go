@@ -0,0 +1,225 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// sqlTimeout is how long we wait on a database query.
+const sqlTimeout = 10 * time.Second
+
+// sqlTable is the table holding the data.
+const sqlTable = "godrop_storage"
+
+// SQLStore is a Store that keeps data in a database table. This lets several
+// clients share data or lets you keep it with your other data.
+//
+// We support PostgreSQL and MySQL. We create the table if it doesn't exist.
+type SQLStore struct {
+	db      *sql.DB
+	dialect sqlDialect
+
+	// closeDB is true if we opened the database and so should close it.
+	closeDB bool
+}
+
+// sqlDialect holds the queries that differ between databases.
+type sqlDialect struct {
+	create  string
+	get     string
+	put     string
+	delete  string
+	keys    string
+	buckets string
+}
+
+var sqlDialects = map[string]sqlDialect{
+	"postgres": {
+		create: `CREATE TABLE IF NOT EXISTS ` + sqlTable + ` (
+			bucket VARCHAR(255) NOT NULL,
+			name VARCHAR(255) NOT NULL,
+			value TEXT NOT NULL,
+			PRIMARY KEY (bucket, name)
+		)`,
+		get: `SELECT value FROM ` + sqlTable + ` WHERE bucket = $1 AND name = $2`,
+		put: `INSERT INTO ` + sqlTable + ` (bucket, name, value)
+			VALUES ($1, $2, $3)
+			ON CONFLICT (bucket, name) DO UPDATE SET value = EXCLUDED.value`,
+		delete:  `DELETE FROM ` + sqlTable + ` WHERE bucket = $1 AND name = $2`,
+		keys:    `SELECT name FROM ` + sqlTable + ` WHERE bucket = $1`,
+		buckets: `SELECT DISTINCT bucket FROM ` + sqlTable,
+	},
+	"mysql": {
+		create: `CREATE TABLE IF NOT EXISTS ` + sqlTable + ` (
+			bucket VARCHAR(255) NOT NULL,
+			name VARCHAR(255) NOT NULL,
+			value MEDIUMTEXT NOT NULL,
+			PRIMARY KEY (bucket, name)
+		)`,
+		get: `SELECT value FROM ` + sqlTable + ` WHERE bucket = ? AND name = ?`,
+		put: `INSERT INTO ` + sqlTable + ` (bucket, name, value)
+			VALUES (?, ?, ?)
+			ON DUPLICATE KEY UPDATE value = VALUES(value)`,
+		delete:  `DELETE FROM ` + sqlTable + ` WHERE bucket = ? AND name = ?`,
+		keys:    `SELECT name FROM ` + sqlTable + ` WHERE bucket = ?`,
+		buckets: `SELECT DISTINCT bucket FROM ` + sqlTable,
+	},
+}
+
+// OpenSQL opens a SQLStore. driver is postgres or mysql. The program must
+// import the database driver, such as github.com/lib/pq or
+// github.com/go-sql-driver/mysql. dsn says how to connect and depends on the
+// driver.
+func OpenSQL(driver, dsn string) (*SQLStore, error) {
+	if _, ok := sqlDialects[driver]; !ok {
+		return nil, fmt.Errorf("unsupported database: %s", driver)
+	}
+
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("error opening database: %s", err)
+	}
+
+	s, err := NewSQL(db, driver)
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	s.closeDB = true
+	return s, nil
+}
+
+// NewSQL creates a SQLStore using a database you already opened. dialect is
+// postgres or mysql. Close does not close the database.
+func NewSQL(db *sql.DB, dialect string) (*SQLStore, error) {
+	d, ok := sqlDialects[dialect]
+	if !ok {
+		return nil, fmt.Errorf("unsupported database: %s", dialect)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), sqlTimeout)
+	defer cancel()
+
+	if _, err := db.ExecContext(ctx, d.create); err != nil {
+		return nil, fmt.Errorf("error creating table: %s", err)
+	}
+
+	return &SQLStore{db: db, dialect: d}, nil
+}
+
+// Get decodes the value of the key in the bucket into v.
+func (s *SQLStore) Get(bucket, key string, v interface{}) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), sqlTimeout)
+	defer cancel()
+
+	var raw string
+	err := s.db.QueryRowContext(ctx, s.dialect.get, bucket, key).Scan(&raw)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error looking up %s/%s: %s", bucket, key, err)
+	}
+
+	if err := json.Unmarshal([]byte(raw), v); err != nil {
+		return false, fmt.Errorf("error decoding %s/%s: %s", bucket, key, err)
+	}
+
+	return true, nil
+}
+
+// Put sets the value of the key in the bucket.
+func (s *SQLStore) Put(bucket, key string, v interface{}) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("error encoding %s/%s: %s", bucket, key, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), sqlTimeout)
+	defer cancel()
+
+	if _, err := s.db.ExecContext(ctx, s.dialect.put, bucket, key,
+		string(raw)); err != nil {
+		return fmt.Errorf("error storing %s/%s: %s", bucket, key, err)
+	}
+
+	return nil
+}
+
+// Delete removes the key from the bucket.
+func (s *SQLStore) Delete(bucket, key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), sqlTimeout)
+	defer cancel()
+
+	if _, err := s.db.ExecContext(ctx, s.dialect.delete, bucket,
+		key); err != nil {
+		return fmt.Errorf("error deleting %s/%s: %s", bucket, key, err)
+	}
+
+	return nil
+}
+
+// Keys lists the keys in the bucket.
+func (s *SQLStore) Keys(bucket string) ([]string, error) {
+	keys, err := s.list(s.dialect.keys, bucket)
+	if err != nil {
+		return nil, fmt.Errorf("error listing %s: %s", bucket, err)
+	}
+	return keys, nil
+}
+
+// Buckets lists the buckets that have keys.
+func (s *SQLStore) Buckets() ([]string, error) {
+	buckets, err := s.list(s.dialect.buckets)
+	if err != nil {
+		return nil, fmt.Errorf("error listing buckets: %s", err)
+	}
+	return buckets, nil
+}
+
+// list runs a query returning one string column and returns the values
+// sorted.
+func (s *SQLStore) list(query string, args ...interface{}) ([]string,
+	error) {
+	ctx, cancel := context.WithTimeout(context.Background(), sqlTimeout)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var values []string
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Databases order differently depending on their collation. Sort the same
+	// way as FileStore.
+	sort.Strings(values)
+
+	return values, nil
+}
+
+// Close cleans up the store. If we opened the database, we close it.
+func (s *SQLStore) Close() error {
+	if !s.closeDB {
+		return nil
+	}
+	return s.db.Close()
+}
@@ -0,0 +1,204 @@
+// Package storage provides persistent key/value storage for plugins.
+//
+// Data is organized into buckets. Each bucket holds keys mapping to values.
+// Values are stored as JSON, so any value that can be encoded to JSON can be
+// stored.
+//
+// Plugins should use buckets named after themselves unless they deliberately
+// share data with another plugin.
+//
+// FileStore keeps data in a file. SQLStore keeps it in a PostgreSQL or MySQL
+// database.
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// Store is persistent key/value storage.
+type Store interface {
+	// Get decodes the value of the key in the bucket into v. It reports whether
+	// the key exists.
+	Get(bucket, key string, v interface{}) (bool, error)
+
+	// Put sets the value of the key in the bucket.
+	Put(bucket, key string, v interface{}) error
+
+	// Delete removes the key from the bucket. It is not an error if the key does
+	// not exist.
+	Delete(bucket, key string) error
+
+	// Keys lists the keys in the bucket in sorted order.
+	Keys(bucket string) ([]string, error)
+
+	// Buckets lists the buckets that have keys in sorted order.
+	Buckets() ([]string, error)
+
+	// Close cleans up the store.
+	Close() error
+}
+
+// FileStore is a Store that keeps all data in memory and writes it to a JSON
+// file after every change.
+//
+// This is simple and suitable for the small amounts of data plugins keep.
+type FileStore struct {
+	mutex sync.Mutex
+	file  string
+	data  map[string]map[string]json.RawMessage
+}
+
+// OpenFile opens a FileStore. If the file does not exist, it will be created
+// when data is first stored.
+func OpenFile(file string) (*FileStore, error) {
+	s := &FileStore{
+		file: file,
+		data: map[string]map[string]json.RawMessage{},
+	}
+
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, fmt.Errorf("error reading %s: %s", file, err)
+	}
+
+	if len(buf) == 0 {
+		return s, nil
+	}
+
+	if err := json.Unmarshal(buf, &s.data); err != nil {
+		return nil, fmt.Errorf("error decoding %s: %s", file, err)
+	}
+
+	return s, nil
+}
+
+// Get decodes the value of the key in the bucket into v.
+func (s *FileStore) Get(bucket, key string, v interface{}) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	raw, ok := s.data[bucket][key]
+	if !ok {
+		return false, nil
+	}
+
+	if err := json.Unmarshal(raw, v); err != nil {
+		return false, fmt.Errorf("error decoding %s/%s: %s", bucket, key, err)
+	}
+
+	return true, nil
+}
+
+// Put sets the value of the key in the bucket.
+func (s *FileStore) Put(bucket, key string, v interface{}) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("error encoding %s/%s: %s", bucket, key, err)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.data[bucket]; !ok {
+		s.data[bucket] = map[string]json.RawMessage{}
+	}
+	s.data[bucket][key] = raw
+
+	return s.save()
+}
+
+// Delete removes the key from the bucket.
+func (s *FileStore) Delete(bucket, key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.data[bucket][key]; !ok {
+		return nil
+	}
+
+	delete(s.data[bucket], key)
+	if len(s.data[bucket]) == 0 {
+		delete(s.data, bucket)
+	}
+
+	return s.save()
+}
+
+// Keys lists the keys in the bucket.
+func (s *FileStore) Keys(bucket string) ([]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var keys []string
+	for k := range s.data[bucket] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys, nil
+}
+
+// Buckets lists the buckets that have keys.
+func (s *FileStore) Buckets() ([]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var buckets []string
+	for b := range s.data {
+		buckets = append(buckets, b)
+	}
+	sort.Strings(buckets)
+
+	return buckets, nil
+}
+
+// Close cleans up the store. Everything is already written, so there is
+// nothing to do.
+func (s *FileStore) Close() error {
+	return nil
+}
+
+// save writes the data to the file.
+//
+// We write to a temporary file and rename it so we never leave a partially
+// written file behind.
+//
+// The caller must hold the mutex.
+func (s *FileStore) save() error {
+	buf, err := json.MarshalIndent(s.data, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding data: %s", err)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.file), filepath.Base(s.file))
+	if err != nil {
+		return fmt.Errorf("error creating temporary file: %s", err)
+	}
+
+	if _, err := tmp.Write(buf); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return fmt.Errorf("error writing %s: %s", tmp.Name(), err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return fmt.Errorf("error closing %s: %s", tmp.Name(), err)
+	}
+
+	if err := os.Rename(tmp.Name(), s.file); err != nil {
+		_ = os.Remove(tmp.Name())
+		return fmt.Errorf("error renaming %s: %s", tmp.Name(), err)
+	}
+
+	return nil
+}
@@ -0,0 +1,188 @@
+package godrop
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrSTSUpgrade is what Loop returns when the server told us to reconnect
+// with TLS. Connect again to do so.
+var ErrSTSUpgrade = fmt.Errorf("server requires TLS (STS)")
+
+// stsBucket is the storage bucket holding STS policies.
+const stsBucket = "sts"
+
+// stsPolicy is a strict transport security policy a server gave us. While it
+// is valid we only connect to the server with TLS.
+type stsPolicy struct {
+	Port    int
+	Expires time.Time
+}
+
+// parseSTS parses the value of the sts capability. It looks like
+// port=6697,duration=86400.
+func parseSTS(value string) (port int, duration time.Duration, hasDuration bool) {
+	for _, kv := range strings.Split(value, ",") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		n, err := strconv.Atoi(parts[1])
+		if err != nil || n < 0 {
+			continue
+		}
+
+		switch parts[0] {
+		case "port":
+			port = n
+		case "duration":
+			duration = time.Duration(n) * time.Second
+			hasDuration = true
+		}
+	}
+
+	return port, duration, hasDuration
+}
+
+// handleSTS deals with the sts capability being offered.
+//
+// If we're connected without TLS, we switch to TLS on the port it gives and
+// return ErrSTSUpgrade. If we're connected with TLS, we remember the policy.
+func (c *Client) handleSTS() error {
+	value, ok := c.CapValue("sts")
+	if !ok {
+		return nil
+	}
+
+	port, duration, hasDuration := parseSTS(value)
+
+	c.mutex.Lock()
+	useTLS, currentPort := c.tls, c.port
+	c.mutex.Unlock()
+
+	if !useTLS {
+		if port == 0 {
+			return nil
+		}
+		c.Log().Info("Server requires TLS (STS). Reconnecting", "port", port)
+		c.mutex.Lock()
+		c.tls = true
+		c.port = port
+		c.stsUpgraded = true
+		c.updateServer()
+		c.mutex.Unlock()
+		return ErrSTSUpgrade
+	}
+
+	if !hasDuration {
+		return nil
+	}
+
+	if duration == 0 {
+		c.deleteSTSPolicy()
+		return nil
+	}
+
+	c.saveSTSPolicy(stsPolicy{
+		Port:    currentPort,
+		Expires: time.Now().Add(duration),
+	})
+	return nil
+}
+
+// applySTSPolicy switches to TLS if we have a valid policy for the host. It
+// reports whether we have one.
+func (c *Client) applySTSPolicy() bool {
+	policy, ok := c.loadSTSPolicy()
+	if !ok {
+		return false
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !c.tls {
+		c.Log().Info("Using TLS due to STS policy", "host", c.host,
+			"port", policy.Port)
+		c.tls = true
+		c.port = policy.Port
+		c.updateServer()
+	}
+	return true
+}
+
+// stsKey is the key for the current host's STS policy.
+func (c *Client) stsKey() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return strings.ToLower(c.host)
+}
+
+func (c *Client) loadSTSPolicy() (stsPolicy, bool) {
+	key := c.stsKey()
+
+	c.mutex.Lock()
+	policy, ok := c.stsPolicies[key]
+	c.mutex.Unlock()
+
+	if !ok {
+		store, err := c.Storage()
+		if err != nil {
+			return stsPolicy{}, false
+		}
+
+		found, err := store.Get(stsBucket, key, &policy)
+		if err != nil {
+			c.Log().Error("Unable to look up STS policy", "error", err)
+			return stsPolicy{}, false
+		}
+		if !found {
+			return stsPolicy{}, false
+		}
+	}
+
+	if time.Now().After(policy.Expires) {
+		return stsPolicy{}, false
+	}
+
+	return policy, true
+}
+
+func (c *Client) saveSTSPolicy(policy stsPolicy) {
+	key := c.stsKey()
+
+	c.mutex.Lock()
+	c.stsPolicies[key] = policy
+	c.mutex.Unlock()
+
+	// Without storage we remember the policy only while running.
+	store, err := c.Storage()
+	if err != nil {
+		return
+	}
+
+	if err := store.Put(stsBucket, key, policy); err != nil {
+		c.Log().Error("Unable to store STS policy", "error", err)
+	}
+}
+
+func (c *Client) deleteSTSPolicy() {
+	key := c.stsKey()
+
+	c.mutex.Lock()
+	delete(c.stsPolicies, key)
+	c.mutex.Unlock()
+
+	store, err := c.Storage()
+	if err != nil {
+		return
+	}
+
+	if err := store.Delete(stsBucket, key); err != nil {
+		c.Log().Error("Unable to delete STS policy", "error", err)
+	}
+}
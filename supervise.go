@@ -0,0 +1,99 @@
+package godrop
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// superviseMinDelay and superviseMaxDelay bound how long we wait before
+	// restarting a goroutine that failed.
+	superviseMinDelay = time.Second
+	superviseMaxDelay = 5 * time.Minute
+
+	// superviseMaxFailures is how many times in a row a goroutine may fail
+	// before we stop restarting it.
+	superviseMaxFailures = 10
+
+	// superviseHealthy is how long a goroutine must run before we forget
+	// about its earlier failures.
+	superviseHealthy = 10 * time.Minute
+)
+
+// Go runs fn in its own goroutine and restarts it if it fails.
+//
+// This is for long running goroutines such as pollers and listeners so they
+// don't die without anyone noticing. If fn panics or returns an error we
+// report it and run it again after a delay. The delay doubles each time it
+// fails in a row, up to 5 minutes. After 10 failures in a row we give up. If
+// fn returns nil, it's done.
+//
+// name is the plugin running it. Failures count in its health (see
+// PluginStatuses).
+//
+// fn should return once Done is closed. We don't start or restart it after
+// the client is shut down (see Shutdown).
+func (c *Client) Go(name string, fn func() error) {
+	if c.isShutdown() {
+		return
+	}
+	go c.supervise(name, fn)
+}
+
+// supervise runs fn until it returns nil or fails too many times.
+func (c *Client) supervise(name string, fn func() error) {
+	failures := 0
+	delay := superviseMinDelay
+
+	for {
+		start := time.Now()
+		panicked, err := c.runSupervised(name, fn)
+		if (err == nil && !panicked) || c.isShutdown() {
+			return
+		}
+		if err != nil {
+			c.PluginError(name, err)
+		}
+
+		if time.Since(start) >= superviseHealthy {
+			failures = 0
+			delay = superviseMinDelay
+		}
+
+		failures++
+		if failures >= superviseMaxFailures {
+			c.PluginError(name, fmt.Errorf(
+				"goroutine failed %d times in a row, not restarting it", failures))
+			return
+		}
+
+		c.Log().Info("Restarting goroutine", "plugin", name, "delay", delay)
+		select {
+		case <-time.After(delay):
+		case <-c.Done():
+			return
+		}
+
+		delay *= 2
+		if delay > superviseMaxDelay {
+			delay = superviseMaxDelay
+		}
+
+		c.healthMutex.Lock()
+		c.pluginHealth(name).restarts++
+		c.healthMutex.Unlock()
+	}
+}
+
+// runSupervised runs fn once. It returns whether it panicked and its error.
+func (c *Client) runSupervised(name string,
+	fn func() error) (panicked bool, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			c.pluginPanicked(name, r)
+			panicked = true
+		}
+	}()
+
+	return false, fn()
+}
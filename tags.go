@@ -0,0 +1,122 @@
+package godrop
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/horgh/irc"
+)
+
+// Typing notification states for Typing.
+const (
+	TypingActive = "active"
+	TypingPaused = "paused"
+	TypingDone   = "done"
+)
+
+// TagMessage sends a TAGMSG. This is a message with tags but no text. Clients
+// use these for things like typing notifications and reactions.
+//
+// Tags clients send to each other start with +.
+//
+// This requires the message-tags capability.
+func (c *Client) TagMessage(target string, tags map[string]string) error {
+	if !c.HasCap("message-tags") {
+		return fmt.Errorf("server does not support message-tags")
+	}
+
+	return c.writeTagged(tags, irc.Message{
+		Command: "TAGMSG",
+		Params:  []string{target},
+	})
+}
+
+// MessageWithTags sends a message along with tags.
+//
+// If the server doesn't support the message-tags capability, we send the
+// message without the tags. If the message is long enough that we split it,
+// each line gets the tags.
+//
+// The message is queued with PriorityNormal. See Send.
+func (c *Client) MessageWithTags(target, message string,
+	tags map[string]string) error {
+	if !c.HasCap("message-tags") {
+		return c.Message(target, message)
+	}
+
+	for _, piece := range splitMessage(message) {
+		if err := c.sendTagged(tags, irc.Message{
+			Command: "PRIVMSG",
+			Params:  []string{target, piece},
+		}, PriorityNormal, false); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Typing tells the target we're typing. state is one of TypingActive,
+// TypingPaused, or TypingDone.
+func (c *Client) Typing(target, state string) error {
+	return c.TagMessage(target, map[string]string{"+typing": state})
+}
+
+// React sends a reaction (such as an emoji) to the message with the given ID.
+// Message IDs are in the msgid tag.
+func (c *Client) React(target, msgID, reaction string) error {
+	return c.TagMessage(target, map[string]string{
+		"+draft/react": reaction,
+		"+draft/reply": msgID,
+	})
+}
+
+// writeTagged writes a message with tags.
+func (c *Client) writeTagged(tags map[string]string, m irc.Message) error {
+	buf, err := m.Encode()
+	if err != nil && err != irc.ErrTruncated {
+		return fmt.Errorf("unable to encode message: %s", err)
+	}
+
+	if len(tags) == 0 {
+		return c.write(buf)
+	}
+
+	return c.write("@" + encodeTags(tags) + " " + buf)
+}
+
+// encodeTags encodes tags for a message. We sort them so the output is
+// stable.
+func encodeTags(tags map[string]string) string {
+	var keys []string
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var encoded []string
+	for _, k := range keys {
+		if tags[k] == "" {
+			encoded = append(encoded, k)
+			continue
+		}
+		encoded = append(encoded, k+"="+escapeTagValue(tags[k]))
+	}
+
+	return strings.Join(encoded, ";")
+}
+
+var tagEscaper = strings.NewReplacer(
+	"\\", "\\\\",
+	";", "\\:",
+	" ", "\\s",
+	"\r", "\\r",
+	"\n", "\\n",
+)
+
+// escapeTagValue escapes a tag value as the message-tags specification
+// describes.
+func escapeTagValue(v string) string {
+	return tagEscaper.Replace(v)
+}
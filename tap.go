@@ -0,0 +1,100 @@
+package godrop
+
+import (
+	"fmt"
+	"strings"
+)
+
+// TapDirection says whether a line came from the server or went to it.
+type TapDirection int
+
+const (
+	// TapReceived is a line we read from the server.
+	TapReceived TapDirection = iota
+
+	// TapSent is a line we wrote to the server.
+	TapSent
+)
+
+func (d TapDirection) String() string {
+	if d == TapSent {
+		return "sent"
+	}
+	return "received"
+}
+
+// Tap is a function that gets each raw line we read from or write to the
+// server, without its CRLF. This is for debug consoles, protocol logs, or
+// passing traffic through to another program.
+//
+// Taps run as we read and write, so they must be quick and must not send
+// anything themselves. Passwords in lines we send are redacted the same as in
+// transcripts (see SetTranscriptDir).
+type Tap func(c *Client, d TapDirection, line string)
+
+// AddTap adds a tap to the client. It gets lines starting with the next one
+// we read or write. It returns an error if the client already has a tap with
+// the name.
+func (c *Client) AddTap(name string, tap Tap) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if _, ok := c.taps[name]; ok {
+		return fmt.Errorf("tap %s already added", name)
+	}
+
+	// Copy so we don't change a map a reader may be using.
+	taps := map[string]Tap{name: tap}
+	for n, t := range c.taps {
+		taps[n] = t
+	}
+	c.taps = taps
+	return nil
+}
+
+// RemoveTap removes a tap from the client. It reports whether the client had
+// it.
+func (c *Client) RemoveTap(name string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if _, ok := c.taps[name]; !ok {
+		return false
+	}
+
+	taps := map[string]Tap{}
+	for n, t := range c.taps {
+		if n != name {
+			taps[n] = t
+		}
+	}
+	c.taps = taps
+	return true
+}
+
+// tap gives the line to each tap. If one panics we log it and carry on.
+func (c *Client) tap(d TapDirection, line string) {
+	c.mutex.Lock()
+	taps := c.taps
+	c.mutex.Unlock()
+
+	if len(taps) == 0 {
+		return
+	}
+
+	line = strings.TrimRight(line, "\r\n")
+	for name, t := range taps {
+		c.runTap(name, t, d, line)
+	}
+}
+
+// runTap calls the tap, recovering if it panics.
+func (c *Client) runTap(name string, t Tap, d TapDirection, line string) {
+	defer func() {
+		if r := recover(); r != nil {
+			c.Log().Error("Tap panicked", "tap", name, "panic", r)
+		}
+	}()
+
+	t(c, d, line)
+}
@@ -0,0 +1,365 @@
+// Package tell passes messages on to people who aren't around.
+//
+// Usage:
+// - !tell <nick> <message> - Leave a message for someone. We give it to them
+//   the next time they speak or join a channel we're on.
+// - !tells - List the messages you left that we haven't given out yet.
+// - !tells cancel <number> - Cancel one of them. The number is the one shown
+//   by !tells.
+//
+// We give someone their messages where they spoke or joined, or privately if
+// they spoke to us privately. Messages nobody picks up expire.
+//
+// Messages are kept in persistent storage so they survive restarts. This
+// requires storage-file to be set.
+//
+// Configuration options:
+// - tell-expiry - How long to keep messages that haven't been given out.
+//   Default 720h (30 days).
+//
+// Messages are given out using the template memo. Its data is a Delivery.
+package tell
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/horgh/godrop"
+	"github.com/horgh/irc"
+)
+
+func init() {
+	godrop.RegisterEventHook("tell", Hook)
+	godrop.RegisterConfig("tell",
+		godrop.ConfigKey{Name: "storage-file", Required: true},
+		godrop.ConfigKey{Name: "tell-expiry", Kind: godrop.ConfigDuration},
+	)
+	godrop.RegisterTemplate("tell", "memo",
+		"{{.Nick}}: {{.From}} said {{.Ago}}: {{.Message}}")
+	godrop.RegisterCommand("tell", godrop.Command{
+		Name:    "tell",
+		Usage:   "<nick> <message>",
+		Help:    "Leave a message for someone.",
+		MinArgs: 2,
+		Run:     triggerTell,
+	})
+	godrop.RegisterCommand("tell", godrop.Command{
+		Name:  "tells",
+		Usage: "[cancel <number>]",
+		Help:  "List or cancel messages you left.",
+		Run:   triggerTells,
+	})
+}
+
+const (
+	// bucket holds the messages for each nick keyed by canonicalized nick.
+	bucket = "tell"
+
+	defaultExpiry = 30 * 24 * time.Hour
+
+	// Limit how many messages may wait for each person.
+	maxMemosPerNick = 10
+)
+
+// Memo is a message left for someone.
+type Memo struct {
+	ID string
+
+	// From is who left it. Nick is who it's for.
+	From    string
+	Nick    string
+	Message string
+	Time    time.Time
+}
+
+// Delivery is the data for the memo template.
+type Delivery struct {
+	Memo
+
+	// Ago is how long ago it was left, such as 3 hours ago.
+	Ago string
+}
+
+// mutex protects reading and updating messages in storage.
+var mutex sync.Mutex
+
+// Hook fires when an IRC message of some kind occurs.
+func Hook(c *godrop.Client, e godrop.Event) {
+	m := e.Message
+	if m.Command != "PRIVMSG" && m.Command != "JOIN" {
+		return
+	}
+	if len(m.Params) == 0 {
+		return
+	}
+
+	nick := godrop.SourceNick(m)
+	if nick == "" {
+		return
+	}
+
+	// Reply where they are. If they messaged us privately, that's privately.
+	target := m.Params[0]
+	if !godrop.IsChannel(target) {
+		target = nick
+	}
+
+	mutex.Lock()
+	memos, err := take(c, nick)
+	mutex.Unlock()
+	if err != nil {
+		c.PluginError("tell", fmt.Errorf("unable to look up messages: %s", err))
+		return
+	}
+
+	for _, memo := range memos {
+		// Address them by the nick they have now.
+		memo.Nick = nick
+		_ = c.Message(target, c.Format("tell", "memo", target, Delivery{
+			Memo: memo,
+			Ago:  ago(time.Since(memo.Time)),
+		}))
+	}
+}
+
+// triggerTell handles !tell
+func triggerTell(c *godrop.Client, m irc.Message, args []string) error {
+	target := godrop.ReplyTarget(m)
+	source := godrop.SourceNick(m)
+	nick := args[0]
+	message := strings.Join(args[1:], " ")
+
+	if godrop.Canonicalize(nick) == godrop.Canonicalize(source) {
+		return c.Message(target, fmt.Sprintf("%s: Tell yourself.", source))
+	}
+	if godrop.Canonicalize(nick) == godrop.Canonicalize(c.GetNick()) {
+		return c.Message(target, fmt.Sprintf("%s: I'm listening.", source))
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	memos, err := get(c, nick)
+	if err != nil {
+		return fmt.Errorf("unable to look up messages: %s", err)
+	}
+	if len(memos) >= maxMemosPerNick {
+		return c.Message(target, fmt.Sprintf(
+			"%s: %s has too many messages waiting.", source, nick))
+	}
+
+	now := time.Now()
+	memos = append(memos, Memo{
+		ID:      strconv.FormatInt(now.UnixNano(), 10),
+		From:    source,
+		Nick:    nick,
+		Message: message,
+		Time:    now,
+	})
+	if err := put(c, nick, memos); err != nil {
+		return fmt.Errorf("unable to store message: %s", err)
+	}
+
+	return c.Message(target, fmt.Sprintf("%s: I'll tell %s.", source, nick))
+}
+
+// triggerTells handles !tells
+func triggerTells(c *godrop.Client, m irc.Message, args []string) error {
+	target := godrop.ReplyTarget(m)
+	source := godrop.SourceNick(m)
+
+	if len(args) == 2 && strings.EqualFold(args[0], "cancel") {
+		return cancelMemo(c, target, source, args[1])
+	}
+	if len(args) != 0 {
+		return c.Message(target, "Usage: !tells [cancel <number>]")
+	}
+
+	mutex.Lock()
+	memos, err := getSent(c, source)
+	mutex.Unlock()
+	if err != nil {
+		return fmt.Errorf("unable to look up messages: %s", err)
+	}
+
+	if len(memos) == 0 {
+		return c.Message(target, fmt.Sprintf("%s: You have no messages waiting.",
+			source))
+	}
+
+	for i, memo := range memos {
+		if err := c.Message(target, fmt.Sprintf("%s: #%d: For %s, %s: %s",
+			source, i+1, memo.Nick, ago(time.Since(memo.Time)),
+			memo.Message)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cancelMemo cancels one of the messages listed by !tells.
+func cancelMemo(c *godrop.Client, target, nick, number string) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	sent, err := getSent(c, nick)
+	if err != nil {
+		return fmt.Errorf("unable to look up messages: %s", err)
+	}
+
+	n, err := strconv.Atoi(number)
+	if err != nil || n < 1 || n > len(sent) {
+		return c.Message(target, fmt.Sprintf("%s: No such message.", nick))
+	}
+	cancelled := sent[n-1]
+
+	memos, err := get(c, cancelled.Nick)
+	if err != nil {
+		return fmt.Errorf("unable to look up messages: %s", err)
+	}
+	var kept []Memo
+	for _, memo := range memos {
+		if memo.ID != cancelled.ID {
+			kept = append(kept, memo)
+		}
+	}
+	if err := put(c, cancelled.Nick, kept); err != nil {
+		return fmt.Errorf("unable to store messages: %s", err)
+	}
+
+	return c.Message(target, fmt.Sprintf("%s: Message #%d cancelled.", nick, n))
+}
+
+// take retrieves the messages for the nick and removes them from storage.
+//
+// The caller must hold mutex.
+func take(c *godrop.Client, nick string) ([]Memo, error) {
+	memos, err := get(c, nick)
+	if err != nil || len(memos) == 0 {
+		return nil, err
+	}
+	if err := put(c, nick, nil); err != nil {
+		return nil, err
+	}
+	return memos, nil
+}
+
+// get retrieves the messages for the nick oldest first, leaving out expired
+// ones.
+//
+// The caller must hold mutex.
+func get(c *godrop.Client, nick string) ([]Memo, error) {
+	store, err := c.Storage()
+	if err != nil {
+		return nil, err
+	}
+
+	var memos []Memo
+	if _, err := store.Get(bucket, godrop.Canonicalize(nick),
+		&memos); err != nil {
+		return nil, err
+	}
+	return unexpired(c, memos), nil
+}
+
+// put stores the messages for the nick. If there are none we delete the
+// nick's entry.
+//
+// The caller must hold mutex.
+func put(c *godrop.Client, nick string, memos []Memo) error {
+	store, err := c.Storage()
+	if err != nil {
+		return err
+	}
+
+	if len(memos) == 0 {
+		return store.Delete(bucket, godrop.Canonicalize(nick))
+	}
+	return store.Put(bucket, godrop.Canonicalize(nick), memos)
+}
+
+// getSent retrieves the messages the nick left oldest first, leaving out
+// expired ones. We include ones from nicks they recently changed from.
+//
+// The caller must hold mutex.
+func getSent(c *godrop.Client, nick string) ([]Memo, error) {
+	store, err := c.Storage()
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := store.Keys(bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	nicks := map[string]struct{}{godrop.Canonicalize(nick): {}}
+	for _, n := range c.PreviousNicks(nick) {
+		nicks[godrop.Canonicalize(n)] = struct{}{}
+	}
+
+	var sent []Memo
+	for _, key := range keys {
+		var memos []Memo
+		if _, err := store.Get(bucket, key, &memos); err != nil {
+			return nil, err
+		}
+		for _, memo := range unexpired(c, memos) {
+			if _, ok := nicks[godrop.Canonicalize(memo.From)]; ok {
+				sent = append(sent, memo)
+			}
+		}
+	}
+
+	sort.Slice(sent, func(i, j int) bool {
+		return sent[i].Time.Before(sent[j].Time)
+	})
+	return sent, nil
+}
+
+// unexpired leaves out the messages that have been waiting longer than
+// tell-expiry. They stay in storage until the nick's messages are next
+// stored.
+func unexpired(c *godrop.Client, memos []Memo) []Memo {
+	expiry := c.Conf().GetDuration("tell-expiry", defaultExpiry)
+
+	var kept []Memo
+	for _, memo := range memos {
+		if time.Since(memo.Time) < expiry {
+			kept = append(kept, memo)
+		}
+	}
+	return kept
+}
+
+// ago describes how long ago something was in its largest unit, such as 3
+// hours ago.
+func ago(d time.Duration) string {
+	units := []struct {
+		d    time.Duration
+		name string
+	}{
+		{365 * 24 * time.Hour, "year"},
+		{7 * 24 * time.Hour, "week"},
+		{24 * time.Hour, "day"},
+		{time.Hour, "hour"},
+		{time.Minute, "minute"},
+		{time.Second, "second"},
+	}
+
+	for _, u := range units {
+		n := int(d / u.d)
+		if n == 0 {
+			continue
+		}
+		if n == 1 {
+			return fmt.Sprintf("1 %s ago", u.name)
+		}
+		return fmt.Sprintf("%d %ss ago", n, u.name)
+	}
+	return "just now"
+}
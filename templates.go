@@ -0,0 +1,278 @@
+package godrop
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// TemplateFuncs are functions templates may use. Most help format text for
+// IRC:
+// - bold, italic, underline - Format the text.
+// - color - Color the text, such as {{color "red" .Text}}. The colors are
+//   white, black, blue, green, red, brown, purple, orange, yellow,
+//   lightgreen, cyan, lightcyan, lightblue, pink, grey, and lightgrey.
+// - plain - Remove formatting from the text.
+// - truncate - Cut the text to at most n characters, such as
+//   {{truncate 100 .Title}}.
+// - plural - Choose a word based on a count, such as
+//   {{plural .Days "day" "days"}}.
+// - join - Join strings with a separator.
+// - choose - Pick one of its arguments at random.
+// - time - Show a date and time in the channel's timezone and format. See
+//   ChannelSettings.
+// - clock - Show a time of day in the channel's timezone and format.
+var TemplateFuncs = template.FuncMap{
+	"bold": func(s interface{}) string {
+		return "\x02" + fmt.Sprint(s) + "\x02"
+	},
+	"italic": func(s interface{}) string {
+		return "\x1d" + fmt.Sprint(s) + "\x1d"
+	},
+	"underline": func(s interface{}) string {
+		return "\x1f" + fmt.Sprint(s) + "\x1f"
+	},
+	"color": func(color string, s interface{}) (string, error) {
+		n, ok := ircColors[strings.ToLower(color)]
+		if !ok {
+			return "", fmt.Errorf("unknown color: %s", color)
+		}
+		return fmt.Sprintf("\x03%02d%s\x03", n, fmt.Sprint(s)), nil
+	},
+	"plain": func(s interface{}) string {
+		return StripFormatting(fmt.Sprint(s))
+	},
+	"truncate": func(n int, s interface{}) string {
+		return truncate(fmt.Sprint(s), n)
+	},
+	"plural": func(n int, singular, plural string) string {
+		if n == 1 {
+			return singular
+		}
+		return plural
+	},
+	"join": func(sep string, s []string) string {
+		return strings.Join(s, sep)
+	},
+	"choose": func(choices ...string) string {
+		if len(choices) == 0 {
+			return ""
+		}
+		return choices[rand.Intn(len(choices))]
+	},
+	// Format replaces these with ones using the target's settings.
+	"time":  ChannelSettings{}.FormatTime,
+	"clock": ChannelSettings{}.FormatClock,
+}
+
+// ircColors maps color names to their numbers.
+var ircColors = map[string]int{
+	"white":      0,
+	"black":      1,
+	"blue":       2,
+	"green":      3,
+	"red":        4,
+	"brown":      5,
+	"purple":     6,
+	"orange":     7,
+	"yellow":     8,
+	"lightgreen": 9,
+	"cyan":       10,
+	"lightcyan":  11,
+	"lightblue":  12,
+	"pink":       13,
+	"grey":       14,
+	"lightgrey":  15,
+}
+
+// StripFormatting removes IRC formatting such as bold and colors from text.
+func StripFormatting(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\x02', '\x0f', '\x16', '\x1d', '\x1e', '\x1f':
+		case '\x03':
+			// Up to two digits, optionally a comma and up to two more.
+			i = skipDigits(s, i+1, 2) - 1
+			if i+2 < len(s) && s[i+1] == ',' && isDigit(s[i+2]) {
+				i = skipDigits(s, i+2, 2) - 1
+			}
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+// skipDigits returns the index after at most max digits starting at i.
+func skipDigits(s string, i, max int) int {
+	for n := 0; n < max && i < len(s) && isDigit(s[i]); n++ {
+		i++
+	}
+	return i
+}
+
+func isDigit(b byte) bool {
+	return b >= '0' && b <= '9'
+}
+
+// templates holds the templates plugins register keyed by templateKey.
+var templates = struct {
+	sync.Mutex
+	defaults map[string]registeredTemplate
+}{defaults: map[string]registeredTemplate{}}
+
+type registeredTemplate struct {
+	plugin string
+	tmpl   *template.Template
+}
+
+// RegisterTemplate sets the template a plugin uses for a kind of line it
+// outputs. Packages call this from an init() function. See Format.
+//
+// The template is a text/template template and may use TemplateFuncs. It
+// panics if the template is invalid.
+func RegisterTemplate(plugin, name, text string) {
+	templates.Lock()
+	defer templates.Unlock()
+
+	key := templateKey(plugin, name)
+	templates.defaults[key] = registeredTemplate{
+		plugin: plugin,
+		tmpl: template.Must(template.New(key).Funcs(TemplateFuncs).
+			Parse(text)),
+	}
+}
+
+// Format makes a line a plugin outputs using the template registered for it
+// with RegisterTemplate. target is where it's going.
+//
+// The config may override the template with the key
+// template-<plugin>-<name>. For one channel it may use
+// template-<plugin>-<name>-<channel>. If an override fails we log it and fall
+// back to the next.
+func (c *Client) Format(plugin, name, target string,
+	data interface{}) string {
+	key := templateKey(plugin, name)
+
+	templates.Lock()
+	t, ok := templates.defaults[key]
+	templates.Unlock()
+	if !ok {
+		c.PluginError(plugin, fmt.Errorf("no template %s", name))
+		return ""
+	}
+
+	settings := c.ChannelSettings(target)
+	funcs := template.FuncMap{
+		"time":  settings.FormatTime,
+		"clock": settings.FormatClock,
+	}
+
+	for _, k := range []string{key + "-" + target, key} {
+		text := c.Conf()[k]
+		if text == "" {
+			continue
+		}
+
+		s, err := executeTemplate(k, text, funcs, data)
+		if err == nil {
+			return s
+		}
+		c.Log().Warn("Invalid template", "key", k, "error", err)
+	}
+
+	tmpl, err := t.tmpl.Clone()
+	if err != nil {
+		c.PluginError(plugin, fmt.Errorf("unable to format %s: %s", name, err))
+		return ""
+	}
+
+	buf := &bytes.Buffer{}
+	if err := tmpl.Funcs(funcs).Execute(buf, data); err != nil {
+		c.PluginError(plugin, fmt.Errorf("unable to format %s: %s", name, err))
+		return ""
+	}
+	return buf.String()
+}
+
+// executeTemplate parses and runs a template. funcs replace any of
+// TemplateFuncs with the same name.
+func executeTemplate(name, text string, funcs template.FuncMap,
+	data interface{}) (string, error) {
+	tmpl, err := template.New(name).Funcs(TemplateFuncs).Funcs(funcs).
+		Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	buf := &bytes.Buffer{}
+	if err := tmpl.Execute(buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// templateKey is the config key to override a template.
+func templateKey(plugin, name string) string {
+	return "template-" + plugin + "-" + name
+}
+
+// validateTemplates checks the template overrides in the config parse. It
+// returns a problem for each one that doesn't or that doesn't match a
+// registered template.
+func validateTemplates(config map[string]string) []ConfigProblem {
+	templates.Lock()
+	var keys []string
+	plugins := map[string]string{}
+	for key, t := range templates.defaults {
+		keys = append(keys, key)
+		plugins[key] = t.plugin
+	}
+	templates.Unlock()
+
+	// Check longer keys first so template-a-b-c matches the template b-c
+	// rather than b with the channel c.
+	sort.Slice(keys, func(i, j int) bool { return len(keys[i]) > len(keys[j]) })
+
+	var problems []ConfigProblem
+	for name, text := range config {
+		if !strings.HasPrefix(name, "template-") {
+			continue
+		}
+
+		plugin := ""
+		for _, key := range keys {
+			if name == key || strings.HasPrefix(name, key+"-") {
+				plugin = plugins[key]
+				break
+			}
+		}
+		if plugin == "" {
+			problems = append(problems, ConfigProblem{
+				Plugin: "templates",
+				Key:    name,
+				Err:    fmt.Errorf("there is no such template"),
+			})
+			continue
+		}
+
+		if _, err := template.New(name).Funcs(TemplateFuncs).
+			Parse(text); err != nil {
+			problems = append(problems, ConfigProblem{
+				Plugin: plugin,
+				Key:    name,
+				Err:    err,
+			})
+		}
+	}
+
+	sort.Slice(problems, func(i, j int) bool {
+		return problems[i].Key < problems[j].Key
+	})
+	return problems
+}
@@ -0,0 +1,355 @@
+// Package timer provides countdown timers.
+//
+// Usage:
+// - !timer <duration> [message] - Start a timer. When it is up we announce it
+//   where it was set. Duration is something like 10m, 1h30m, or 2d.
+// - !timers - List your active timers.
+// - !timer cancel <number> - Cancel one of your timers. The number is the one
+//   shown by !timers.
+//
+// Timers are kept in persistent storage so they survive restarts. This
+// requires storage-file to be set.
+package timer
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/horgh/godrop"
+	"github.com/horgh/irc"
+)
+
+func init() {
+	godrop.Register("timer", Hook)
+	godrop.RegisterConfig("timer",
+		godrop.ConfigKey{Name: "storage-file", Required: true},
+	)
+	godrop.RegisterCommand("timer", godrop.Command{
+		Name:    "timer",
+		Usage:   "<duration> [message] or cancel <number>",
+		Help:    "Start a countdown timer.",
+		MinArgs: 1,
+		Run:     triggerTimer,
+	})
+	godrop.RegisterCommand("timer", godrop.Command{
+		Name: "timers",
+		Help: "List your timers.",
+		Run:  triggerTimers,
+	})
+}
+
+var cancelRE = regexp.MustCompile(`(?i)^cancel\s+([0-9]+)$`)
+
+const (
+	// bucket is the storage bucket holding timers.
+	bucket = "timers"
+
+	// Limit how many timers each person may have.
+	maxTimersPerNick = 10
+
+	// Limit how long timers may be.
+	maxDuration = 30 * 24 * time.Hour
+)
+
+// Timer is a countdown timer.
+type Timer struct {
+	ID       string
+	Nick     string
+	Target   string
+	Message  string
+	Duration string
+	Due      time.Time
+}
+
+var (
+	mutex sync.Mutex
+
+	// scheduled holds the timers we've scheduled keyed by client and ID. Each
+	// client schedules its own since a client that's shut down doesn't
+	// announce them.
+	scheduled = map[scheduleKey]*time.Timer{}
+)
+
+// scheduleKey identifies a timer a client scheduled.
+type scheduleKey struct {
+	c  *godrop.Client
+	id string
+}
+
+// Hook fires when an IRC message of some kind occurs.
+func Hook(c *godrop.Client, m irc.Message) {
+	// Schedule timers from storage once we're connected. We do this on every
+	// connect. Anything that failed to send while we were disconnected gets
+	// tried again.
+	if m.Command == irc.ReplyWelcome {
+		restoreTimers(c)
+	}
+}
+
+// triggerTimer handles !timer
+func triggerTimer(c *godrop.Client, m irc.Message, words []string) error {
+	target := godrop.ReplyTarget(m)
+	nick := godrop.SourceNick(m)
+	args := strings.Join(words, " ")
+
+	if matches := cancelRE.FindStringSubmatch(args); matches != nil {
+		cancelTimer(c, target, nick, matches[1])
+		return nil
+	}
+
+	fields := strings.SplitN(args, " ", 2)
+	if fields[0] == "" {
+		return c.Message(target, "Usage: !timer <duration> [message]")
+	}
+
+	d, err := godrop.ParseDuration(fields[0])
+	if err != nil || d <= 0 {
+		return c.Message(target, fmt.Sprintf(
+			"%s: Invalid duration: %s. Try something like 10m or 1h30m.", nick,
+			fields[0]))
+	}
+
+	if d > maxDuration {
+		return c.Message(target, fmt.Sprintf("%s: Timers may be at most %s.", nick,
+			maxDuration))
+	}
+
+	message := ""
+	if len(fields) == 2 {
+		message = strings.TrimSpace(fields[1])
+	}
+
+	store, err := c.Storage()
+	if err != nil {
+		return c.Message(target, fmt.Sprintf("Unable to store timer: %s", err))
+	}
+
+	timers, err := getTimers(c, nick)
+	if err != nil {
+		return c.Message(target, fmt.Sprintf("Unable to look up timers: %s", err))
+	}
+
+	if len(timers) >= maxTimersPerNick {
+		return c.Message(target, fmt.Sprintf("%s: You have too many timers.", nick))
+	}
+
+	now := time.Now()
+	t := Timer{
+		ID:       strconv.FormatInt(now.UnixNano(), 10),
+		Nick:     nick,
+		Target:   target,
+		Message:  message,
+		Duration: fields[0],
+		Due:      now.Add(d),
+	}
+
+	if err := store.Put(bucket, t.ID, t); err != nil {
+		return c.Message(target, fmt.Sprintf("Unable to store timer: %s", err))
+	}
+
+	schedule(c, t)
+
+	return c.Message(target, fmt.Sprintf("%s: Timer set for %s (at %s).", nick,
+		fields[0], c.ChannelSettings(target).FormatTime(t.Due)))
+}
+
+// triggerTimers handles !timers
+func triggerTimers(c *godrop.Client, m irc.Message, args []string) error {
+	target := godrop.ReplyTarget(m)
+	nick := godrop.SourceNick(m)
+
+	timers, err := getTimers(c, nick)
+	if err != nil {
+		return c.Message(target, fmt.Sprintf("Unable to look up timers: %s", err))
+	}
+
+	if len(timers) == 0 {
+		return c.Message(target, fmt.Sprintf("%s: You have no timers.", nick))
+	}
+
+	now := time.Now()
+	for i, t := range timers {
+		s := fmt.Sprintf("%s: #%d: %s left", nick, i+1,
+			t.Due.Sub(now).Round(time.Second))
+		if t.Message != "" {
+			s += ": " + t.Message
+		}
+		_ = c.Message(target, s)
+	}
+	return nil
+}
+
+func cancelTimer(c *godrop.Client, target, nick, number string) {
+	timers, err := getTimers(c, nick)
+	if err != nil {
+		_ = c.Message(target, fmt.Sprintf("Unable to look up timers: %s", err))
+		return
+	}
+
+	n, err := strconv.Atoi(number)
+	if err != nil || n < 1 || n > len(timers) {
+		_ = c.Message(target, fmt.Sprintf("%s: No such timer.", nick))
+		return
+	}
+
+	t := timers[n-1]
+
+	store, err := c.Storage()
+	if err != nil {
+		_ = c.Message(target, fmt.Sprintf("Unable to cancel timer: %s", err))
+		return
+	}
+
+	if err := store.Delete(bucket, t.ID); err != nil {
+		_ = c.Message(target, fmt.Sprintf("Unable to cancel timer: %s", err))
+		return
+	}
+
+	mutex.Lock()
+	if st, ok := scheduled[scheduleKey{c, t.ID}]; ok {
+		st.Stop()
+		delete(scheduled, scheduleKey{c, t.ID})
+	}
+	mutex.Unlock()
+
+	_ = c.Message(target, fmt.Sprintf("%s: Timer #%d cancelled.", nick, n))
+}
+
+// getTimers retrieves the nick's timers ordered by when they are due. This
+// includes ones they set using nicks they recently changed from.
+func getTimers(c *godrop.Client, nick string) ([]Timer, error) {
+	timers, err := getAllTimers(c)
+	if err != nil {
+		return nil, err
+	}
+
+	nicks := append([]string{nick}, c.PreviousNicks(nick)...)
+
+	var nickTimers []Timer
+	for _, t := range timers {
+		for _, n := range nicks {
+			if godrop.Canonicalize(t.Nick) == godrop.Canonicalize(n) {
+				nickTimers = append(nickTimers, t)
+				break
+			}
+		}
+	}
+
+	return nickTimers, nil
+}
+
+// getAllTimers retrieves every timer from storage ordered by when they are
+// due.
+func getAllTimers(c *godrop.Client) ([]Timer, error) {
+	store, err := c.Storage()
+	if err != nil {
+		return nil, err
+	}
+
+	ids, err := store.Keys(bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	var timers []Timer
+	for _, id := range ids {
+		var t Timer
+		ok, err := store.Get(bucket, id, &t)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		timers = append(timers, t)
+	}
+
+	sort.Slice(timers, func(i, j int) bool {
+		return timers[i].Due.Before(timers[j].Due)
+	})
+
+	return timers, nil
+}
+
+// restoreTimers schedules every stored timer that is not yet scheduled.
+func restoreTimers(c *godrop.Client) {
+	timers, err := getAllTimers(c)
+	if err != nil {
+		c.PluginError("timer", fmt.Errorf("unable to restore timers: %s", err))
+		return
+	}
+
+	for _, t := range timers {
+		schedule(c, t)
+	}
+}
+
+// schedule arranges for the timer to fire. If it is already scheduled we do
+// nothing.
+func schedule(c *godrop.Client, t Timer) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if _, ok := scheduled[scheduleKey{c, t.ID}]; ok {
+		return
+	}
+
+	d := time.Until(t.Due)
+	if d < 0 {
+		d = 0
+	}
+
+	scheduled[scheduleKey{c, t.ID}] = c.After("timer", d,
+		func(c *godrop.Client) {
+			fire(c, t.ID)
+		})
+}
+
+// fire announces that the timer is up.
+func fire(c *godrop.Client, id string) {
+	mutex.Lock()
+	delete(scheduled, scheduleKey{c, id})
+	mutex.Unlock()
+
+	store, err := c.Storage()
+	if err != nil {
+		c.PluginError("timer", fmt.Errorf("unable to fire timer: %s", err))
+		return
+	}
+
+	// Look it up again in case it was cancelled.
+	var t Timer
+	ok, err := store.Get(bucket, id, &t)
+	if err != nil {
+		c.PluginError("timer", fmt.Errorf("unable to fire timer: %s", err))
+		return
+	}
+	if !ok {
+		return
+	}
+
+	// If they changed their nick, address them by their new one.
+	nick, _ := c.CurrentNick(t.Nick)
+
+	message := fmt.Sprintf("%s: Your %s timer is up!", nick, t.Duration)
+	if t.Message != "" {
+		message = fmt.Sprintf("%s: Your %s timer is up: %s", nick, t.Duration,
+			t.Message)
+	}
+
+	// If we can't send it, leave it in storage. We'll try again when we next
+	// connect.
+	if err := c.Message(t.Target, message); err != nil {
+		c.PluginError("timer", fmt.Errorf("unable to announce timer: %s", err))
+		return
+	}
+
+	if err := store.Delete(bucket, id); err != nil {
+		c.PluginError("timer", fmt.Errorf("unable to delete timer: %s", err))
+	}
+}
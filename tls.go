@@ -0,0 +1,115 @@
+package godrop
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// TLSVerification says how to check the server's certificate when we connect
+// with TLS.
+type TLSVerification struct {
+	// Verify is whether to check the certificate is valid for the server and
+	// signed by a CA we trust. Often IRC servers don't have valid
+	// certificates, so by default we don't. We always do if the server gave us
+	// an STS policy.
+	Verify bool
+
+	// CAFile is a file of PEM encoded CA certificates to trust rather than the
+	// system's. It's for networks with their own CA.
+	CAFile string
+
+	// Fingerprint is the SHA-256 fingerprint of the certificate the server
+	// must present, in hex with or without colons. It works with or without
+	// Verify, so it suits servers with self-signed certificates.
+	Fingerprint string
+}
+
+// SetTLSVerification sets how to check the server's certificate. It takes
+// effect the next time we connect.
+//
+// It returns an error if we can't load the CA file or the fingerprint is
+// invalid.
+func (c *Client) SetTLSVerification(v TLSVerification) error {
+	var pool *x509.CertPool
+	if v.CAFile != "" {
+		buf, err := ioutil.ReadFile(v.CAFile)
+		if err != nil {
+			return fmt.Errorf("unable to read CA file: %s", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(buf) {
+			return fmt.Errorf("no certificates found in CA file: %s", v.CAFile)
+		}
+	}
+
+	var fingerprint []byte
+	if v.Fingerprint != "" {
+		var err error
+		fingerprint, err = parseFingerprint(v.Fingerprint)
+		if err != nil {
+			return err
+		}
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.tlsVerify = v.Verify
+	c.tlsRoots = pool
+	c.tlsFingerprint = fingerprint
+	return nil
+}
+
+// parseFingerprint parses a SHA-256 fingerprint in hex such as ab:cd:...
+func parseFingerprint(s string) ([]byte, error) {
+	fingerprint, err := hex.DecodeString(strings.Replace(s, ":", "", -1))
+	if err != nil {
+		return nil, fmt.Errorf("invalid fingerprint: %s", err)
+	}
+	if len(fingerprint) != sha256.Size {
+		return nil, fmt.Errorf("invalid fingerprint: it must be SHA-256")
+	}
+	return fingerprint, nil
+}
+
+// tlsConfig creates the TLS config to connect to the host with. sts is true
+// if we have an STS policy for it, in which case we always verify.
+func (c *Client) tlsConfig(host string, sts bool) *tls.Config {
+	c.mutex.Lock()
+	verify := sts || c.tlsVerify
+	roots := c.tlsRoots
+	fingerprint := c.tlsFingerprint
+	c.mutex.Unlock()
+
+	config := &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: !verify,
+		RootCAs:            roots,
+		Certificates:       c.clientCertificates(),
+	}
+
+	if fingerprint != nil {
+		// This runs after the usual checks if we verify.
+		config.VerifyPeerCertificate = func(raw [][]byte,
+			_ [][]*x509.Certificate) error {
+			if len(raw) == 0 {
+				return fmt.Errorf("server presented no certificate")
+			}
+			sum := sha256.Sum256(raw[0])
+			if !bytes.Equal(sum[:], fingerprint) {
+				return fmt.Errorf(
+					"server certificate fingerprint %s does not match pinned %s",
+					hex.EncodeToString(sum[:]), hex.EncodeToString(fingerprint))
+			}
+			return nil
+		}
+	}
+
+	return config
+}
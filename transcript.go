@@ -0,0 +1,244 @@
+package godrop
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxTranscriptSize is how large a transcript file may get before we start
+	// another.
+	maxTranscriptSize = 10 * 1024 * 1024
+
+	// defaultTranscriptKeep is how many transcript files we keep by default.
+	defaultTranscriptKeep = 20
+
+	// transcriptPrefix starts the names of transcript files.
+	transcriptPrefix = "transcript-"
+)
+
+// transcript writes each line we send and receive to a file.
+type transcript struct {
+	mutex sync.Mutex
+
+	dir  string
+	keep int
+
+	// server names the server we're connected to. It's part of the file name.
+	server string
+
+	// log is the client's Logger.
+	log Logger
+
+	file *os.File
+	size int64
+}
+
+// SetTranscriptDir turns on writing a transcript of the raw protocol lines we
+// send and receive. This is separate from the log and is useful to figure out
+// what happened around a disconnect.
+//
+// Each connection gets a new file in the directory. We also start a new file
+// if one gets large. We keep the newest keep files and delete older ones. If
+// keep is zero we use a default.
+//
+// Passwords we send are not written to the transcript.
+func (c *Client) SetTranscriptDir(dir string, keep int) error {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("unable to use transcript directory: %s", err)
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("transcript directory is not a directory: %s", dir)
+	}
+
+	if keep <= 0 {
+		keep = defaultTranscriptKeep
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.transcriptDir = dir
+	c.transcriptKeep = keep
+	return nil
+}
+
+// startTranscript starts a transcript for a new connection.
+//
+// The caller must hold the mutex.
+func (c *Client) startTranscript() {
+	c.stopTranscript()
+
+	if c.transcriptDir == "" {
+		return
+	}
+
+	c.transcript = &transcript{
+		dir:    c.transcriptDir,
+		keep:   c.transcriptKeep,
+		server: Server{Host: c.host, Port: c.port, TLS: c.tls}.String(),
+		log:    c.Log(),
+	}
+}
+
+// stopTranscript closes the transcript for the connection.
+//
+// The caller must hold the mutex.
+func (c *Client) stopTranscript() {
+	if c.transcript == nil {
+		return
+	}
+
+	c.transcript.close()
+	c.transcript = nil
+}
+
+// recordTranscript writes a line to the transcript if we're keeping one.
+// direction is < for lines we receive and > for lines we send. Lines we send
+// must already be redacted (see redactLine).
+func (c *Client) recordTranscript(direction, line string) {
+	c.mutex.Lock()
+	t := c.transcript
+	c.mutex.Unlock()
+
+	if t == nil {
+		return
+	}
+
+	now := time.Now().UTC().Format("2006-01-02T15:04:05.000Z")
+	if err := t.write(now + " " + direction + " " +
+		strings.TrimRight(line, "\r\n") + "\n"); err != nil {
+		c.Log().Error("Unable to write transcript", "error", err)
+	}
+}
+
+// redactLine hides passwords in a line we send.
+func redactLine(line string) string {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return line
+	}
+
+	switch strings.ToUpper(fields[0]) {
+	case "PASS", "OPER":
+		return strings.ToUpper(fields[0]) + " <redacted>"
+	case "WEBIRC":
+		// WEBIRC <password> <gateway> <host> <ip>
+		if len(fields) < 2 {
+			break
+		}
+		return strings.Join(append([]string{"WEBIRC", "<redacted>"},
+			fields[2:]...), " ")
+	case "AUTHENTICATE":
+		// + is an empty response. Anything else may hold credentials.
+		if len(fields) < 2 || fields[1] == "+" || fields[1] == ":+" {
+			break
+		}
+		return "AUTHENTICATE <redacted>"
+	case "PRIVMSG":
+		if len(fields) < 3 || !strings.EqualFold(fields[1], "NickServ") {
+			break
+		}
+		command := strings.ToUpper(strings.TrimPrefix(fields[2], ":"))
+		if command == "IDENTIFY" || command == "GHOST" {
+			return "PRIVMSG " + fields[1] + " :" + command + " <redacted>"
+		}
+	}
+
+	return line
+}
+
+func (t *transcript) write(s string) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.file == nil || t.size+int64(len(s)) > maxTranscriptSize {
+		if err := t.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := t.file.WriteString(s)
+	t.size += int64(n)
+	return err
+}
+
+// rotate starts a new file and deletes old ones.
+//
+// The caller must hold the mutex.
+func (t *transcript) rotate() error {
+	if t.file != nil {
+		if err := t.file.Close(); err != nil {
+			t.log.Error("Unable to close transcript", "error", err)
+		}
+		t.file = nil
+	}
+
+	name := transcriptPrefix + strings.Replace(t.server, ":", "_", -1) + "-" +
+		time.Now().UTC().Format("20060102-150405.000") + ".log"
+
+	f, err := os.OpenFile(filepath.Join(t.dir, name),
+		os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to open transcript: %s", err)
+	}
+
+	t.file = f
+	t.size = 0
+
+	t.prune()
+	return nil
+}
+
+// prune deletes the oldest transcript files so we have at most keep.
+func (t *transcript) prune() {
+	fis, err := ioutil.ReadDir(t.dir)
+	if err != nil {
+		t.log.Error("Unable to list transcripts", "error", err)
+		return
+	}
+
+	var files []os.FileInfo
+	for _, fi := range fis {
+		if fi.Mode().IsRegular() &&
+			strings.HasPrefix(fi.Name(), transcriptPrefix) &&
+			strings.HasSuffix(fi.Name(), ".log") {
+			files = append(files, fi)
+		}
+	}
+
+	if len(files) <= t.keep {
+		return
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+
+	for _, fi := range files[:len(files)-t.keep] {
+		if err := os.Remove(filepath.Join(t.dir, fi.Name())); err != nil {
+			t.log.Error("Unable to delete old transcript", "error", err)
+		}
+	}
+}
+
+func (t *transcript) close() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.file == nil {
+		return
+	}
+
+	if err := t.file.Close(); err != nil {
+		t.log.Error("Unable to close transcript", "error", err)
+	}
+	t.file = nil
+}
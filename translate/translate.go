@@ -0,0 +1,249 @@
+// Package translate translates text between languages.
+//
+// Usage:
+// - !tr <to> <text> - Translate text to a language, such as !tr fr hello.
+//   We detect the text's language.
+// - !tr <from>:<to> <text> - Translate text from one language to another,
+//   such as !tr en:de hello.
+//
+// Languages are codes such as en, fr, or de. The reply says which language
+// we translated from, so you see what we detected.
+//
+// Configuration options:
+// - translate-provider - Who translates: libretranslate (the default) or
+//   deepl.
+// - translate-url - The LibreTranslate server to use, such as
+//   https://libretranslate.example.com. Required for libretranslate.
+// - translate-api-key - The API key. Required for deepl. Optional for
+//   libretranslate, depending on the server.
+//
+// The reply uses the template translation. Its data is a Translation.
+package translate
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/horgh/godrop"
+	"github.com/horgh/irc"
+)
+
+func init() {
+	godrop.Register("translate", nil)
+	godrop.RegisterConfig("translate",
+		godrop.ConfigKey{Name: "translate-provider", Check: checkProvider},
+		godrop.ConfigKey{Name: "translate-url"},
+		godrop.ConfigKey{Name: "translate-api-key"},
+	)
+	godrop.RegisterTemplate("translate", "translation",
+		"[{{.From}} → {{.To}}] {{.Text}}")
+	godrop.RegisterCommand("translate", godrop.Command{
+		Name:    "tr",
+		Aliases: []string{"translate"},
+		Usage:   "<[from:]to> <text>",
+		Help:    "Translate text, such as !tr fr hello.",
+		MinArgs: 2,
+		Run:     triggerTranslate,
+	})
+}
+
+// Providers.
+const (
+	providerLibreTranslate = "libretranslate"
+	providerDeepL          = "deepl"
+)
+
+func checkProvider(s string) error {
+	if s != providerLibreTranslate && s != providerDeepL {
+		return fmt.Errorf("must be %s or %s", providerLibreTranslate,
+			providerDeepL)
+	}
+	return nil
+}
+
+var languagesRE = regexp.MustCompile(
+	`^(?:([A-Za-z]{2,3}(?:-[A-Za-z]+)?):)?([A-Za-z]{2,3}(?:-[A-Za-z]+)?)$`)
+
+// Translation is translated text.
+type Translation struct {
+	// From is the language we translated from. If we detected it, it's what
+	// we detected.
+	From string
+	To   string
+	Text string
+}
+
+// triggerTranslate handles !tr
+func triggerTranslate(c *godrop.Client, m irc.Message, args []string) error {
+	target := godrop.ReplyTarget(m)
+
+	matches := languagesRE.FindStringSubmatch(args[0])
+	if matches == nil {
+		return c.Message(target, "Usage: !tr <[from:]to> <text>")
+	}
+	from := strings.ToLower(matches[1])
+	to := strings.ToLower(matches[2])
+	text := strings.Join(args[1:], " ")
+
+	var t Translation
+	var err error
+	switch c.Conf().GetString("translate-provider") {
+	case providerDeepL:
+		t, err = translateDeepL(c.Web(), c.Conf().GetString("translate-api-key"),
+			from, to, text)
+	default:
+		t, err = translateLibre(c.Web(), c.Conf().GetString("translate-url"),
+			c.Conf().GetString("translate-api-key"), from, to, text)
+	}
+	if err != nil {
+		return err
+	}
+
+	return c.Message(target, c.Format("translate", "translation", target, t))
+}
+
+// translateLibre translates with a LibreTranslate server. An empty from means
+// to detect the language.
+func translateLibre(web *godrop.WebClient, server, key, from, to,
+	text string) (Translation, error) {
+	if server == "" {
+		return Translation{}, fmt.Errorf("no translate-url configured")
+	}
+
+	source := from
+	if source == "" {
+		source = "auto"
+	}
+	request := map[string]string{
+		"q":      text,
+		"source": source,
+		"target": to,
+		"format": "text",
+	}
+	if key != "" {
+		request["api_key"] = key
+	}
+	buf, err := json.Marshal(request)
+	if err != nil {
+		return Translation{}, fmt.Errorf("unable to encode request: %s", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost,
+		strings.TrimSuffix(server, "/")+"/translate", bytes.NewReader(buf))
+	if err != nil {
+		return Translation{}, fmt.Errorf("unable to create request: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, body, err := web.Fetch(req)
+	if err != nil {
+		return Translation{}, fmt.Errorf("failed to perform HTTP request: %s",
+			err)
+	}
+
+	var response struct {
+		TranslatedText   string `json:"translatedText"`
+		DetectedLanguage struct {
+			Language string `json:"language"`
+		} `json:"detectedLanguage"`
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil &&
+		resp.StatusCode == http.StatusOK {
+		return Translation{}, fmt.Errorf("unable to decode: %s", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		if response.Error != "" {
+			return Translation{}, fmt.Errorf("unsuccessful request: %s: %s",
+				resp.Status, response.Error)
+		}
+		return Translation{}, fmt.Errorf("unsuccessful request: %s",
+			resp.Status)
+	}
+
+	if from == "" {
+		from = response.DetectedLanguage.Language
+	}
+	return Translation{
+		From: from,
+		To:   to,
+		Text: response.TranslatedText,
+	}, nil
+}
+
+// translateDeepL translates with DeepL. An empty from means to detect the
+// language.
+func translateDeepL(web *godrop.WebClient, key, from, to,
+	text string) (Translation, error) {
+	if key == "" {
+		return Translation{}, fmt.Errorf("no translate-api-key configured")
+	}
+
+	// Free API keys end with :fx and use their own server.
+	u := "https://api.deepl.com/v2/translate"
+	if strings.HasSuffix(key, ":fx") {
+		u = "https://api-free.deepl.com/v2/translate"
+	}
+
+	vals := url.Values{}
+	vals.Set("text", text)
+	vals.Set("target_lang", strings.ToUpper(to))
+	if from != "" {
+		vals.Set("source_lang", strings.ToUpper(from))
+	}
+
+	req, err := http.NewRequest(http.MethodPost, u,
+		strings.NewReader(vals.Encode()))
+	if err != nil {
+		return Translation{}, fmt.Errorf("unable to create request: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "DeepL-Auth-Key "+key)
+
+	resp, body, err := web.Fetch(req)
+	if err != nil {
+		return Translation{}, fmt.Errorf("failed to perform HTTP request: %s",
+			err)
+	}
+
+	var response struct {
+		Translations []struct {
+			DetectedSourceLanguage string `json:"detected_source_language"`
+			Text                   string `json:"text"`
+		} `json:"translations"`
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil &&
+		resp.StatusCode == http.StatusOK {
+		return Translation{}, fmt.Errorf("unable to decode: %s", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		if response.Message != "" {
+			return Translation{}, fmt.Errorf("unsuccessful request: %s: %s",
+				resp.Status, response.Message)
+		}
+		return Translation{}, fmt.Errorf("unsuccessful request: %s",
+			resp.Status)
+	}
+
+	if len(response.Translations) == 0 {
+		return Translation{}, fmt.Errorf("no translation returned")
+	}
+	tr := response.Translations[0]
+
+	if from == "" {
+		from = strings.ToLower(tr.DetectedSourceLanguage)
+	}
+	return Translation{
+		From: from,
+		To:   to,
+		Text: tr.Text,
+	}, nil
+}
@@ -2,7 +2,8 @@
 // Twitch.
 //
 // There are two main features:
-// - Poll a list of usernames and notify to channels when they start streaming.
+// - Poll a list of usernames every 10 minutes and notify to channels when
+//   they start streaming.
 // - A channel trigger to look up the streaming status of users.
 //
 // Setup:
@@ -17,17 +18,21 @@
 // - twitchstreams-users - Users to notify about when they start streaming.
 //   Also the default list of users when you use the !twitch trigger without a
 //   username.
+//
+// Output uses the templates live (someone started streaming), streaming
+// (!twitch), and offline (!twitch). The data for live and streaming is a
+// Stream, and for offline it has .Username. See godrop's Format to override
+// them.
 package twitchstreams
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"log"
 	"net/http"
 	"net/url"
-	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/horgh/godrop"
@@ -35,49 +40,83 @@ import (
 )
 
 func init() {
-	godrop.Hooks = append(godrop.Hooks, Hook)
+	godrop.Register("twitchstreams", Hook)
+	godrop.RegisterConfig("twitchstreams",
+		godrop.ConfigKey{Name: "twitchstreams-client-id", Required: true},
+		godrop.ConfigKey{Name: "twitchstreams-channels"},
+		godrop.ConfigKey{Name: "twitchstreams-users"},
+	)
+	godrop.RegisterTemplate("twitchstreams", "live", streamTemplate)
+	godrop.RegisterTemplate("twitchstreams", "streaming", streamTemplate)
+	godrop.RegisterTemplate("twitchstreams", "offline",
+		"{{.Username}} is not streaming")
+	godrop.RegisterCommand("twitchstreams", godrop.Command{
+		Name:  "twitch",
+		Usage: "[username ...]",
+		Help:  "Check whether people are streaming on Twitch.",
+		Run:   triggerTwitch,
+	})
 }
 
-var triggerRE = regexp.MustCompile(`(?i)^\s*[!.]twitch\s*(.*)`)
+const streamTemplate = "{{.Username}} is streaming" +
+	"{{if .Title}}: {{.Title}}{{end}} ({{.URL}})"
+
+// pollMutex protects usernameStreaming. Hold it while polling.
+var pollMutex sync.Mutex
+var usernameStreaming = map[string]bool{}
+var durationBetweenPolls = 10 * time.Minute
+
+// pollTimeout limits how long each poll's requests may take.
+var pollTimeout = time.Minute
 
 // Hook fires when an IRC message of some kind occurs.
 func Hook(c *godrop.Client, m irc.Message) {
-	pollStreams(c)
-
-	if m.Command != "PRIVMSG" {
+	// Start polling once we're connected. Polling happens in its own goroutine
+	// so it doesn't hold up reading messages, and quiet channels still hear
+	// about streams. It stops when the connection ends, and we start again
+	// when we next connect since the config might be new.
+	if m.Command != irc.ReplyWelcome {
 		return
 	}
 
-	target := m.Params[0]
-	text := m.Params[1]
+	ctx := c.Context()
+	c.Go("twitchstreams", func() error {
+		return poll(ctx, c)
+	})
+}
 
-	if matches := triggerRE.FindStringSubmatch(text); matches != nil {
-		args := ""
-		if len(matches) > 1 {
-			args = strings.ToLower(strings.TrimSpace(matches[1]))
-		}
+// poll polls streams now and then every durationBetweenPolls until the
+// context is done.
+func poll(ctx context.Context, c *godrop.Client) error {
+	pollStreams(ctx, c)
 
-		triggerTwitch(c, target, args)
-		return
+	ticker := time.NewTicker(durationBetweenPolls)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			pollStreams(ctx, c)
+		}
 	}
 }
 
-var usernameStreaming = map[string]bool{}
-var lastPollTime time.Time
-var durationBetweenPolls = 10 * time.Minute
+func pollStreams(ctx context.Context, c *godrop.Client) {
+	pollMutex.Lock()
+	defer pollMutex.Unlock()
 
-func pollStreams(c *godrop.Client) {
-	now := time.Now()
-	if now.Sub(lastPollTime) < durationBetweenPolls {
-		return
-	}
-	lastPollTime = now
+	ctx, cancel := context.WithTimeout(ctx, pollTimeout)
+	defer cancel()
 
-	users := getDefaultUsers(c.Config)
+	users := getDefaultUsers(c.Conf())
 	for _, username := range users {
-		streams, err := getStreams(c.Config["twitchstreams-client-id"], username)
+		streams, err := getStreams(ctx, c.Web(),
+			c.Conf()["twitchstreams-client-id"], username)
 		if err != nil {
-			log.Printf("error retrieving streams for %s: %s", username, err)
+			c.PluginError("twitchstreams",
+				fmt.Errorf("error retrieving streams for %s: %s", username, err))
 			return
 		}
 
@@ -86,8 +125,8 @@ func pollStreams(c *godrop.Client) {
 			continue
 		}
 
-		// If this is the first time, don't notify. We just started. Partly this is
-		// a workaround to not try to output while unregistered.
+		// If this is the first time, don't notify. We just started, so they
+		// probably didn't just start streaming.
 		if _, polledUserAlready := usernameStreaming[username]; !polledUserAlready {
 			usernameStreaming[username] = true
 			continue
@@ -99,27 +138,35 @@ func pollStreams(c *godrop.Client) {
 
 		usernameStreaming[username] = true
 
-		for _, ch := range strings.Fields(c.Config["twitchstreams-channels"]) {
+		for _, ch := range c.Conf().GetStringSlice("twitchstreams-channels") {
 			for _, stream := range streams {
-				_ = c.Message(ch, stream.String())
+				_ = c.Message(ch, c.Format("twitchstreams", "live", ch, stream))
 			}
 		}
 	}
 }
 
-func triggerTwitch(c *godrop.Client, target, args string) {
-	if args != "" {
-		outputStreams(c, target, strings.Fields(args))
-		return
+// triggerTwitch handles !twitch.
+func triggerTwitch(c *godrop.Client, m irc.Message, args []string) error {
+	target := godrop.ReplyTarget(m)
+	if len(args) > 0 {
+		var users []string
+		for _, arg := range args {
+			users = append(users, strings.ToLower(arg))
+		}
+		outputStreams(c, target, users)
+		return nil
 	}
 
-	users := getDefaultUsers(c.Config)
+	users := getDefaultUsers(c.Conf())
 	outputStreams(c, target, users)
+	return nil
 }
 
 func outputStreams(c *godrop.Client, target string, usernames []string) {
 	for _, username := range usernames {
-		streams, err := getStreams(c.Config["twitchstreams-client-id"], username)
+		streams, err := getStreams(c.Context(), c.Web(),
+			c.Conf()["twitchstreams-client-id"], username)
 		if err != nil {
 			_ = c.Message(target, fmt.Sprintf("error retrieving streams for %s: %s",
 				username, err))
@@ -127,20 +174,22 @@ func outputStreams(c *godrop.Client, target string, usernames []string) {
 		}
 
 		if len(streams) == 0 {
-			_ = c.Message(target, fmt.Sprintf("%s is not streaming", username))
+			_ = c.Message(target, c.Format("twitchstreams", "offline", target,
+				Stream{Username: username}))
 			continue
 		}
 
 		for _, stream := range streams {
-			_ = c.Message(target, stream.String())
+			_ = c.Message(target, c.Format("twitchstreams", "streaming", target,
+				stream))
 		}
 	}
 }
 
-func getDefaultUsers(config map[string]string) []string {
+func getDefaultUsers(config godrop.Config) []string {
 	var users []string
 
-	for _, u := range strings.Fields(config["twitchstreams-users"]) {
+	for _, u := range config.GetStringSlice("twitchstreams-users") {
 		u = strings.ToLower(strings.TrimSpace(u))
 		if u == "" {
 			continue
@@ -166,17 +215,13 @@ type Stream struct {
 	Title    string
 }
 
-func (s Stream) String() string {
-	u := fmt.Sprintf("https://www.twitch.tv/%s", url.PathEscape(s.Username))
-
-	if s.Title == "" {
-		return fmt.Sprintf("%s is streaming (%s)", s.Username, u)
-	}
-
-	return fmt.Sprintf("%s is streaming: %s (%s)", s.Username, s.Title, u)
+// URL is the stream's URL.
+func (s Stream) URL() string {
+	return fmt.Sprintf("https://www.twitch.tv/%s", url.PathEscape(s.Username))
 }
 
-func getStreams(clientID, username string) ([]Stream, error) {
+func getStreams(ctx context.Context, web *godrop.WebClient, clientID,
+	username string) ([]Stream, error) {
 	clientID = strings.TrimSpace(clientID)
 	if clientID == "" {
 		return nil, fmt.Errorf("no client ID given")
@@ -197,7 +242,7 @@ func getStreams(clientID, username string) ([]Stream, error) {
 
 	u := "https://api.twitch.tv/helix/streams?" + vals.Encode()
 
-	resp, err := get(clientID, u)
+	resp, err := get(ctx, web, clientID, u)
 	if err != nil {
 		return nil, fmt.Errorf("error looking up streams: %s", err)
 	}
@@ -234,9 +279,8 @@ func getStreams(clientID, username string) ([]Stream, error) {
 	return streams, nil
 }
 
-var client *http.Client
-
-func get(clientID, url string) (map[string]interface{}, error) {
+func get(ctx context.Context, web *godrop.WebClient, clientID,
+	url string) (map[string]interface{}, error) {
 	if clientID == "" || url == "" {
 		return nil, fmt.Errorf("missing client ID or url")
 	}
@@ -248,27 +292,11 @@ func get(clientID, url string) (map[string]interface{}, error) {
 
 	req.Header.Set("Client-ID", clientID)
 
-	if client == nil {
-		client = &http.Client{
-			Timeout: 30 * time.Second,
-		}
-	}
-
-	resp, err := client.Do(req)
+	resp, buf, err := web.Fetch(req.WithContext(ctx))
 	if err != nil {
 		return nil, fmt.Errorf("error performing HTTP request: %s", err)
 	}
 
-	buf, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		_ = resp.Body.Close()
-		return nil, fmt.Errorf("error reading response body: %s", err)
-	}
-
-	if err := resp.Body.Close(); err != nil {
-		return nil, fmt.Errorf("error closing response body: %s", err)
-	}
-
 	if resp.StatusCode != http.StatusOK {
 		return nil, fmt.Errorf("unsuccessful request: %s: %s", resp.Status, buf)
 	}
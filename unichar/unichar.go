@@ -0,0 +1,193 @@
+// Package unichar looks up Unicode characters.
+//
+// Usage:
+// - !u <character> - Show the character's codepoint, name, category, and
+//   UTF-8 bytes. Give up to 5 characters to look up each.
+// - !u U+XXXX - Look up a codepoint.
+// - !u <words> - Find characters whose names have the words, such as
+//   !u snowman.
+//
+// Names come from the Unicode data table in golang.org/x/text.
+package unichar
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/horgh/godrop"
+	"github.com/horgh/irc"
+	"golang.org/x/text/unicode/runenames"
+)
+
+func init() {
+	godrop.Register("unichar", nil)
+	godrop.RegisterCommand("unichar", godrop.Command{
+		Name:    "u",
+		Usage:   "<character|U+XXXX|name>",
+		Help:    "Look up Unicode characters.",
+		MinArgs: 1,
+		Run:     triggerUnichar,
+	})
+
+	for name := range unicode.Categories {
+		if len(name) == 2 {
+			categories = append(categories, name)
+		}
+	}
+	sort.Strings(categories)
+}
+
+var codepointRE = regexp.MustCompile(`(?i)^(?:U\+|0x)([0-9a-f]{1,6})$`)
+
+// maxResults is how many characters we show.
+const maxResults = 5
+
+// categories are the two letter general categories such as Lu, sorted.
+var categories []string
+
+// triggerUnichar handles !u
+func triggerUnichar(c *godrop.Client, m irc.Message, args []string) error {
+	target := godrop.ReplyTarget(m)
+	source := godrop.SourceNick(m)
+
+	// Characters may be punctuation or spaces, so take them as written.
+	runes, err := lookup(strings.TrimSpace(c.CommandText(m)))
+	if err != nil {
+		return c.Message(target, fmt.Sprintf("%s: %s", source, err))
+	}
+
+	for _, r := range runes {
+		if err := c.Message(target, describe(r)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lookup finds the characters the argument asks about.
+func lookup(arg string) ([]rune, error) {
+	if matches := codepointRE.FindStringSubmatch(arg); matches != nil {
+		n, err := strconv.ParseInt(matches[1], 16, 32)
+		if err != nil || n > unicode.MaxRune {
+			return nil, fmt.Errorf("%s is not a codepoint", arg)
+		}
+		return []rune{rune(n)}, nil
+	}
+
+	// A single character or some that aren't plain words.
+	if utf8.RuneCountInString(arg) == 1 || !isWords(arg) {
+		var runes []rune
+		for _, r := range arg {
+			if len(runes) == maxResults {
+				break
+			}
+			runes = append(runes, r)
+		}
+		return runes, nil
+	}
+
+	runes := search(strings.Fields(strings.ToUpper(arg)))
+	if len(runes) == 0 {
+		return nil, fmt.Errorf("no characters named like %s", arg)
+	}
+	return runes, nil
+}
+
+// isWords checks whether the text looks like words to search names for.
+func isWords(s string) bool {
+	for _, r := range s {
+		if r > unicode.MaxASCII || (!unicode.IsLetter(r) && !unicode.IsDigit(r) &&
+			r != ' ' && r != '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// search finds characters whose names have all the words. Exact matches come
+// first.
+func search(words []string) []rune {
+	exact := strings.Join(words, " ")
+	var found []rune
+	for r := rune(0); r <= unicode.MaxRune; r++ {
+		// Skip surrogates and control characters. The latter have names like
+		// <control>.
+		if r >= 0xd800 && r <= 0xdfff {
+			continue
+		}
+		name := runenames.Name(r)
+		if name == "" || strings.HasPrefix(name, "<") {
+			continue
+		}
+
+		if name == exact {
+			found = append([]rune{r}, found...)
+			continue
+		}
+		if len(found) >= maxResults*2 || !hasWords(name, words) {
+			continue
+		}
+		found = append(found, r)
+	}
+
+	if len(found) > maxResults {
+		found = found[:maxResults]
+	}
+	return found
+}
+
+// hasWords checks whether the name has each word as a whole word.
+func hasWords(name string, words []string) bool {
+	nameWords := strings.FieldsFunc(name, func(r rune) bool {
+		return r == ' ' || r == '-'
+	})
+	for _, w := range words {
+		found := false
+		for _, nw := range nameWords {
+			if nw == w {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// describe shows a character's details.
+func describe(r rune) string {
+	name := runenames.Name(r)
+	if name == "" {
+		name = "<unassigned>"
+	}
+
+	s := fmt.Sprintf("U+%04X %s (%s)", r, name, category(r))
+	if unicode.IsPrint(r) {
+		s += " " + string(r)
+	}
+
+	buf := make([]byte, utf8.UTFMax)
+	n := utf8.EncodeRune(buf, r)
+	var bytes []string
+	for _, b := range buf[:n] {
+		bytes = append(bytes, fmt.Sprintf("%02x", b))
+	}
+	return s + " UTF-8: " + strings.Join(bytes, " ")
+}
+
+// category finds the character's general category.
+func category(r rune) string {
+	for _, name := range categories {
+		if unicode.Is(unicode.Categories[name], r) {
+			return name
+		}
+	}
+	return "Cn"
+}
@@ -0,0 +1,332 @@
+// Package weather looks up current weather conditions.
+//
+// Usage:
+// - !weather <location> - Look up the weather somewhere. The location becomes
+//   your default location.
+// - !weather - Look up the weather in your default location.
+//
+// Default locations are kept in persistent storage in the "locations" bucket
+// keyed by nick, shared with the aqi plugin.
+//
+// We show temperatures and wind speeds in the channel's units. Set
+// channel-units or use !chanset units to change them.
+//
+// Configuration options:
+// - weather-provider - Where to get the weather: wttr (wttr.in, the
+//   default) or openweathermap.
+// - weather-api-key - The API key for openweathermap.
+// - storage-file - To remember default locations.
+//
+// The reply uses the template weather. Its data is a Report.
+package weather
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/horgh/godrop"
+	"github.com/horgh/irc"
+)
+
+func init() {
+	godrop.Register("weather", nil)
+	godrop.RegisterConfig("weather",
+		godrop.ConfigKey{Name: "weather-provider", Check: checkProvider},
+		godrop.ConfigKey{Name: "weather-api-key"},
+	)
+	godrop.RegisterTemplate("weather", "weather",
+		"{{.Location}}: {{.Description}}, {{.Temperature}} "+
+			"(feels like {{.FeelsLike}}), humidity {{.Humidity}}%, "+
+			"wind {{.Wind}}")
+	godrop.RegisterCommand("weather", godrop.Command{
+		Name:  "weather",
+		Usage: "[location]",
+		Help:  "Look up the weather. The location becomes your default.",
+		Run:   triggerWeather,
+	})
+}
+
+// locationsBucket is the storage bucket holding default locations.
+const locationsBucket = "locations"
+
+// Providers.
+const (
+	providerWttr           = "wttr"
+	providerOpenWeatherMap = "openweathermap"
+)
+
+func checkProvider(s string) error {
+	if s != providerWttr && s != providerOpenWeatherMap {
+		return fmt.Errorf("must be %s or %s", providerWttr,
+			providerOpenWeatherMap)
+	}
+	return nil
+}
+
+// Weather is the current weather somewhere. It's in metric units.
+type Weather struct {
+	Location    string
+	Description string
+	TempC       float64
+	FeelsLikeC  float64
+	Humidity    int
+	WindKmh     float64
+
+	// WindDirection is a compass direction such as SW. It may be blank.
+	WindDirection string
+}
+
+// Report is the data for the weather template. The measurements are in the
+// channel's units.
+type Report struct {
+	Weather
+
+	Temperature string
+	FeelsLike   string
+	Wind        string
+}
+
+// triggerWeather handles !weather
+func triggerWeather(c *godrop.Client, m irc.Message, args []string) error {
+	target := godrop.ReplyTarget(m)
+	nick := godrop.SourceNick(m)
+
+	location := strings.Join(args, " ")
+	if location == "" {
+		loc, err := getDefaultLocation(c, nick)
+		if err != nil {
+			c.Log().Error("Unable to look up default location", "plugin",
+				"weather", "error", err)
+		}
+		if loc == "" {
+			return c.Message(target, "Usage: !weather <location>")
+		}
+		location = loc
+	}
+
+	w, err := getWeather(c, location)
+	if err != nil {
+		return err
+	}
+
+	imperial := c.ChannelSettings(target).Imperial()
+	if err := c.Message(target, c.Format("weather", "weather", target,
+		newReport(w, imperial))); err != nil {
+		return err
+	}
+
+	if err := setDefaultLocation(c, nick, location); err != nil {
+		c.Log().Error("Unable to store default location", "plugin", "weather",
+			"error", err)
+	}
+	return nil
+}
+
+func newReport(w Weather, imperial bool) Report {
+	r := Report{Weather: w}
+	if imperial {
+		r.Temperature = fmt.Sprintf("%.0f°F", w.TempC*9/5+32)
+		r.FeelsLike = fmt.Sprintf("%.0f°F", w.FeelsLikeC*9/5+32)
+		r.Wind = fmt.Sprintf("%.0f mph", w.WindKmh/1.609344)
+	} else {
+		r.Temperature = fmt.Sprintf("%.0f°C", w.TempC)
+		r.FeelsLike = fmt.Sprintf("%.0f°C", w.FeelsLikeC)
+		r.Wind = fmt.Sprintf("%.0f km/h", w.WindKmh)
+	}
+	if w.WindDirection != "" {
+		r.Wind += " " + w.WindDirection
+	}
+	return r
+}
+
+func getDefaultLocation(c *godrop.Client, nick string) (string, error) {
+	store, err := c.Storage()
+	if err != nil {
+		return "", err
+	}
+
+	var location string
+	if _, err := store.Get(locationsBucket, strings.ToLower(nick),
+		&location); err != nil {
+		return "", err
+	}
+
+	return location, nil
+}
+
+func setDefaultLocation(c *godrop.Client, nick, location string) error {
+	store, err := c.Storage()
+	if err != nil {
+		return err
+	}
+
+	return store.Put(locationsBucket, strings.ToLower(nick), location)
+}
+
+// getWeather looks up the weather using the configured provider.
+func getWeather(c *godrop.Client, location string) (Weather, error) {
+	provider := c.Conf().GetString("weather-provider")
+	if provider == providerOpenWeatherMap {
+		return getOpenWeatherMap(c.Web(), c.Conf()["weather-api-key"], location)
+	}
+	return getWttr(c.Web(), location)
+}
+
+// getWttr looks up the weather from wttr.in.
+func getWttr(web *godrop.WebClient, location string) (Weather, error) {
+	u := "https://wttr.in/" + url.PathEscape(location) + "?format=j1"
+
+	resp, body, err := web.Get(u)
+	if err != nil {
+		return Weather{}, fmt.Errorf("failed to perform HTTP request: %s", err)
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		return Weather{}, fmt.Errorf("unknown location: %s", location)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return Weather{}, fmt.Errorf("unsuccessful request: %s", resp.Status)
+	}
+
+	type value []struct {
+		Value string `json:"value"`
+	}
+	var response struct {
+		CurrentCondition []struct {
+			TempC         string `json:"temp_C"`
+			FeelsLikeC    string `json:"FeelsLikeC"`
+			Humidity      string `json:"humidity"`
+			WindspeedKmph string `json:"windspeedKmph"`
+			WindDir       string `json:"winddir16Point"`
+			WeatherDesc   value  `json:"weatherDesc"`
+		} `json:"current_condition"`
+		NearestArea []struct {
+			AreaName value `json:"areaName"`
+			Region   value `json:"region"`
+			Country  value `json:"country"`
+		} `json:"nearest_area"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return Weather{}, fmt.Errorf("unable to decode: %s", err)
+	}
+
+	if len(response.CurrentCondition) == 0 {
+		return Weather{}, fmt.Errorf("no weather found for %s", location)
+	}
+	cc := response.CurrentCondition[0]
+
+	w := Weather{
+		Location:      location,
+		TempC:         parseFloat(cc.TempC),
+		FeelsLikeC:    parseFloat(cc.FeelsLikeC),
+		Humidity:      int(parseFloat(cc.Humidity)),
+		WindKmh:       parseFloat(cc.WindspeedKmph),
+		WindDirection: cc.WindDir,
+	}
+	if len(cc.WeatherDesc) > 0 {
+		w.Description = strings.TrimSpace(cc.WeatherDesc[0].Value)
+	}
+
+	if len(response.NearestArea) > 0 {
+		area := response.NearestArea[0]
+		var parts []string
+		for _, v := range []value{area.AreaName, area.Region, area.Country} {
+			if len(v) > 0 && v[0].Value != "" {
+				parts = append(parts, v[0].Value)
+			}
+		}
+		if len(parts) > 0 {
+			w.Location = strings.Join(parts, ", ")
+		}
+	}
+
+	return w, nil
+}
+
+// getOpenWeatherMap looks up the weather from OpenWeatherMap.
+func getOpenWeatherMap(web *godrop.WebClient, key,
+	location string) (Weather, error) {
+	key = strings.TrimSpace(key)
+	if key == "" {
+		return Weather{}, fmt.Errorf("no API key configured")
+	}
+
+	vals := url.Values{}
+	vals.Set("q", location)
+	vals.Set("appid", key)
+	vals.Set("units", "metric")
+	u := "https://api.openweathermap.org/data/2.5/weather?" + vals.Encode()
+
+	resp, body, err := web.Get(u)
+	if err != nil {
+		// Don't include the error as it contains the URL, and so the key.
+		return Weather{}, fmt.Errorf("failed to perform HTTP request")
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		return Weather{}, fmt.Errorf("unknown location: %s", location)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return Weather{}, fmt.Errorf("unsuccessful request: %s", resp.Status)
+	}
+
+	var response struct {
+		Name string `json:"name"`
+		Sys  struct {
+			Country string `json:"country"`
+		} `json:"sys"`
+		Main struct {
+			Temp      float64 `json:"temp"`
+			FeelsLike float64 `json:"feels_like"`
+			Humidity  int     `json:"humidity"`
+		} `json:"main"`
+		Weather []struct {
+			Description string `json:"description"`
+		} `json:"weather"`
+		Wind struct {
+			// Speed is in m/s.
+			Speed float64 `json:"speed"`
+			Deg   float64 `json:"deg"`
+		} `json:"wind"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return Weather{}, fmt.Errorf("unable to decode: %s", err)
+	}
+
+	w := Weather{
+		Location:      response.Name,
+		TempC:         response.Main.Temp,
+		FeelsLikeC:    response.Main.FeelsLike,
+		Humidity:      response.Main.Humidity,
+		WindKmh:       response.Wind.Speed * 3.6,
+		WindDirection: compass(response.Wind.Deg),
+	}
+	if response.Sys.Country != "" {
+		w.Location += ", " + response.Sys.Country
+	}
+	if len(response.Weather) > 0 {
+		w.Description = response.Weather[0].Description
+	}
+	return w, nil
+}
+
+func parseFloat(s string) float64 {
+	f, _ := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	return f
+}
+
+// compass gives the 16 point compass direction for degrees.
+func compass(deg float64) string {
+	directions := []string{"N", "NNE", "NE", "ENE", "E", "ESE", "SE", "SSE", "S",
+		"SSW", "SW", "WSW", "W", "WNW", "NW", "NNW"}
+	i := int(math.Mod(math.Round(deg/22.5), 16))
+	if i < 0 {
+		i += 16
+	}
+	return directions[i]
+}
@@ -0,0 +1,271 @@
+package godrop
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultWebTimeout is how long requests may take by default.
+	defaultWebTimeout = 15 * time.Second
+
+	// defaultWebHostInterval is how long we wait between requests to the same
+	// host by default.
+	defaultWebHostInterval = time.Second
+
+	// defaultUserAgent is the User-Agent we send by default.
+	defaultUserAgent = "godrop (+https://github.com/horgh/godrop)"
+
+	// maxWebBody is the largest response body we read.
+	maxWebBody = 10 * 1024 * 1024
+
+	// maxWebCacheEntries is how many responses we cache at most.
+	maxWebCacheEntries = 1000
+)
+
+// WebClient makes HTTP requests for plugins. Plugins share it so they share
+// connections and settings.
+//
+// It sends a common User-Agent unless a request sets one. It waits between
+// requests to the same host so plugins don't hammer the services they use.
+// It can also cache successful GET responses.
+type WebClient struct {
+	client       *http.Client
+	userAgent    string
+	hostInterval time.Duration
+	cacheTTL     time.Duration
+
+	mutex sync.Mutex
+
+	// next is when we may next make a request to each host.
+	next map[string]time.Time
+
+	// cache holds responses keyed by URL.
+	cache map[string]webCacheEntry
+}
+
+type webCacheEntry struct {
+	resp    *http.Response
+	body    []byte
+	expires time.Time
+}
+
+// Web retrieves the WebClient plugins use to make HTTP requests.
+//
+// We create it the first time this is called using these config keys:
+// - web-timeout - How long requests may take. Default 15s.
+// - web-proxy - A proxy to use, such as http://127.0.0.1:3128. If it's not
+//   set, we use the one in the environment (HTTPS_PROXY etc) if any.
+// - web-user-agent - The User-Agent to send.
+// - web-host-interval - How long to wait between requests to the same host.
+//   Default 1s.
+// - web-cache - How long to cache successful GET responses, such as 5m. If
+//   it's not set, we don't cache.
+//
+// If a value is invalid we log it and use the default.
+func (c *Client) Web() *WebClient {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.web != nil {
+		return c.web
+	}
+
+	timeout := c.webDuration("web-timeout", defaultWebTimeout)
+	proxy := http.ProxyFromEnvironment
+	if s := strings.TrimSpace(c.Config["web-proxy"]); s != "" {
+		u, err := url.Parse(s)
+		if err != nil {
+			c.Log().Warn("Invalid web-proxy", "error", err)
+		} else {
+			proxy = http.ProxyURL(u)
+		}
+	}
+
+	userAgent := defaultUserAgent
+	if s := strings.TrimSpace(c.Config["web-user-agent"]); s != "" {
+		userAgent = s
+	}
+
+	c.web = &WebClient{
+		client: &http.Client{
+			Timeout: timeout,
+			Transport: &http.Transport{
+				Proxy: proxy,
+				DialContext: (&net.Dialer{
+					Timeout:   timeout,
+					KeepAlive: 30 * time.Second,
+				}).DialContext,
+				MaxIdleConns:          100,
+				MaxIdleConnsPerHost:   4,
+				IdleConnTimeout:       90 * time.Second,
+				TLSHandshakeTimeout:   timeout,
+				ExpectContinueTimeout: time.Second,
+			},
+		},
+		userAgent: userAgent,
+		hostInterval: c.webDuration("web-host-interval",
+			defaultWebHostInterval),
+		cacheTTL: c.webDuration("web-cache", 0),
+		next:     map[string]time.Time{},
+		cache:    map[string]webCacheEntry{},
+	}
+	return c.web
+}
+
+// webDuration reads a duration from the config. If it's not set or is
+// invalid, we use the default.
+func (c *Client) webDuration(key string, def time.Duration) time.Duration {
+	s := strings.TrimSpace(c.Config[key])
+	if s == "" {
+		return def
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		c.Log().Warn("Invalid duration", "key", key, "value", s)
+		return def
+	}
+	return d
+}
+
+// Do makes a request. It's like http.Client's Do.
+//
+// If we made a request to the same host too recently, we wait first.
+func (w *WebClient) Do(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", w.userAgent)
+	}
+
+	w.waitForHost(req.URL.Host)
+
+	return w.client.Do(req)
+}
+
+// Fetch makes a request and reads the response body. The response's body is
+// closed.
+//
+// Unlike Do, we return the response whatever its status. Callers should
+// check it.
+//
+// If caching is on, we return a cached response to a GET if we have one, and
+// we cache successful GET responses. Requests with the same URL share a
+// cache entry.
+func (w *WebClient) Fetch(req *http.Request) (*http.Response, []byte, error) {
+	cacheable := req.Method == http.MethodGet && w.cacheTTL > 0
+	key := req.URL.String()
+
+	if cacheable {
+		if resp, body, ok := w.cached(key); ok {
+			return resp, body, nil
+		}
+	}
+
+	resp, err := w.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxWebBody))
+	if err != nil {
+		_ = resp.Body.Close()
+		return nil, nil, fmt.Errorf("read failure: %s", err)
+	}
+	_ = resp.Body.Close()
+
+	if cacheable && resp.StatusCode == http.StatusOK {
+		w.store(key, resp, body)
+	}
+
+	return resp, body, nil
+}
+
+// Get fetches a URL. See Fetch.
+func (w *WebClient) Get(u string) (*http.Response, []byte, error) {
+	return w.GetContext(context.Background(), u)
+}
+
+// GetContext is like Get. If the context is done, we give up on the request.
+// Plugins can pass the client's Context so requests stop when we disconnect.
+func (w *WebClient) GetContext(ctx context.Context, u string) (*http.Response,
+	[]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("preparing request: %s", err)
+	}
+	return w.Fetch(req.WithContext(ctx))
+}
+
+// waitForHost waits until we may make a request to the host.
+func (w *WebClient) waitForHost(host string) {
+	if w.hostInterval <= 0 {
+		return
+	}
+
+	w.mutex.Lock()
+	now := time.Now()
+	at := w.next[host]
+	if at.Before(now) {
+		at = now
+	}
+	w.next[host] = at.Add(w.hostInterval)
+
+	for h, t := range w.next {
+		if t.Before(now) {
+			delete(w.next, h)
+		}
+	}
+	w.mutex.Unlock()
+
+	time.Sleep(time.Until(at))
+}
+
+func (w *WebClient) cached(key string) (*http.Response, []byte, bool) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	entry, ok := w.cache[key]
+	if !ok {
+		return nil, nil, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(w.cache, key)
+		return nil, nil, false
+	}
+
+	resp := *entry.resp
+	return &resp, entry.body, true
+}
+
+func (w *WebClient) store(key string, resp *http.Response, body []byte) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	now := time.Now()
+	if len(w.cache) >= maxWebCacheEntries {
+		for k, entry := range w.cache {
+			if now.After(entry.expires) {
+				delete(w.cache, k)
+			}
+		}
+	}
+	if len(w.cache) >= maxWebCacheEntries {
+		return
+	}
+
+	stored := *resp
+	stored.Body = http.NoBody
+	w.cache[key] = webCacheEntry{
+		resp:    &stored,
+		body:    body,
+		expires: now.Add(w.cacheTTL),
+	}
+}
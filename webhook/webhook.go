@@ -0,0 +1,348 @@
+// Package webhook sends IRC events to other systems. It POSTs each event we
+// choose as JSON to URLs.
+//
+// Configuration options:
+// - webhook-urls - Space separated URLs to POST to. Required.
+// - webhook-events - Space separated kinds of events to send. These are
+//   message (PRIVMSG and NOTICE on channels), private (private PRIVMSG and
+//   NOTICE), highlight (messages mentioning our nick), join, part, quit,
+//   kick, nick, and topic. Default message.
+// - webhook-channels - Space separated channels to send events for. If this
+//   is not set, we send them for all channels.
+// - webhook-match - A regular expression. If set, we send only messages that
+//   match it.
+// - webhook-secret - If set, we sign requests. The X-Godrop-Signature header
+//   is sha256= followed by the hex HMAC-SHA256 of the body using the secret.
+//
+// If a request fails we try again a few times, waiting longer each time. If
+// the URLs can't keep up, we drop events.
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/horgh/godrop"
+)
+
+func init() {
+	godrop.RegisterEventHook("webhook", Hook)
+	godrop.RegisterConfig("webhook",
+		godrop.ConfigKey{Name: "webhook-urls", Required: true},
+		godrop.ConfigKey{Name: "webhook-events", Check: checkEvents},
+		godrop.ConfigKey{Name: "webhook-channels"},
+		godrop.ConfigKey{Name: "webhook-match", Check: checkMatch},
+		godrop.ConfigKey{Name: "webhook-secret"},
+	)
+}
+
+// Event is what we send.
+type Event struct {
+	// Kind is the kind of event, such as message or join.
+	Kind string `json:"kind"`
+
+	// Nick and Mask are who did it.
+	Nick string `json:"nick"`
+	Mask string `json:"mask"`
+
+	// Account is their services account if we know it.
+	Account string `json:"account,omitempty"`
+
+	// Target is the channel, or for private messages, our nick.
+	Target string `json:"target"`
+
+	// Text is the message, reason, new nick, or topic.
+	Text string `json:"text,omitempty"`
+
+	Command string `json:"command"`
+	Time    string `json:"time"`
+}
+
+// kinds are the kinds of events we know.
+var kinds = map[string]bool{
+	"message":   true,
+	"private":   true,
+	"highlight": true,
+	"join":      true,
+	"part":      true,
+	"quit":      true,
+	"kick":      true,
+	"nick":      true,
+	"topic":     true,
+}
+
+const (
+	// queueSize is how many events we hold waiting to send.
+	queueSize = 100
+
+	// attempts is how many times we try to send an event.
+	attempts = 4
+
+	// retryDelay is how long we wait before trying again the first time. We
+	// double it each time.
+	retryDelay = 2 * time.Second
+)
+
+var (
+	mutex sync.Mutex
+
+	// queues holds the events waiting to send for each client we're sending
+	// for.
+	queues = map[*godrop.Client]chan Event{}
+)
+
+// getQueue retrieves the client's queue. The first time, we start sending
+// what's in it. We stop once the client is shut down.
+func getQueue(c *godrop.Client) chan Event {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if q, ok := queues[c]; ok {
+		return q
+	}
+
+	q := make(chan Event, queueSize)
+	queues[c] = q
+	c.Go("webhook", func() error {
+		for {
+			select {
+			case e := <-q:
+				send(c, e)
+			case <-c.Done():
+				mutex.Lock()
+				delete(queues, c)
+				mutex.Unlock()
+				return nil
+			}
+		}
+	})
+	return q
+}
+
+// Hook fires when an IRC message of some kind occurs.
+//
+// We start sending if we're not already and queue the events we send.
+func Hook(c *godrop.Client, e godrop.Event) {
+	if e.Historical || e.Kind == godrop.EventSelfMessage ||
+		e.Kind == godrop.EventShutdown {
+		return
+	}
+
+	q := getQueue(c)
+
+	ev, ok := convert(c, e)
+	if !ok {
+		return
+	}
+
+	select {
+	case q <- ev:
+	default:
+		c.PluginError("webhook", fmt.Errorf("queue is full, dropping %s event",
+			ev.Kind))
+	}
+}
+
+// convert makes an Event from the event if we send it.
+func convert(c *godrop.Client, e godrop.Event) (Event, bool) {
+	ev := Event{
+		Nick:    godrop.SourceNick(e.Message),
+		Mask:    e.Prefix,
+		Account: c.IdentifyEvent(e).Account,
+		Command: e.Command,
+		Time:    e.Time.UTC().Format(time.RFC3339Nano),
+	}
+
+	switch e.Command {
+	case "PRIVMSG", "NOTICE":
+		if len(e.Params) != 2 {
+			return ev, false
+		}
+		ev.Target = e.Params[0]
+		ev.Text = e.Params[1]
+		ev.Kind = "message"
+		if !godrop.IsChannel(ev.Target) {
+			ev.Kind = "private"
+		}
+		if match := c.Conf().GetString("webhook-match"); match != "" {
+			re, err := regexp.Compile(match)
+			if err != nil || !re.MatchString(ev.Text) {
+				return ev, false
+			}
+		}
+		if wanted(c.Conf(), "highlight") && ev.Kind == "message" &&
+			mentions(ev.Text, c.GetNick()) {
+			ev.Kind = "highlight"
+		}
+	case "JOIN", "PART", "KICK", "TOPIC":
+		if len(e.Params) == 0 {
+			return ev, false
+		}
+		ev.Kind = strings.ToLower(e.Command)
+		ev.Target = e.Params[0]
+		if len(e.Params) > 1 {
+			ev.Text = e.Params[len(e.Params)-1]
+		}
+		// Extended JOIN has the account and realname rather than text.
+		if e.Command == "JOIN" {
+			ev.Text = ""
+		}
+		if e.Command == "KICK" && len(e.Params) > 2 {
+			ev.Text = e.Params[1] + ": " + e.Params[2]
+		}
+	case "QUIT", "NICK":
+		ev.Kind = strings.ToLower(e.Command)
+		if len(e.Params) > 0 {
+			ev.Text = e.Params[0]
+		}
+	default:
+		return ev, false
+	}
+
+	if !wanted(c.Conf(), ev.Kind) {
+		return ev, false
+	}
+
+	if ev.Target != "" && godrop.IsChannel(ev.Target) &&
+		!channelWanted(c.Conf(), ev.Target) {
+		return ev, false
+	}
+
+	return ev, true
+}
+
+// wanted checks whether we send events of the kind.
+func wanted(config godrop.Config, kind string) bool {
+	events := config.GetStringSlice("webhook-events")
+	if len(events) == 0 {
+		events = []string{"message"}
+	}
+
+	for _, k := range events {
+		if strings.EqualFold(k, kind) {
+			return true
+		}
+	}
+	return false
+}
+
+// channelWanted checks whether we send events for the channel.
+func channelWanted(config godrop.Config, channel string) bool {
+	channels := config.GetStringSlice("webhook-channels")
+	if len(channels) == 0 {
+		return true
+	}
+
+	for _, ch := range channels {
+		if godrop.Canonicalize(ch) == godrop.Canonicalize(channel) {
+			return true
+		}
+	}
+	return false
+}
+
+// mentions checks whether the text mentions the nick as a word.
+func mentions(text, nick string) bool {
+	if nick == "" {
+		return false
+	}
+	re, err := regexp.Compile(`(?i)(^|\W)` + regexp.QuoteMeta(nick) +
+		`($|\W)`)
+	if err != nil {
+		return false
+	}
+	return re.MatchString(text)
+}
+
+// send POSTs the event to each URL.
+func send(c *godrop.Client, e Event) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		c.PluginError("webhook", fmt.Errorf("unable to encode event: %s", err))
+		return
+	}
+
+	for _, u := range c.Conf().GetStringSlice("webhook-urls") {
+		if err := post(c, u, body); err != nil {
+			c.PluginError("webhook", fmt.Errorf("unable to send %s event to %s: %s",
+				e.Kind, u, err))
+		}
+	}
+}
+
+// post POSTs the body to the URL. If it fails we try again.
+func post(c *godrop.Client, u string, body []byte) error {
+	delay := retryDelay
+	var err error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+
+		var retry bool
+		retry, err = postOnce(c, u, body)
+		if err == nil || !retry {
+			return err
+		}
+	}
+	return err
+}
+
+// postOnce POSTs the body to the URL. If it fails, it reports whether trying
+// again may help.
+func postOnce(c *godrop.Client, u string, body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return false, fmt.Errorf("error creating request: %s", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if secret := c.Conf().GetString("webhook-secret"); secret != "" {
+		req.Header.Set("X-Godrop-Signature", "sha256="+sign(secret, body))
+	}
+
+	resp, _, err := c.Web().Fetch(req)
+	if err != nil {
+		return true, err
+	}
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+
+	// Client errors other than rate limiting won't go away.
+	retry := resp.StatusCode >= 500 ||
+		resp.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("unsuccessful request: %s", resp.Status)
+}
+
+// sign makes the signature of the body.
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func checkEvents(value string) error {
+	for _, k := range strings.Fields(value) {
+		if !kinds[strings.ToLower(k)] {
+			return fmt.Errorf("unknown event %s", k)
+		}
+	}
+	return nil
+}
+
+func checkMatch(value string) error {
+	_, err := regexp.Compile(value)
+	return err
+}
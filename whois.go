@@ -0,0 +1,218 @@
+package godrop
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/horgh/irc"
+)
+
+// whoisTimeout is how long we wait for the server to answer a WHOIS.
+const whoisTimeout = 30 * time.Second
+
+// WhoisReply is what the server told us about a user in reply to WHOIS.
+type WhoisReply struct {
+	Nick     string
+	Ident    string
+	Host     string
+	Realname string
+
+	// Server is the server they're on and ServerInfo its description.
+	Server     string
+	ServerInfo string
+
+	// Channels are the channels they're on that we can see. They may have
+	// prefixes such as @ showing their status.
+	Channels []string
+
+	// Idle is how long since they last sent a message. SignOn is when they
+	// connected. These are zero if the server doesn't say.
+	Idle   time.Duration
+	SignOn time.Time
+
+	// Account is the services account they're logged in to, if any.
+	Account string
+
+	// Operator is true if they're an IRC operator.
+	Operator bool
+
+	// Away is their away message if they're away.
+	Away string
+
+	// Secure is true if they're connected with TLS.
+	Secure bool
+}
+
+// pendingWhois is a WHOIS we're waiting on replies to.
+type pendingWhois struct {
+	reply     WhoisReply
+	err       error
+	callbacks []func(*Client, WhoisReply, error)
+	timer     *time.Timer
+}
+
+// Whois looks up a user. It sends WHOIS and calls fn in its own goroutine
+// with what the server tells us. If the user doesn't exist or the server
+// doesn't answer in time, fn gets an error.
+//
+// Waiting for the reply from a hook would stop the client reading it, so we
+// use a function.
+func (c *Client) Whois(nick string,
+	fn func(*Client, WhoisReply, error)) error {
+	key := Canonicalize(nick)
+
+	c.mutex.Lock()
+	if p, ok := c.whois[key]; ok {
+		p.callbacks = append(p.callbacks, fn)
+		c.mutex.Unlock()
+		return nil
+	}
+
+	p := &pendingWhois{
+		reply:     WhoisReply{Nick: nick},
+		callbacks: []func(*Client, WhoisReply, error){fn},
+	}
+	p.timer = time.AfterFunc(whoisTimeout, func() {
+		c.finishWhois(key, p, fmt.Errorf("no reply to WHOIS %s", nick))
+	})
+	c.whois[key] = p
+	c.mutex.Unlock()
+
+	if err := c.WriteMessage(irc.Message{
+		Command: "WHOIS",
+		Params:  []string{nick},
+	}); err != nil {
+		c.mutex.Lock()
+		delete(c.whois, key)
+		c.mutex.Unlock()
+		p.timer.Stop()
+		return err
+	}
+
+	return nil
+}
+
+// handleWhois collects WHOIS replies.
+func (c *Client) handleWhois(m irc.Message) {
+	// Replies look like <me> <nick> ...
+	if len(m.Params) < 2 {
+		return
+	}
+
+	key := Canonicalize(m.Params[1])
+
+	c.mutex.Lock()
+	p, ok := c.whois[key]
+	if !ok {
+		c.mutex.Unlock()
+		return
+	}
+	done := p.update(m)
+	c.mutex.Unlock()
+
+	if done {
+		c.finishWhois(key, p, nil)
+	}
+}
+
+// update records what a reply says. It reports whether it's the last reply.
+//
+// The caller must hold the client's mutex.
+func (p *pendingWhois) update(m irc.Message) bool {
+	r := &p.reply
+	params := m.Params[2:]
+	switch m.Command {
+	case "311":
+		// RPL_WHOISUSER: <me> <nick> <user> <host> * :<realname>
+		r.Nick = m.Params[1]
+		if len(params) >= 4 {
+			r.Ident = params[0]
+			r.Host = params[1]
+			r.Realname = params[3]
+		}
+	case "312":
+		// RPL_WHOISSERVER: <me> <nick> <server> :<info>
+		if len(params) >= 2 {
+			r.Server = params[0]
+			r.ServerInfo = params[1]
+		}
+	case "313":
+		// RPL_WHOISOPERATOR
+		r.Operator = true
+	case "317":
+		// RPL_WHOISIDLE: <me> <nick> <idle> <signon> :seconds idle, signon time
+		if len(params) >= 1 {
+			if n, err := strconv.Atoi(params[0]); err == nil {
+				r.Idle = time.Duration(n) * time.Second
+			}
+		}
+		if len(params) >= 3 {
+			if n, err := strconv.ParseInt(params[1], 10, 64); err == nil {
+				r.SignOn = time.Unix(n, 0)
+			}
+		}
+	case "319":
+		// RPL_WHOISCHANNELS: <me> <nick> :<channels>
+		if len(params) >= 1 {
+			r.Channels = append(r.Channels, strings.Fields(params[0])...)
+		}
+	case "330":
+		// RPL_WHOISACCOUNT: <me> <nick> <account> :is logged in as
+		if len(params) >= 1 {
+			r.Account = params[0]
+		}
+	case "301":
+		// RPL_AWAY: <me> <nick> :<message>
+		if len(params) >= 1 {
+			r.Away = params[0]
+		}
+	case "671":
+		// RPL_WHOISSECURE
+		r.Secure = true
+	case "401":
+		// ERR_NOSUCHNICK. Servers send RPL_ENDOFWHOIS after it.
+		p.err = fmt.Errorf("no such nick: %s", m.Params[1])
+	case "318":
+		// RPL_ENDOFWHOIS
+		return true
+	}
+	return false
+}
+
+// finishWhois calls the functions waiting on a WHOIS. If the server said
+// there was an error, they get it instead of err. If it's already done, it
+// does nothing.
+func (c *Client) finishWhois(key string, p *pendingWhois, err error) {
+	c.mutex.Lock()
+	if c.whois[key] != p {
+		c.mutex.Unlock()
+		return
+	}
+	delete(c.whois, key)
+	reply := p.reply
+	if p.err != nil {
+		err = p.err
+	}
+	c.mutex.Unlock()
+
+	p.timer.Stop()
+
+	for _, fn := range p.callbacks {
+		go fn(c, reply, err)
+	}
+}
+
+// failWhois fails every WHOIS we're waiting on.
+//
+// The caller must hold the mutex.
+func (c *Client) failWhois(err error) {
+	for key, p := range c.whois {
+		delete(c.whois, key)
+		p.timer.Stop()
+		for _, fn := range p.callbacks {
+			go fn(c, p.reply, err)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+// Package whois provides a way to look up who someone is.
+//
+// Usage:
+// - !whois <nick> - Show their user@host, realname, server, channels, idle
+//   time, and services account.
+//
+// Only administrators and people matching whois-trusted may use it.
+//
+// Configuration options:
+// - whois-trusted - Space separated nick!user@host masks and $a:account
+//   entries for people who may use !whois in addition to administrators.
+package whois
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/horgh/godrop"
+	"github.com/horgh/irc"
+)
+
+func init() {
+	godrop.Register("whois", nil)
+	godrop.RegisterConfig("whois",
+		godrop.ConfigKey{Name: "whois-trusted"},
+	)
+	godrop.RegisterCommand("whois", godrop.Command{
+		Name:    "whois",
+		Usage:   "<nick>",
+		Help:    "Show who someone is.",
+		MinArgs: 1,
+		Run:     triggerWhois,
+	})
+}
+
+// triggerWhois handles !whois
+func triggerWhois(c *godrop.Client, m irc.Message, args []string) error {
+	target := godrop.ReplyTarget(m)
+	source := godrop.SourceNick(m)
+
+	if !c.IsAdmin(m) && !c.Identify(m).MatchesAny(c.Conf()["whois-trusted"]) {
+		return c.Message(target, fmt.Sprintf(
+			"%s: Only administrators and trusted people may do that.", source))
+	}
+
+	if len(args) != 1 {
+		return c.Message(target, "Usage: !whois <nick>")
+	}
+
+	if err := c.Whois(args[0], func(c *godrop.Client, r godrop.WhoisReply,
+		err error) {
+		if err != nil {
+			_ = c.Message(target, fmt.Sprintf("%s: %s", source, err))
+			return
+		}
+		for _, line := range describe(r, c.ChannelSettings(target)) {
+			_ = c.Message(target, line)
+		}
+	}); err != nil {
+		return fmt.Errorf("unable to look up %s: %s", args[0], err)
+	}
+	return nil
+}
+
+// describe summarizes the reply in one or two lines.
+func describe(r godrop.WhoisReply, settings godrop.ChannelSettings) []string {
+	s := fmt.Sprintf("%s is %s@%s", r.Nick, r.Ident, r.Host)
+	if r.Realname != "" {
+		s += fmt.Sprintf(" (%s)", r.Realname)
+	}
+	if r.Server != "" {
+		s += fmt.Sprintf(" on %s", r.Server)
+	}
+
+	var details []string
+	if r.Account != "" {
+		details = append(details, "logged in as "+r.Account)
+	}
+	if r.Operator {
+		details = append(details, "an IRC operator")
+	}
+	if r.Secure {
+		details = append(details, "using TLS")
+	}
+	if r.Idle > 0 {
+		details = append(details, "idle "+r.Idle.Round(time.Second).String())
+	}
+	if !r.SignOn.IsZero() {
+		details = append(details, "connected since "+settings.FormatTime(r.SignOn))
+	}
+	if r.Away != "" {
+		details = append(details, "away: "+r.Away)
+	}
+	if len(details) > 0 {
+		s += ", " + strings.Join(details, ", ")
+	}
+
+	lines := []string{s}
+	if len(r.Channels) > 0 {
+		lines = append(lines, fmt.Sprintf("%s is on %s", r.Nick,
+			strings.Join(r.Channels, " ")))
+	}
+	return lines
+}
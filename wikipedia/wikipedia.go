@@ -0,0 +1,225 @@
+// Package wikipedia looks up Wikipedia articles.
+//
+// Usage:
+// - !wiki <term> - Show the first paragraph of the article about the term
+//   and a link to it. If the term is ambiguous, we list articles it might
+//   mean instead.
+//
+// Configuration options:
+// - wikipedia-language - The language edition to use, such as en or fr.
+//   Default en.
+//
+// The reply uses the template summary. Its data is a Summary.
+package wikipedia
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/horgh/godrop"
+	"github.com/horgh/irc"
+)
+
+func init() {
+	godrop.Register("wikipedia", nil)
+	godrop.RegisterConfig("wikipedia",
+		godrop.ConfigKey{Name: "wikipedia-language", Check: checkLanguage},
+	)
+	godrop.RegisterTemplate("wikipedia", "summary",
+		"{{.Title}}: {{truncate 350 .Extract}} {{.URL}}")
+	godrop.RegisterCommand("wikipedia", godrop.Command{
+		Name:    "wiki",
+		Aliases: []string{"wikipedia"},
+		Usage:   "<term>",
+		Help:    "Summarize the Wikipedia article about something.",
+		MinArgs: 1,
+		Run:     triggerWiki,
+	})
+}
+
+const (
+	defaultLanguage = "en"
+
+	// maxAlternatives is how many articles we list for ambiguous terms.
+	maxAlternatives = 5
+)
+
+var languageRE = regexp.MustCompile(`^[a-z]{2,3}(-[a-z]+)*$`)
+
+func checkLanguage(s string) error {
+	if !languageRE.MatchString(s) {
+		return fmt.Errorf("must be a language code such as en")
+	}
+	return nil
+}
+
+// Summary is the start of an article.
+type Summary struct {
+	Title string
+
+	// Extract is the first paragraph of the article.
+	Extract string
+
+	URL string
+
+	// Disambiguation is true if the article lists articles the term might
+	// mean.
+	Disambiguation bool
+}
+
+// triggerWiki handles !wiki
+func triggerWiki(c *godrop.Client, m irc.Message, args []string) error {
+	target := godrop.ReplyTarget(m)
+	source := godrop.SourceNick(m)
+	term := strings.Join(args, " ")
+
+	language := c.Conf().GetString("wikipedia-language")
+	if language == "" {
+		language = defaultLanguage
+	}
+
+	web := c.Web()
+
+	s, found, err := getSummary(web, language, term)
+	if err != nil {
+		return err
+	}
+
+	if !found || s.Disambiguation {
+		titles, err := search(web, language, term)
+		if err != nil {
+			return err
+		}
+
+		if !found {
+			// The term may not be a title. Use the best match if there is one.
+			if len(titles) == 0 {
+				return c.Message(target, fmt.Sprintf("%s: No article found for %s.",
+					source, term))
+			}
+			s, found, err = getSummary(web, language, titles[0])
+			if err != nil {
+				return err
+			}
+			if !found {
+				return c.Message(target, fmt.Sprintf("%s: No article found for %s.",
+					source, term))
+			}
+		}
+
+		if s.Disambiguation {
+			return c.Message(target, fmt.Sprintf("%s: %s may mean: %s (%s)",
+				source, s.Title, strings.Join(alternatives(titles, s.Title), ", "),
+				s.URL))
+		}
+	}
+
+	return c.Message(target, c.Format("wikipedia", "summary", target, s))
+}
+
+// alternatives picks the titles to list for an ambiguous term. We leave out
+// the disambiguation page itself.
+func alternatives(titles []string, title string) []string {
+	var alts []string
+	for _, t := range titles {
+		if strings.EqualFold(t, title) {
+			continue
+		}
+		alts = append(alts, t)
+		if len(alts) == maxAlternatives {
+			break
+		}
+	}
+	if len(alts) == 0 {
+		return []string{"see the article"}
+	}
+	return alts
+}
+
+// getSummary retrieves the summary of the article with the title using the
+// REST API. It reports whether there is such an article. We follow
+// redirects.
+func getSummary(web *godrop.WebClient, language,
+	title string) (Summary, bool, error) {
+	u := fmt.Sprintf("https://%s.wikipedia.org/api/rest_v1/page/summary/%s",
+		language, url.PathEscape(strings.Replace(title, " ", "_", -1)))
+
+	resp, body, err := web.Get(u)
+	if err != nil {
+		return Summary{}, false, fmt.Errorf("failed to perform HTTP request: %s",
+			err)
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		return Summary{}, false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return Summary{}, false, fmt.Errorf("unsuccessful request: %s",
+			resp.Status)
+	}
+
+	var response struct {
+		Type        string `json:"type"`
+		Title       string `json:"title"`
+		Extract     string `json:"extract"`
+		ContentURLs struct {
+			Desktop struct {
+				Page string `json:"page"`
+			} `json:"desktop"`
+		} `json:"content_urls"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return Summary{}, false, fmt.Errorf("unable to decode: %s", err)
+	}
+
+	extract := strings.TrimSpace(response.Extract)
+	if i := strings.Index(extract, "\n"); i != -1 {
+		extract = extract[:i]
+	}
+
+	return Summary{
+		Title:          response.Title,
+		Extract:        extract,
+		URL:            response.ContentURLs.Desktop.Page,
+		Disambiguation: response.Type == "disambiguation",
+	}, true, nil
+}
+
+// search finds the titles of articles matching the term, best first.
+func search(web *godrop.WebClient, language, term string) ([]string, error) {
+	vals := url.Values{}
+	vals.Set("action", "opensearch")
+	vals.Set("search", term)
+	vals.Set("limit", fmt.Sprintf("%d", maxAlternatives+1))
+	vals.Set("namespace", "0")
+	vals.Set("format", "json")
+	u := fmt.Sprintf("https://%s.wikipedia.org/w/api.php?%s", language,
+		vals.Encode())
+
+	resp, body, err := web.Get(u)
+	if err != nil {
+		return nil, fmt.Errorf("failed to perform HTTP request: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unsuccessful request: %s", resp.Status)
+	}
+
+	// The response is [term, [titles], [descriptions], [urls]].
+	var response []json.RawMessage
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, fmt.Errorf("unable to decode: %s", err)
+	}
+	if len(response) < 2 {
+		return nil, fmt.Errorf("unexpected search response")
+	}
+
+	var titles []string
+	if err := json.Unmarshal(response[1], &titles); err != nil {
+		return nil, fmt.Errorf("unable to decode titles: %s", err)
+	}
+	return titles, nil
+}
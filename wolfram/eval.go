@@ -0,0 +1,250 @@
+package wolfram
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// evaluate calculates an arithmetic expression such as 2 * (3 + 4) ^ 2.
+//
+// It supports + - * / % ^, parentheses, the constants pi and e, and the
+// functions abs, sqrt, cbrt, exp, ln, log (base 10), sin, cos, and tan
+// (radians).
+func evaluate(expr string) (float64, error) {
+	p := &parser{s: expr}
+	v, err := p.expression()
+	if err != nil {
+		return 0, err
+	}
+	p.skipSpace()
+	if p.pos < len(p.s) {
+		return 0, fmt.Errorf("unexpected %q", p.s[p.pos:])
+	}
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, fmt.Errorf("result is undefined")
+	}
+	return v, nil
+}
+
+// parser parses and evaluates an expression by recursive descent:
+//
+//	expression = term { ("+" | "-") term }
+//	term       = unary { ("*" | "/" | "%") unary }
+//	unary      = ("-" | "+") unary | power
+//	power      = primary [ "^" unary ]
+//	primary    = number | constant | function "(" expression ")" |
+//	             "(" expression ")"
+type parser struct {
+	s   string
+	pos int
+}
+
+var constants = map[string]float64{
+	"pi": math.Pi,
+	"e":  math.E,
+}
+
+var functions = map[string]func(float64) float64{
+	"abs":  math.Abs,
+	"sqrt": math.Sqrt,
+	"cbrt": math.Cbrt,
+	"exp":  math.Exp,
+	"ln":   math.Log,
+	"log":  math.Log10,
+	"sin":  math.Sin,
+	"cos":  math.Cos,
+	"tan":  math.Tan,
+}
+
+func (p *parser) expression() (float64, error) {
+	v, err := p.term()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		switch p.next() {
+		case '+':
+			p.pos++
+			w, err := p.term()
+			if err != nil {
+				return 0, err
+			}
+			v += w
+		case '-':
+			p.pos++
+			w, err := p.term()
+			if err != nil {
+				return 0, err
+			}
+			v -= w
+		default:
+			return v, nil
+		}
+	}
+}
+
+func (p *parser) term() (float64, error) {
+	v, err := p.unary()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		op := p.next()
+		if op != '*' && op != '/' && op != '%' {
+			return v, nil
+		}
+		p.pos++
+		w, err := p.unary()
+		if err != nil {
+			return 0, err
+		}
+		switch op {
+		case '*':
+			v *= w
+		case '/':
+			if w == 0 {
+				return 0, fmt.Errorf("division by zero")
+			}
+			v /= w
+		case '%':
+			if w == 0 {
+				return 0, fmt.Errorf("division by zero")
+			}
+			v = math.Mod(v, w)
+		}
+	}
+}
+
+func (p *parser) unary() (float64, error) {
+	switch p.next() {
+	case '-':
+		p.pos++
+		v, err := p.unary()
+		return -v, err
+	case '+':
+		p.pos++
+		return p.unary()
+	}
+	return p.power()
+}
+
+func (p *parser) power() (float64, error) {
+	v, err := p.primary()
+	if err != nil {
+		return 0, err
+	}
+	if p.next() != '^' {
+		return v, nil
+	}
+	p.pos++
+	// ^ is right associative, and binds tighter than a unary minus on its
+	// left but not its right, so -2^2 is -4 and 2^-1 is 0.5.
+	w, err := p.unary()
+	if err != nil {
+		return 0, err
+	}
+	return math.Pow(v, w), nil
+}
+
+func (p *parser) primary() (float64, error) {
+	c := p.next()
+	switch {
+	case c == '(':
+		p.pos++
+		v, err := p.expression()
+		if err != nil {
+			return 0, err
+		}
+		if p.next() != ')' {
+			return 0, fmt.Errorf("missing )")
+		}
+		p.pos++
+		return v, nil
+	case c == '.' || isDigit(c):
+		return p.number()
+	case unicode.IsLetter(rune(c)):
+		name := p.name()
+		if v, ok := constants[name]; ok {
+			return v, nil
+		}
+		fn, ok := functions[name]
+		if !ok {
+			return 0, fmt.Errorf("unknown name: %s", name)
+		}
+		if p.next() != '(' {
+			return 0, fmt.Errorf("%s needs (", name)
+		}
+		v, err := p.primary()
+		if err != nil {
+			return 0, err
+		}
+		return fn(v), nil
+	case c == 0:
+		return 0, fmt.Errorf("unexpected end of expression")
+	}
+	return 0, fmt.Errorf("unexpected %q", string(c))
+}
+
+func (p *parser) number() (float64, error) {
+	start := p.pos
+	for p.pos < len(p.s) && (isDigit(p.s[p.pos]) || p.s[p.pos] == '.' ||
+		p.s[p.pos] == ',') {
+		p.pos++
+	}
+	// Allow exponents such as 1e6, but not e alone which is a constant.
+	if p.pos+1 < len(p.s) && (p.s[p.pos] == 'e' || p.s[p.pos] == 'E') {
+		end := p.pos + 1
+		if p.s[end] == '+' || p.s[end] == '-' {
+			end++
+		}
+		if end < len(p.s) && isDigit(p.s[end]) {
+			p.pos = end
+			for p.pos < len(p.s) && isDigit(p.s[p.pos]) {
+				p.pos++
+			}
+		}
+	}
+
+	s := strings.Replace(p.s[start:p.pos], ",", "", -1)
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number: %s", p.s[start:p.pos])
+	}
+	return v, nil
+}
+
+func (p *parser) name() string {
+	start := p.pos
+	for p.pos < len(p.s) && unicode.IsLetter(rune(p.s[p.pos])) {
+		p.pos++
+	}
+	return strings.ToLower(p.s[start:p.pos])
+}
+
+// next skips spaces and returns the next byte. It's 0 at the end.
+func (p *parser) next() byte {
+	p.skipSpace()
+	if p.pos == len(p.s) {
+		return 0
+	}
+	return p.s[p.pos]
+}
+
+func (p *parser) skipSpace() {
+	for p.pos < len(p.s) && unicode.IsSpace(rune(p.s[p.pos])) {
+		p.pos++
+	}
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// formatNumber shows a result without floating point noise, such as 0.3
+// rather than 0.30000000000000004.
+func formatNumber(v float64) string {
+	return strconv.FormatFloat(v, 'g', 15, 64)
+}
@@ -0,0 +1,109 @@
+// Package wolfram answers questions with Wolfram|Alpha.
+//
+// Usage:
+// - !wa <query> - Answer a question, such as a calculation, a unit
+//   conversion, or a fact like the population of France.
+// - !calc <expression> - The same. Without an API key this only does
+//   arithmetic.
+//
+// We use the Short Answers API. Units in answers follow the channel's units
+// (see godrop's ChannelSettings).
+//
+// If there's no API key we calculate arithmetic ourselves, such as
+// 2 * (3 + 4) ^ 2 or sqrt(2) / pi.
+//
+// Configuration options:
+// - wolfram-api-key - A Wolfram|Alpha AppID with access to the Short Answers
+//   API.
+package wolfram
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/horgh/godrop"
+	"github.com/horgh/irc"
+)
+
+func init() {
+	godrop.Register("wolfram", nil)
+	godrop.RegisterConfig("wolfram",
+		godrop.ConfigKey{Name: "wolfram-api-key"},
+	)
+	godrop.RegisterCommand("wolfram", godrop.Command{
+		Name:    "wa",
+		Usage:   "<query>",
+		Help:    "Ask Wolfram|Alpha a question.",
+		MinArgs: 1,
+		Run:     triggerQuery,
+	})
+	godrop.RegisterCommand("wolfram", godrop.Command{
+		Name:    "calc",
+		Usage:   "<expression>",
+		Help:    "Calculate something.",
+		MinArgs: 1,
+		Run:     triggerQuery,
+	})
+}
+
+// triggerQuery handles !wa and !calc
+func triggerQuery(c *godrop.Client, m irc.Message, args []string) error {
+	target := godrop.ReplyTarget(m)
+	source := godrop.SourceNick(m)
+	query := strings.Join(args, " ")
+
+	key := c.Conf().GetString("wolfram-api-key")
+	if key == "" {
+		v, err := evaluate(query)
+		if err != nil {
+			return c.Message(target, fmt.Sprintf(
+				"%s: I can only do arithmetic (%s).", source, err))
+		}
+		return c.Message(target, fmt.Sprintf("%s: %s", source, formatNumber(v)))
+	}
+
+	units := "metric"
+	if c.ChannelSettings(target).Imperial() {
+		units = "imperial"
+	}
+
+	answer, err := getAnswer(c.Web(), key, query, units)
+	if err != nil {
+		return err
+	}
+	return c.Message(target, fmt.Sprintf("%s: %s", source, answer))
+}
+
+// getAnswer asks the Short Answers API the query.
+func getAnswer(web *godrop.WebClient, key, query,
+	units string) (string, error) {
+	vals := url.Values{}
+	vals.Set("appid", key)
+	vals.Set("i", query)
+	vals.Set("units", units)
+	u := "https://api.wolframalpha.com/v1/result?" + vals.Encode()
+
+	resp, body, err := web.Get(u)
+	if err != nil {
+		// The error may include the URL. Don't show the key.
+		return "", fmt.Errorf("failed to perform HTTP request: %s",
+			strings.Replace(err.Error(), key, "<key>", -1))
+	}
+
+	// It responds 501 if it doesn't understand the query or has no short
+	// answer for it.
+	if resp.StatusCode == http.StatusNotImplemented {
+		return "", fmt.Errorf("no answer found")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unsuccessful request: %s", resp.Status)
+	}
+
+	answer := strings.TrimSpace(string(body))
+	if answer == "" {
+		return "", fmt.Errorf("no answer found")
+	}
+	return answer, nil
+}
@@ -0,0 +1,305 @@
+// Package youtube shows information about YouTube videos.
+//
+// When someone posts a link to a YouTube video on a channel, we say its
+// title, duration, channel, and views.
+//
+// Usage:
+// - !yt <query> - Search for a video and show the best match.
+//
+// We use the YouTube Data API.
+//
+// Configuration options:
+// - youtube-api-key - A YouTube Data API key. Required.
+// - youtube-ignore-channels - A space separated list of channels where we
+//   don't announce links. !yt still works there.
+//
+// Replies use the templates video, for links, and result, for searches. Their
+// data is a Video.
+package youtube
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/horgh/godrop"
+	"github.com/horgh/irc"
+)
+
+func init() {
+	godrop.Register("youtube", Hook)
+	godrop.RegisterConfig("youtube",
+		godrop.ConfigKey{Name: "youtube-api-key", Required: true},
+		godrop.ConfigKey{Name: "youtube-ignore-channels"},
+	)
+	godrop.RegisterTemplate("youtube", "video",
+		"{{.Title}} [{{.Duration}}] by {{.Channel}}, {{.Views}} views")
+	godrop.RegisterTemplate("youtube", "result",
+		"{{.Title}} [{{.Duration}}] by {{.Channel}}, {{.Views}} views {{.URL}}")
+	godrop.RegisterCommand("youtube", godrop.Command{
+		Name:    "yt",
+		Aliases: []string{"youtube"},
+		Usage:   "<query>",
+		Help:    "Search YouTube.",
+		MinArgs: 1,
+		Run:     triggerSearch,
+	})
+}
+
+// videoRE matches links to videos and captures their IDs.
+var videoRE = regexp.MustCompile(
+	`(?i)(?:https?://)?(?:(?:www|m|music)\.)?(?:youtube\.com/` +
+		`(?:watch\?(?:\S*&)?v=|shorts/|live/|embed/)|youtu\.be/)` +
+		`([A-Za-z0-9_-]{11})`)
+
+// maxLinks is how many links in a message we announce.
+const maxLinks = 3
+
+const apiURL = "https://www.googleapis.com/youtube/v3/"
+
+// Video is information about a video.
+type Video struct {
+	ID      string
+	Title   string
+	Channel string
+
+	// Duration is how long it is, such as 3:45 or 1:02:03. It's live for live
+	// streams.
+	Duration string
+
+	// Views is how many times it was viewed with thousands separators.
+	Views string
+
+	URL string
+}
+
+// Hook fires when an IRC message of some kind occurs.
+func Hook(c *godrop.Client, m irc.Message) {
+	if m.Command != "PRIVMSG" || len(m.Params) != 2 {
+		return
+	}
+
+	channel := m.Params[0]
+	text := m.Params[1]
+	if !godrop.IsChannel(channel) {
+		return
+	}
+	if _, _, ok := c.ParseCommand(text); ok {
+		return
+	}
+
+	matches := videoRE.FindAllStringSubmatch(text, -1)
+	if matches == nil {
+		return
+	}
+
+	for _, ignored := range c.Conf().GetStringSlice("youtube-ignore-channels") {
+		if godrop.Canonicalize(ignored) == godrop.Canonicalize(channel) {
+			return
+		}
+	}
+
+	key := c.Conf().GetString("youtube-api-key")
+	if key == "" {
+		return
+	}
+
+	seen := map[string]struct{}{}
+	var ids []string
+	for _, match := range matches {
+		if _, ok := seen[match[1]]; ok {
+			continue
+		}
+		seen[match[1]] = struct{}{}
+		ids = append(ids, match[1])
+		if len(ids) == maxLinks {
+			break
+		}
+	}
+
+	videos, err := getVideos(c.Web(), key, ids)
+	if err != nil {
+		c.PluginError("youtube", err)
+		return
+	}
+
+	for _, v := range videos {
+		_ = c.Message(channel, c.Format("youtube", "video", channel, v))
+	}
+}
+
+// triggerSearch handles !yt
+func triggerSearch(c *godrop.Client, m irc.Message, args []string) error {
+	target := godrop.ReplyTarget(m)
+	source := godrop.SourceNick(m)
+
+	key := c.Conf().GetString("youtube-api-key")
+	if key == "" {
+		return fmt.Errorf("no API key configured")
+	}
+
+	web := c.Web()
+
+	id, err := search(web, key, strings.Join(args, " "))
+	if err != nil {
+		return err
+	}
+	if id == "" {
+		return c.Message(target, fmt.Sprintf("%s: No videos found.", source))
+	}
+
+	videos, err := getVideos(web, key, []string{id})
+	if err != nil {
+		return err
+	}
+	if len(videos) == 0 {
+		return c.Message(target, fmt.Sprintf("%s: No videos found.", source))
+	}
+
+	return c.Message(target, c.Format("youtube", "result", target, videos[0]))
+}
+
+// search finds the ID of the video best matching the query. It's blank if
+// there are none.
+func search(web *godrop.WebClient, key, query string) (string, error) {
+	vals := url.Values{}
+	vals.Set("part", "snippet")
+	vals.Set("type", "video")
+	vals.Set("maxResults", "1")
+	vals.Set("q", query)
+
+	var response struct {
+		Items []struct {
+			ID struct {
+				VideoID string `json:"videoId"`
+			} `json:"id"`
+		} `json:"items"`
+	}
+	if err := get(web, key, "search", vals, &response); err != nil {
+		return "", err
+	}
+
+	if len(response.Items) == 0 {
+		return "", nil
+	}
+	return response.Items[0].ID.VideoID, nil
+}
+
+// getVideos looks up the videos with the IDs. Videos that don't exist are
+// left out.
+func getVideos(web *godrop.WebClient, key string,
+	ids []string) ([]Video, error) {
+	vals := url.Values{}
+	vals.Set("part", "snippet,contentDetails,statistics")
+	vals.Set("id", strings.Join(ids, ","))
+
+	var response struct {
+		Items []struct {
+			ID      string `json:"id"`
+			Snippet struct {
+				Title                string `json:"title"`
+				ChannelTitle         string `json:"channelTitle"`
+				LiveBroadcastContent string `json:"liveBroadcastContent"`
+			} `json:"snippet"`
+			ContentDetails struct {
+				Duration string `json:"duration"`
+			} `json:"contentDetails"`
+			Statistics struct {
+				ViewCount string `json:"viewCount"`
+			} `json:"statistics"`
+		} `json:"items"`
+	}
+	if err := get(web, key, "videos", vals, &response); err != nil {
+		return nil, err
+	}
+
+	var videos []Video
+	for _, item := range response.Items {
+		duration := formatDuration(item.ContentDetails.Duration)
+		if item.Snippet.LiveBroadcastContent == "live" {
+			duration = "live"
+		}
+		videos = append(videos, Video{
+			ID:       item.ID,
+			Title:    item.Snippet.Title,
+			Channel:  item.Snippet.ChannelTitle,
+			Duration: duration,
+			Views:    formatCount(item.Statistics.ViewCount),
+			URL:      "https://youtu.be/" + item.ID,
+		})
+	}
+	return videos, nil
+}
+
+// get requests the API resource and decodes the response into v.
+func get(web *godrop.WebClient, key, resource string, vals url.Values,
+	v interface{}) error {
+	vals.Set("key", key)
+	resp, body, err := web.Get(apiURL + resource + "?" + vals.Encode())
+	if err != nil {
+		// The error may include the URL. Don't show the key.
+		return fmt.Errorf("failed to perform HTTP request: %s",
+			strings.Replace(err.Error(), key, "<key>", -1))
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var response struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := json.Unmarshal(body, &response); err == nil &&
+			response.Error.Message != "" {
+			return fmt.Errorf("unsuccessful request: %s: %s", resp.Status,
+				response.Error.Message)
+		}
+		return fmt.Errorf("unsuccessful request: %s", resp.Status)
+	}
+
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("unable to decode: %s", err)
+	}
+	return nil
+}
+
+var durationRE = regexp.MustCompile(
+	`^P(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?)?$`)
+
+// formatDuration formats an ISO 8601 duration such as PT1H2M3S as 1:02:03.
+// If we can't parse it we return it as is.
+func formatDuration(s string) string {
+	matches := durationRE.FindStringSubmatch(s)
+	if matches == nil {
+		return s
+	}
+
+	var n [4]int
+	for i := range n {
+		n[i], _ = strconv.Atoi(matches[i+1])
+	}
+	hours := n[0]*24 + n[1]
+
+	if hours > 0 {
+		return fmt.Sprintf("%d:%02d:%02d", hours, n[2], n[3])
+	}
+	return fmt.Sprintf("%d:%02d", n[2], n[3])
+}
+
+// formatCount adds thousands separators to a count such as 1234567.
+func formatCount(s string) string {
+	if s == "" {
+		return "0"
+	}
+	var b strings.Builder
+	for i, r := range s {
+		if i > 0 && (len(s)-i)%3 == 0 {
+			b.WriteRune(',')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}